@@ -0,0 +1,153 @@
+// Package cdn signs URLs for downloading files through a CDN in front of the files bucket.
+package cdn
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guregu/intertube/metrics"
+)
+
+// Signer creates URLs that expire.
+type Signer interface {
+	// Sign returns a URL for the object at key that works for ttl.
+	Sign(key string, ttl time.Duration) (string, error)
+}
+
+type Type string
+
+const (
+	TypeCloudFront Type = "cloudfront"
+	TypeCloudflare Type = "cloudflare"
+	TypeBunny      Type = "bunny"
+)
+
+// CountryHeader is the request header this CDN puts the viewer's country code in.
+func (t Type) CountryHeader() string {
+	switch t {
+	case TypeCloudFront:
+		return "CloudFront-Viewer-Country"
+	case TypeCloudflare:
+		return "CF-IPCountry"
+	case TypeBunny:
+		return "CDN-RequestCountryCode"
+	}
+	return ""
+}
+
+type Config struct {
+	Type   Type
+	Domain string // like "intertube.download"
+	Keys   []Key
+}
+
+// Key is a signing key. The newest usable key signs new URLs.
+// Older keys should stay trusted by the CDN until URLs signed with them expire.
+type Key struct {
+	// for CloudFront, the key pair ID and path to its PEM private key
+	ID             string
+	PrivateKeyFile string
+
+	// for Cloudflare and BunnyCDN, the token authentication key
+	Secret string
+
+	// the key isn't used until then, so the CDN can be told about it first
+	NotBefore time.Time
+}
+
+var (
+	signer   Signer
+	signerMu sync.RWMutex
+)
+
+// Init sets up signing for the configured CDN.
+// Without it, files are downloaded straight from storage.
+// It can be called again to rotate keys; if it fails, the previous keys are kept.
+func Init(cfg Config) error {
+	if cfg.Domain == "" {
+		return fmt.Errorf("cdn: missing domain")
+	}
+	if len(cfg.Keys) == 0 {
+		return fmt.Errorf("cdn: no signing keys")
+	}
+	ring := make(keyring, 0, len(cfg.Keys))
+	for i, key := range cfg.Keys {
+		var s Signer
+		var err error
+		switch cfg.Type {
+		case TypeCloudFront:
+			s, err = newCloudFront(cfg.Domain, key)
+		case TypeCloudflare:
+			s, err = newCloudflare(cfg.Domain, key)
+		case TypeBunny:
+			s, err = newBunny(cfg.Domain, key)
+		default:
+			return fmt.Errorf("cdn: unknown type %q", cfg.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("cdn: key %d: %w", i+1, err)
+		}
+		ring = append(ring, signingKey{Signer: s, notBefore: key.NotBefore})
+	}
+	sort.SliceStable(ring, func(i, j int) bool {
+		return ring[i].notBefore.Before(ring[j].notBefore)
+	})
+
+	signerMu.Lock()
+	signer = ring
+	signerMu.Unlock()
+	return nil
+}
+
+// Enabled reports whether downloads should go through the CDN.
+func Enabled() bool {
+	signerMu.RLock()
+	defer signerMu.RUnlock()
+	return signer != nil
+}
+
+// Sign returns a CDN URL for the object at key in the files bucket.
+func Sign(key string, ttl time.Duration) (string, error) {
+	signerMu.RLock()
+	s := signer
+	signerMu.RUnlock()
+	if s == nil {
+		return "", fmt.Errorf("cdn: not configured")
+	}
+	href, err := s.Sign(key, ttl)
+	if err != nil {
+		metrics.SigningFailed("cdn")
+	}
+	return href, err
+}
+
+type signingKey struct {
+	Signer
+	notBefore time.Time
+}
+
+// keyring signs with its newest usable key. It's sorted oldest first.
+type keyring []signingKey
+
+func (ring keyring) Sign(key string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	for i := len(ring) - 1; i >= 0; i-- {
+		if !ring[i].notBefore.After(now) {
+			return ring[i].Sign(key, ttl)
+		}
+	}
+	return "", fmt.Errorf("cdn: no signing key is usable yet")
+}
+
+// objectURL is the unsigned URL of key on domain.
+func objectURL(domain, key string) *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host:   strings.TrimSuffix(domain, "/"),
+		Path:   "/" + key,
+	}
+}
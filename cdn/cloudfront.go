@@ -0,0 +1,76 @@
+package cdn
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+// how long to wait before trying to load a private key again, doubling up to the max
+const (
+	keyRetryMin = time.Second
+	keyRetryMax = time.Minute
+)
+
+type cloudFront struct {
+	domain string
+	keyID  string
+	file   string
+
+	mu      sync.Mutex
+	signer  *sign.URLSigner
+	err     error
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// newCloudFront tries to load the private key, but doesn't fail if it can't:
+// loading is retried when signing, so a missing key only breaks CDN links until it shows up.
+func newCloudFront(domain string, key Key) (*cloudFront, error) {
+	if key.ID == "" || key.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("cloudfront needs key_id and private_key")
+	}
+	cf := &cloudFront{
+		domain: domain,
+		keyID:  key.ID,
+		file:   key.PrivateKeyFile,
+	}
+	if _, err := cf.load(); err != nil {
+		slog.Warn("cdn: will retry loading key later", "err", err)
+	}
+	return cf, nil
+}
+
+func (cf *cloudFront) load() (*sign.URLSigner, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.signer != nil {
+		return cf.signer, nil
+	}
+	if time.Now().Before(cf.retryAt) {
+		return nil, cf.err
+	}
+
+	var priv *rsa.PrivateKey
+	priv, cf.err = sign.LoadPEMPrivKeyFile(cf.file)
+	if cf.err != nil {
+		cf.err = fmt.Errorf("loading cloudfront key %s: %w", cf.keyID, cf.err)
+		cf.backoff = min(max(cf.backoff*2, keyRetryMin), keyRetryMax)
+		cf.retryAt = time.Now().Add(cf.backoff)
+		return nil, cf.err
+	}
+	cf.signer = sign.NewURLSigner(cf.keyID, priv)
+	return cf.signer, nil
+}
+
+func (cf *cloudFront) Sign(key string, ttl time.Duration) (string, error) {
+	signer, err := cf.load()
+	if err != nil {
+		return "", err
+	}
+	return signer.Sign(objectURL(cf.domain, key).String(), time.Now().Add(ttl))
+}
@@ -0,0 +1,229 @@
+// Package config reads intertube's configuration from a TOML file,
+// with some settings overridable by environment variables.
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Config is the configuration file's layout.
+// Fields with an env tag are replaced by that environment variable when it's set.
+type Config struct {
+	Domain     string `toml:"domain" env:"DOMAIN"`
+	InviteOnly bool   `toml:"invite_only"`
+	LapseGrace int    `toml:"lapse_grace_days"`
+	SelfHosted bool   `toml:"self_hosted" env:"SELF_HOSTED"`
+	Quota      string `toml:"quota" env:"QUOTA"`
+	// "text" (default) or "json"
+	LogFormat string `toml:"log_format" env:"LOG_FORMAT"`
+	// "debug", "info" (default), "warn", or "error"
+	LogLevel string `toml:"log_level" env:"LOG_LEVEL"`
+	// retries for throttling, 5xx errors, and dropped connections to storage and the database
+	MaxRetries int `toml:"max_retries" env:"MAX_RETRIES"`
+	Web        struct {
+		// largest file users can upload, like "1GB"
+		MaxFileSize string `toml:"max_file_size" env:"MAX_FILE_SIZE"`
+		// how long links stay valid
+		DownloadLinkMinutes  int `toml:"download_link_minutes" env:"DOWNLOAD_LINK_MINUTES"`
+		ThumbnailLinkMinutes int `toml:"thumbnail_link_minutes"`
+		UploadLinkMinutes    int `toml:"upload_link_minutes" env:"UPLOAD_LINK_MINUTES"`
+		ExportLinkMinutes    int `toml:"export_link_minutes"`
+		// lets Prometheus scrape /metrics as a bearer token
+		MetricsToken string `toml:"metrics_token" env:"METRICS_TOKEN"`
+		// lets /debug/pprof/ and /debug/vars be used with a bearer token
+		DebugToken string `toml:"debug_token" env:"DEBUG_TOKEN"`
+		// load balancers and CDNs in front of us, as CIDR ranges;
+		// the client's address is read from X-Forwarded-For only when it came through one
+		TrustedProxies []string `toml:"trusted_proxies"`
+		// where icons and other static files are served from
+		StaticURL string `toml:"static_url" env:"STATIC_URL"`
+		// header with the client's country code, by default the one the CDN uses
+		CountryHeader string `toml:"country_header"`
+		// how long database and storage calls can take per request
+		RequestTimeoutSeconds int `toml:"request_timeout_seconds" env:"REQUEST_TIMEOUT_SECONDS"`
+		// the same, for processing uploads and admin maintenance
+		SlowRequestTimeoutSeconds int `toml:"slow_request_timeout_seconds"`
+		// how long to wait for in-flight requests and jobs when stopping
+		ShutdownSeconds int `toml:"shutdown_seconds" env:"SHUTDOWN_SECONDS"`
+	} `toml:"web"`
+	// monthly download allowances
+	Egress struct {
+		// plan name ("none" for accounts without a plan) to allowance, like "500GB"
+		Caps map[string]string `toml:"caps"`
+		// past the cap, slow downloads to this many bytes per second, like "128KB"
+		// instead of refusing them
+		Throttle string `toml:"throttle"`
+	} `toml:"egress"`
+	DB struct {
+		// "dynamodb" (default), "postgres", or "sqlite"
+		Type string `toml:"type"`
+		// connection string for SQL databases, or the file path for SQLite
+		URL      string `toml:"url" env:"DATABASE_URL"`
+		Region   string `toml:"region"`
+		Prefix   string `toml:"prefix"`
+		Endpoint string `toml:"endpoint"`
+		Debug    bool   `toml:"debug"`
+		// keep this many recent reads in memory, 0 to disable
+		CacheSize int `toml:"cache_size" env:"CACHE_SIZE"`
+		// how long cached users are trusted
+		CacheSeconds int `toml:"cache_seconds"`
+	} `toml:"db"`
+	Storage struct {
+		Type              string `toml:"type"`
+		FilesBucket       string `toml:"files_bucket"`
+		UploadsBucket     string `toml:"uploads_bucket"`
+		CacheBucket       string `toml:"cache_bucket"`
+		AccessKeyID       string `toml:"access_key_id"`
+		AccessKeySecret   string `toml:"access_key_secret"`
+		CloudflareAccount string `toml:"cloudflare_account"`
+		KMSKeyID          string `toml:"kms_key_id"`
+		ColdStorageClass  string `toml:"cold_storage_class"`
+		ColdAfterDays     int    `toml:"cold_after_days"`
+		RestoreDays       int    `toml:"restore_days"`
+		DeleteOrphans     bool   `toml:"delete_orphans"`
+		Domain            string `toml:"domain"`
+		Region            string `toml:"region"`
+		Endpoint          string `toml:"endpoint"`
+		PathStyle         *bool  `toml:"path_style"`
+		CredentialsFile   string `toml:"credentials_file"`
+		Path              string `toml:"path"`
+		URL               string `toml:"url"`
+		Secret            string `toml:"secret"`
+		EncryptionKey     string `toml:"encryption_key" env:"ENCRYPTION_KEY"`
+		// connection pooling and timeouts for requests to the storage service
+		MaxIdleConnsPerHost          int `toml:"max_idle_conns_per_host" env:"STORAGE_MAX_IDLE_CONNS_PER_HOST"`
+		DialTimeoutSeconds           int `toml:"dial_timeout_seconds"`
+		ResponseHeaderTimeoutSeconds int `toml:"response_header_timeout_seconds"`
+		// bucket name -> region
+		Regions  map[string]string `toml:"regions"`
+		Replicas []struct {
+			Bucket    string   `toml:"bucket"`
+			Region    string   `toml:"region"`
+			Countries []string `toml:"countries"`
+		} `toml:"replicas"`
+	} `toml:"storage"`
+	CDN struct {
+		Type       string `toml:"type"`
+		Domain     string `toml:"domain"`
+		KeyID      string `toml:"key_id"`
+		PrivateKey string `toml:"private_key"`
+		Secret     string `toml:"secret"`
+		// for rotation, used alongside the key above
+		Keys []struct {
+			KeyID      string    `toml:"key_id"`
+			PrivateKey string    `toml:"private_key"`
+			Secret     string    `toml:"secret"`
+			NotBefore  time.Time `toml:"not_before"`
+		} `toml:"keys"`
+		// reload keys this often, 0 = only on SIGHUP
+		ReloadMinutes int `toml:"reload_minutes"`
+	} `toml:"cdn"`
+	Tracing struct {
+		// OTLP/HTTP collector, like "localhost:4318"
+		// the standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable works too
+		Endpoint   string  `toml:"endpoint"`
+		Insecure   bool    `toml:"insecure"`
+		SampleRate float64 `toml:"sample_rate"`
+	} `toml:"tracing"`
+	Queue struct {
+		SQS    string `toml:"sqs"`
+		Region string `toml:"region"`
+		// background workers on the local server,
+		// or jobs from an SQS batch run at once on Lambda
+		Workers     int `toml:"workers"`
+		MaxAttempts int `toml:"max_attempts"`
+	} `toml:"queue"`
+	Email struct {
+		// "ses" (default) or "smtp"
+		Type   string `toml:"type"`
+		From   string `toml:"from"`
+		Region string `toml:"region"`
+		// SMTP server as host:port
+		SMTPAddr     string `toml:"smtp_addr"`
+		SMTPUsername string `toml:"smtp_username"`
+		SMTPPassword string `toml:"smtp_password" env:"SMTP_PASSWORD"`
+	} `toml:"email"`
+	LDAP struct {
+		URL                string `toml:"url"`
+		StartTLS           bool   `toml:"start_tls"`
+		InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+		BindDN             string `toml:"bind_dn"`
+		BindPassword       string `toml:"bind_password" env:"LDAP_BIND_PASSWORD"`
+		BaseDN             string `toml:"base_dn"`
+		UserFilter         string `toml:"user_filter"`
+		EmailAttr          string `toml:"email_attr"`
+		GroupAttr          string `toml:"group_attr"`
+		DefaultQuota       string `toml:"default_quota"`
+		RequireGroup       bool   `toml:"require_group"`
+		Groups             []struct {
+			DN    string `toml:"dn"`
+			Quota string `toml:"quota"`
+		} `toml:"groups"`
+	} `toml:"ldap"`
+	Lyrics struct {
+		// tried in order when a track has no lyrics
+		Providers []struct {
+			// "lrclib"
+			Type string `toml:"type"`
+			// for a mirror or self-hosted instance
+			URL string `toml:"url"`
+		} `toml:"providers"`
+	} `toml:"lyrics"`
+}
+
+// Read loads the config file at path, then applies environment overrides.
+func Read(path string) (Config, error) {
+	var cfg Config
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := toml.Unmarshal(raw, &cfg); err != nil {
+		return cfg, err
+	}
+	err = applyEnv(reflect.ValueOf(&cfg).Elem())
+	return cfg, err
+}
+
+// applyEnv sets fields tagged with env from the environment.
+// Bools are true for any value except "false" or "0".
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, f := v.Type().Field(i), v.Field(i)
+		if f.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			if err := applyEnv(f); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		env := os.Getenv(name)
+		if env == "" {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(env)
+		case reflect.Bool:
+			f.SetBool(env != "false" && env != "0")
+		case reflect.Int:
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			f.SetInt(int64(n))
+		default:
+			return fmt.Errorf("config: can't set %s from the environment", field.Name)
+		}
+	}
+	return nil
+}
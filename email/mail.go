@@ -1,34 +1,111 @@
 package email
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net/mail"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
 )
 
-const noreply = " <noreply@inter.tube>"
+// Config chooses how e-mail is sent.
+type Config struct {
+	// "ses" (default) or "smtp"
+	Type string
+	// address mail is sent from
+	From string
+	// SES region
+	Region string
+	// SMTP server as host:port, and credentials if it wants them
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+}
 
-var mailer *ses.SES
+type sender interface {
+	send(from mail.Address, to, subject, html string) error
+}
 
-// TODO: make this configurable later
-// for now just fail without exploding
+var (
+	mailer   sender
+	fromAddr = "noreply@inter.tube"
+)
 
+// Without Init, SES is used.
+// If that doesn't work, sending fails but nothing else does.
 func init() {
 	sesh, err := session.NewSession()
 	if err != nil {
-		log.Println("email is not configured:", err)
+		slog.Warn("email is not configured", "err", err)
 		return
 	}
-	mailer = ses.New(sesh, &aws.Config{
-		Region: aws.String("us-west-2"),
-	})
+	mailer = newSESSender(sesh, "us-west-2")
+}
+
+// Init sets up sending e-mail, replacing the default SES setup.
+func Init(cfg Config) error {
+	if cfg.From != "" {
+		addr, err := mail.ParseAddress(cfg.From)
+		if err != nil {
+			return fmt.Errorf("email: invalid from address: %w", err)
+		}
+		fromAddr = addr.Address
+	}
+	switch cfg.Type {
+	case "", "ses":
+		sesh, err := session.NewSession()
+		if err != nil {
+			return err
+		}
+		region := cfg.Region
+		if region == "" {
+			region = "us-west-2"
+		}
+		mailer = newSESSender(sesh, region)
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			return fmt.Errorf("email: missing SMTP server address")
+		}
+		mailer = smtpSender{
+			addr:     cfg.SMTPAddr,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+		}
+	default:
+		return fmt.Errorf("email: unknown type %q", cfg.Type)
+	}
+	return nil
 }
 
+// Send sends an HTML e-mail. from is the sender's display name.
 func Send(from, to, subject, content string) error {
+	if mailer == nil {
+		return fmt.Errorf("email: not configured")
+	}
+	return mailer.send(mail.Address{Name: from, Address: fromAddr}, to, subject, content)
+}
+
+func IsEnabled() bool {
+	return mailer != nil
+}
+
+type sesSender struct {
+	ses *ses.SES
+}
+
+func newSESSender(sesh *session.Session, region string) sesSender {
+	return sesSender{
+		ses: ses.New(sesh, &aws.Config{
+			Region: aws.String(region),
+		}),
+	}
+}
+
+func (s sesSender) send(from mail.Address, to, subject, content string) error {
 	input := &ses.SendEmailInput{
-		Source: aws.String(from + noreply),
+		Source: aws.String(from.String()),
 		Destination: &ses.Destination{
 			ToAddresses: []*string{aws.String(to)},
 		},
@@ -45,10 +122,6 @@ func Send(from, to, subject, content string) error {
 			},
 		},
 	}
-	_, err := mailer.SendEmail(input)
+	_, err := s.ses.SendEmail(input)
 	return err
 }
-
-func IsEnabled() bool {
-	return mailer != nil
-}
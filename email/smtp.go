@@ -0,0 +1,58 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+type smtpSender struct {
+	addr     string
+	username string
+	password string
+}
+
+func (s smtpSender) send(from mail.Address, to, subject, content string) error {
+	msg, err := buildMessage(from, to, subject, content, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return fmt.Errorf("email: invalid SMTP address: %w", err)
+		}
+		// only sent over TLS (or to localhost), smtp.SendMail upgrades with STARTTLS
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	return smtp.SendMail(s.addr, auth, from.Address, []string{to}, msg)
+}
+
+func buildMessage(from mail.Address, to, subject, content string, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+	}
+	header("From", from.String())
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/html; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,86 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/guregu/intertube/tube"
+	"github.com/guregu/intertube/web"
+)
+
+type cronJob struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// scheduled maintenance jobs, run in order
+var cronJobs = []cronJob{
+	{"purge accounts", purgeAccounts},
+	{"report metered usage", web.ReportMeteredUsage},
+	{"cold storage tiering", tube.FreezeColdTracks},
+	{"reconcile usage", tube.ReconcileAllUsage},
+	{"collect garbage", tube.CollectGarbageJob},
+	{"metadata backups", web.ScheduleBackups},
+	{"expire exports", tube.ExpireExports},
+	{"empty trash", tube.EmptyTrash},
+}
+
+// handleCron is invoked periodically by a scheduled rule.
+func handleCron(ctx context.Context) (string, error) {
+	if err := RunCron(ctx); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ran %d job(s)", len(cronJobs)), nil
+}
+
+// RunCron runs every scheduled job once.
+// A failing job is logged and doesn't prevent the rest from running.
+func RunCron(ctx context.Context) error {
+	var failed int
+	for _, job := range cronJobs {
+		start := time.Now()
+		if err := job.run(ctx); err != nil {
+			slog.ErrorContext(ctx, "cron: failed", "job", job.name, "err", err)
+			failed++
+			continue
+		}
+		slog.InfoContext(ctx, "cron: done", "job", job.name, "took", time.Since(start))
+	}
+	if failed > 0 {
+		return fmt.Errorf("cron: %d job(s) failed", failed)
+	}
+	return nil
+}
+
+// RunCronEvery runs the scheduled jobs on an interval until ctx is canceled.
+// Used by the local dev server, where there's no scheduler.
+func RunCronEvery(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := RunCron(ctx); err != nil {
+				slog.ErrorContext(ctx, "cron failed", "err", err)
+			}
+		}
+	}
+}
+
+func purgeAccounts(ctx context.Context) error {
+	users, err := tube.GetUsersToPurge(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := tube.PurgeUser(ctx, u); err != nil {
+			return fmt.Errorf("purge user %d: %w", u.ID, err)
+		}
+		slog.InfoContext(ctx, "cron: purged user", "user_id", u.ID)
+	}
+	return nil
+}
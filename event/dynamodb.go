@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,13 +27,12 @@ func handleChange(ctx context.Context, e events.DynamoDBEvent) (string, error) {
 	// lc, _ := lambdacontext.FromContext(ctx)
 	changes := make(map[int64]*trackChange)
 	for _, rec := range e.Records {
-		fmt.Println(rec)
+		slog.DebugContext(ctx, "dynamodb: stream record", "event", rec.EventName, "keys", rec.Change.Keys)
 		// TODO: maybe ignore Continue time
 		at := rec.Change.ApproximateCreationDateTime.UTC()
 		userID, err := rec.Change.Keys["UserID"].Integer()
 		if err != nil {
-			log.Println("BAD KEY???", rec.Change.Keys)
-			log.Println(rec.Change)
+			slog.ErrorContext(ctx, "dynamodb: bad key", "keys", rec.Change.Keys, "err", err)
 			continue
 		}
 		ch, ok := changes[userID]
@@ -69,7 +68,7 @@ func handleChange(ctx context.Context, e events.DynamoDBEvent) (string, error) {
 			defer wg.Done()
 			err := tube.RefreshDump(ctx, int(uID), ch.lastmod, ch.tracks, ch.deletes)
 			if err != nil {
-				log.Println("ERROR:", err)
+				slog.ErrorContext(ctx, "dynamodb: refresh dump failed", "user_id", uID, "err", err)
 				atomic.AddInt32(errflag, 1)
 			}
 		}()
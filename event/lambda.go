@@ -2,14 +2,19 @@ package event
 
 import (
 	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/guregu/intertube/web"
 )
 
 func StartLambda(mode string) {
 	switch mode {
 	case "CHANGE":
 		lambda.Start(handleChange)
-	case "FILE":
-		lambda.Start(handleFileQueue)
+	case "FILE", "JOB":
+		lambda.Start(handleJobQueue)
+	case "CRON":
+		web.InitStripe()
+		lambda.Start(handleCron)
 	}
 	panic("unhandled mode: " + mode)
 }
@@ -2,39 +2,23 @@ package event
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/guregu/intertube/storage"
-	"github.com/guregu/intertube/tube"
-	"github.com/guregu/intertube/web"
+	"github.com/guregu/intertube/job"
 )
 
-func handleFileQueue(ctx context.Context, e events.SQSEvent) (string, error) {
-	for _, rec := range e.Records {
-		var fe storage.FileEvent
-		if err := json.Unmarshal([]byte(rec.Body), &fe); err != nil {
-			return "", err
-		}
-
-		u, err := tube.GetUser(ctx, fe.UserID)
-		if err != nil {
-			return "", err
-		}
-
-		f, err := tube.GetFile(ctx, fe.FileID)
-		if err != nil {
-			return "", err
-		}
-
-		if _, err := web.ProcessUpload(ctx, &f, u, fe.Path); err != nil {
-			return "", err
-		}
-
-		if err := storage.QueueAck(rec.ReceiptHandle); err != nil {
-			return "", err
-		}
+// handleJobQueue runs jobs delivered by SQS, a few at a time.
+// Failed jobs are requeued by job.Run, so an error here means
+// a job's state couldn't be saved, and the batch is delivered again.
+// Jobs that already finished are skipped the second time around.
+func handleJobQueue(ctx context.Context, e events.SQSEvent) (string, error) {
+	bodies := make([]string, len(e.Records))
+	for i, rec := range e.Records {
+		bodies[i] = rec.Body
+	}
+	if err := job.RunMessages(ctx, bodies); err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("processed %d event(s)", len(e.Records)), nil
+	return fmt.Sprintf("processed %d job(s)", len(e.Records)), nil
 }
@@ -0,0 +1,286 @@
+// Package job runs background work from a queue.
+//
+// Jobs are recorded in the database, and the queue only carries their keys,
+// so the same job can be delivered more than once without running twice.
+// The queue is SQS when configured, and in-process otherwise.
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/guregu/intertube/tracing"
+	"github.com/guregu/intertube/tube"
+)
+
+// Handler does the work for a job.
+// Returning an error (or panicking) retries the job later, until it runs out of attempts.
+type Handler func(ctx context.Context, j *tube.Job) error
+
+var handlers = make(map[string]Handler)
+
+// Handle registers the handler for jobs of the given kind.
+// It should be called from init.
+func Handle(kind string, h Handler) {
+	if _, ok := handlers[kind]; ok {
+		panic("job: duplicate handler for " + kind)
+	}
+	handlers[kind] = h
+}
+
+// Key identifies a job. It's what the queue delivers.
+type Key struct {
+	UserID int
+	ID     string
+}
+
+// Queue delivers job keys to workers.
+type Queue interface {
+	// Send delivers key after delay.
+	Send(ctx context.Context, key Key, delay time.Duration) error
+	// Receive waits for the next key.
+	// The worker calls done with the result of running it;
+	// on error, the key will be delivered again later.
+	Receive(ctx context.Context) (key Key, done func(error), err error)
+}
+
+type Config struct {
+	// SQS queue URL; in-process if empty
+	SQSURL    string
+	SQSRegion string
+
+	MaxAttempts int
+	// how many jobs from an SQS batch run at once
+	BatchWorkers int
+}
+
+var (
+	queue Queue = newMemQueue()
+	// workers started by Start
+	running sync.WaitGroup
+
+	// MaxAttempts is how many times a job is tried before it fails for good.
+	MaxAttempts = 5
+	// BatchWorkers is how many jobs from an SQS batch RunMessages runs at once.
+	BatchWorkers = 4
+)
+
+const (
+	// retry delays double from here
+	minBackoff = 10 * time.Second
+	// the most SQS can delay a message
+	maxBackoff = 15 * time.Minute
+)
+
+func Init(cfg Config) {
+	if cfg.SQSURL != "" {
+		queue = newSQSQueue(cfg.SQSRegion, cfg.SQSURL)
+	}
+	if cfg.MaxAttempts > 0 {
+		MaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BatchWorkers > 0 {
+		BatchWorkers = cfg.BatchWorkers
+	}
+}
+
+// UsingSQS reports whether jobs are sent to SQS,
+// in which case they might run on a different server.
+func UsingSQS() bool {
+	_, ok := queue.(*sqsQueue)
+	return ok
+}
+
+// Enqueue records a new job and sends it to the queue.
+// The payload is encoded as JSON.
+func Enqueue(ctx context.Context, userID int, kind string, payload any) (tube.Job, error) {
+	if _, ok := handlers[kind]; !ok {
+		return tube.Job{}, fmt.Errorf("job: no handler for %q", kind)
+	}
+	j, err := tube.NewJob(userID, kind, payload)
+	if err != nil {
+		return j, err
+	}
+	if err := j.Create(ctx); err != nil {
+		return j, err
+	}
+	return j, queue.Send(ctx, Key{UserID: j.UserID, ID: j.ID}, 0)
+}
+
+// Retry requeues a failed job with a fresh set of attempts.
+func Retry(ctx context.Context, j *tube.Job) error {
+	if err := j.Requeue(ctx); err != nil {
+		return err
+	}
+	return queue.Send(ctx, Key{UserID: j.UserID, ID: j.ID}, 0)
+}
+
+// Run runs the job with the given key, if it hasn't already finished.
+// Failures of the job itself are recorded and retried;
+// an error means its state couldn't be saved and the delivery should be retried.
+func Run(ctx context.Context, key Key) error {
+	j := tube.Job{UserID: key.UserID, ID: key.ID}
+	err := j.Start(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		// already finished, or deleted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h, ok := handlers[j.Kind]
+	if !ok {
+		return j.Fail(ctx, fmt.Errorf("no handler for %q", j.Kind))
+	}
+
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "job "+j.Kind,
+		attribute.String("job.id", j.ID),
+		attribute.Int("job.user", j.UserID),
+		attribute.Int("job.attempt", j.Attempts))
+	runErr := call(spanCtx, h, &j)
+	tracing.End(span, runErr)
+	if runErr == nil {
+		slog.InfoContext(ctx, "job: done", "kind", j.Kind, "job_id", j.ID, "took", time.Since(start))
+		return j.Finish(ctx)
+	}
+
+	slog.WarnContext(ctx, "job: attempt failed", "kind", j.Kind, "job_id", j.ID, "attempt", j.Attempts, "err", runErr)
+	if j.Attempts >= MaxAttempts {
+		return j.Fail(ctx, runErr)
+	}
+	delay := backoff(j.Attempts)
+	if err := j.Retry(ctx, runErr, time.Now().Add(delay)); err != nil {
+		return err
+	}
+	return queue.Send(ctx, key, delay)
+}
+
+func call(ctx context.Context, h Handler, j *tube.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.ErrorContext(ctx, "job: panic", "kind", j.Kind, "job_id", j.ID, "err", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(ctx, j)
+}
+
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Start runs workers that take jobs from the queue until ctx is canceled.
+// With the in-process queue, unfinished jobs from before a restart are picked up again.
+// Canceling ctx doesn't interrupt jobs that are already running; use Drain to wait for them.
+func Start(ctx context.Context, workers int) {
+	if _, ok := queue.(*memQueue); ok {
+		if err := resume(ctx); err != nil {
+			slog.ErrorContext(ctx, "job: failed to resume unfinished jobs", "err", err)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		running.Add(1)
+		go work(ctx)
+	}
+}
+
+// Drain waits for workers to finish their current jobs after Start's context is canceled.
+// Jobs still running when ctx is done are left for the next process to pick up.
+func Drain(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func work(ctx context.Context) {
+	defer running.Done()
+	for {
+		key, done, err := queue.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "job: receive failed", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(minBackoff):
+			}
+			continue
+		}
+		// finish the job even if we're shutting down
+		err = Run(context.WithoutCancel(ctx), key)
+		if err != nil {
+			slog.ErrorContext(ctx, "job: run failed", "job_id", key.ID, "err", err)
+		}
+		done(err)
+	}
+}
+
+// resume requeues jobs that were queued or running when the server stopped.
+func resume(ctx context.Context) error {
+	for _, status := range []tube.JobStatus{tube.JobQueued, tube.JobRunning} {
+		jobs, err := tube.GetJobsByStatus(ctx, status)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			delay := time.Until(j.RunAfter)
+			if delay < 0 {
+				delay = 0
+			}
+			if err := queue.Send(ctx, Key{UserID: j.UserID, ID: j.ID}, delay); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunMessage runs the job in an SQS message body, for the Lambda event handler.
+func RunMessage(ctx context.Context, body string) error {
+	var key Key
+	if err := json.Unmarshal([]byte(body), &key); err != nil {
+		return err
+	}
+	return Run(ctx, key)
+}
+
+// RunMessages runs the jobs in a batch of SQS message bodies, BatchWorkers at a time.
+// Every job gets to run even if some fail; the first error is returned.
+func RunMessages(ctx context.Context, bodies []string) error {
+	var grp errgroup.Group
+	grp.SetLimit(BatchWorkers)
+	for _, body := range bodies {
+		grp.Go(func() error {
+			return RunMessage(ctx, body)
+		})
+	}
+	return grp.Wait()
+}
@@ -0,0 +1,226 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// okDone gets the ID of each test-ok job that runs.
+var okDone = make(chan string, 10)
+
+func init() {
+	Handle("test-ok", func(ctx context.Context, j *tube.Job) error {
+		okDone <- j.ID
+		return nil
+	})
+	Handle("test-fail", func(ctx context.Context, j *tube.Job) error {
+		return errors.New("nope")
+	})
+	Handle("test-panic", func(ctx context.Context, j *tube.Job) error {
+		panic("oh no")
+	})
+}
+
+// testQueue records what's sent, and never delivers anything by itself.
+type testQueue struct {
+	mu   sync.Mutex
+	sent []time.Duration
+}
+
+func (q *testQueue) Send(_ context.Context, key Key, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sent = append(q.sent, delay)
+	return nil
+}
+
+func (q *testQueue) Receive(ctx context.Context) (Key, func(error), error) {
+	<-ctx.Done()
+	return Key{}, nil, ctx.Err()
+}
+
+func (q *testQueue) take() []time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sent := q.sent
+	q.sent = nil
+	return sent
+}
+
+func testSetup(t *testing.T, q Queue) context.Context {
+	t.Helper()
+	if err := tube.InitSQL("sqlite", filepath.Join(t.TempDir(), "tube.db"), "Test-"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := tube.CreateTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prevQueue, prevAttempts := queue, MaxAttempts
+	queue = q
+	t.Cleanup(func() { queue, MaxAttempts = prevQueue, prevAttempts })
+	return ctx
+}
+
+func TestRun(t *testing.T) {
+	q := new(testQueue)
+	ctx := testSetup(t, q)
+	MaxAttempts = 2
+
+	if _, err := Enqueue(ctx, 1, "test-unknown", nil); err == nil {
+		t.Error("enqueued a job with no handler")
+	}
+
+	tests := []struct {
+		kind     string
+		runs     int
+		status   tube.JobStatus
+		attempts int
+		err      string
+		sent     []time.Duration // after enqueueing, then after each run
+	}{
+		// duplicate deliveries of a finished job do nothing
+		{"test-ok", 2, tube.JobDone, 1, "", []time.Duration{0}},
+		{"test-fail", 1, tube.JobQueued, 1, "nope", []time.Duration{0, minBackoff}},
+		{"test-fail", 3, tube.JobFailed, 2, "nope", []time.Duration{0, minBackoff}},
+		{"test-panic", 2, tube.JobFailed, 2, "panic: oh no", []time.Duration{0, minBackoff}},
+	}
+	for _, test := range tests {
+		j, err := Enqueue(ctx, 1, test.kind, map[string]string{"x": "y"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test.runs; i++ {
+			if err := Run(ctx, Key{UserID: j.UserID, ID: j.ID}); err != nil {
+				t.Fatalf("%s run %d: %v", test.kind, i+1, err)
+			}
+		}
+		got, err := tube.GetJob(ctx, j.UserID, j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != test.status || got.Attempts != test.attempts || got.Error != test.err {
+			t.Errorf("%s after %d runs: status %s, %d attempts, error %q; want %s, %d, %q",
+				test.kind, test.runs, got.Status, got.Attempts, got.Error, test.status, test.attempts, test.err)
+		}
+		if sent := q.take(); !slices.Equal(sent, test.sent) {
+			t.Errorf("%s: sent with delays %v, want %v", test.kind, sent, test.sent)
+		}
+		var payload map[string]string
+		if err := got.Decode(&payload); err != nil || payload["x"] != "y" {
+			t.Errorf("%s: payload %v, %v", test.kind, payload, err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	q := new(testQueue)
+	ctx := testSetup(t, q)
+	MaxAttempts = 1
+
+	j, err := Enqueue(ctx, 1, "test-fail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(ctx, Key{UserID: j.UserID, ID: j.ID}); err != nil {
+		t.Fatal(err)
+	}
+	j, err = tube.GetJob(ctx, j.UserID, j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != tube.JobFailed {
+		t.Fatalf("status: %s, want failed", j.Status)
+	}
+	q.take()
+
+	if err := Retry(ctx, &j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != tube.JobQueued || j.Attempts != 0 {
+		t.Errorf("after Retry: status %s, %d attempts; want queued, 0", j.Status, j.Attempts)
+	}
+	if sent := q.take(); len(sent) != 1 {
+		t.Errorf("after Retry: sent %d times, want 1", len(sent))
+	}
+	// only failed jobs can be retried
+	if err := Retry(ctx, &j); err == nil {
+		t.Error("retried a queued job")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, minBackoff},
+		{2, 2 * minBackoff},
+		{3, 4 * minBackoff},
+		{20, maxBackoff},
+	}
+	for _, test := range tests {
+		if got := backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestMemQueue(t *testing.T) {
+	ctx := testSetup(t, newMemQueue())
+	for len(okDone) > 0 {
+		<-okDone
+	}
+
+	// left over from before a restart
+	leftover, err := tube.NewJob(1, "test-ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leftover.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	Start(workCtx, 2)
+	j, err := Enqueue(ctx, 1, "test-ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{leftover.ID: true, j.ID: true}
+	for len(want) > 0 {
+		select {
+		case id := <-okDone:
+			delete(want, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("jobs didn't run: %v", want)
+		}
+	}
+
+	cancel()
+	drainCtx, cancelDrain := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelDrain()
+	if err := Drain(drainCtx); err != nil {
+		t.Fatal("workers didn't stop:", err)
+	}
+	// the job is finished by the time its handler returns, but give it a moment to be saved
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := tube.GetJob(ctx, j.UserID, j.ID)
+		if err == nil && got.Status == tube.JobDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job status: %s, %v; want done", got.Status, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
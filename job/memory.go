@@ -0,0 +1,40 @@
+package job
+
+import (
+	"context"
+	"time"
+)
+
+// memQueue is an in-process queue. Jobs are still recorded in the database,
+// so Start can pick up where a previous process left off.
+type memQueue struct {
+	keys chan Key
+}
+
+// how long to wait before redelivering a job whose state couldn't be saved
+const memRedeliverDelay = time.Minute
+
+func newMemQueue() *memQueue {
+	return &memQueue{keys: make(chan Key)}
+}
+
+func (q *memQueue) Send(_ context.Context, key Key, delay time.Duration) error {
+	// never block the sender, even with no workers running
+	time.AfterFunc(delay, func() {
+		q.keys <- key
+	})
+	return nil
+}
+
+func (q *memQueue) Receive(ctx context.Context) (Key, func(error), error) {
+	select {
+	case <-ctx.Done():
+		return Key{}, nil, ctx.Err()
+	case key := <-q.keys:
+		return key, func(err error) {
+			if err != nil {
+				q.Send(context.Background(), key, memRedeliverDelay)
+			}
+		}, nil
+	}
+}
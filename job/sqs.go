@@ -0,0 +1,75 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/guregu/intertube/retry"
+)
+
+type sqsQueue struct {
+	client *sqs.SQS
+	url    string
+}
+
+func newSQSQueue(region, href string) *sqsQueue {
+	client := sqs.New(session.Must(session.NewSession(retry.AWS(&aws.Config{
+		Region: aws.String(region),
+	}))))
+	return &sqsQueue{client: client, url: href}
+}
+
+func (q *sqsQueue) Send(ctx context.Context, key Key, delay time.Duration) error {
+	bs, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	_, err = q.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:     &q.url,
+		MessageBody:  aws.String(string(bs)),
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+	})
+	return err
+}
+
+func (q *sqsQueue) Receive(ctx context.Context) (Key, func(error), error) {
+	for {
+		out, err := q.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            &q.url,
+			MaxNumberOfMessages: aws.Int64(1),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			return Key{}, nil, err
+		}
+		if len(out.Messages) == 0 {
+			continue
+		}
+		msg := out.Messages[0]
+		var key Key
+		if err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), &key); err != nil {
+			return Key{}, nil, err
+		}
+		return key, func(err error) {
+			if err != nil {
+				// redelivered once the visibility timeout is up
+				return
+			}
+			if _, err := q.client.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      &q.url,
+				ReceiptHandle: msg.ReceiptHandle,
+			}); err != nil {
+				slog.Error("job: failed to delete SQS message", "err", err)
+			}
+		}, nil
+	}
+}
@@ -3,15 +3,17 @@
 package main
 
 import (
-	"net/http"
-
 	"github.com/akrylysov/algnhsa"
 	"github.com/guregu/intertube/event"
+	"github.com/guregu/intertube/web"
 	// "github.com/aws/aws-lambda-go/lambda"
 )
 
 func startLambda() {
-	algnhsa.ListenAndServe(http.DefaultServeMux, nil)
+	algnhsa.ListenAndServe(web.Handler(), &algnhsa.Options{
+		// artwork from /art/
+		BinaryContentTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+	})
 }
 
 func startEventLambda(mode string) {
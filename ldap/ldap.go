@@ -0,0 +1,223 @@
+// Package ldap authenticates users against an LDAP or Active Directory server.
+package ldap
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// CacheTTL is how long successful logins are remembered,
+// so Subsonic clients don't bind on every request.
+const CacheTTL = 5 * time.Minute
+
+var (
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+	ErrNoGroup            = errors.New("ldap: user is not in any allowed group")
+)
+
+type Config struct {
+	URL      string // ldap:// or ldaps://
+	StartTLS bool
+	// skip certificate verification, for testing only
+	InsecureSkipVerify bool
+
+	// service account used to look up users
+	BindDN       string
+	BindPassword string
+
+	BaseDN string
+	// %s is replaced with the escaped login, like "(&(objectClass=person)(mail=%s))"
+	UserFilter string
+	EmailAttr  string
+	GroupAttr  string
+
+	// quota for users that aren't in any mapped group, 0 = unlimited
+	DefaultQuota int64
+	// reject users that aren't in any mapped group
+	RequireGroup bool
+	Groups       []Group
+}
+
+// Group maps membership in a directory group to a storage quota.
+type Group struct {
+	DN    string
+	Quota int64 // 0 = unlimited
+}
+
+// Identity is an authenticated directory user.
+type Identity struct {
+	DN     string
+	Email  string
+	Groups []string
+	Quota  int64 // 0 = unlimited
+}
+
+var (
+	config  Config
+	enabled bool
+
+	cache   = make(map[[sha256.Size]byte]cachedIdentity)
+	cacheMu sync.Mutex
+)
+
+type cachedIdentity struct {
+	Identity
+	expires time.Time
+}
+
+func Init(cfg Config) {
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(mail=%s)"
+	}
+	if cfg.EmailAttr == "" {
+		cfg.EmailAttr = "mail"
+	}
+	if cfg.GroupAttr == "" {
+		cfg.GroupAttr = "memberOf"
+	}
+	config = cfg
+	enabled = cfg.URL != ""
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+// Authenticate checks login and password against the directory
+// and determines the user's quota from their groups.
+func Authenticate(login, password string) (Identity, error) {
+	// an empty password is an unauthenticated bind, which always succeeds
+	if login == "" || password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	key := sha256.Sum256([]byte(login + "\x00" + password))
+	cacheMu.Lock()
+	hit, ok := cache[key]
+	cacheMu.Unlock()
+	if ok && time.Now().Before(hit.expires) {
+		return hit.Identity, nil
+	}
+
+	id, err := authenticate(login, password)
+	if err != nil {
+		return id, err
+	}
+
+	cacheMu.Lock()
+	now := time.Now()
+	for k, v := range cache {
+		if now.After(v.expires) {
+			delete(cache, k)
+		}
+	}
+	cache[key] = cachedIdentity{Identity: id, expires: now.Add(CacheTTL)}
+	cacheMu.Unlock()
+	return id, nil
+}
+
+func authenticate(login, password string) (Identity, error) {
+	conn, err := dial()
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	if config.BindDN != "" {
+		if err := conn.Bind(config.BindDN, config.BindPassword); err != nil {
+			return Identity{}, fmt.Errorf("ldap: service bind: %w", err)
+		}
+	}
+
+	req := goldap.NewSearchRequest(
+		config.BaseDN,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(config.UserFilter, goldap.EscapeFilter(login)),
+		[]string{"dn", config.EmailAttr, config.GroupAttr},
+		nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("ldap: search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{}, fmt.Errorf("ldap: bind: %w", err)
+	}
+
+	id := Identity{
+		DN:     entry.DN,
+		Email:  strings.ToLower(entry.GetAttributeValue(config.EmailAttr)),
+		Groups: entry.GetAttributeValues(config.GroupAttr),
+	}
+	if id.Email == "" {
+		return Identity{}, fmt.Errorf("ldap: %s has no %s", entry.DN, config.EmailAttr)
+	}
+	quota, ok := groupQuota(id.Groups)
+	if !ok {
+		if config.RequireGroup {
+			return Identity{}, ErrNoGroup
+		}
+		quota = config.DefaultQuota
+	}
+	id.Quota = quota
+	return id, nil
+}
+
+// groupQuota returns the most generous quota of the mapped groups the user belongs to.
+func groupQuota(groups []string) (quota int64, ok bool) {
+	for _, g := range config.Groups {
+		for _, dn := range groups {
+			if !strings.EqualFold(g.DN, dn) {
+				continue
+			}
+			if g.Quota == 0 {
+				// unlimited
+				return 0, true
+			}
+			if g.Quota > quota {
+				quota = g.Quota
+			}
+			ok = true
+		}
+	}
+	return quota, ok
+}
+
+func dial() (*goldap.Conn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: bad url: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	conn, err := goldap.DialURL(config.URL, goldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: dial: %w", err)
+	}
+	conn.SetTimeout(10 * time.Second)
+	if config.StartTLS {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,264 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testBaseDN  = "ou=people,dc=example,dc=com"
+	testMusicDN = "cn=music,ou=groups,dc=example,dc=com"
+	testAdminDN = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+type testEntry struct {
+	dn       string
+	password string
+	mail     string
+	groups   []string
+}
+
+// testDirectory is just enough of an LDAP server for Authenticate:
+// simple binds, and searches by (mail=...).
+type testDirectory struct {
+	entries []testEntry
+	binds   int
+}
+
+func (d *testDirectory) serve(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.handle(conn)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func (d *testDirectory) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		id := req.Children[0].Value
+		op := req.Children[1]
+		var resps []*ber.Packet
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			d.binds++
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := goldap.LDAPResultInvalidCredentials
+			if dn == "cn=service" && password == "service" {
+				code = goldap.LDAPResultSuccess
+			}
+			for _, e := range d.entries {
+				if e.dn == dn && e.password == password {
+					code = goldap.LDAPResultSuccess
+				}
+			}
+			resps = append(resps, ldapResult(goldap.ApplicationBindResponse, code))
+		case goldap.ApplicationSearchRequest:
+			filter, err := goldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, e := range d.entries {
+				if filter != "(mail="+goldap.EscapeFilter(e.mail)+")" {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				attrs.AppendChild(testAttr("mail", e.mail))
+				attrs.AppendChild(testAttr("memberOf", e.groups...))
+				entry.AppendChild(attrs)
+				resps = append(resps, entry)
+			}
+			resps = append(resps, ldapResult(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess))
+		default:
+			return
+		}
+		for _, resp := range resps {
+			msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			msg.AppendChild(resp)
+			if _, err := conn.Write(msg.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func ldapResult(op ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func testAttr(name string, values ...string) *ber.Packet {
+	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+	vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+	for _, v := range values {
+		vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+	}
+	attr.AppendChild(vals)
+	return attr
+}
+
+func testInit(t *testing.T, cfg Config) {
+	t.Helper()
+	Init(cfg)
+	cache = make(map[[sha256.Size]byte]cachedIdentity)
+	t.Cleanup(func() {
+		Init(Config{})
+		cache = make(map[[sha256.Size]byte]cachedIdentity)
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	dir := &testDirectory{entries: []testEntry{
+		{dn: "uid=alice," + testBaseDN, password: "hunter2", mail: "Alice@Example.com", groups: []string{testMusicDN}},
+		{dn: "uid=bob," + testBaseDN, password: "swordfish", mail: "bob@example.com"},
+	}}
+	url := dir.serve(t)
+
+	tests := []struct {
+		name     string
+		require  bool
+		login    string
+		password string
+		want     Identity
+		err      error
+	}{
+		{
+			name:  "member of a group",
+			login: "Alice@Example.com", password: "hunter2",
+			want: Identity{DN: "uid=alice," + testBaseDN, Email: "alice@example.com", Groups: []string{testMusicDN}, Quota: 500},
+		},
+		{
+			name:  "not in any group",
+			login: "bob@example.com", password: "swordfish",
+			want: Identity{DN: "uid=bob," + testBaseDN, Email: "bob@example.com", Quota: 50},
+		},
+		{
+			name:    "not in any group, when one is required",
+			require: true,
+			login:   "bob@example.com", password: "swordfish",
+			err: ErrNoGroup,
+		},
+		{
+			name:  "wrong password",
+			login: "Alice@Example.com", password: "hunter3",
+			err: ErrInvalidCredentials,
+		},
+		{
+			name:  "unknown user",
+			login: "carol@example.com", password: "hunter2",
+			err: ErrInvalidCredentials,
+		},
+		{
+			name:  "filter injection",
+			login: "*", password: "hunter2",
+			err: ErrInvalidCredentials,
+		},
+	}
+	for _, test := range tests {
+		testInit(t, Config{
+			URL:          url,
+			BindDN:       "cn=service",
+			BindPassword: "service",
+			BaseDN:       testBaseDN,
+			DefaultQuota: 50,
+			RequireGroup: test.require,
+			Groups: []Group{
+				{DN: testMusicDN, Quota: 500},
+				{DN: testAdminDN, Quota: 0},
+			},
+		})
+		got, err := Authenticate(test.login, test.password)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if got.DN != test.want.DN || got.Email != test.want.Email || got.Quota != test.want.Quota ||
+			len(got.Groups) != len(test.want.Groups) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticateCache(t *testing.T) {
+	dir := &testDirectory{entries: []testEntry{
+		{dn: "uid=alice," + testBaseDN, password: "hunter2", mail: "alice@example.com"},
+	}}
+	testInit(t, Config{URL: dir.serve(t), BaseDN: testBaseDN})
+
+	// an empty password would be an unauthenticated bind, which always succeeds
+	if _, err := Authenticate("alice@example.com", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("empty password: %v, want ErrInvalidCredentials", err)
+	}
+	if dir.binds != 0 {
+		t.Errorf("empty password: bound %d times, want 0", dir.binds)
+	}
+
+	if _, err := Authenticate("alice@example.com", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	binds := dir.binds
+	if _, err := Authenticate("alice@example.com", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if dir.binds != binds {
+		t.Error("second login wasn't cached")
+	}
+	// failures aren't cached, and don't match the cached success
+	if _, err := Authenticate("alice@example.com", "hunter3"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password after a cached login: %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestGroupQuota(t *testing.T) {
+	testInit(t, Config{Groups: []Group{
+		{DN: "cn=small", Quota: 100},
+		{DN: "cn=big", Quota: 1000},
+		{DN: "cn=unlimited", Quota: 0},
+	}})
+
+	tests := []struct {
+		groups []string
+		quota  int64
+		ok     bool
+	}{
+		{nil, 0, false},
+		{[]string{"cn=other"}, 0, false},
+		{[]string{"cn=small"}, 100, true},
+		{[]string{"CN=Small"}, 100, true},
+		{[]string{"cn=small", "cn=big"}, 1000, true},
+		{[]string{"cn=big", "cn=unlimited", "cn=small"}, 0, true},
+	}
+	for _, test := range tests {
+		quota, ok := groupQuota(test.groups)
+		if quota != test.quota || ok != test.ok {
+			t.Errorf("groupQuota(%v) = %d, %v; want %d, %v", test.groups, quota, ok, test.quota, test.ok)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package logging sets up structured logging with log/slog.
+//
+// Attributes added to a context with With are included in every record
+// logged with that context, like slog.InfoContext(ctx, ...).
+// This is how request IDs, user IDs, and routes end up in the logs.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type attrskey struct{}
+
+// Init makes slog's default logger (and the log package's) write to stderr.
+// format is "text" (the default) or "json". level is "debug", "info" (the default), "warn", or "error".
+func Init(format, level string) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("logging: invalid level %q", level)
+		}
+	}
+	h, err := newHandler(os.Stderr, format, lvl)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func newHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return contextHandler{slog.NewTextHandler(w, opts)}, nil
+	case "json":
+		return contextHandler{slog.NewJSONHandler(w, opts)}, nil
+	}
+	return nil, fmt.Errorf("logging: invalid format %q", format)
+}
+
+// With returns a context whose log records include the given attributes,
+// as key-value pairs like slog.Logger.With.
+func With(ctx context.Context, args ...any) context.Context {
+	prev, _ := ctx.Value(attrskey{}).([]slog.Attr)
+	r := slog.Record{}
+	r.Add(args...)
+	attrs := make([]slog.Attr, len(prev), len(prev)+r.NumAttrs())
+	copy(attrs, prev)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, attrskey{}, attrs)
+}
+
+// contextHandler adds attributes from With and the current trace to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(attrskey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,77 @@
+package lyrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const lrclibURL = "https://lrclib.net"
+
+// lrclib looks up lyrics with LRCLIB's API.
+// See: https://lrclib.net/docs
+type lrclib struct {
+	base string
+}
+
+func newLRCLIB(base string) lrclib {
+	if base == "" {
+		base = lrclibURL
+	}
+	return lrclib{base: strings.TrimSuffix(base, "/")}
+}
+
+func (lrclib) Name() string {
+	return string(TypeLRCLIB)
+}
+
+func (p lrclib) Find(ctx context.Context, q Query) (Lyrics, error) {
+	params := url.Values{
+		"track_name":  {q.Title},
+		"artist_name": {q.Artist},
+	}
+	if q.Album != "" {
+		params.Set("album_name", q.Album)
+	}
+	if q.Duration > 0 {
+		params.Set("duration", strconv.Itoa(q.Duration))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.base+"/api/get?"+params.Encode(), nil)
+	if err != nil {
+		return Lyrics{}, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return Lyrics{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return Lyrics{}, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return Lyrics{}, fmt.Errorf("lrclib: unexpected status: %s", resp.Status)
+	}
+
+	var result struct {
+		Instrumental bool   `json:"instrumental"`
+		PlainLyrics  string `json:"plainLyrics"`
+		SyncedLyrics string `json:"syncedLyrics"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Lyrics{}, fmt.Errorf("lrclib: %w", err)
+	}
+	switch {
+	case result.Instrumental:
+		return Lyrics{Instrumental: true}, nil
+	case result.SyncedLyrics != "":
+		return Lyrics{Text: result.SyncedLyrics, Synced: true}, nil
+	case result.PlainLyrics != "":
+		return Lyrics{Text: result.PlainLyrics}, nil
+	}
+	return Lyrics{}, ErrNotFound
+}
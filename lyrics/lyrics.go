@@ -0,0 +1,122 @@
+// Package lyrics looks up song lyrics from external providers like LRCLIB.
+package lyrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// ErrNotFound is returned when no provider has lyrics for a song.
+var ErrNotFound = errors.New("lyrics: not found")
+
+// Query is the song to look up.
+type Query struct {
+	Title    string
+	Artist   string
+	Album    string
+	Duration int // seconds, 0 if unknown
+}
+
+// Lyrics are a song's words.
+type Lyrics struct {
+	Text string
+	// Text is in LRC format, with timestamps
+	Synced bool
+	// the song has no words; Text is empty
+	Instrumental bool
+	// name of the provider they came from
+	Provider string
+}
+
+// Provider finds lyrics.
+type Provider interface {
+	Name() string
+	// Find returns ErrNotFound if it doesn't have lyrics for q.
+	Find(ctx context.Context, q Query) (Lyrics, error)
+}
+
+type Type string
+
+const (
+	TypeLRCLIB Type = "lrclib"
+)
+
+type Config struct {
+	// tried in order
+	Providers []ProviderConfig
+}
+
+type ProviderConfig struct {
+	Type Type
+	// base URL, for mirrors or self-hosted instances
+	URL string
+}
+
+const (
+	requestTimeout = 10 * time.Second
+	userAgent      = "intertube (https://github.com/guregu/intertube)"
+)
+
+var (
+	providers []Provider
+	client    = &http.Client{Timeout: requestTimeout}
+)
+
+// Init sets up the providers lyrics are fetched from.
+// Without it, lyrics are never fetched.
+func Init(cfg Config) error {
+	var ps []Provider
+	for _, pc := range cfg.Providers {
+		switch pc.Type {
+		case TypeLRCLIB:
+			ps = append(ps, newLRCLIB(pc.URL))
+		default:
+			return fmt.Errorf("lyrics: unknown provider type %q", pc.Type)
+		}
+	}
+	providers = ps
+	return nil
+}
+
+// Enabled reports whether any providers are configured.
+func Enabled() bool {
+	return len(providers) > 0
+}
+
+// Find asks each provider in turn for the lyrics to q.
+// A provider that fails is logged and skipped.
+func Find(ctx context.Context, q Query) (Lyrics, error) {
+	if q.Title == "" {
+		return Lyrics{}, ErrNotFound
+	}
+	var lastErr error
+	for _, p := range providers {
+		found, err := p.Find(ctx, q)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "lyrics: provider failed", "provider", p.Name(), "err", err)
+			lastErr = err
+			continue
+		}
+		found.Provider = p.Name()
+		return found, nil
+	}
+	if lastErr != nil {
+		return Lyrics{}, lastErr
+	}
+	return Lyrics{}, ErrNotFound
+}
+
+var lrcLine = regexp.MustCompile(`(?m)^\[\d+:\d+(\.\d+)?\]`)
+
+// IsSynced reports whether text looks like LRC, with timestamped lines.
+func IsSynced(text string) bool {
+	return lrcLine.MatchString(text)
+}
@@ -3,14 +3,30 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
+
+	"github.com/guregu/intertube/cdn"
+	"github.com/guregu/intertube/config"
+	"github.com/guregu/intertube/email"
+	"github.com/guregu/intertube/event"
+	"github.com/guregu/intertube/job"
+	"github.com/guregu/intertube/ldap"
+	"github.com/guregu/intertube/logging"
+	"github.com/guregu/intertube/lyrics"
+	"github.com/guregu/intertube/retry"
 	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tracing"
 	"github.com/guregu/intertube/tube"
 	"github.com/guregu/intertube/web"
 )
@@ -19,9 +35,25 @@ var (
 	domainFlag = flag.String("domain", "", "domain")
 	bindFlag   = flag.String("addr", ":8000", "addr to bind on")
 	cfgFlag    = flag.String("cfg", "config.toml", "configuration file location")
+
+	migrateFlag     = flag.String("migrate-to", "", "copy stored objects to the storage backend configured in this file, then exit")
+	migrateUserFlag = flag.Int("migrate-user", 0, "with -migrate-to, only copy this user's objects")
+	dryRunFlag      = flag.Bool("dry-run", false, "with -migrate-to, report what would be copied without copying")
+)
+
+// how often scheduled jobs run on the local server
+const cronInterval = time.Hour
+
+var (
+	// how many background jobs run at once on the local server
+	jobWorkers = 4
+	// how long to wait for uploads and jobs to finish when stopping
+	shutdownTimeout = 30 * time.Second
 )
 
 func init() {
+	// until the config is read
+	logging.Init("", "")
 	rand.Seed(time.Now().UnixNano())
 }
 
@@ -29,41 +61,139 @@ func main() {
 	flag.Parse()
 
 	if *cfgFlag != "" {
-		cfg, err := readConfig(*cfgFlag)
+		cfg, err := config.Read(*cfgFlag)
 		if err != nil {
-			log.Fatalln("Failed to read config file:", *cfgFlag, "error:", err)
+			fatal("Failed to read config file", "path", *cfgFlag, "err", err)
+		}
+		if err := logging.Init(cfg.LogFormat, cfg.LogLevel); err != nil {
+			fatal("Invalid logging config", "err", err)
+		}
+		if cfg.MaxRetries > 0 {
+			retry.MaxRetries = cfg.MaxRetries
 		}
 		web.Domain = cfg.Domain
+		web.InviteOnly = cfg.InviteOnly
+		if err := configureWeb(cfg); err != nil {
+			fatal("Invalid web config", "err", err)
+		}
+		if err := configureEgress(cfg); err != nil {
+			fatal("Invalid egress config", "err", err)
+		}
+		if cfg.LapseGrace > 0 {
+			tube.LapseGracePeriod = time.Duration(cfg.LapseGrace) * 24 * time.Hour
+		}
+		tube.DeleteOrphans = cfg.Storage.DeleteOrphans
+		if cfg.Storage.ColdStorageClass != "" {
+			tube.ColdAfter = time.Duration(cfg.Storage.ColdAfterDays) * 24 * time.Hour
+		}
+		if cfg.SelfHosted {
+			if err := selfHost(cfg.Quota); err != nil {
+				fatal("Invalid quota", "quota", cfg.Quota, "err", err)
+			}
+		}
+
+		switch cfg.DB.Type {
+		case "", "dynamodb":
+			tube.Init(cfg.DB.Region, cfg.DB.Prefix, cfg.DB.Endpoint, cfg.DB.Debug)
+		default:
+			if err := tube.InitSQL(cfg.DB.Type, cfg.DB.URL, cfg.DB.Prefix); err != nil {
+				fatal("Failed to connect to database", "err", err)
+			}
+		}
+		if cfg.DB.CacheSize > 0 {
+			tube.EnableCache(int64(cfg.DB.CacheSize), time.Duration(cfg.DB.CacheSeconds)*time.Second)
+		}
+
+		if cfg.Tracing.Endpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+			flushTraces, err := tracing.Init(context.Background(), tracing.Config{
+				Endpoint:   cfg.Tracing.Endpoint,
+				Insecure:   cfg.Tracing.Insecure,
+				SampleRate: cfg.Tracing.SampleRate,
+			})
+			if err != nil {
+				fatal("Invalid tracing config", "err", err)
+			}
+			defer flushTraces(context.Background())
+		}
+
+		storage.Init(storageConfig(cfg))
+		job.Init(job.Config{
+			SQSURL:      cfg.Queue.SQS,
+			SQSRegion:   cfg.Queue.Region,
+			MaxAttempts: cfg.Queue.MaxAttempts,
+			// Lambda runs a batch's jobs with the same concurrency
+			BatchWorkers: cfg.Queue.Workers,
+		})
+		if cfg.Queue.Workers > 0 {
+			jobWorkers = cfg.Queue.Workers
+		}
+
+		if cfg.CDN.Type != "" {
+			if err := cdn.Init(cdnConfig(cfg)); err != nil {
+				fatal("Invalid CDN config", "err", err)
+			}
+			go reloadCDN(*cfgFlag, time.Duration(cfg.CDN.ReloadMinutes)*time.Minute)
+		}
+
+		if cfg.Email.Type != "" || cfg.Email.From != "" {
+			err := email.Init(email.Config{
+				Type:         cfg.Email.Type,
+				From:         cfg.Email.From,
+				Region:       cfg.Email.Region,
+				SMTPAddr:     cfg.Email.SMTPAddr,
+				SMTPUsername: cfg.Email.SMTPUsername,
+				SMTPPassword: cfg.Email.SMTPPassword,
+			})
+			if err != nil {
+				fatal("Invalid email config", "err", err)
+			}
+		}
+
+		if len(cfg.Lyrics.Providers) > 0 {
+			var lyricsCfg lyrics.Config
+			for _, p := range cfg.Lyrics.Providers {
+				lyricsCfg.Providers = append(lyricsCfg.Providers, lyrics.ProviderConfig{
+					Type: lyrics.Type(p.Type),
+					URL:  p.URL,
+				})
+			}
+			if err := lyrics.Init(lyricsCfg); err != nil {
+				fatal("Invalid lyrics config", "err", err)
+			}
+		}
 
-		tube.Init(cfg.DB.Region, cfg.DB.Prefix, cfg.DB.Endpoint, cfg.DB.Debug)
+		if cfg.LDAP.URL != "" {
+			ldapCfg, err := ldapConfig(cfg)
+			if err != nil {
+				fatal("Invalid LDAP config", "err", err)
+			}
+			ldap.Init(ldapCfg)
+		}
+	}
 
-		storageCfg := storage.Config{
-			Type:            storage.StorageType(cfg.Storage.Type),
-			FilesBucket:     cfg.Storage.FilesBucket,
-			UploadsBucket:   cfg.Storage.UploadsBucket,
-			CacheBucket:     cfg.Storage.CacheBucket,
-			AccessKeyID:     cfg.Storage.AccessKeyID,
-			AccessKeySecret: cfg.Storage.AccessKeySecret,
-			Region:          cfg.Storage.Region,
-			Endpoint:        cfg.Storage.Endpoint,
-			CFAccountID:     cfg.Storage.CloudflareAccount,
-			SQSURL:          cfg.Queue.SQS,
-			SQSRegion:       cfg.Queue.Region,
+	if *migrateFlag != "" {
+		if err := migrateStorage(*migrateFlag, *migrateUserFlag, *dryRunFlag); err != nil {
+			fatal("Migration failed", "err", err)
 		}
-		storage.Init(storageCfg)
+		return
 	}
 
 	if os.Getenv("LAMBDA_TASK_ROOT") != "" {
 		// TODO: split these into separate binaries maybe
 		mode := os.Getenv("MODE")
-		log.Println("Lambda mode", mode)
+		slog.Info("Lambda mode", "mode", mode)
 		switch mode {
 		case "WEB":
 			// web server
-			log.Println("deploy time:", web.Deployed)
-			web.Load()
+			slog.Info("Deploy time", "deployed", web.Deployed)
+			if err := web.Load(); err != nil {
+				fatal("Failed to load", "err", err)
+			}
+			if !job.UsingSQS() {
+				job.Start(context.Background(), jobWorkers)
+			}
 			startLambda()
-		case "CHANGE", "FILE":
+		case "CHANGE", "FILE", "CRON":
 			startEventLambda(mode)
 		}
 		return
@@ -71,7 +201,7 @@ func main() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	if err := tube.CreateTables(ctx); err != nil {
-		log.Fatalln("Failed to create tables:", err)
+		fatal("Failed to create tables", "err", err)
 	}
 	cancel()
 
@@ -83,16 +213,277 @@ func main() {
 	// os.Exit(0)
 
 	// local server for dev
-	log.Println("Build date:", web.Deployed)
+	slog.Info("Build date", "deployed", web.Deployed)
 	web.DebugMode = true
-	web.Load()
+	if err := web.Load(); err != nil {
+		fatal("Failed to load", "err", err)
+	}
 
-	log.Println("Starting up local webserver at:", bindAddr())
+	slog.Info("Starting up local webserver", "addr", bindAddr())
 	closeWatch := web.WatchFiles()
-	if err := http.ListenAndServe(*bindFlag, nil); err != nil {
-		panic(err)
+	defer closeWatch()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go event.RunCronEvery(ctx, cronInterval)
+	job.Start(ctx, jobWorkers)
+	handler, err := web.Compress(web.Handler())
+	if err != nil {
+		fatal("Failed to set up compression", "err", err)
+	}
+	srv := &http.Server{Addr: *bindFlag, Handler: handler}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("Server failed", "err", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(srv)
+}
+
+// shutdown stops accepting requests and waits for in-flight requests and jobs to finish,
+// up to shutdownTimeout. A second signal exits immediately.
+func shutdown(srv *http.Server) {
+	slog.Info("Shutting down", "timeout", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Gave up waiting for requests", "err", err)
+	}
+	if err := job.Drain(ctx); err != nil {
+		slog.Error("Gave up waiting for jobs", "err", err)
+	}
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// selfHost disables billing and gives every account the given quota.
+func selfHost(quota string) error {
+	bytes, err := parseQuota(quota)
+	if err != nil {
+		return err
+	}
+	web.SelfHosted = true
+	tube.DisablePlans(bytes)
+	if quota == "" {
+		quota = "unlimited"
+	}
+	slog.Info("Self-hosted mode", "quota", quota)
+	return nil
+}
+
+// configureWeb applies limits that default to constants in package web.
+func configureWeb(cfg config.Config) error {
+	if cfg.Web.MaxFileSize != "" {
+		size, err := humanize.ParseBytes(cfg.Web.MaxFileSize)
+		if err != nil {
+			return fmt.Errorf("max_file_size: %w", err)
+		}
+		web.MaxFileSize = int64(size)
+	}
+	minutes := func(dst *time.Duration, n int) {
+		if n > 0 {
+			*dst = time.Duration(n) * time.Minute
+		}
+	}
+	minutes(&web.FileDownloadTTL, cfg.Web.DownloadLinkMinutes)
+	minutes(&web.ThumbnailDownloadTTL, cfg.Web.ThumbnailLinkMinutes)
+	minutes(&web.UploadTTL, cfg.Web.UploadLinkMinutes)
+	minutes(&web.ExportLinkTTL, cfg.Web.ExportLinkMinutes)
+	seconds := func(dst *time.Duration, n int) {
+		if n > 0 {
+			*dst = time.Duration(n) * time.Second
+		}
+	}
+	seconds(&web.RequestTimeout, cfg.Web.RequestTimeoutSeconds)
+	seconds(&web.SlowRequestTimeout, cfg.Web.SlowRequestTimeoutSeconds)
+	seconds(&shutdownTimeout, cfg.Web.ShutdownSeconds)
+	web.MetricsToken = cfg.Web.MetricsToken
+	web.DebugToken = cfg.Web.DebugToken
+	if cfg.Web.StaticURL != "" {
+		web.StaticURL = strings.TrimSuffix(cfg.Web.StaticURL, "/")
+	}
+	for _, cidr := range cfg.Web.TrustedProxies {
+		if !strings.Contains(cidr, "/") {
+			cidr = singleAddr(cidr)
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("trusted_proxies: %w", err)
+		}
+		web.TrustedProxies = append(web.TrustedProxies, ipnet)
+	}
+	web.CountryHeader = cfg.Web.CountryHeader
+	if web.CountryHeader == "" {
+		web.CountryHeader = cdn.Type(cfg.CDN.Type).CountryHeader()
+	}
+	return nil
+}
+
+// singleAddr turns a bare IP address into a CIDR range with just it.
+func singleAddr(addr string) string {
+	if strings.Contains(addr, ":") {
+		return addr + "/128"
+	}
+	return addr + "/32"
+}
+
+// configureEgress sets monthly download caps per plan.
+func configureEgress(cfg config.Config) error {
+	for name, limit := range cfg.Egress.Caps {
+		kind := tube.PlanKind(name)
+		if name == "none" {
+			kind = tube.PlanKindNone
+		}
+		bytes, err := parseQuota(limit)
+		if err != nil {
+			return fmt.Errorf("caps.%s: %w", name, err)
+		}
+		if err := tube.SetPlanEgressCap(kind, bytes); err != nil {
+			return err
+		}
+	}
+	if cfg.Egress.Throttle != "" {
+		rate, err := humanize.ParseBytes(cfg.Egress.Throttle)
+		if err != nil {
+			return fmt.Errorf("throttle: %w", err)
+		}
+		web.EgressThrottle = int64(rate)
+	}
+	return nil
+}
+
+func storageConfig(cfg config.Config) storage.Config {
+	var replicas []storage.ReplicaConfig
+	for _, r := range cfg.Storage.Replicas {
+		replicas = append(replicas, storage.ReplicaConfig{
+			Bucket:    r.Bucket,
+			Region:    r.Region,
+			Countries: r.Countries,
+		})
+	}
+	return storage.Config{
+		Type:            storage.StorageType(cfg.Storage.Type),
+		FilesBucket:     cfg.Storage.FilesBucket,
+		UploadsBucket:   cfg.Storage.UploadsBucket,
+		CacheBucket:     cfg.Storage.CacheBucket,
+		AccessKeyID:     cfg.Storage.AccessKeyID,
+		AccessKeySecret: cfg.Storage.AccessKeySecret,
+		Region:          cfg.Storage.Region,
+		Endpoint:        cfg.Storage.Endpoint,
+		PathStyle:       cfg.Storage.PathStyle,
+		BucketRegions:   cfg.Storage.Regions,
+		Replicas:        replicas,
+		CFAccountID:     cfg.Storage.CloudflareAccount,
+		KMSKeyID:        cfg.Storage.KMSKeyID,
+		CredentialsFile: cfg.Storage.CredentialsFile,
+		Path:            cfg.Storage.Path,
+		URL:             cfg.Storage.URL,
+		Secret:          cfg.Storage.Secret,
+		EncryptionKey:   cfg.Storage.EncryptionKey,
+
+		ColdStorageClass: cfg.Storage.ColdStorageClass,
+		RestoreDays:      cfg.Storage.RestoreDays,
+
+		HTTP: storage.HTTPConfig{
+			MaxIdleConnsPerHost:   cfg.Storage.MaxIdleConnsPerHost,
+			DialTimeout:           time.Duration(cfg.Storage.DialTimeoutSeconds) * time.Second,
+			ResponseHeaderTimeout: time.Duration(cfg.Storage.ResponseHeaderTimeoutSeconds) * time.Second,
+		},
+	}
+}
+
+func cdnConfig(cfg config.Config) cdn.Config {
+	cdnCfg := cdn.Config{
+		Type:   cdn.Type(cfg.CDN.Type),
+		Domain: cfg.CDN.Domain,
+	}
+	if cfg.CDN.KeyID != "" || cfg.CDN.PrivateKey != "" || cfg.CDN.Secret != "" {
+		cdnCfg.Keys = append(cdnCfg.Keys, cdn.Key{
+			ID:             cfg.CDN.KeyID,
+			PrivateKeyFile: cfg.CDN.PrivateKey,
+			Secret:         cfg.CDN.Secret,
+		})
+	}
+	for _, k := range cfg.CDN.Keys {
+		cdnCfg.Keys = append(cdnCfg.Keys, cdn.Key{
+			ID:             k.KeyID,
+			PrivateKeyFile: k.PrivateKey,
+			Secret:         k.Secret,
+			NotBefore:      k.NotBefore,
+		})
+	}
+	return cdnCfg
+}
+
+// reloadCDN reloads CDN signing keys from the config file on SIGHUP, and every interval if set.
+// If the new config is broken, the old keys stay in use.
+func reloadCDN(cfgPath string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+		}
+		cfg, err := config.Read(cfgPath)
+		if err != nil {
+			slog.Error("CDN key reload failed", "err", err)
+			continue
+		}
+		if err := cdn.Init(cdnConfig(cfg)); err != nil {
+			slog.Error("CDN key reload failed", "err", err)
+			continue
+		}
+		slog.Info("Reloaded CDN keys")
+	}
+}
+
+func ldapConfig(cfg config.Config) (ldap.Config, error) {
+	ldapCfg := ldap.Config{
+		URL:                cfg.LDAP.URL,
+		StartTLS:           cfg.LDAP.StartTLS,
+		InsecureSkipVerify: cfg.LDAP.InsecureSkipVerify,
+		BindDN:             cfg.LDAP.BindDN,
+		BindPassword:       cfg.LDAP.BindPassword,
+		BaseDN:             cfg.LDAP.BaseDN,
+		UserFilter:         cfg.LDAP.UserFilter,
+		EmailAttr:          cfg.LDAP.EmailAttr,
+		GroupAttr:          cfg.LDAP.GroupAttr,
+		RequireGroup:       cfg.LDAP.RequireGroup,
+	}
+	var err error
+	ldapCfg.DefaultQuota, err = parseQuota(cfg.LDAP.DefaultQuota)
+	if err != nil {
+		return ldapCfg, fmt.Errorf("default_quota: %w", err)
+	}
+	for _, g := range cfg.LDAP.Groups {
+		quota, err := parseQuota(g.Quota)
+		if err != nil {
+			return ldapCfg, fmt.Errorf("group %s: %w", g.DN, err)
+		}
+		ldapCfg.Groups = append(ldapCfg.Groups, ldap.Group{DN: g.DN, Quota: quota})
+	}
+	return ldapCfg, nil
+}
+
+// parseQuota parses sizes like "100GB". Empty means unlimited (0).
+func parseQuota(quota string) (int64, error) {
+	if quota == "" {
+		return 0, nil
 	}
-	closeWatch()
+	bytes, err := humanize.ParseBytes(quota)
+	return int64(bytes), err
 }
 
 func bindAddr() string {
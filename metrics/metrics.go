@@ -0,0 +1,123 @@
+// Package metrics collects Prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "intertube"
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+
+	uploads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_started_total",
+		Help:      "Files that clients were given upload links for.",
+	})
+
+	ingests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingests_total",
+		Help:      "Uploaded files processed into tracks, by result.",
+	}, []string{"result"})
+
+	ingestBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_bytes_total",
+		Help:      "Size of uploaded files successfully processed into tracks.",
+	})
+
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Failed storage operations, by operation.",
+	}, []string{"op"})
+
+	signingFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signing_failures_total",
+		Help:      "Failures to sign download or upload links, by signer.",
+	}, []string{"signer"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Calls to other services retried after a transient failure, by service.",
+	}, []string{"service"})
+
+	quotaRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_rejections_total",
+		Help:      "Uploads refused because they would exceed the user's quota.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest records how long a request took.
+// The route should be low-cardinality, like "/track/:id".
+func ObserveRequest(method, route string, code int, took time.Duration) {
+	requestDuration.WithLabelValues(method, route, statusCode(code)).Observe(took.Seconds())
+}
+
+// UploadStarted counts a file a client was given an upload link for.
+func UploadStarted() {
+	uploads.Inc()
+}
+
+// Ingested counts a processed upload of the given size.
+func Ingested(size int64, err error) {
+	if err != nil {
+		ingests.WithLabelValues("error").Inc()
+		return
+	}
+	ingests.WithLabelValues("ok").Inc()
+	ingestBytes.Add(float64(size))
+}
+
+// StorageError counts a failed storage operation, like "get" or "put".
+func StorageError(op string) {
+	storageErrors.WithLabelValues(op).Inc()
+}
+
+// SigningFailed counts a link that couldn't be signed, by "storage" or "cdn".
+func SigningFailed(signer string) {
+	signingFailures.WithLabelValues(signer).Inc()
+}
+
+// Retried counts a retry of a call to a service, like "s3" or "dynamodb".
+func Retried(service string) {
+	retries.WithLabelValues(service).Inc()
+}
+
+// QuotaRejected counts an upload refused for exceeding quota.
+func QuotaRejected() {
+	quotaRejections.Inc()
+}
+
+func statusCode(code int) string {
+	switch {
+	case code >= 500:
+		return "5xx"
+	case code >= 400:
+		return "4xx"
+	case code >= 300:
+		return "3xx"
+	default:
+		return "2xx"
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/guregu/intertube/config"
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
+)
+
+// migrateStorage copies objects from the current storage backend to the one in dstCfgPath.
+// Object keys are derived from IDs, so nothing in the database needs to change:
+// once a run finishes without failures, point [storage] at the new backend.
+// Running it again only copies what's new, so it can be repeated right before cutover.
+func migrateStorage(dstCfgPath string, userID int, dryRun bool) error {
+	dstCfg, err := config.Read(dstCfgPath)
+	if err != nil {
+		return err
+	}
+	dst := storage.Open(storageConfig(dstCfg))
+	src := storage.Backend{
+		Files:   storage.FilesBucket,
+		Uploads: storage.UploadsBucket,
+		Cache:   storage.CacheBucket,
+	}
+
+	ctx := context.Background()
+	var stats storage.MigrateStats
+	if userID != 0 {
+		err = migrateUser(ctx, src, dst, userID, dryRun, &stats)
+	} else {
+		err = migrateAll(ctx, src, dst, dryRun, &stats)
+	}
+	if err != nil {
+		return err
+	}
+
+	for key, err := range stats.Failed {
+		slog.Error("Failed to copy", "key", key, "err", err)
+	}
+	slog.Info("Migration done", "stats", stats)
+	if len(stats.Failed) > 0 {
+		return fmt.Errorf("%d objects failed to copy, run again to retry", len(stats.Failed))
+	}
+	if !dryRun && userID == 0 {
+		slog.Info("All objects verified. Stop uploads, run this once more, then switch [storage] to the new config", "config", dstCfgPath)
+	}
+	return nil
+}
+
+func migrateAll(ctx context.Context, src, dst storage.Backend, dryRun bool, stats *storage.MigrateStats) error {
+	slog.Info("Migrating files bucket...")
+	if err := storage.MigrateBucket(ctx, src.Files, dst.Files, "", dryRun, stats); err != nil {
+		return err
+	}
+	slog.Info("Migrating uploads bucket...")
+	if err := storage.MigrateBucket(ctx, src.Uploads, dst.Uploads, "", dryRun, stats); err != nil {
+		return err
+	}
+	if src.Cache != nil && dst.Cache != nil {
+		slog.Info("Migrating cache bucket...")
+		if err := storage.MigrateBucket(ctx, src.Cache, dst.Cache, "", dryRun, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateUser(ctx context.Context, src, dst storage.Backend, userID int, dryRun bool, stats *storage.MigrateStats) error {
+	u, err := tube.GetUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("user %d: %w", userID, err)
+	}
+	slog.Info("Migrating user", "user_id", u.ID, "email", u.Email)
+
+	tracks, err := tube.GetTracks(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	pics := make(map[string]struct{})
+	for _, t := range tracks {
+		if t.Deleted {
+			continue
+		}
+		storage.MigrateObject(src.Files, dst.Files, t.StorageKey(), dryRun, stats)
+		if t.Picture.ID != "" {
+			pics[t.Picture.StorageKey()] = struct{}{}
+		}
+	}
+	for key := range pics {
+		storage.MigrateObject(src.Files, dst.Files, key, dryRun, stats)
+	}
+	if err := storage.MigrateBucket(ctx, src.Files, dst.Files, fmt.Sprintf("export/%d/", u.ID), dryRun, stats); err != nil {
+		return err
+	}
+
+	// uploads that haven't been processed yet
+	files, err := tube.GetFilesByUser(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Ready || f.Deleted || !src.Uploads.Exists(f.Path()) {
+			continue
+		}
+		storage.MigrateObject(src.Uploads, dst.Uploads, f.Path(), dryRun, stats)
+	}
+
+	if src.Cache != nil && dst.Cache != nil {
+		key := tube.Dump{UserID: u.ID}.Key()
+		if src.Cache.Exists(key) {
+			storage.MigrateObject(src.Cache, dst.Cache, key, dryRun, stats)
+		}
+	}
+	return nil
+}
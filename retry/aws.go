@@ -0,0 +1,58 @@
+package retry
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/guregu/intertube/metrics"
+)
+
+// AWS sets up cfg to retry transient failures, for AWS SDK clients.
+// On top of what the SDK retries by default, this also retries dropped connections
+// and DynamoDB transactions that lost a conflict.
+func AWS(cfg *aws.Config) *aws.Config {
+	cfg.Retryer = awsRetryer{client.DefaultRetryer{
+		NumMaxRetries:    MaxRetries,
+		MinRetryDelay:    minDelay,
+		MaxRetryDelay:    maxDelay,
+		MinThrottleDelay: minThrottleDelay,
+		MaxThrottleDelay: maxThrottleDelay,
+	}}
+	// so every retry goes through ShouldRetry and gets counted
+	cfg.EnforceShouldRetryCheck = aws.Bool(true)
+	return cfg
+}
+
+type awsRetryer struct {
+	client.DefaultRetryer
+}
+
+func (r awsRetryer) ShouldRetry(req *request.Request) bool {
+	retry := r.DefaultRetryer.ShouldRetry(req) || Transient(req.Error) || isTxConflict(req.Error)
+	if retry && req.RetryCount < r.MaxRetries() {
+		metrics.Retried(req.ClientInfo.ServiceName)
+	}
+	return retry
+}
+
+// isTxConflict reports whether a DynamoDB transaction was canceled only
+// because of throttling or another transaction.
+func isTxConflict(err error) bool {
+	txe, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		return false
+	}
+	conflict := false
+	for _, reason := range txe.CancellationReasons {
+		switch aws.StringValue(reason.Code) {
+		case "", "None":
+		case "ThrottlingError", "ProvisionedThroughputExceeded", "TransactionConflict":
+			conflict = true
+		default:
+			return false
+		}
+	}
+	return conflict
+}
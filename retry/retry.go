@@ -0,0 +1,84 @@
+// Package retry retries calls that fail for reasons that tend to go away on their own:
+// throttling, 5xx responses, and dropped connections.
+// Retries are counted in metrics.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/guregu/intertube/metrics"
+)
+
+// MaxRetries is how many times a failed call is tried again.
+var MaxRetries = 4
+
+const (
+	minDelay         = 50 * time.Millisecond
+	maxDelay         = 5 * time.Second
+	minThrottleDelay = 500 * time.Millisecond
+	maxThrottleDelay = 20 * time.Second
+)
+
+// Transient reports whether err might go away if the call is tried again.
+// Errors can decide for themselves with a Transient() bool method.
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var t interface{ Transient() bool }
+	if errors.As(err, &t) {
+		return t.Transient()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return isConnectionReset(err)
+}
+
+// See: https://future-architect.github.io/articles/20211026a/
+func isConnectionReset(err error) bool {
+	if strings.Contains(err.Error(), "read: connection reset") {
+		return false
+	}
+
+	if strings.Contains(err.Error(), "use of closed network connection") ||
+		strings.Contains(err.Error(), "connection reset") ||
+		strings.Contains(err.Error(), "broken pipe") {
+		return true
+	}
+
+	return false
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't Transient, or runs out of retries,
+// waiting exponentially longer between tries. It gives up early if ctx is done.
+// service labels the retries in metrics.
+func Do(ctx context.Context, service string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= MaxRetries || !Transient(err) {
+			return err
+		}
+		metrics.Retried(service)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff(attempt, minDelay, maxDelay)):
+		}
+	}
+}
+
+// backoff doubles from min for each attempt up to max, with jitter.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 30 && min<<attempt < max {
+		delay = min << attempt
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	azureVersion = "2020-10-02"
+	// SAS tokens used for our own requests to Azure
+	azureRequestTTL = 15 * time.Minute
+)
+
+var azureClient = &http.Client{Transport: transport, Timeout: 5 * time.Minute}
+
+// AzureBucket is a container in Azure Blob Storage.
+// Like GCS, every request is authorized with a SAS token signed by the account key.
+type AzureBucket struct {
+	Name  string
+	Azure *AzureClient
+
+	// set by WithContext
+	ctx context.Context
+}
+
+func (b AzureBucket) reqctx() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+type AzureClient struct {
+	Endpoint string
+	account  string
+	key      []byte
+}
+
+// NewAzure takes a storage account name and its base64-encoded access key.
+// If endpoint is empty, the public Azure endpoint for the account is used.
+// For Azurite, set it to something like http://127.0.0.1:10000/devstoreaccount1.
+func NewAzure(account, key, endpoint string) (*AzureClient, error) {
+	if account == "" {
+		return nil, errors.New("azure: missing account name")
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("azure: invalid account key: %w", err)
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	return &AzureClient{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		account:  account,
+		key:      rawKey,
+	}, nil
+}
+
+func openAzure(cfg Config) Backend {
+	client, err := NewAzure(cfg.AccessKeyID, cfg.AccessKeySecret, cfg.Endpoint)
+	if err != nil {
+		panic(err)
+	}
+	backend := Backend{
+		Files:   AzureBucket{Name: cfg.FilesBucket, Azure: client},
+		Uploads: AzureBucket{Name: cfg.UploadsBucket, Azure: client},
+	}
+	if cfg.CacheBucket != "" {
+		backend.Cache = AzureBucket{Name: cfg.CacheBucket, Azure: client}
+	}
+	return backend
+}
+
+// SAS creates a service SAS URL for a blob, or the container itself if key is empty.
+// See: https://learn.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (c *AzureClient) SAS(perms, container, key string, query url.Values, ttl time.Duration) string {
+	expiry := time.Now().UTC().Add(ttl).Format(time.RFC3339)
+	resource := "/blob/" + c.account + "/" + container
+	sr := "c"
+	if key != "" {
+		resource += "/" + key
+		sr = "b"
+	}
+	toSign := strings.Join([]string{
+		perms,
+		"", // start
+		expiry,
+		resource,
+		"", // identifier
+		"", // IP
+		"", // protocol
+		azureVersion,
+		sr,
+		"", // snapshot time
+		"", // rscc
+		"", // rscd
+		"", // rsce
+		"", // rscl
+		"", // rsct
+	}, "\n")
+	mac := hmac.New(sha256.New, c.key)
+	io.WriteString(mac, toSign)
+
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("sv", azureVersion)
+	q.Set("sp", perms)
+	q.Set("se", expiry)
+	q.Set("sr", sr)
+	q.Set("sig", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	href := c.Endpoint + "/" + container
+	if key != "" {
+		href += "/" + escapeKey(key)
+	}
+	return href + "?" + q.Encode()
+}
+
+type azureError struct {
+	Status int
+	Body   string
+}
+
+func (err azureError) Error() string {
+	return fmt.Sprintf("azure: status %d: %s", err.Status, err.Body)
+}
+
+func (err azureError) Transient() bool {
+	return transientStatus(err.Status)
+}
+
+func isAzureNotFound(err error) bool {
+	var aerr azureError
+	return errors.As(err, &aerr) && aerr.Status == http.StatusNotFound
+}
+
+// do makes a request to Azure. The caller must close the response body.
+// do sends a request, retrying transient failures.
+func (b AzureBucket) do(method, perms, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	var resp *http.Response
+	err := retryRequest(b.reqctx(), "azure", body, func() error {
+		var err error
+		resp, err = b.send(method, perms, key, query, header, body, size)
+		return err
+	})
+	return resp, err
+}
+
+func (b AzureBucket) send(method, perms, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	href := b.Azure.SAS(perms, b.Name, key, query, azureRequestTTL)
+	req, err := http.NewRequestWithContext(b.reqctx(), method, href, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	if body != nil {
+		req.ContentLength = size
+	}
+	resp, err := azureClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, azureError{Status: resp.StatusCode, Body: string(msg)}
+	}
+	return resp, nil
+}
+
+func (b AzureBucket) Put(contentType, key string, r io.ReadSeeker) error {
+	return b.PutObject(key, ObjectInfo{Type: contentType}, r)
+}
+
+func (b AzureBucket) PutObject(key string, info ObjectInfo, r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", info.Type)
+	if info.Disposition != "" {
+		header.Set("x-ms-blob-content-disposition", info.Disposition)
+	}
+	resp, err := b.do(http.MethodPut, "cw", key, nil, header, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b AzureBucket) Get(key string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, "r", key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b AzureBucket) GetRange(key string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {rangeHeader(off, n)}}
+	resp, err := b.do(http.MethodGet, "r", key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b AzureBucket) Head(key string) (ObjectInfo, error) {
+	resp, err := b.do(http.MethodHead, "r", key, nil, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return ObjectInfo{
+		Type:        resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		Disposition: resp.Header.Get("Content-Disposition"),
+	}, nil
+}
+
+func (b AzureBucket) Exists(key string) bool {
+	_, err := b.Head(key)
+	return err == nil
+}
+
+func (b AzureBucket) Delete(key string) error {
+	resp, err := b.do(http.MethodDelete, "d", key, nil, nil, nil, 0)
+	if isAzureNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b AzureBucket) List(prefix string) (map[string]ObjectInfo, error) {
+	objs := make(map[string]ObjectInfo)
+	var marker string
+	for {
+		q := url.Values{}
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := b.do(http.MethodGet, "l", "", q, nil, nil, 0)
+		if err != nil {
+			return objs, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name     string
+				Size     int64  `xml:"Properties>Content-Length"`
+				Modified string `xml:"Properties>Last-Modified"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return objs, err
+		}
+		for _, blob := range result.Blobs {
+			modified, _ := http.ParseTime(blob.Modified)
+			objs[blob.Name] = ObjectInfo{Size: blob.Size, Modified: modified}
+		}
+		if result.NextMarker == "" {
+			return objs, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// CopyFromBucket uses Put Blob From URL, which (unlike Copy Blob) is synchronous and can set headers.
+func (b AzureBucket) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error {
+	from, ok := srcBucket.(AzureBucket)
+	if !ok {
+		return fmt.Errorf("storage: can't copy to Azure from %T", srcBucket)
+	}
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("x-ms-copy-source", from.Azure.SAS("r", from.Name, src, nil, azureRequestTTL))
+	header.Set("x-ms-blob-content-type", mime)
+	header.Set("x-ms-blob-content-disposition", contentDisp)
+	resp, err := b.do(http.MethodPut, "cw", dst, nil, header, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PresignPut returns a SAS URL for uploading.
+// SAS can't restrict the content length, so the size must be checked after the upload.
+func (b AzureBucket) PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error) {
+	return b.Azure.SAS("cw", b.Name, key, nil, ttl), nil
+}
+
+func (AzureBucket) putHeaders() map[string]string {
+	return map[string]string{"x-ms-blob-type": "BlockBlob"}
+}
+
+func (b AzureBucket) PresignGet(key string, ttl time.Duration) (string, error) {
+	return b.Azure.SAS("r", b.Name, key, nil, ttl), nil
+}
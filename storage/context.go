@@ -0,0 +1,38 @@
+package storage
+
+import "context"
+
+// WithContext returns b with its requests bound to ctx,
+// so they're abandoned when ctx is canceled or its deadline passes.
+// Buckets on local disk ignore ctx.
+// Objects from Get must be read before ctx is done.
+func WithContext(ctx context.Context, b Bucket) Bucket {
+	switch b := b.(type) {
+	case meteredBucket:
+		b.Bucket = WithContext(ctx, b.Bucket)
+		return b
+	case tracedBucket:
+		b.Bucket = WithContext(ctx, b.Bucket)
+		return b
+	case Replicated:
+		bound := Replicated{
+			Primary:  WithContext(ctx, b.Primary),
+			Replicas: make([]Replica, len(b.Replicas)),
+		}
+		for i, r := range b.Replicas {
+			r.Bucket = WithContext(ctx, r.Bucket)
+			bound.Replicas[i] = r
+		}
+		return bound
+	case S3Bucket:
+		b.ctx = ctx
+		return b
+	case GCSBucket:
+		b.ctx = ctx
+		return b
+	case AzureBucket:
+		b.ctx = ctx
+		return b
+	}
+	return b
+}
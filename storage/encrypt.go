@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted objects are split into chunks sealed with AES-256-GCM,
+// so they can be decrypted while streaming and seeked without reading everything.
+//
+//	header: magic (4) | nonce prefix (8)
+//	chunk:  ciphertext of up to encChunkSize bytes | GCM tag (16)
+//
+// Each chunk's nonce is the prefix followed by the chunk index,
+// and the last chunk is sealed with different additional data so truncation is detected.
+const (
+	encMagic      = "ITE1"
+	encPrefixSize = 8
+	encHeaderSize = len(encMagic) + encPrefixSize
+	encChunkSize  = 64 * 1024
+	encTagSize    = 16
+)
+
+var (
+	ErrEncryptionDisabled = errors.New("storage: encryption isn't configured")
+	errBadCiphertext      = errors.New("storage: invalid encrypted object")
+)
+
+// masterKey wraps each user's data key.
+var masterKey []byte
+
+func initEncryption(key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("storage: encryption key must be 32 bytes, got %d", len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+// EncryptionEnabled reports whether a master key is configured.
+func EncryptionEnabled() bool {
+	return masterKey != nil
+}
+
+// NewDataKey creates a random data key, returned wrapped by the master key.
+// Only the wrapped form should be persisted.
+func NewDataKey() ([]byte, error) {
+	if !EncryptionEnabled() {
+		return nil, ErrEncryptionDisabled
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func unwrapKey(wrapped []byte) (cipher.AEAD, error) {
+	if !EncryptionEnabled() {
+		return nil, ErrEncryptionDisabled
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("storage: invalid data key")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("storage: can't unwrap data key: %w", err)
+	}
+	return newGCM(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext with the given wrapped data key.
+func Seal(wrappedKey, plaintext []byte) ([]byte, error) {
+	sealer, err := NewSealer(wrappedKey, bytes.NewReader(plaintext), int64(len(plaintext)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(sealer)
+}
+
+// Sealer encrypts a plaintext of known size as it's read, a chunk at a time.
+// It implements io.ReadSeeker, so it can be uploaded (and retried)
+// without holding the whole ciphertext in memory.
+type Sealer struct {
+	aead   cipher.AEAD
+	src    io.ReaderAt
+	size   int64 // plaintext size
+	header []byte
+
+	pos   int64  // ciphertext offset
+	chunk int64  // index of the chunk in sealed
+	buf   []byte // plaintext scratch space
+	// the current sealed chunk, or nil
+	sealed []byte
+}
+
+// NewSealer returns a Sealer reading size bytes of plaintext from src.
+func NewSealer(wrappedKey []byte, src io.ReaderAt, size int64) (*Sealer, error) {
+	aead, err := unwrapKey(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic):]); err != nil {
+		return nil, err
+	}
+	return &Sealer{
+		aead:   aead,
+		src:    src,
+		size:   size,
+		header: header,
+	}, nil
+}
+
+// seal encrypts chunk i into s.sealed.
+func (s *Sealer) seal(i int64) error {
+	if s.sealed != nil && s.chunk == i {
+		return nil
+	}
+	// a full last chunk is followed by an empty one
+	last := i == s.size/encChunkSize
+	n := int64(encChunkSize)
+	if last {
+		n = s.size % encChunkSize
+	}
+	if s.buf == nil {
+		s.buf = make([]byte, encChunkSize)
+	}
+	plain := s.buf[:n]
+	if got, err := s.src.ReadAt(plain, i*encChunkSize); got < len(plain) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	prefix := s.header[len(encMagic):]
+	s.sealed = s.aead.Seal(s.sealed[:0], chunkNonce(prefix, i), plain, chunkAD(last))
+	s.chunk = i
+	return nil
+}
+
+func (s *Sealer) Read(p []byte) (int, error) {
+	if s.pos >= EncryptedSize(s.size) {
+		return 0, io.EOF
+	}
+	if s.pos < int64(len(s.header)) {
+		n := copy(p, s.header[s.pos:])
+		s.pos += int64(n)
+		return n, nil
+	}
+	off := s.pos - int64(len(s.header))
+	i := off / (encChunkSize + encTagSize)
+	if err := s.seal(i); err != nil {
+		return 0, err
+	}
+	n := copy(p, s.sealed[off%(encChunkSize+encTagSize):])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *Sealer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += EncryptedSize(s.size)
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// EncryptedSize returns the size of a sealed object with the given plaintext size.
+func EncryptedSize(size int64) int64 {
+	chunks := size/encChunkSize + 1
+	return int64(encHeaderSize) + size + chunks*encTagSize
+}
+
+func chunkNonce(prefix []byte, i int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], uint32(i))
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Decrypter reads an encrypted object as plaintext.
+// It implements io.ReadSeeker, so it can be used with http.ServeContent.
+// Seeking backwards reopens the object; seeking forwards skips ahead.
+type Decrypter struct {
+	bucket Bucket
+	key    string
+	aead   cipher.AEAD
+	size   int64 // plaintext size
+
+	r      io.ReadCloser
+	prefix []byte
+	chunk  int64  // index of the next chunk in r
+	buf    []byte // unread plaintext of the previous chunk
+	pos    int64  // plaintext offset
+}
+
+// OpenEncrypted returns a Decrypter for an object sealed with wrappedKey.
+// size is the plaintext size.
+func OpenEncrypted(b Bucket, key string, wrappedKey []byte, size int64) (*Decrypter, error) {
+	aead, err := unwrapKey(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Decrypter{
+		bucket: b,
+		key:    key,
+		aead:   aead,
+		size:   size,
+	}, nil
+}
+
+// open starts reading the object from the beginning.
+func (d *Decrypter) open() error {
+	d.Close()
+	r, err := d.bucket.Get(d.key)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		r.Close()
+		return err
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		r.Close()
+		return errBadCiphertext
+	}
+	d.r = r
+	d.prefix = header[len(encMagic):]
+	d.chunk = 0
+	d.buf = nil
+	return nil
+}
+
+func (d *Decrypter) lastChunk() int64 {
+	return d.size / encChunkSize
+}
+
+// next decrypts the next chunk into d.buf.
+func (d *Decrypter) next() error {
+	if d.chunk > d.lastChunk() {
+		return io.EOF
+	}
+	last := d.chunk == d.lastChunk()
+	n := encChunkSize
+	if last {
+		n = int(d.size % encChunkSize)
+	}
+	sealed := make([]byte, n+encTagSize)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := d.aead.Open(sealed[:0], chunkNonce(d.prefix, d.chunk), sealed, chunkAD(last))
+	if err != nil {
+		return errBadCiphertext
+	}
+	d.chunk++
+	d.buf = plain
+	// the empty chunk after a full last chunk would never be read, so check it now
+	if d.chunk == d.lastChunk() && d.size%encChunkSize == 0 {
+		if err := d.next(); err != nil {
+			return err
+		}
+		d.buf = plain
+	}
+	return nil
+}
+
+func (d *Decrypter) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	if len(d.buf) == 0 {
+		want := d.pos / encChunkSize
+		if d.r == nil || want < d.chunk {
+			if err := d.open(); err != nil {
+				return 0, err
+			}
+		}
+		if want > d.chunk {
+			skip := (want - d.chunk) * (encChunkSize + encTagSize)
+			if _, err := io.CopyN(io.Discard, d.r, skip); err != nil {
+				return 0, err
+			}
+			d.chunk = want
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+		d.buf = d.buf[d.pos%encChunkSize:]
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *Decrypter) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = d.pos + offset
+	case io.SeekEnd:
+		pos = d.size + offset
+	default:
+		return d.pos, errors.New("storage: invalid whence")
+	}
+	if pos < 0 {
+		return d.pos, errors.New("storage: negative position")
+	}
+	if pos != d.pos {
+		// Read will skip ahead or reopen as needed
+		d.buf = nil
+		d.pos = pos
+	}
+	return pos, nil
+}
+
+func (d *Decrypter) Close() error {
+	if d.r == nil {
+		return nil
+	}
+	err := d.r.Close()
+	d.r = nil
+	return err
+}
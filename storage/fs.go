@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalPrefix is the path that presigned URLs for local storage point to.
+// The web server must route it to ServeLocal.
+const LocalPrefix = "/storage/"
+
+// metadata (content type etc.) is kept in a parallel directory tree
+const fsMetaDir = ".meta"
+
+var (
+	localBuckets = make(map[string]FSBucket)
+	localURL     string
+	localSecret  []byte
+)
+
+// FSBucket stores objects as files in a directory on local disk.
+// Presigned URLs are served by this server, authenticated with an HMAC signature.
+type FSBucket struct {
+	Name string
+	Root string
+}
+
+type fsMeta struct {
+	Type        string
+	Disposition string `json:",omitempty"`
+}
+
+func openFS(cfg Config) Backend {
+	if cfg.Path == "" {
+		panic(fmt.Errorf("missing storage.path in configuration"))
+	}
+	localURL = strings.TrimSuffix(cfg.URL, "/")
+	localSecret = []byte(cfg.Secret)
+	if len(localSecret) == 0 {
+		slog.Warn("storage: no storage.secret configured, presigned URLs won't survive restarts")
+		localSecret = make([]byte, 32)
+		if _, err := rand.Read(localSecret); err != nil {
+			panic(err)
+		}
+	}
+
+	newBucket := func(name string) FSBucket {
+		b := FSBucket{Name: name, Root: filepath.Join(cfg.Path, name)}
+		if err := os.MkdirAll(b.Root, 0o755); err != nil {
+			panic(fmt.Errorf("storage: %w", err))
+		}
+		localBuckets[name] = b
+		return b
+	}
+	backend := Backend{
+		Files:   newBucket(cfg.FilesBucket),
+		Uploads: newBucket(cfg.UploadsBucket),
+	}
+	if cfg.CacheBucket != "" {
+		backend.Cache = newBucket(cfg.CacheBucket)
+	}
+	return backend
+}
+
+// path returns the file path for key, rejecting keys that would escape the bucket.
+func (b FSBucket) path(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != key || clean == fsMetaDir || strings.HasPrefix(clean, fsMetaDir+"/") {
+		return "", fmt.Errorf("storage: invalid key: %q", key)
+	}
+	return filepath.Join(b.Root, filepath.FromSlash(clean)), nil
+}
+
+func (b FSBucket) metaPath(key string) string {
+	return filepath.Join(b.Root, fsMetaDir, filepath.FromSlash(key)+".json")
+}
+
+func (b FSBucket) Put(contentType, key string, r io.ReadSeeker) error {
+	return b.write(key, r, -1, fsMeta{Type: contentType})
+}
+
+func (b FSBucket) PutObject(key string, info ObjectInfo, r io.ReadSeeker) error {
+	return b.write(key, r, -1, fsMeta{Type: info.Type, Disposition: info.Disposition})
+}
+
+// write atomically saves an object. If size isn't -1, the content must be exactly that long.
+func (b FSBucket) write(key string, r io.Reader, size int64, meta fsMeta) error {
+	dst, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if size >= 0 {
+		r = io.LimitReader(r, size+1)
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("storage: expected %d bytes, got %d", size, n)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := b.writeMeta(key, meta); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (b FSBucket) writeMeta(key string, meta fsMeta) error {
+	mp := b.metaPath(key)
+	if err := os.MkdirAll(filepath.Dir(mp), 0o755); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(mp, raw, 0o644)
+}
+
+func (b FSBucket) readMeta(key string) fsMeta {
+	var meta fsMeta
+	raw, err := os.ReadFile(b.metaPath(key))
+	if err == nil {
+		json.Unmarshal(raw, &meta)
+	}
+	return meta
+}
+
+func (b FSBucket) Get(key string) (io.ReadCloser, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (b FSBucket) GetRange(key string, off, n int64) (io.ReadCloser, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return limitedReadCloser{io.NewSectionReader(f, off, n), f}, nil
+}
+
+func (b FSBucket) Head(key string) (ObjectInfo, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	meta := b.readMeta(key)
+	return ObjectInfo{
+		Type:        meta.Type,
+		Size:        fi.Size(),
+		Disposition: meta.Disposition,
+	}, nil
+}
+
+func (b FSBucket) Exists(key string) bool {
+	_, err := b.Head(key)
+	return err == nil
+}
+
+// Delete removes an object. Like S3, deleting something that doesn't exist isn't an error.
+func (b FSBucket) Delete(key string) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(b.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b FSBucket) List(prefix string) (map[string]ObjectInfo, error) {
+	objs := make(map[string]ObjectInfo)
+	err := filepath.WalkDir(b.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == fsMetaDir && filepath.Dir(p) == b.Root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objs[key] = ObjectInfo{Size: fi.Size(), Modified: fi.ModTime()}
+		return nil
+	})
+	return objs, err
+}
+
+func (b FSBucket) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error {
+	r, err := srcBucket.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return b.write(dst, r, -1, fsMeta{Type: mime, Disposition: contentDisp})
+}
+
+func (b FSBucket) PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error) {
+	return b.presign(http.MethodPut, key, size, ttl)
+}
+
+func (b FSBucket) PresignGet(key string, ttl time.Duration) (string, error) {
+	return b.presign(http.MethodGet, key, -1, ttl)
+}
+
+func (b FSBucket) presign(method, key string, size int64, ttl time.Duration) (string, error) {
+	if _, err := b.path(key); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{}
+	q.Set("exp", exp)
+	if size >= 0 {
+		q.Set("size", strconv.FormatInt(size, 10))
+	}
+	q.Set("sig", localSignature(method, b.Name, key, exp, q.Get("size")))
+	href := localURL + LocalPrefix + url.PathEscape(b.Name) + "/" + escapeKey(key) + "?" + q.Encode()
+	return href, nil
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func localSignature(method, bucket, key, exp, size string) string {
+	mac := hmac.New(sha256.New, localSecret)
+	io.WriteString(mac, strings.Join([]string{method, bucket, key, exp, size}, "\n"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ServeLocal handles presigned GET and PUT requests for local storage.
+// objPath is the part of the URL after LocalPrefix.
+func ServeLocal(w http.ResponseWriter, r *http.Request, objPath string) {
+	name, key, _ := strings.Cut(objPath, "/")
+	b, ok := localBuckets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	q := r.URL.Query()
+	exp, size := q.Get("exp"), q.Get("size")
+	want := localSignature(method, b.Name, key, exp, size)
+	if !hmac.Equal([]byte(want), []byte(q.Get("sig"))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	if unix, err := strconv.ParseInt(exp, 10, 64); err != nil || time.Now().Unix() > unix {
+		http.Error(w, "link expired", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		p, err := b.path(key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		meta := b.readMeta(key)
+		if meta.Type != "" {
+			w.Header().Set("Content-Type", meta.Type)
+		}
+		if meta.Disposition != "" {
+			w.Header().Set("Content-Disposition", meta.Disposition)
+		}
+		http.ServeContent(w, r, path.Base(key), fi.ModTime(), f)
+	case http.MethodPut:
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			http.Error(w, "missing size", http.StatusBadRequest)
+			return
+		}
+		meta := fsMeta{
+			Type:        r.Header.Get("Content-Type"),
+			Disposition: r.Header.Get("Content-Disposition"),
+		}
+		if err := b.write(key, r.Body, n, meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
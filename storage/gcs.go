@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gcsEndpoint = "https://storage.googleapis.com"
+	// signed URLs used for our own requests to GCS
+	gcsRequestTTL = 15 * time.Minute
+	// GCS doesn't accept V4 signatures valid for longer than this
+	gcsMaxTTL = 7 * 24 * time.Hour
+)
+
+var gcsClient = &http.Client{Transport: transport, Timeout: 5 * time.Minute}
+
+// GCSBucket is a bucket in Google Cloud Storage.
+// Every request, ours and clients', is authenticated with a V4 signed URL
+// using a service account key, so no OAuth token dance is needed.
+type GCSBucket struct {
+	Name string
+	GCS  *GCSClient
+
+	// set by WithContext
+	ctx context.Context
+}
+
+func (b GCSBucket) reqctx() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+type GCSClient struct {
+	Endpoint string
+	email    string
+	key      *rsa.PrivateKey
+}
+
+// NewGCS reads a service account key file, as downloaded from the GCP console.
+func NewGCS(credentialsFile, endpoint string) (*GCSClient, error) {
+	raw, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, fmt.Errorf("gcs: invalid credentials file: %w", err)
+	}
+	if creds.Type != "service_account" {
+		return nil, fmt.Errorf("gcs: credentials must be a service account key, got %q", creds.Type)
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcs: invalid private key")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("gcs: private key isn't RSA")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("gcs: invalid private key: %w", err)
+	}
+
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	return &GCSClient{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		email:    creds.ClientEmail,
+		key:      key,
+	}, nil
+}
+
+func openGCS(cfg Config) Backend {
+	client, err := NewGCS(cfg.CredentialsFile, cfg.Endpoint)
+	if err != nil {
+		panic(err)
+	}
+	backend := Backend{
+		Files:   GCSBucket{Name: cfg.FilesBucket, GCS: client},
+		Uploads: GCSBucket{Name: cfg.UploadsBucket, GCS: client},
+	}
+	if cfg.CacheBucket != "" {
+		backend.Cache = GCSBucket{Name: cfg.CacheBucket, GCS: client}
+	}
+	return backend
+}
+
+// Sign creates a V4 signed URL.
+// All of the given headers are signed, so the client must send them as-is.
+// See: https://cloud.google.com/storage/docs/access-control/signed-urls
+func (c *GCSClient) Sign(method, bucket, key string, query url.Values, header http.Header, ttl time.Duration) (string, error) {
+	if ttl > gcsMaxTTL {
+		ttl = gcsMaxTTL
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	datetime := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+
+	headers := map[string]string{"host": endpoint.Host}
+	for k, v := range header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	q.Set("X-Goog-Credential", c.email+"/"+scope)
+	q.Set("X-Goog-Date", datetime)
+	q.Set("X-Goog-Expires", strconv.Itoa(int(ttl.Seconds())))
+	q.Set("X-Goog-SignedHeaders", signedHeaders)
+	canonQuery := gcsQuery(q)
+
+	path := "/" + bucket
+	if key != "" {
+		path += "/" + gcsEscapePath(key)
+	}
+	canonReq := strings.Join([]string{
+		method,
+		path,
+		canonQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "GOOG4-RSA-SHA256\n" + datetime + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	digest := sha256.Sum256([]byte(toSign))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return c.Endpoint + path + "?" + canonQuery + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+func gcsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func gcsEscapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = gcsEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func gcsQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, gcsEscape(k)+"="+gcsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type gcsError struct {
+	Status int
+	Body   string
+}
+
+func (err gcsError) Error() string {
+	return fmt.Sprintf("gcs: status %d: %s", err.Status, err.Body)
+}
+
+func (err gcsError) Transient() bool {
+	return transientStatus(err.Status)
+}
+
+func isGCSNotFound(err error) bool {
+	var gerr gcsError
+	return errors.As(err, &gerr) && gerr.Status == http.StatusNotFound
+}
+
+// do makes a request to GCS. The caller must close the response body.
+// do sends a request, retrying transient failures.
+func (b GCSBucket) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	var resp *http.Response
+	err := retryRequest(b.reqctx(), "gcs", body, func() error {
+		var err error
+		resp, err = b.send(method, key, query, header, body, size)
+		return err
+	})
+	return resp, err
+}
+
+func (b GCSBucket) send(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	href, err := b.GCS.Sign(method, b.Name, key, query, header, gcsRequestTTL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(b.reqctx(), method, href, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	resp, err := gcsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, gcsError{Status: resp.StatusCode, Body: string(msg)}
+	}
+	return resp, nil
+}
+
+func (b GCSBucket) Put(contentType, key string, r io.ReadSeeker) error {
+	return b.PutObject(key, ObjectInfo{Type: contentType}, r)
+}
+
+func (b GCSBucket) PutObject(key string, info ObjectInfo, r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", info.Type)
+	if info.Disposition != "" {
+		header.Set("Content-Disposition", info.Disposition)
+	}
+	resp, err := b.do(http.MethodPut, key, nil, header, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b GCSBucket) Get(key string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b GCSBucket) GetRange(key string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {rangeHeader(off, n)}}
+	resp, err := b.do(http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b GCSBucket) Head(key string) (ObjectInfo, error) {
+	resp, err := b.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return ObjectInfo{
+		Type:        resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		Disposition: resp.Header.Get("Content-Disposition"),
+	}, nil
+}
+
+func (b GCSBucket) Exists(key string) bool {
+	_, err := b.Head(key)
+	return err == nil
+}
+
+func (b GCSBucket) Delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if isGCSNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b GCSBucket) List(prefix string) (map[string]ObjectInfo, error) {
+	objs := make(map[string]ObjectInfo)
+	var token string
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := b.do(http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return objs, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return objs, err
+		}
+		for _, obj := range result.Contents {
+			objs[obj.Key] = ObjectInfo{Size: obj.Size, Modified: obj.LastModified}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b GCSBucket) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error {
+	from, ok := srcBucket.(GCSBucket)
+	if !ok {
+		return fmt.Errorf("storage: can't copy to GCS from %T", srcBucket)
+	}
+	header := http.Header{}
+	header.Set("X-Goog-Copy-Source", "/"+from.Name+"/"+gcsEscapePath(src))
+	header.Set("X-Goog-Metadata-Directive", "REPLACE")
+	header.Set("Content-Type", mime)
+	header.Set("Content-Disposition", contentDisp)
+	resp, err := b.do(http.MethodPut, dst, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b GCSBucket) PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Set("Content-Disposition", disp)
+	return b.GCS.Sign(http.MethodPut, b.Name, key, nil, header, ttl)
+}
+
+func (b GCSBucket) PresignGet(key string, ttl time.Duration) (string, error) {
+	return b.GCS.Sign(http.MethodGet, b.Name, key, nil, nil, ttl)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// HTTPConfig tunes connections to the storage service.
+// Zero values use the defaults.
+type HTTPConfig struct {
+	// idle connections kept open to each host, for reuse
+	MaxIdleConnsPerHost int
+	// how long to wait to connect
+	DialTimeout time.Duration
+	// how long to wait for a response after sending a request
+	ResponseHeaderTimeout time.Duration
+}
+
+const (
+	// net/http keeps 2, so bursts of uploads open and close connections all the time
+	defaultMaxIdleConnsPerHost   = 64
+	defaultDialTimeout           = 10 * time.Second
+	defaultResponseHeaderTimeout = 2 * time.Minute
+	idleConnTimeout              = 90 * time.Second
+)
+
+// transport is shared by every storage client.
+var transport = newTransport(HTTPConfig{}, nil)
+
+// publicTransport is for endpoints chosen by users, and only connects to public addresses.
+// The check happens when dialing, so a host name that resolves somewhere else later is still refused.
+var publicTransport = newTransport(HTTPConfig{}, dialPublic)
+
+// ErrPrivateAddress is returned when connecting to a non-public address with Config.PublicOnly.
+var ErrPrivateAddress = errors.New("storage: refusing to connect to a non-public address")
+
+// PublicIP reports whether ip is reachable on the internet,
+// as opposed to loopback, private, link-local (like cloud metadata services), or unspecified.
+func PublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+func newTransport(cfg HTTPConfig, control func(network, address string, c syscall.RawConn) error) *http.Transport {
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.ResponseHeaderTimeout <= 0 {
+		cfg.ResponseHeaderTimeout = defaultResponseHeaderTimeout
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}).DialContext
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	// one bucket per host is typical, but leave room for replicas
+	t.MaxIdleConns = 4 * cfg.MaxIdleConnsPerHost
+	t.IdleConnTimeout = idleConnTimeout
+	t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	return t
+}
+
+// configureHTTP replaces the transport used by storage clients created from now on,
+// and by the GCS and Azure clients.
+func configureHTTP(cfg HTTPConfig) {
+	transport = newTransport(cfg, nil)
+	publicTransport = newTransport(cfg, dialPublic)
+	gcsClient.Transport = transport
+	azureClient.Transport = transport
+}
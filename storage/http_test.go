@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+	}
+	for _, test := range tests {
+		if got := PublicIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("PublicIP(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestPublicTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	resp, err := (&http.Client{Transport: publicTransport}).Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("connected to a loopback server")
+	}
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("error: %v, want ErrPrivateAddress", err)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"io"
+	"time"
+
+	"github.com/guregu/intertube/metrics"
+)
+
+// meteredBucket counts failed operations.
+// Init wraps the default buckets with it.
+type meteredBucket struct {
+	Bucket
+}
+
+// unwrapBucket returns the bucket underneath any metering or tracing,
+// so type checks see the real backend.
+func unwrapBucket(b Bucket) Bucket {
+	for {
+		switch wrapped := b.(type) {
+		case meteredBucket:
+			b = wrapped.Bucket
+		case tracedBucket:
+			b = wrapped.Bucket
+		default:
+			return b
+		}
+	}
+}
+
+func meter(b Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return meteredBucket{b}
+}
+
+func count(op string, err error) error {
+	if err != nil {
+		metrics.StorageError(op)
+	}
+	return err
+}
+
+func (b meteredBucket) Put(contentType, key string, r io.ReadSeeker) error {
+	return count("put", b.Bucket.Put(contentType, key, r))
+}
+
+func (b meteredBucket) PutObject(key string, info ObjectInfo, r io.ReadSeeker) error {
+	return count("put", b.Bucket.PutObject(key, info, r))
+}
+
+func (b meteredBucket) Get(key string) (io.ReadCloser, error) {
+	r, err := b.Bucket.Get(key)
+	return r, count("get", err)
+}
+
+func (b meteredBucket) GetRange(key string, off, n int64) (io.ReadCloser, error) {
+	r, err := GetRange(b.Bucket, key, off, n)
+	return r, count("get", err)
+}
+
+func (b meteredBucket) Head(key string) (ObjectInfo, error) {
+	info, err := b.Bucket.Head(key)
+	return info, count("head", err)
+}
+
+func (b meteredBucket) Delete(key string) error {
+	return count("delete", b.Bucket.Delete(key))
+}
+
+func (b meteredBucket) List(prefix string) (map[string]ObjectInfo, error) {
+	objs, err := b.Bucket.List(prefix)
+	return objs, count("list", err)
+}
+
+func (b meteredBucket) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error {
+	return count("copy", b.Bucket.CopyFromBucket(dst, unwrapBucket(srcBucket), src, mime, contentDisp))
+}
+
+func (b meteredBucket) PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error) {
+	href, err := b.Bucket.PresignPut(key, size, disp, ttl)
+	if err != nil {
+		metrics.SigningFailed("storage")
+	}
+	return href, err
+}
+
+func (b meteredBucket) PresignGet(key string, ttl time.Duration) (string, error) {
+	href, err := b.Bucket.PresignGet(key, ttl)
+	if err != nil {
+		metrics.SigningFailed("storage")
+	}
+	return href, err
+}
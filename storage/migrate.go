@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MigrateStats summarizes copying objects between buckets.
+type MigrateStats struct {
+	Copied  int
+	Skipped int // already in the destination
+	Bytes   int64
+	Failed  map[string]error
+}
+
+func (s *MigrateStats) fail(key string, err error) {
+	if s.Failed == nil {
+		s.Failed = make(map[string]error)
+	}
+	s.Failed[key] = err
+}
+
+func (s MigrateStats) String() string {
+	return fmt.Sprintf("%d copied (%d bytes), %d skipped, %d failed", s.Copied, s.Bytes, s.Skipped, len(s.Failed))
+}
+
+// MigrateBucket copies every object under prefix from src to dst.
+// See MigrateObject.
+func MigrateBucket(ctx context.Context, src, dst Bucket, prefix string, dryRun bool, stats *MigrateStats) error {
+	objs, err := src.List(prefix)
+	if err != nil {
+		return fmt.Errorf("storage: listing source: %w", err)
+	}
+	for key := range objs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		MigrateObject(src, dst, key, dryRun, stats)
+	}
+	return nil
+}
+
+// MigrateObject copies an object from src to dst, keeping its key and metadata,
+// then checks that the destination has the same size.
+// Objects already in the destination with the same size are skipped,
+// so an interrupted migration can be run again to pick up where it left off.
+// Errors are recorded in stats.
+func MigrateObject(src, dst Bucket, key string, dryRun bool, stats *MigrateStats) {
+	info, err := src.Head(key)
+	if err != nil {
+		stats.fail(key, err)
+		return
+	}
+	if have, err := dst.Head(key); err == nil && have.Size == info.Size {
+		stats.Skipped++
+		return
+	}
+	if dryRun {
+		stats.Copied++
+		stats.Bytes += info.Size
+		return
+	}
+	if err := copyObject(src, dst, key, info); err != nil {
+		stats.fail(key, err)
+		return
+	}
+	have, err := dst.Head(key)
+	if err != nil {
+		stats.fail(key, fmt.Errorf("verify: %w", err))
+		return
+	}
+	if have.Size != info.Size {
+		stats.fail(key, fmt.Errorf("verify: size mismatch: want %d, got %d", info.Size, have.Size))
+		return
+	}
+	stats.Copied++
+	stats.Bytes += info.Size
+}
+
+// copyObject spools the object to a temporary file, because Put needs to seek.
+func copyObject(src, dst Bucket, key string, info ObjectInfo) error {
+	r, err := src.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "intertube-migrate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return dst.PutObject(key, info, tmp)
+}
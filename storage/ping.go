@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// pingKey is looked up by Ping for backends that can't check a bucket directly.
+// It doesn't need to exist.
+const pingKey = "ping"
+
+// Ping checks that b can be reached, without reading or writing any objects.
+// For replicated buckets, only the primary is checked.
+func Ping(ctx context.Context, b Bucket) error {
+	switch b := unwrapBucket(b).(type) {
+	case S3Bucket:
+		_, err := b.S3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: &b.Name})
+		return err
+	case FSBucket:
+		fi, err := os.Stat(b.Root)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("storage: %s is not a directory", b.Root)
+		}
+		return nil
+	case GCSBucket:
+		_, err := WithContext(ctx, b).Head(pingKey)
+		if isGCSNotFound(err) {
+			return nil
+		}
+		return err
+	case AzureBucket:
+		_, err := WithContext(ctx, b).Head(pingKey)
+		if isAzureNotFound(err) {
+			return nil
+		}
+		return err
+	case Replicated:
+		return Ping(ctx, b.Primary)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Ranger is implemented by buckets that can read part of an object.
+type Ranger interface {
+	// GetRange reads n bytes of key starting at off.
+	GetRange(key string, off, n int64) (io.ReadCloser, error)
+}
+
+// GetRange reads n bytes of key starting at off.
+// Buckets that can't read ranges read the whole object and skip the rest.
+func GetRange(b Bucket, key string, off, n int64) (io.ReadCloser, error) {
+	if rb, ok := b.(Ranger); ok {
+		return rb.GetRange(key, off, n)
+	}
+	r, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, off); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return limitedReadCloser{io.LimitReader(r, n), r}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func rangeHeader(off, n int64) string {
+	return fmt.Sprintf("bytes=%d-%d", off, off+n-1)
+}
+
+const (
+	// smallest read from storage
+	rangeBlockSize = 64 << 10
+	// reading straight through doubles each read up to this
+	maxRangeRead = 16 << 20
+)
+
+// ObjectReader reads an object of known size, fetching only the parts that are read.
+// Reading straight through fetches bigger and bigger chunks,
+// so reading the whole thing only takes a handful of requests.
+// Fetched parts are kept in memory, so each byte is only downloaded once.
+// It's not safe for concurrent use.
+type ObjectReader struct {
+	b    Bucket
+	key  string
+	data []byte
+	// which blocks have been fetched
+	have []bool
+	pos  int64
+	// end of the last fetch and how big it was, for readahead
+	last    int64
+	lastLen int64
+	fetched int64
+}
+
+// NewObjectReader returns a reader for size bytes of key in b.
+func NewObjectReader(b Bucket, key string, size int64) *ObjectReader {
+	return &ObjectReader{
+		b:    b,
+		key:  key,
+		data: make([]byte, size),
+		have: make([]bool, (size+rangeBlockSize-1)/rangeBlockSize),
+	}
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("storage: negative offset")
+	}
+	size := int64(len(r.data))
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), size)
+	if err := r.load(off, end); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.data[off:end])
+	if end == size && n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(len(r.data))
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Size returns the size of the object.
+func (r *ObjectReader) Size() int64 {
+	return int64(len(r.data))
+}
+
+// Fetched returns how many bytes have been downloaded so far.
+func (r *ObjectReader) Fetched() int64 {
+	return r.fetched
+}
+
+// Bytes returns the whole object, fetching whatever hasn't been read yet.
+func (r *ObjectReader) Bytes() ([]byte, error) {
+	if err := r.load(0, int64(len(r.data))); err != nil {
+		return nil, err
+	}
+	return r.data, nil
+}
+
+// load makes sure data[from:to] has been fetched.
+func (r *ObjectReader) load(from, to int64) error {
+	for blk := from / rangeBlockSize; blk*rangeBlockSize < to; {
+		if r.have[blk] {
+			blk++
+			continue
+		}
+		start := blk * rangeBlockSize
+		want := int64(rangeBlockSize)
+		if start == r.last {
+			want = min(max(r.lastLen*2, want), maxRangeRead)
+		}
+		want = max(want, to-start)
+		// stop at the next block we already have
+		end := start
+		for i := blk; i < int64(len(r.have)) && !r.have[i] && end-start < want; i++ {
+			end = min(end+rangeBlockSize, int64(len(r.data)))
+		}
+		if err := r.fetch(start, end); err != nil {
+			return err
+		}
+		for ; blk*rangeBlockSize < end; blk++ {
+			r.have[blk] = true
+		}
+		r.last, r.lastLen = end, end-start
+	}
+	return nil
+}
+
+func (r *ObjectReader) fetch(start, end int64) error {
+	body, err := GetRange(r.b, r.key, start, end-start)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, r.data[start:end])
+	r.fetched += int64(n)
+	if err != nil {
+		return fmt.Errorf("storage: reading %s at %d: %w", r.key, start, err)
+	}
+	return nil
+}
+
+// StreamReader reads an object of known size from wherever it's seeked to, through to the end.
+// Unlike ObjectReader, it keeps nothing in memory, so it suits serving big files with http.ServeContent.
+type StreamReader struct {
+	b    Bucket
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+// NewStreamReader returns a reader for size bytes of key in b.
+func NewStreamReader(b Bucket, key string, size int64) *StreamReader {
+	return &StreamReader{b: b, key: key, size: size}
+}
+
+func (r *StreamReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := GetRange(r.b, r.key, r.pos, r.size-r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	if offset != r.pos {
+		// start over from there on the next read
+		r.Close()
+		r.pos = offset
+	}
+	return offset, nil
+}
+
+func (r *StreamReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
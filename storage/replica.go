@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Replica is a copy of a bucket in another region.
+type Replica struct {
+	Bucket
+	// two-letter country codes that should be served from this replica
+	Countries []string
+}
+
+// Replicated writes to a primary bucket and all of its replicas,
+// and serves downloads from whichever copy is nearest to the client.
+// Reads go to the primary.
+type Replicated struct {
+	Primary  Bucket
+	Replicas []Replica
+}
+
+func (b Replicated) all() []Bucket {
+	all := []Bucket{b.Primary}
+	for _, r := range b.Replicas {
+		all = append(all, r.Bucket)
+	}
+	return all
+}
+
+// Near returns the bucket that should serve clients from country.
+func (b Replicated) Near(country string) Bucket {
+	for _, r := range b.Replicas {
+		for _, cc := range r.Countries {
+			if strings.EqualFold(cc, country) {
+				return r.Bucket
+			}
+		}
+	}
+	return b.Primary
+}
+
+func (b Replicated) Put(contentType, key string, r io.ReadSeeker) error {
+	return b.PutObject(key, ObjectInfo{Type: contentType}, r)
+}
+
+func (b Replicated) PutObject(key string, info ObjectInfo, r io.ReadSeeker) error {
+	for _, bucket := range b.all() {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := bucket.PutObject(key, info, r); err != nil {
+			return fmt.Errorf("storage: replicating %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (b Replicated) Get(key string) (io.ReadCloser, error) {
+	return b.Primary.Get(key)
+}
+
+func (b Replicated) GetRange(key string, off, n int64) (io.ReadCloser, error) {
+	return GetRange(b.Primary, key, off, n)
+}
+
+func (b Replicated) Head(key string) (ObjectInfo, error) {
+	return b.Primary.Head(key)
+}
+
+func (b Replicated) Exists(key string) bool {
+	return b.Primary.Exists(key)
+}
+
+func (b Replicated) Delete(key string) error {
+	for _, bucket := range b.all() {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b Replicated) List(prefix string) (map[string]ObjectInfo, error) {
+	return b.Primary.List(prefix)
+}
+
+func (b Replicated) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error {
+	if from, ok := srcBucket.(Replicated); ok {
+		srcBucket = from.Primary
+	}
+	for _, bucket := range b.all() {
+		if err := bucket.CopyFromBucket(dst, srcBucket, src, mime, contentDisp); err != nil {
+			return fmt.Errorf("storage: replicating %s: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+func (b Replicated) PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error) {
+	return "", fmt.Errorf("storage: can't upload directly to a replicated bucket")
+}
+
+func (b Replicated) PresignGet(key string, ttl time.Duration) (string, error) {
+	return b.Primary.PresignGet(key, ttl)
+}
+
+// PresignGetNear is like Bucket.PresignGet, but picks the replica nearest to country.
+// country is a two-letter code, and may be empty if unknown.
+func PresignGetNear(b Bucket, key string, ttl time.Duration, country string) (string, error) {
+	if rb, ok := unwrapBucket(b).(Replicated); ok {
+		return meter(rb.Near(country)).PresignGet(key, ttl)
+	}
+	return b.PresignGet(key, ttl)
+}
+
+// replicatedTiers applies tiering to every copy that supports it.
+type replicatedTiers []Tiered
+
+func (ts replicatedTiers) Freeze(key string) error {
+	for _, t := range ts {
+		if err := t.Freeze(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts replicatedTiers) Thaw(key string) (bool, error) {
+	ready := true
+	for _, t := range ts {
+		ok, err := t.Thaw(key)
+		if err != nil {
+			return false, err
+		}
+		ready = ready && ok
+	}
+	return ready, nil
+}
+
+func (ts replicatedTiers) Warm(key string) error {
+	for _, t := range ts {
+		if err := t.Warm(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,40 +1,40 @@
 package storage
 
 import (
-	"strings"
+	"context"
+	"io"
+	"net/http"
 
-	"github.com/aws/aws-sdk-go/aws/client"
-	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/guregu/intertube/retry"
 )
 
-// See: https://future-architect.github.io/articles/20211026a/
-
-type Retryer struct {
-	client.DefaultRetryer
-}
-
-func (r Retryer) ShouldRetry(req *request.Request) bool {
-	if origErr := req.Error; origErr != nil {
-		switch origErr.(type) {
-		case interface{ Temporary() bool }:
-			if isErrConnectionReset(origErr) {
-				return true
-			}
-		}
+// retryRequest sends a request with retry.Do, rewinding body before each retry.
+// Bodies that can't be rewound are only sent once.
+func retryRequest(ctx context.Context, service string, body io.Reader, send func() error) error {
+	if body == nil {
+		return retry.Do(ctx, service, send)
 	}
-	return r.DefaultRetryer.ShouldRetry(req)
-}
-
-func isErrConnectionReset(err error) bool {
-	if strings.Contains(err.Error(), "read: connection reset") {
-		return false
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return send()
 	}
-
-	if strings.Contains(err.Error(), "use of closed network connection") ||
-		strings.Contains(err.Error(), "connection reset") ||
-		strings.Contains(err.Error(), "broken pipe") {
-		return true
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return send()
 	}
+	first := true
+	return retry.Do(ctx, service, func() error {
+		if !first {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+		return send()
+	})
+}
 
-	return false
+// transientStatus reports whether an HTTP status is worth retrying.
+func transientStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
 }
@@ -1,46 +1,124 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-)
 
-var (
-	FilesBucket   S3Bucket
-	UploadsBucket S3Bucket
-	CacheBucket   S3Bucket
+	"github.com/guregu/intertube/retry"
 )
 
+// S3Bucket is a bucket in S3 or an S3-compatible service (B2, R2, MinIO...).
 type S3Bucket struct {
 	S3   *s3.S3
 	Name string
 	Type StorageType
+	// if set, objects are written with SSE-KMS using this key
+	// and Head rejects objects that aren't
+	KMSKeyID string
+
+	// storage class for cold objects, see Tiered
+	ColdClass   string
+	RestoreDays int
+
+	// set by WithContext
+	ctx context.Context
+}
+
+func (b S3Bucket) reqctx() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+var ErrNotKMSEncrypted = errors.New("storage: object isn't encrypted with the configured KMS key")
+
+const sseKMS = "aws:kms"
+
+func (b S3Bucket) sse() (*string, *string) {
+	if b.KMSKeyID == "" {
+		return nil, nil
+	}
+	return aws.String(sseKMS), aws.String(b.KMSKeyID)
+}
+
+// checkKMS verifies the encryption reported by S3.
+// S3 always reports key ARNs, so aliases can only be checked for SSE-KMS in general.
+func (b S3Bucket) checkKMS(sse, keyID *string) error {
+	if b.KMSKeyID == "" {
+		return nil
+	}
+	if aws.StringValue(sse) != sseKMS {
+		return ErrNotKMSEncrypted
+	}
+	got := aws.StringValue(keyID)
+	switch {
+	case strings.HasPrefix(b.KMSKeyID, "alias/"), strings.Contains(b.KMSKeyID, ":alias/"):
+		return nil
+	case strings.HasPrefix(b.KMSKeyID, "arn:"):
+		if got != b.KMSKeyID {
+			return ErrNotKMSEncrypted
+		}
+	default:
+		if got != b.KMSKeyID && !strings.HasSuffix(got, ":key/"+b.KMSKeyID) {
+			return ErrNotKMSEncrypted
+		}
+	}
+	return nil
+}
+
+func (b S3Bucket) putHeaders() map[string]string {
+	if b.KMSKeyID == "" {
+		return nil
+	}
+	return map[string]string{
+		"x-amz-server-side-encryption":                sseKMS,
+		"x-amz-server-side-encryption-aws-kms-key-id": b.KMSKeyID,
+	}
 }
 
 func (b S3Bucket) Put(contentType, key string, r io.ReadSeeker) error {
-	_, err := b.S3.PutObject(&s3.PutObjectInput{
+	return b.PutObject(key, ObjectInfo{Type: contentType}, r)
+}
+
+func (b S3Bucket) PutObject(key string, info ObjectInfo, r io.ReadSeeker) error {
+	input := &s3.PutObjectInput{
 		Body:        r,
 		Bucket:      aws.String(b.Name),
 		Key:         aws.String(key),
-		ContentType: aws.String(contentType),
-	})
+		ContentType: aws.String(info.Type),
+	}
+	if info.Disposition != "" {
+		input.ContentDisposition = aws.String(info.Disposition)
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = b.sse()
+	_, err := b.S3.PutObjectWithContext(b.reqctx(), input)
 	return err
 }
 
+// PresignPut returns a URL for uploading.
+// With SSE-KMS, clients must send the headers from PutHeaders.
 func (b S3Bucket) PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error) {
-	req, _ := b.S3.PutObjectRequest(&s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(b.Name),
 		Key:    aws.String(key),
 		// ContentType: aws.String(contentType),
 		ContentLength:      aws.Int64(size),
 		ContentDisposition: aws.String(disp),
-	})
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = b.sse()
+	req, _ := b.S3.PutObjectRequest(input)
 	url, err := req.Presign(ttl)
 	return url, err
 }
@@ -55,15 +133,16 @@ func (b S3Bucket) PresignGet(key string, ttl time.Duration) (string, error) {
 }
 
 func (b S3Bucket) Delete(key string) error {
-	_, err := b.S3.DeleteObject(&s3.DeleteObjectInput{
-		Key: aws.String(key),
+	_, err := b.S3.DeleteObjectWithContext(b.reqctx(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(key),
 	})
 	return err
 }
 
 func (b S3Bucket) Keys() ([]string, error) {
 	var keys []string
-	err := b.S3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: &b.Name}, func(out *s3.ListObjectsV2Output, _ bool) bool {
+	err := b.S3.ListObjectsV2PagesWithContext(b.reqctx(), &s3.ListObjectsV2Input{Bucket: &b.Name}, func(out *s3.ListObjectsV2Output, _ bool) bool {
 		for _, c := range out.Contents {
 			keys = append(keys, *c.Key)
 		}
@@ -73,7 +152,19 @@ func (b S3Bucket) Keys() ([]string, error) {
 }
 
 func (b S3Bucket) Get(key string) (io.ReadCloser, error) {
-	out, err := b.S3.GetObject(&s3.GetObjectInput{Bucket: &b.Name, Key: &key})
+	out, err := b.S3.GetObjectWithContext(b.reqctx(), &s3.GetObjectInput{Bucket: &b.Name, Key: &key})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (b S3Bucket) GetRange(key string, off, n int64) (io.ReadCloser, error) {
+	out, err := b.S3.GetObjectWithContext(b.reqctx(), &s3.GetObjectInput{
+		Bucket: &b.Name,
+		Key:    &key,
+		Range:  aws.String(rangeHeader(off, n)),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -81,93 +172,207 @@ func (b S3Bucket) Get(key string) (io.ReadCloser, error) {
 }
 
 func (b S3Bucket) Exists(key string) bool {
-	_, err := b.S3.HeadObject(&s3.HeadObjectInput{Bucket: &b.Name, Key: &key})
+	_, err := b.S3.HeadObjectWithContext(b.reqctx(), &s3.HeadObjectInput{Bucket: &b.Name, Key: &key})
 	// TODO actually check the error lol
 	return err == nil
 }
 
 func (b S3Bucket) Copy(dst, src string) error {
-	_, err := b.S3.CopyObject(&s3.CopyObjectInput{Bucket: &b.Name, CopySource: aws.String(b.Name + "/" + src), Key: &dst})
+	_, err := b.S3.CopyObjectWithContext(b.reqctx(), &s3.CopyObjectInput{Bucket: &b.Name, CopySource: aws.String(b.Name + "/" + src), Key: &dst})
 	return err
 }
 
-func (b S3Bucket) CopyFromBucket(dst string, srcBucket S3Bucket, src string, mime, contentDisp string) error {
-	copySrc := srcBucket.Name + "/" + src
-	_, err := b.S3.CopyObject(&s3.CopyObjectInput{
+func (b S3Bucket) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error {
+	from, ok := srcBucket.(S3Bucket)
+	if !ok {
+		return fmt.Errorf("storage: can't copy to S3 from %T", srcBucket)
+	}
+	copySrc := from.Name + "/" + src
+	input := &s3.CopyObjectInput{
 		Bucket:             &b.Name,
 		CopySource:         &copySrc,
 		Key:                &dst,
 		ContentType:        &mime,
 		ContentDisposition: &contentDisp,
-	})
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = b.sse()
+	_, err := b.S3.CopyObjectWithContext(b.reqctx(), input)
 	return err
 }
 
-type S3Head struct {
-	Type string
-	Size int64
-}
-
-func (b S3Bucket) Head(key string) (S3Head, error) {
-	head, err := b.S3.HeadObject(&s3.HeadObjectInput{Bucket: &b.Name, Key: &key})
+func (b S3Bucket) Head(key string) (ObjectInfo, error) {
+	head, err := b.S3.HeadObjectWithContext(b.reqctx(), &s3.HeadObjectInput{Bucket: &b.Name, Key: &key})
 	if err != nil {
-		return S3Head{}, err
+		return ObjectInfo{}, err
 	}
-	ret := S3Head{}
+	if err := b.checkKMS(head.ServerSideEncryption, head.SSEKMSKeyId); err != nil {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", err, key)
+	}
+	ret := ObjectInfo{}
 	if head.ContentType != nil {
 		ret.Type = *head.ContentType
 	}
 	if head.ContentLength != nil {
 		ret.Size = *head.ContentLength
 	}
+	if head.ContentDisposition != nil {
+		ret.Disposition = *head.ContentDisposition
+	}
 	return ret, nil
 }
 
-func (b S3Bucket) List(prefix string) (map[string]S3Head, error) {
-	objs := make(map[string]S3Head)
-	err := b.S3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+// Freeze changes the object's storage class to ColdClass.
+func (b S3Bucket) Freeze(key string) error {
+	return b.setStorageClass(key, b.ColdClass)
+}
+
+// Thaw starts a restore for archived objects.
+// Objects in classes that don't need restoring, like GLACIER_IR, are always ready.
+func (b S3Bucket) Thaw(key string) (bool, error) {
+	head, err := b.S3.HeadObjectWithContext(b.reqctx(), &s3.HeadObjectInput{Bucket: &b.Name, Key: &key})
+	if err != nil {
+		return false, err
+	}
+	switch aws.StringValue(head.StorageClass) {
+	case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+	default:
+		return true, nil
+	}
+	if restore := aws.StringValue(head.Restore); restore != "" {
+		// ongoing-request="false" means the restored copy is available
+		return strings.Contains(restore, `ongoing-request="false"`), nil
+	}
+	days := int64(b.RestoreDays)
+	if days <= 0 {
+		days = 7
+	}
+	_, err = b.S3.RestoreObjectWithContext(b.reqctx(), &s3.RestoreObjectInput{
+		Bucket: &b.Name,
+		Key:    &key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(s3.TierStandard),
+			},
+		},
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	return false, err
+}
+
+// Warm copies a restored object back to the STANDARD storage class.
+func (b S3Bucket) Warm(key string) error {
+	return b.setStorageClass(key, s3.StorageClassStandard)
+}
+
+func (b S3Bucket) setStorageClass(key, class string) error {
+	copySrc := b.Name + "/" + key
+	input := &s3.CopyObjectInput{
+		Bucket:            &b.Name,
+		CopySource:        &copySrc,
+		Key:               &key,
+		StorageClass:      aws.String(class),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = b.sse()
+	_, err := b.S3.CopyObjectWithContext(b.reqctx(), input)
+	return err
+}
+
+func (b S3Bucket) List(prefix string) (map[string]ObjectInfo, error) {
+	objs := make(map[string]ObjectInfo)
+	err := b.S3.ListObjectsV2PagesWithContext(b.reqctx(), &s3.ListObjectsV2Input{
 		Bucket: aws.String(b.Name),
 		Prefix: aws.String(prefix),
 	}, func(out *s3.ListObjectsV2Output, _ bool) bool {
 		for _, item := range out.Contents {
-			objs[*item.Key] = S3Head{Size: *item.Size}
+			objs[*item.Key] = ObjectInfo{Size: *item.Size, Modified: aws.TimeValue(item.LastModified)}
 		}
 		return true
 	})
 	return objs, err
 }
 
-func newB2(region string, keyID, key string) *s3.S3 {
-	endpoint := fmt.Sprintf("https://s3.%s.backblazeb2.com", region)
-	return s3.New(session.Must(session.NewSession(&aws.Config{
-		Region:           aws.String(region),
-		Endpoint:         aws.String(endpoint),
-		Credentials:      credentials.NewStaticCredentials(keyID, key, ""),
-		S3ForcePathStyle: aws.Bool(true),
-		Retryer:          Retryer{},
-	})))
+// s3Options describes how to reach an S3-compatible service.
+type s3Options struct {
+	Region   string
+	Endpoint string // "{region}" is replaced with Region
+	// use bucket names in the path instead of the host name
+	PathStyle bool
+
+	KeyID  string
+	Secret string
+
+	// only connect to public addresses
+	PublicOnly bool
 }
 
-func newR2(accountID string, keyID, key string) *s3.S3 {
-	endpoint := fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID)
-	return s3.New(session.Must(session.NewSession(&aws.Config{
-		Region:      aws.String("auto"),
-		Endpoint:    aws.String(endpoint),
-		Credentials: credentials.NewStaticCredentials(keyID, key, ""),
-		Retryer:     Retryer{},
-	})))
+// s3Defaults fills in the endpoint and addressing style for each provider,
+// so only credentials and a region need to be configured.
+func s3Defaults(cfg Config) (s3Options, error) {
+	opts := s3Options{
+		Region:   cfg.Region,
+		Endpoint: cfg.Endpoint,
+		KeyID:    cfg.AccessKeyID,
+		Secret:   cfg.AccessKeySecret,
+
+		PublicOnly: cfg.PublicOnly,
+	}
+	switch cfg.Type {
+	case StorageTypeS3:
+		// custom endpoints are usually MinIO and friends, which want path-style
+		opts.PathStyle = opts.Endpoint != ""
+	case StorageTypeB2:
+		if opts.Endpoint == "" {
+			opts.Endpoint = "https://s3.{region}.backblazeb2.com"
+		}
+		opts.PathStyle = true
+	case StorageTypeR2:
+		if opts.Endpoint == "" {
+			if cfg.CFAccountID == "" {
+				return opts, fmt.Errorf("missing storage.cloudflare_account in configuration")
+			}
+			opts.Endpoint = fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.CFAccountID)
+		}
+		if opts.Region == "" {
+			opts.Region = "auto"
+		}
+	case StorageTypeWasabi:
+		if opts.Endpoint == "" {
+			opts.Endpoint = "https://s3.{region}.wasabisys.com"
+		}
+		if opts.Region == "" {
+			opts.Region = "us-east-1"
+		}
+	default:
+		return opts, fmt.Errorf("unknown storage.type in configuration: %q", cfg.Type)
+	}
+	if cfg.PathStyle != nil {
+		opts.PathStyle = *cfg.PathStyle
+	}
+	return opts, nil
 }
 
-func newS3(region, key, secret, endpoint string) *s3.S3 {
-	cfg := &aws.Config{
-		Region:  aws.String(region),
-		Retryer: Retryer{},
+func newS3(opts s3Options) *s3.S3 {
+	rt := transport
+	if opts.PublicOnly {
+		rt = publicTransport
+	}
+	cfg := retry.AWS(&aws.Config{
+		Region: aws.String(opts.Region),
+		// no overall timeout, so long downloads can be streamed
+		HTTPClient: &http.Client{Transport: rt},
+	})
+	if opts.KeyID != "" && opts.Secret != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(opts.KeyID, opts.Secret, "")
 	}
-	if key != "" && secret != "" {
-		cfg.Credentials = credentials.NewStaticCredentials(key, secret, "")
+	if opts.Endpoint != "" {
+		cfg.Endpoint = aws.String(strings.ReplaceAll(opts.Endpoint, "{region}", opts.Region))
 	}
-	if endpoint != "" {
-		cfg.Endpoint = &endpoint
+	if opts.PathStyle {
 		cfg.S3ForcePathStyle = aws.Bool(true)
 	}
 	return s3.New(session.Must(session.NewSession(cfg)))
@@ -183,78 +388,3 @@ var (
 	// for R2
 	CFAccountID string
 )
-
-type Config struct {
-	Type StorageType
-
-	FilesBucket   string
-	UploadsBucket string
-	CacheBucket   string
-
-	Region   string
-	Endpoint string
-
-	AccessKeyID     string
-	AccessKeySecret string
-
-	// for R2
-	CFAccountID string
-
-	// for SQS
-	SQSURL    string
-	SQSRegion string
-}
-
-type StorageType string
-
-const (
-	StorageTypeS3 StorageType = "s3"
-	StorageTypeB2 StorageType = "b2"
-	StorageTypeR2 StorageType = "r2"
-	// StorageTypeFS StorageType = "fs"
-)
-
-func Init(cfg Config) {
-	var client *s3.S3
-	awsClient := newS3("us-west-2", "", "", "")
-	switch cfg.Type {
-	case StorageTypeS3:
-		client = newS3(cfg.Region, cfg.AccessKeyID, cfg.AccessKeySecret, cfg.Endpoint)
-	case StorageTypeB2:
-		client = newB2(cfg.Region, cfg.AccessKeyID, cfg.AccessKeySecret)
-	case StorageTypeR2:
-		client = newR2(cfg.CFAccountID, cfg.AccessKeyID, cfg.AccessKeySecret)
-	case "":
-		panic(fmt.Errorf("missing storage.type in configuration"))
-	default:
-		panic(fmt.Errorf("unknown storage.type in configuration: %q", cfg.Type))
-	}
-
-	FilesBucket = S3Bucket{
-		Name: cfg.FilesBucket,
-		S3:   client,
-		Type: cfg.Type,
-	}
-
-	UploadsBucket = S3Bucket{
-		Name: cfg.UploadsBucket,
-		S3:   client,
-		Type: cfg.Type,
-	}
-
-	if cfg.CacheBucket != "" {
-		CacheBucket = S3Bucket{
-			Name: cfg.CacheBucket,
-			S3:   awsClient,
-			Type: StorageTypeS3,
-		}
-	}
-
-	if cfg.SQSURL != "" {
-		UseSQS(cfg.SQSRegion, cfg.SQSURL)
-	}
-}
-
-func IsCacheEnabled() bool {
-	return CacheBucket.Type != ""
-}
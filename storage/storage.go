@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	FilesBucket   Bucket
+	UploadsBucket Bucket
+	CacheBucket   Bucket
+)
+
+// Bucket is a place to store objects, like an S3 bucket or a local directory.
+type Bucket interface {
+	Put(contentType, key string, r io.ReadSeeker) error
+	// PutObject is like Put, but also sets the Content-Disposition from info.
+	PutObject(key string, info ObjectInfo, r io.ReadSeeker) error
+	Get(key string) (io.ReadCloser, error)
+	Head(key string) (ObjectInfo, error)
+	Exists(key string) bool
+	Delete(key string) error
+	List(prefix string) (map[string]ObjectInfo, error)
+	CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) error
+
+	// PresignPut returns a URL clients can upload to directly.
+	PresignPut(key string, size int64, disp string, ttl time.Duration) (string, error)
+	// PresignGet returns a URL clients can download from directly.
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// Tiered is implemented by buckets that can move objects to cheaper, slower storage.
+type Tiered interface {
+	// Freeze moves an object to cold storage.
+	Freeze(key string) error
+	// Thaw requests that a cold object be made readable, and reports whether it is.
+	// It's safe to call again while waiting.
+	Thaw(key string) (ready bool, err error)
+	// Warm moves a readable cold object back to regular storage.
+	Warm(key string) error
+}
+
+// Tiering returns b as a Tiered bucket, if it supports cold storage and it's configured.
+// Currently only S3 with a cold storage class.
+// For replicated buckets, every copy is tiered together.
+func Tiering(b Bucket) (Tiered, bool) {
+	b = unwrapBucket(b)
+	if rb, ok := b.(Replicated); ok {
+		var tiers replicatedTiers
+		for _, bucket := range rb.all() {
+			if t, ok := Tiering(bucket); ok {
+				tiers = append(tiers, t)
+			}
+		}
+		return tiers, len(tiers) > 0
+	}
+	if s3b, ok := b.(S3Bucket); ok && s3b.ColdClass != "" {
+		return s3b, true
+	}
+	return nil, false
+}
+
+// PutHeaders returns extra headers that clients must send when uploading to a PresignPut URL.
+func PutHeaders(b Bucket) map[string]string {
+	b = unwrapBucket(b)
+	if hb, ok := b.(interface{ putHeaders() map[string]string }); ok {
+		return hb.putHeaders()
+	}
+	return nil
+}
+
+type ObjectInfo struct {
+	Type        string
+	Size        int64
+	Disposition string    // only set by Head
+	Modified    time.Time // only set by List
+}
+
+type Config struct {
+	Type StorageType
+
+	FilesBucket   string
+	UploadsBucket string
+	CacheBucket   string
+
+	Region   string
+	Endpoint string
+	// nil means the provider's default
+	PathStyle *bool
+	// overrides Region for specific buckets
+	BucketRegions map[string]string
+	// copies of the files bucket in other regions
+	Replicas []ReplicaConfig
+
+	AccessKeyID     string
+	AccessKeySecret string
+
+	// for R2
+	CFAccountID string
+	// for SSE-KMS, the key ID, ARN, or alias to encrypt objects with
+	KMSKeyID string
+	// for cold storage tiering, like GLACIER or DEEP_ARCHIVE
+	ColdStorageClass string
+	// how long restored copies of cold objects stay readable
+	RestoreDays int
+
+	// for GCS, path to a service account key
+	CredentialsFile string
+
+	// for local filesystem storage
+	Path   string // root directory
+	URL    string // base URL of this server, for presigned URLs
+	Secret string // signs presigned URLs
+
+	// base64-encoded 32 byte key that wraps users' encryption keys
+	// if empty, client-side encryption is unavailable
+	EncryptionKey string
+
+	HTTP HTTPConfig
+	// only connect to public addresses, for endpoints given by users
+	PublicOnly bool
+}
+
+// ReplicaConfig is a copy of the files bucket, on the same service.
+type ReplicaConfig struct {
+	Bucket    string
+	Region    string
+	Countries []string // served from this replica
+}
+
+type StorageType string
+
+const (
+	StorageTypeS3     StorageType = "s3"
+	StorageTypeB2     StorageType = "b2"
+	StorageTypeR2     StorageType = "r2"
+	StorageTypeWasabi StorageType = "wasabi"
+	StorageTypeFS     StorageType = "fs"
+	StorageTypeGCS    StorageType = "gcs"
+	StorageTypeAzure  StorageType = "azure"
+)
+
+// Backend is a set of buckets on one storage service.
+type Backend struct {
+	Files   Bucket
+	Uploads Bucket
+	Cache   Bucket // optional
+}
+
+func Init(cfg Config) {
+	key, err := base64.StdEncoding.DecodeString(cfg.EncryptionKey)
+	if err != nil {
+		panic(fmt.Errorf("invalid storage.encryption_key in configuration: %w", err))
+	}
+	if err := initEncryption(key); err != nil {
+		panic(err)
+	}
+
+	backend := Open(cfg)
+	FilesBucket = meter(backend.Files)
+	UploadsBucket = meter(backend.Uploads)
+	CacheBucket = meter(backend.Cache)
+}
+
+// Open connects to the buckets described by cfg without making them the default.
+func Open(cfg Config) Backend {
+	if len(cfg.Replicas) > 0 && (cfg.Type == StorageTypeFS || cfg.Type == StorageTypeGCS || cfg.Type == StorageTypeAzure) {
+		panic(fmt.Errorf("storage.replicas isn't supported for storage type %q", cfg.Type))
+	}
+	configureHTTP(cfg.HTTP)
+	switch cfg.Type {
+	case StorageTypeFS:
+		return openFS(cfg)
+	case StorageTypeGCS:
+		return openGCS(cfg)
+	case StorageTypeAzure:
+		return openAzure(cfg)
+	case "":
+		panic(fmt.Errorf("missing storage.type in configuration"))
+	}
+
+	opts, err := s3Defaults(cfg)
+	if err != nil {
+		panic(err)
+	}
+	clients := make(map[string]*s3.S3)
+	bucket := func(name, region string) S3Bucket {
+		regional := opts
+		if region != "" {
+			regional.Region = region
+		} else if region, ok := cfg.BucketRegions[name]; ok {
+			regional.Region = region
+		}
+		client, ok := clients[regional.Region]
+		if !ok {
+			client = newS3(regional)
+			clients[regional.Region] = client
+		}
+		return S3Bucket{
+			Name:     name,
+			S3:       client,
+			Type:     cfg.Type,
+			KMSKeyID: cfg.KMSKeyID,
+
+			ColdClass:   cfg.ColdStorageClass,
+			RestoreDays: cfg.RestoreDays,
+		}
+	}
+
+	backend := Backend{
+		Files:   bucket(cfg.FilesBucket, ""),
+		Uploads: bucket(cfg.UploadsBucket, ""),
+	}
+	if len(cfg.Replicas) > 0 {
+		files := Replicated{Primary: backend.Files}
+		for _, r := range cfg.Replicas {
+			files.Replicas = append(files.Replicas, Replica{
+				Bucket:    bucket(r.Bucket, r.Region),
+				Countries: r.Countries,
+			})
+		}
+		backend.Files = files
+	}
+
+	if cfg.CacheBucket != "" {
+		if cfg.Type == StorageTypeB2 {
+			// inter.tube keeps its cache in AWS, next to the database
+			backend.Cache = S3Bucket{
+				Name: cfg.CacheBucket,
+				S3:   newS3(s3Options{Region: "us-west-2"}),
+				Type: StorageTypeS3,
+			}
+		} else {
+			backend.Cache = bucket(cfg.CacheBucket, "")
+		}
+	}
+	return backend
+}
+
+// OpenS3 connects to a single S3-compatible bucket that isn't ours, like a user's backup bucket.
+// Unlike Open, credentials are required, so the server's own are never used for it.
+func OpenS3(cfg Config, name string) (Bucket, error) {
+	switch cfg.Type {
+	case StorageTypeS3, StorageTypeB2, StorageTypeR2, StorageTypeWasabi:
+	default:
+		return nil, fmt.Errorf("storage: unsupported type %q", cfg.Type)
+	}
+	if cfg.AccessKeyID == "" || cfg.AccessKeySecret == "" {
+		return nil, fmt.Errorf("storage: missing credentials")
+	}
+	opts, err := s3Defaults(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return S3Bucket{
+		Name: name,
+		S3:   newS3(opts),
+		Type: cfg.Type,
+	}, nil
+}
+
+func IsCacheEnabled() bool {
+	return CacheBucket != nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/guregu/intertube/tracing"
+)
+
+// tracedBucket records a span for each operation, as a child of the span in ctx.
+type tracedBucket struct {
+	Bucket
+	ctx context.Context
+}
+
+// Traced returns b with its operations traced as part of the request in ctx.
+// Its requests are also bound to ctx, see WithContext.
+func Traced(ctx context.Context, b Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	if tb, ok := b.(tracedBucket); ok {
+		b = tb.Bucket
+	}
+	return tracedBucket{Bucket: WithContext(ctx, b), ctx: ctx}
+}
+
+func (b tracedBucket) start(op, key string) trace.Span {
+	_, span := tracing.Start(b.ctx, "storage."+op, attribute.String("storage.key", key))
+	return span
+}
+
+func (b tracedBucket) Put(contentType, key string, r io.ReadSeeker) (err error) {
+	span := b.start("Put", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.Put(contentType, key, r)
+}
+
+func (b tracedBucket) PutObject(key string, info ObjectInfo, r io.ReadSeeker) (err error) {
+	span := b.start("PutObject", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.PutObject(key, info, r)
+}
+
+func (b tracedBucket) Get(key string) (r io.ReadCloser, err error) {
+	span := b.start("Get", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.Get(key)
+}
+
+func (b tracedBucket) GetRange(key string, off, n int64) (r io.ReadCloser, err error) {
+	span := b.start("GetRange", key)
+	defer func() { tracing.End(span, err) }()
+	return GetRange(b.Bucket, key, off, n)
+}
+
+func (b tracedBucket) Head(key string) (info ObjectInfo, err error) {
+	span := b.start("Head", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.Head(key)
+}
+
+func (b tracedBucket) Exists(key string) bool {
+	defer b.start("Exists", key).End()
+	return b.Bucket.Exists(key)
+}
+
+func (b tracedBucket) Delete(key string) (err error) {
+	span := b.start("Delete", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.Delete(key)
+}
+
+func (b tracedBucket) List(prefix string) (objs map[string]ObjectInfo, err error) {
+	span := b.start("List", prefix)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.List(prefix)
+}
+
+func (b tracedBucket) CopyFromBucket(dst string, srcBucket Bucket, src string, mime, contentDisp string) (err error) {
+	span := b.start("CopyFromBucket", dst)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.CopyFromBucket(dst, srcBucket, src, mime, contentDisp)
+}
+
+func (b tracedBucket) PresignPut(key string, size int64, disp string, ttl time.Duration) (href string, err error) {
+	span := b.start("PresignPut", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.PresignPut(key, size, disp, ttl)
+}
+
+func (b tracedBucket) PresignGet(key string, ttl time.Duration) (href string, err error) {
+	span := b.start("PresignGet", key)
+	defer func() { tracing.End(span, err) }()
+	return b.Bucket.PresignGet(key, ttl)
+}
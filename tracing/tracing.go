@@ -0,0 +1,109 @@
+// Package tracing sends OpenTelemetry traces to an OTLP collector.
+// Until Init is called, spans are no-ops.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/guregu/intertube")
+
+type Config struct {
+	// OTLP/HTTP endpoint, like "localhost:4318"
+	// if empty, the standard OTEL_EXPORTER_OTLP_* environment variables are used
+	Endpoint string
+	Insecure bool
+	// fraction of requests to trace, from 0 to 1
+	SampleRate float64
+	// defaults to "intertube"
+	ServiceName string
+}
+
+// Init starts exporting traces.
+// The returned function flushes any buffered spans, and should be called before exiting.
+func Init(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	name := cfg.ServiceName
+	if name == "" {
+		name = "intertube"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(name)))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	rate := cfg.SampleRate
+	if rate <= 0 {
+		rate = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(rate))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Start begins a span as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End finishes a span, marking it as failed if err is non-nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InstrumentAWS adds a span for every AWS SDK request made with the given handlers.
+// Requests are children of the span in their context, so use the WithContext methods.
+func InstrumentAWS(handlers *request.Handlers) {
+	// Validate and Complete run once per request, no matter how many times it's retried
+	handlers.Validate.PushFront(func(r *request.Request) {
+		ctx, _ := tracer.Start(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.RPCSystemKey.String("aws-api"),
+				semconv.RPCService(r.ClientInfo.ServiceName),
+				semconv.RPCMethod(r.Operation.Name),
+			))
+		r.SetContext(ctx)
+	})
+	handlers.Complete.PushBack(func(r *request.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.Int("aws.retries", r.RetryCount))
+		if r.HTTPResponse != nil {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(r.HTTPResponse.StatusCode))
+		}
+		End(span, r.Error)
+	})
+}
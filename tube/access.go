@@ -0,0 +1,75 @@
+package tube
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+const (
+	tableTrackAccesses = "TrackAccesses"
+
+	// AccessHistoryTTL is how long track access history is kept.
+	AccessHistoryTTL = 90 * 24 * time.Hour
+)
+
+// TrackAccess is an entry in a user's access history: a track streamed or downloaded,
+// and who by, so users can see what's being listened to and spot leaked credentials.
+type TrackAccess struct {
+	UserID int      `dynamo:",hash"`
+	Time   Timegarb `dynamo:",range"`
+
+	TrackID string
+	// as of the time, in case the track is changed or deleted
+	Title  string `dynamo:",omitempty"`
+	Artist string `dynamo:",omitempty"`
+
+	Kind   TrackAccessKind
+	IP     string
+	Client string `dynamo:",omitempty"` // "web", or the Subsonic client's name
+	// the paired device whose token was used, if any
+	DeviceID   string `dynamo:",omitempty"`
+	DeviceName string `dynamo:",omitempty"`
+	UserAgent  string `dynamo:",omitempty"`
+
+	Expires time.Time `dynamo:",unixtime" json:"-"`
+}
+
+type TrackAccessKind string
+
+const (
+	TrackStreamed   TrackAccessKind = "stream"
+	TrackDownloaded TrackAccessKind = "download"
+)
+
+// RecordTrackAccess adds an entry to the user's access history.
+func RecordTrackAccess(ctx context.Context, a TrackAccess) error {
+	if a.Time.IsZero() {
+		a.Time = NewTimegarb(time.Now())
+	}
+	a.Expires = a.Time.Add(AccessHistoryTTL)
+	table := dbTable(tableTrackAccesses)
+	return table.Put(a).If("attribute_not_exists('UserID')").RunWithContext(ctx)
+}
+
+// GetTrackAccesses returns a user's access history, newest first.
+// Entries that have expired but haven't been cleaned up yet are left out.
+func GetTrackAccesses(ctx context.Context, userID int, limit int64, startFrom dynamo.PagingKey) ([]TrackAccess, dynamo.PagingKey, error) {
+	table := dbTable(tableTrackAccesses)
+	q := table.Get("UserID", userID).
+		Filter("'Expires' > ?", time.Now().UTC().Unix()).
+		Order(dynamo.Descending)
+	if limit > 0 {
+		q.SearchLimit(limit)
+	}
+	if startFrom != nil {
+		q.StartFrom(startFrom)
+	}
+	var history []TrackAccess
+	next, err := q.AllWithLastEvaluatedKeyContext(ctx, &history)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return history, next, err
+}
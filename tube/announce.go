@@ -0,0 +1,85 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const tableAnnouncements = "Announcements"
+
+// Announcement is a message from the admins shown to everyone, like a heads-up about upcoming downtime.
+type Announcement struct {
+	ID      string `dynamo:",hash"`
+	Message string
+	Level   AnnouncementLevel
+	// while it's showing, the site is read-only: streaming works, but changes are refused
+	Maintenance bool `dynamo:",omitempty"`
+
+	// shown from Start until End; zero means right away and until it's deleted
+	Start time.Time `dynamo:",omitempty"`
+	End   time.Time `dynamo:",omitempty"`
+
+	Created time.Time
+	Author  int // admin's user ID
+}
+
+type AnnouncementLevel string
+
+const (
+	AnnouncementInfo    AnnouncementLevel = "info"
+	AnnouncementWarning AnnouncementLevel = "warning"
+)
+
+func NewAnnouncement(author int, message string) (Announcement, error) {
+	now := time.Now().UTC()
+	garb, err := randomString(6)
+	if err != nil {
+		return Announcement{}, err
+	}
+	return Announcement{
+		ID:      strconv.FormatInt(now.UnixNano(), 36) + "-" + garb,
+		Message: message,
+		Level:   AnnouncementInfo,
+		Created: now,
+		Author:  author,
+	}, nil
+}
+
+// Active reports whether the announcement is showing at the given time.
+func (a Announcement) Active(now time.Time) bool {
+	if !a.Start.IsZero() && now.Before(a.Start) {
+		return false
+	}
+	return a.End.IsZero() || now.Before(a.End)
+}
+
+func (a Announcement) Create(ctx context.Context) error {
+	if a.ID == "" {
+		return fmt.Errorf("announcement: missing ID")
+	}
+	table := dbTable(tableAnnouncements)
+	return table.Put(a).If("attribute_not_exists('ID')").RunWithContext(ctx)
+}
+
+func DeleteAnnouncement(ctx context.Context, id string) error {
+	table := dbTable(tableAnnouncements)
+	return table.Delete("ID", id).RunWithContext(ctx)
+}
+
+// GetAnnouncements returns every announcement, including ones that are over or haven't started yet,
+// newest first. There are never many of them.
+func GetAnnouncements(ctx context.Context) ([]Announcement, error) {
+	table := dbTable(tableAnnouncements)
+	var as []Announcement
+	err := table.Scan().AllWithContext(ctx, &as)
+	if err == ErrNotFound {
+		err = nil
+	}
+	sort.Slice(as, func(i, j int) bool {
+		return as[i].Created.After(as[j].Created)
+	})
+	return as, err
+}
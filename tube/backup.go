@@ -0,0 +1,91 @@
+package tube
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+// BackupInterval is how often metadata is backed up to users' own buckets.
+const BackupInterval = 24 * time.Hour
+
+// Backup is a user's own S3-compatible bucket that their metadata is copied to every night,
+// in case inter.tube (or their account) goes away.
+type Backup struct {
+	Type      string // s3, b2, r2, or wasabi
+	Bucket    string
+	Prefix    string `dynamo:",omitempty"`
+	Region    string `dynamo:",omitempty"`
+	Endpoint  string `dynamo:",omitempty"`
+	AccountID string `dynamo:",omitempty"` // for R2
+
+	AccessKeyID     string
+	AccessKeySecret string `json:"-"`
+
+	Scheduled time.Time `dynamo:",omitempty"`
+	LastRun   time.Time `dynamo:",omitempty"`
+	LastError string    `dynamo:",omitempty"`
+}
+
+func (b Backup) Enabled() bool {
+	return b.Bucket != ""
+}
+
+// SetBackup replaces the user's backup settings. A zero Backup turns backups off.
+func (u *User) SetBackup(ctx context.Context, b Backup) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		If("attribute_exists('ID')")
+	if b.Enabled() {
+		update.Set("Backup", b)
+	} else {
+		update.Remove("Backup")
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
+// ScheduleBackup claims the next backup run, so it's only queued once.
+// It returns false if one was already scheduled after since.
+func (u *User) ScheduleBackup(ctx context.Context, now, since time.Time) (bool, error) {
+	users := dbTable(tableUsers)
+	err := users.Update("ID", u.ID).
+		Set("Backup.Scheduled", now.UTC()).
+		If("attribute_exists('Backup')").
+		If("attribute_not_exists('Backup'.'Scheduled') OR 'Backup'.'Scheduled' < ?", since.UTC()).
+		ValueWithContext(ctx, u)
+	if dynamo.IsCondCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetBackupResult records how a backup went.
+func (u *User) SetBackupResult(ctx context.Context, at time.Time, backupErr error) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		Set("Backup.LastRun", at.UTC()).
+		If("attribute_exists('Backup')")
+	if backupErr != nil {
+		update.Set("Backup.LastError", backupErr.Error())
+	} else {
+		update.Remove("Backup.LastError")
+	}
+	err := update.ValueWithContext(ctx, u)
+	if dynamo.IsCondCheckFailed(err) {
+		// turned off in the meantime
+		return nil
+	}
+	return err
+}
+
+// GetUsersWithBackups scans for users who have backups turned on.
+func GetUsersWithBackups(ctx context.Context) ([]User, error) {
+	users := dbTable(tableUsers)
+	var us []User
+	err := users.Scan().Filter("attribute_exists('Backup')").AllWithContext(ctx, &us)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return us, err
+}
@@ -0,0 +1,240 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+)
+
+// readCache holds recently read users, sessions, and track listings. It's nil unless EnableCache is called.
+var readCache *ccache.Cache
+
+var (
+	// how long a cached user or session is trusted; only this process's writes forget them sooner
+	userCacheTTL = 30 * time.Second
+	// track listings are keyed by the user's LastMod, so this just bounds memory use
+	listCacheTTL = time.Hour
+)
+
+// EnableCache keeps up to size recently read items in memory.
+// Users are cached for ttl, and forgotten when changed by this server.
+// Track listings and anything else cached with a user's LastMod in its key
+// are replaced as soon as LastMod is bumped.
+func EnableCache(size int64, ttl time.Duration) {
+	readCache = ccache.New(ccache.Configure().MaxSize(size))
+	if ttl > 0 {
+		userCacheTTL = ttl
+	}
+}
+
+// Cached returns the value for key from the cache, or calls fetch and caches its result.
+// Keys should include the LastMod of the user they belong to.
+// Without a cache, it just calls fetch.
+func Cached[T any](key string, fetch func() (T, error)) (T, error) {
+	if readCache == nil {
+		return fetch()
+	}
+	if item := readCache.Get(key); item != nil && !item.Expired() {
+		return item.Value().(T), nil
+	}
+	v, err := fetch()
+	if err == nil {
+		readCache.Set(key, v, listCacheTTL)
+	}
+	return v, err
+}
+
+// ModKey is a cache key for the given user's data, valid until they're modified.
+func ModKey(u User, kind string) string {
+	return fmt.Sprintf("%s/%d/%d", kind, u.ID, u.LastMod.UnixNano())
+}
+
+func userCacheKey(id int) string {
+	return fmt.Sprintf("user/%d", id)
+}
+
+func cachedUser(id int) (User, bool) {
+	if readCache == nil {
+		return User{}, false
+	}
+	item := readCache.Get(userCacheKey(id))
+	if item == nil || item.Expired() {
+		return User{}, false
+	}
+	return item.Value().(User), true
+}
+
+func cacheUser(u User) {
+	if readCache != nil {
+		readCache.Set(userCacheKey(u.ID), u, userCacheTTL)
+	}
+}
+
+func forgetUser(id any) {
+	if readCache == nil {
+		return
+	}
+	if n, ok := id.(int); ok {
+		readCache.Delete(userCacheKey(n))
+	}
+}
+
+func emailCacheKey(email string) string {
+	return "email/" + email
+}
+
+// cachedUserByEmail looks up the user last seen with email.
+// Emails can change, so the user is only returned if it still matches.
+func cachedUserByEmail(email string) (User, bool) {
+	if readCache == nil {
+		return User{}, false
+	}
+	item := readCache.Get(emailCacheKey(email))
+	if item == nil || item.Expired() {
+		return User{}, false
+	}
+	u, ok := cachedUser(item.Value().(int))
+	if !ok || u.Email != email {
+		return User{}, false
+	}
+	return u, true
+}
+
+func cacheUserByEmail(u User) {
+	if readCache != nil {
+		cacheUser(u)
+		readCache.Set(emailCacheKey(u.Email), u.ID, userCacheTTL)
+	}
+}
+
+func sessionCacheKey(token string) string {
+	return "session/" + token
+}
+
+func cachedSession(token string) (Session, bool) {
+	if readCache == nil {
+		return Session{}, false
+	}
+	item := readCache.Get(sessionCacheKey(token))
+	if item == nil || item.Expired() {
+		return Session{}, false
+	}
+	return item.Value().(Session), true
+}
+
+func cacheSession(sesh Session) {
+	if readCache != nil {
+		readCache.Set(sessionCacheKey(sesh.Token), sesh, userCacheTTL)
+	}
+}
+
+func forgetSession(token string) {
+	if readCache != nil {
+		readCache.Delete(sessionCacheKey(token))
+	}
+}
+
+// usersTable forgets cached users when they are updated or deleted.
+type usersTable struct {
+	table
+}
+
+func (t usersTable) Update(hashKey string, value any) Update {
+	return forgetfulUpdate{t.table.Update(hashKey, value), value}
+}
+
+func (t usersTable) Delete(name string, value any) tableDelete {
+	return forgetfulDelete{t.table.Delete(name, value), value}
+}
+
+type forgetfulUpdate struct {
+	Update
+	id any
+}
+
+func (u forgetfulUpdate) Range(name string, value any) Update {
+	u.Update.Range(name, value)
+	return u
+}
+
+func (u forgetfulUpdate) Set(path string, value any) Update {
+	u.Update.Set(path, value)
+	return u
+}
+
+func (u forgetfulUpdate) Add(path string, value any) Update {
+	u.Update.Add(path, value)
+	return u
+}
+
+func (u forgetfulUpdate) AddStringsToSet(path string, values ...string) Update {
+	u.Update.AddStringsToSet(path, values...)
+	return u
+}
+
+func (u forgetfulUpdate) AddIntsToSet(path string, values ...int) Update {
+	u.Update.AddIntsToSet(path, values...)
+	return u
+}
+
+func (u forgetfulUpdate) Remove(paths ...string) Update {
+	u.Update.Remove(paths...)
+	return u
+}
+
+func (u forgetfulUpdate) If(expr string, args ...any) Update {
+	u.Update.If(expr, args...)
+	return u
+}
+
+func (u forgetfulUpdate) Run() error {
+	return u.RunWithContext(context.Background())
+}
+
+func (u forgetfulUpdate) RunWithContext(ctx context.Context) error {
+	defer forgetUser(u.id)
+	return u.Update.RunWithContext(ctx)
+}
+
+func (u forgetfulUpdate) Value(out any) error {
+	return u.ValueWithContext(context.Background(), out)
+}
+
+func (u forgetfulUpdate) ValueWithContext(ctx context.Context, out any) error {
+	defer forgetUser(u.id)
+	return u.Update.ValueWithContext(ctx, out)
+}
+
+type forgetfulDelete struct {
+	tableDelete
+	id any
+}
+
+func (d forgetfulDelete) Range(name string, value any) tableDelete {
+	d.tableDelete.Range(name, value)
+	return d
+}
+
+func (d forgetfulDelete) If(expr string, args ...any) tableDelete {
+	d.tableDelete.If(expr, args...)
+	return d
+}
+
+func (d forgetfulDelete) Run() error {
+	return d.RunWithContext(context.Background())
+}
+
+func (d forgetfulDelete) RunWithContext(ctx context.Context) error {
+	defer forgetUser(d.id)
+	return d.tableDelete.RunWithContext(ctx)
+}
+
+// unwrapUpdate returns the backend's own update, for transactions.
+func unwrapUpdate(u Update) Update {
+	if fu, ok := u.(forgetfulUpdate); ok {
+		return fu.Update
+	}
+	return u
+}
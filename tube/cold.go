@@ -0,0 +1,125 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/guregu/intertube/storage"
+)
+
+// ColdAfter is how long a track can go without being played
+// before it's moved to cold storage. Zero disables tiering.
+var ColdAfter time.Duration
+
+// IsCold reports whether the track's audio is in cold storage.
+func (t Track) IsCold() bool {
+	return !t.Cold.IsZero()
+}
+
+// lastAccess is the last time anyone cared about this track.
+func (t Track) lastAccess() time.Time {
+	last := t.Date
+	for _, at := range []time.Time{t.LastPlayed, t.Thawing} {
+		if at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+func (t *Track) SetCold(ctx context.Context, at time.Time) error {
+	tracks := dbTable("Tracks")
+	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
+		Set("Cold", at).
+		Remove("Thawing").
+		If("attribute_exists('ID')").
+		ValueWithContext(ctx, t)
+}
+
+func (t *Track) SetThawing(ctx context.Context, at time.Time) error {
+	tracks := dbTable("Tracks")
+	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
+		Set("Thawing", at).
+		If("attribute_exists('Cold')").
+		ValueWithContext(ctx, t)
+}
+
+// SetWarm marks the track as back in regular storage.
+// Thawing is kept so it doesn't get frozen again right away.
+func (t *Track) SetWarm(ctx context.Context) error {
+	tracks := dbTable("Tracks")
+	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
+		Remove("Cold").
+		If("attribute_exists('ID')").
+		ValueWithContext(ctx, t)
+}
+
+// Thaw requests a cold track's audio be restored, and reports whether it can be read now.
+func (t *Track) Thaw(ctx context.Context) (bool, error) {
+	tiered, ok := storage.Tiering(storage.WithContext(ctx, storage.FilesBucket))
+	if !ok {
+		return false, fmt.Errorf("tube: track %s is cold but cold storage isn't configured", t.ID)
+	}
+	ready, err := tiered.Thaw(t.StorageKey())
+	if err != nil {
+		return false, err
+	}
+	if t.Thawing.IsZero() {
+		if err := t.SetThawing(ctx, time.Now().UTC()); err != nil {
+			return ready, err
+		}
+	}
+	return ready, nil
+}
+
+// FreezeColdTracks moves tracks that haven't been played for ColdAfter to cold storage,
+// and moves tracks that were requested while cold back once they're restored.
+// This scans every track, so it shouldn't run more than a few times a day.
+func FreezeColdTracks(ctx context.Context) error {
+	tiered, ok := storage.Tiering(storage.WithContext(ctx, storage.FilesBucket))
+	if ColdAfter == 0 || !ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	cutoff := now.Add(-ColdAfter)
+
+	var frozen, warmed int
+	iter := GetALLTracks(ctx)
+	for {
+		var t Track
+		if !iter.NextWithContext(ctx, &t) {
+			break
+		}
+		switch {
+		case t.Deleted:
+			continue
+		case t.IsCold() && !t.Thawing.IsZero():
+			ready, err := tiered.Thaw(t.StorageKey())
+			if err != nil {
+				return fmt.Errorf("thaw %d/%s: %w", t.UserID, t.ID, err)
+			}
+			if !ready {
+				continue
+			}
+			if err := tiered.Warm(t.StorageKey()); err != nil {
+				return fmt.Errorf("warm %d/%s: %w", t.UserID, t.ID, err)
+			}
+			if err := t.SetWarm(ctx); err != nil {
+				return err
+			}
+			warmed++
+		case !t.IsCold() && t.lastAccess().Before(cutoff):
+			if err := tiered.Freeze(t.StorageKey()); err != nil {
+				return fmt.Errorf("freeze %d/%s: %w", t.UserID, t.ID, err)
+			}
+			if err := t.SetCold(ctx, now); err != nil {
+				return err
+			}
+			frozen++
+		}
+	}
+	slog.InfoContext(ctx, "cold storage: done", "froze", frozen, "warmed", warmed)
+	return iter.Err()
+}
@@ -2,8 +2,11 @@ package tube
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,26 +14,45 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/guregu/dynamo"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/guregu/intertube/retry"
+	"github.com/guregu/intertube/tracing"
 )
 
 var dynamoTables = map[string]any{
-	"Counters":  counter{},
-	"Files":     File{},
-	"Playlists": Playlist{},
-	"Sessions":  Session{},
-	"Stars":     Star{},
-	"Tracks":    Track{},
-	"Users":     User{},
+	"Announcements": Announcement{},
+	"Counters":      counter{},
+	"DeviceTokens":  DeviceToken{},
+	"Events":        Event{},
+	"Exports":       Export{},
+	"Files":         File{},
+	"Gifts":         Gift{},
+	"Invites":       Invite{},
+	"Jobs":          Job{},
+	"Lyrics":        Lyrics{},
+	"Notifications": Notification{},
+	"Pairings":      Pairing{},
+	"PlayQueues":    PlayQueue{},
+	"Playlists":     Playlist{},
+	"Shares":        Share{},
+	"Sessions":      Session{},
+	"Stars":         Star{},
+	"Tombstones":    Tombstone{},
+	"TrackAccesses": TrackAccess{},
+	"Tracks":        Track{},
+	"Trash":         TrashedTrack{},
+	"Users":         User{},
 }
 
 var ErrNotFound = dynamo.ErrNotFound
 
 var (
 	dbPrefix string = "Tube-"
-	db       *dynamo.DB
+	db       database
 	useDump  = false
 )
 
+// Init connects to DynamoDB.
 func Init(region, prefix, endpoint string, debug bool) {
 	dbPrefix = prefix
 	var err error
@@ -38,7 +60,7 @@ func Init(region, prefix, endpoint string, debug bool) {
 	if endpoint == "" {
 		sesh, err = session.NewSession()
 	} else {
-		log.Println("Using DynamoDB endpoint:", endpoint)
+		slog.Info("Using DynamoDB endpoint", "endpoint", endpoint)
 		sesh, err = session.NewSession(&aws.Config{
 			Endpoint:    &endpoint,
 			Credentials: credentials.NewStaticCredentials("dummy", "dummy", ""),
@@ -50,41 +72,68 @@ func Init(region, prefix, endpoint string, debug bool) {
 	if err != nil {
 		panic(err)
 	}
-	cfg := &aws.Config{
+	tracing.InstrumentAWS(&sesh.Handlers)
+	cfg := retry.AWS(&aws.Config{
 		Region: &region,
-	}
+	})
 	if endpoint == "" && region == "" {
 		region = os.Getenv("AWS_REGION")
 	}
 	if debug {
 		cfg.LogLevel = aws.LogLevel(aws.LogDebugWithHTTPBody)
 	}
-	db = dynamo.New(sesh, cfg)
+	db = dynamoDB{dynamo.New(sesh, cfg)}
 }
 
-func dynamoTable(name string) dynamo.Table {
-	return db.Table(dbPrefix + name)
+func dbTable(name string) table {
+	t := db.Table(dbPrefix + name)
+	if name == tableUsers && readCache != nil {
+		return usersTable{t}
+	}
+	return t
 }
 
 type createTabler interface {
 	CreateTable(*dynamo.CreateTable)
 }
 
+// CreateTables creates any tables that don't exist yet.
 func CreateTables(ctx context.Context) error {
-	log.Println("Checking DynamoDB tables... prefix =", dbPrefix)
+	return db.createTables(ctx)
+}
+
+// Ping checks that the database is reachable.
+func Ping(ctx context.Context) error {
+	return db.ping(ctx)
+}
+
+func (d dynamoDB) ping(ctx context.Context) error {
+	var u User
+	err := d.DB.Table(dbPrefix+tableUsers).Get("ID", 0).OneWithContext(ctx, &u)
+	if err == dynamo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (d dynamoDB) createTables(ctx context.Context) error {
+	slog.InfoContext(ctx, "Checking DynamoDB tables...", "prefix", dbPrefix)
 
 	grp, ctx := errgroup.WithContext(ctx)
 	for name, model := range dynamoTables {
-		name := dynamoTable(name).Name()
+		name := dbPrefix + name
 		model := model
 
-		if _, err := db.Table(name).Describe().RunWithContext(ctx); err == nil {
+		if desc, err := d.DB.Table(name).Describe().RunWithContext(ctx); err == nil {
+			grp.Go(func() error {
+				return d.addIndexes(ctx, name, model, desc)
+			})
 			continue
 		}
 
-		log.Println("Creating table:", name)
+		slog.InfoContext(ctx, "Creating table", "table", name)
 		grp.Go(func() error {
-			create := db.CreateTable(name, model).OnDemand(true)
+			create := d.DB.CreateTable(name, model).OnDemand(true)
 			if custom, ok := model.(createTabler); ok {
 				custom.CreateTable(create)
 			}
@@ -94,6 +143,76 @@ func CreateTables(ctx context.Context) error {
 	return grp.Wait()
 }
 
+// addIndexes creates the global secondary indexes an existing table is missing.
+// DynamoDB only builds one new index on a table at a time, so any others are made on a later start.
+func (d dynamoDB) addIndexes(ctx context.Context, name string, model any, desc dynamo.Description) error {
+	// the same struct tags describe indexes for every database
+	schema, err := sqlSchemaOf(name, model)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(desc.GSI))
+	for _, idx := range desc.GSI {
+		have[idx.Name] = true
+	}
+	var missing []string
+	for idxName := range schema.indexes {
+		if !have[idxName] {
+			missing = append(missing, idxName)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	if desc.Status != dynamo.ActiveStatus {
+		slog.InfoContext(ctx, "Table is busy, not creating indexes yet", "table", name, "indexes", missing)
+		return nil
+	}
+
+	idx := schema.indexes[missing[0]]
+	index := dynamo.Index{
+		Name:           missing[0],
+		HashKey:        idx.hash,
+		HashKeyType:    keyTypeOf(model, idx.hash),
+		ProjectionType: dynamo.AllProjection,
+	}
+	if idx.rng != "" {
+		index.RangeKey = idx.rng
+		index.RangeKeyType = keyTypeOf(model, idx.rng)
+	}
+	slog.InfoContext(ctx, "Creating index", "table", name, "index", index.Name, "later", missing[1:])
+	_, err = d.DB.Table(name).UpdateTable().CreateIndex(index).RunWithContext(ctx)
+	return err
+}
+
+// keyTypeOf returns the DynamoDB type of model's attribute attr.
+func keyTypeOf(model any, attr string) dynamo.KeyType {
+	rt := reflect.TypeOf(model)
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("dynamo"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		if name != attr {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return dynamo.NumberType
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.Uint8 {
+				return dynamo.BinaryType
+			}
+		}
+	}
+	// strings, and times which are stored as strings
+	return dynamo.StringType
+}
+
 type counter struct {
 	ID    string `dynamo:",hash"`
 	Count int
@@ -102,8 +221,8 @@ type counter struct {
 func NextID(ctx context.Context, class string) (n int, err error) {
 	var ct counter
 
-	table := dynamoTable("Counters")
-	err = table.Update("ID", class).Add("Count", 1).Value(&ct)
+	table := dbTable("Counters")
+	err = table.Update("ID", class).Add("Count", 1).ValueWithContext(ctx, &ct)
 	return ct.Count, err
 }
 
@@ -0,0 +1,87 @@
+package tube
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// maxDevices is how many recently used devices are remembered per user.
+const maxDevices = 20
+
+func NewDeviceID() (string, error) {
+	return randomString(16)
+}
+
+func (u User) KnownDevice(id string) bool {
+	_, ok := u.Devices[id]
+	return ok
+}
+
+func (u User) KnownCountry(country string) bool {
+	for _, cc := range u.Countries {
+		if cc == country {
+			return true
+		}
+	}
+	return false
+}
+
+// AddDevice records a login from the given device and country (empty if unknown).
+func (u *User) AddDevice(ctx context.Context, id, country string, at time.Time) error {
+	devices := make(map[string]time.Time, len(u.Devices)+1)
+	for k, v := range u.Devices {
+		devices[k] = v
+	}
+	devices[id] = at.UTC()
+	if len(devices) > maxDevices {
+		ids := make([]string, 0, len(devices))
+		for k := range devices {
+			ids = append(ids, k)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return devices[ids[i]].Before(devices[ids[j]])
+		})
+		for _, k := range ids[:len(ids)-maxDevices] {
+			delete(devices, k)
+		}
+	}
+
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).Set("Devices", devices)
+	if country != "" {
+		update.AddStringsToSet("Countries", country)
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
+// SetRevokeCode generates a code for the "this wasn't me" link in login alerts.
+func (u *User) SetRevokeCode(ctx context.Context) error {
+	code, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	users := dbTable(tableUsers)
+	return users.Update("ID", u.ID).
+		Set("RevokeCode", code).
+		ValueWithContext(ctx, u)
+}
+
+// RevokeAccess signs the user out everywhere, unpairs their devices, and starts a password reset.
+func (u *User) RevokeAccess(ctx context.Context) error {
+	if err := DeleteUserSessions(ctx, u.ID); err != nil {
+		return err
+	}
+	if err := DeleteDeviceTokens(ctx, u.ID); err != nil {
+		return err
+	}
+	code, err := randomString(69)
+	if err != nil {
+		return err
+	}
+	users := dbTable(tableUsers)
+	return users.Update("ID", u.ID).
+		Set("Recovery", code).
+		Remove("RevokeCode", "Devices").
+		ValueWithContext(ctx, u)
+}
@@ -5,7 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"sort"
 	"time"
 
@@ -41,11 +41,11 @@ func (d Dump) save(ctx context.Context) error {
 		return err
 	}
 	r := bytes.NewReader(buf.Bytes())
-	return storage.CacheBucket.Put("application/json", d.Key(), r)
+	return storage.WithContext(ctx, storage.CacheBucket).Put("application/json", d.Key(), r)
 }
 
 func (d Dump) encache() {
-	log.Println("dump encache", d.Key())
+	slog.Debug("dump: encache", "key", d.Key())
 	dumpCache.Set(d.Key(), d, 5*time.Minute)
 }
 
@@ -74,13 +74,13 @@ func (d *Dump) Splice(tracks []Track) {
 		}
 		d.Tracks[i] = up
 		delete(update, t.ID)
-		log.Println("spliced", d.UserID, up)
+		slog.Debug("dump: spliced", "user_id", d.UserID, "track", up.ID)
 	}
 	// new tracks
 	for _, t := range update {
 		d.Tracks = append(d.Tracks, t)
 		d.sort()
-		log.Println("added", d.UserID, t)
+		slog.Debug("dump: added", "user_id", d.UserID, "track", t.ID)
 	}
 }
 
@@ -89,7 +89,7 @@ func (d *Dump) Remove(trackID string) {
 	for _, t := range d.Tracks {
 		if t.ID != trackID {
 			tracks = append(tracks, t)
-			log.Println("removed", d.UserID, trackID)
+			slog.Debug("dump: removed", "user_id", d.UserID, "track", trackID)
 		}
 	}
 	d.Tracks = tracks
@@ -100,10 +100,13 @@ func RefreshDump(ctx context.Context, userID int, at time.Time, updates []Track,
 	if err != nil {
 		return err
 	}
+	if u.Deleting() {
+		return nil
+	}
 
 	d, err := u.GetDump()
 	if err != nil {
-		log.Println("RefreshDump GetDump error:", err)
+		slog.WarnContext(ctx, "dump: recreating", "user_id", userID, "err", err)
 		return RecreateDump(ctx, userID, at)
 	}
 
@@ -120,6 +123,9 @@ func RecreateDump(ctx context.Context, userID int, at time.Time) error {
 	if err != nil {
 		return err
 	}
+	if u.Deleting() {
+		return nil
+	}
 
 	// TODO: need to check if it's an actual unexpected error or just a new dump...
 	tracks, err := GetTracks(ctx, userID)
@@ -140,7 +146,7 @@ func (u User) SaveDump(ctx context.Context, d Dump) error {
 	// only save if we 'win' the race
 	err := u.UpdateLastDump(ctx, d.Time)
 	if dynamo.IsCondCheckFailed(err) {
-		log.Println("dump is stale:", err)
+		slog.DebugContext(ctx, "dump: stale", "user_id", d.UserID, "err", err)
 		// stale
 		return nil
 	}
@@ -148,7 +154,7 @@ func (u User) SaveDump(ctx context.Context, d Dump) error {
 		return err
 	}
 	// kewl
-	log.Println("saving new dump...", d.UserID, d.Time, len(d.Tracks))
+	slog.DebugContext(ctx, "dump: saving", "user_id", d.UserID, "time", d.Time, "tracks", len(d.Tracks))
 	return d.save(ctx)
 }
 
@@ -159,10 +165,10 @@ func (u User) GetDump() (Dump, error) {
 	if item := dumpCache.Get(key); item != nil {
 		d := item.Value().(Dump)
 		if d.stale(u.LastDump) {
-			log.Println("stale dumppp")
+			slog.Debug("dump: cached copy is stale", "user_id", u.ID)
 			dumpCache.Delete(key)
 		} else {
-			log.Println("got dump from cache", u.ID)
+			slog.Debug("dump: got from cache", "user_id", u.ID)
 			return item.Value().(Dump), nil
 		}
 	}
@@ -0,0 +1,70 @@
+package tube
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+// Egress is how much a user downloads, counted by calendar month (in UTC).
+// Only what's actually sent counts, so a stream that's stopped halfway counts half the file.
+
+func egressMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// EgressUsed returns how many bytes were downloaded in the month of now.
+func (u User) EgressUsed(now time.Time) int64 {
+	if u.EgressMonth != egressMonth(now) {
+		return 0
+	}
+	return u.Egress
+}
+
+// EgressCap returns the user's monthly download allowance in bytes, or 0 if it's unlimited.
+func (u User) EgressCap() int64 {
+	return GetPlan(u.Plan).EgressCap
+}
+
+// EgressCapped reports whether the user has used up this month's download allowance.
+func (u User) EgressCapped(now time.Time) bool {
+	limit := u.EgressCap()
+	return limit > 0 && u.EgressUsed(now) >= limit
+}
+
+// EgressResets returns when the download allowance starts over: the beginning of next month.
+func EgressResets(now time.Time) time.Time {
+	y, m, _ := now.UTC().Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// AddEgress counts n more bytes downloaded, starting the count over in a new month.
+func (u *User) AddEgress(ctx context.Context, now time.Time, n int64) error {
+	month := egressMonth(now)
+	add := func() error {
+		users := dbTable(tableUsers)
+		return users.Update("ID", u.ID).
+			Add("Egress", n).
+			If("'EgressMonth' = ?", month).
+			ValueWithContext(ctx, u)
+	}
+	err := add()
+	if !dynamo.IsCondCheckFailed(err) {
+		return err
+	}
+
+	// first download this month
+	users := dbTable(tableUsers)
+	err = users.Update("ID", u.ID).
+		Set("Egress", n).
+		Set("EgressMonth", month).
+		If("attribute_exists('ID')").
+		If("attribute_not_exists('EgressMonth') OR 'EgressMonth' <> ?", month).
+		ValueWithContext(ctx, u)
+	if dynamo.IsCondCheckFailed(err) {
+		// another download beat us to it
+		return add()
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package tube
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testDB sets up a fresh SQLite database for the test.
+func testDB(t *testing.T) context.Context {
+	t.Helper()
+	if err := InitSQL("sqlite", filepath.Join(t.TempDir(), "tube.db"), "Test-"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := CreateTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// testUser creates a user for the test.
+func testUser(t *testing.T, ctx context.Context) User {
+	t.Helper()
+	u := User{Email: "test@example.com"}
+	if err := u.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAddEgress(t *testing.T) {
+	ctx := testDB(t)
+	u := testUser(t, ctx)
+
+	oct := time.Date(2026, time.October, 31, 23, 0, 0, 0, time.UTC)
+	nov := oct.Add(2 * time.Hour)
+
+	if err := u.AddEgress(ctx, oct, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddEgress(ctx, oct, 50); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.EgressUsed(oct); got != 150 {
+		t.Errorf("used in October: %d, want 150", got)
+	}
+
+	// a new month starts over
+	if err := u.AddEgress(ctx, nov, 10); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.EgressUsed(nov); got != 10 {
+		t.Errorf("used in November: %d, want 10", got)
+	}
+	if got := u.EgressUsed(oct); got != 0 {
+		t.Errorf("October after November started: %d, want 0", got)
+	}
+
+	// a stale copy of the user still adds to the current month
+	stale := u
+	stale.Egress, stale.EgressMonth = 0, ""
+	if err := stale.AddEgress(ctx, nov, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := stale.EgressUsed(nov); got != 15 {
+		t.Errorf("used after stale add: %d, want 15", got)
+	}
+}
+
+func TestEgressCapped(t *testing.T) {
+	now := time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+	month := egressMonth(now)
+	if err := SetPlanEgressCap(PlanKindNone, 1000); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPlanEgressCap(PlanKindNone, 0) })
+
+	tests := []struct {
+		egress int64
+		month  string
+		capped bool
+	}{
+		{0, "", false},
+		{999, month, false},
+		{1000, month, true},
+		// last month's downloads don't count
+		{5000, "2026-09", false},
+	}
+	for _, test := range tests {
+		u := User{Egress: test.egress, EgressMonth: test.month}
+		if got := u.EgressCapped(now); got != test.capped {
+			t.Errorf("EgressCapped with %d in %q: %v, want %v", test.egress, test.month, got, test.capped)
+		}
+	}
+	if got := EgressResets(now); !got.Equal(time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("EgressResets: %v", got)
+	}
+}
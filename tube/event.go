@@ -2,24 +2,117 @@ package tube
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
 	"strconv"
 	"time"
+
+	"github.com/guregu/dynamo"
 )
 
+const tableEvents = "Events"
+
+// Event is an entry in the append-only audit log.
 type Event struct {
-	UserID int
-	Time   Timegarb
-	Kind   EventKind
+	UserID int       `dynamo:",hash"`
+	Time   Timegarb  `dynamo:",range" index:"Kind-Time-index,range"`
+	Kind   EventKind `index:"Kind-Time-index,hash"`
+
+	Actor  int    `dynamo:",omitempty"` // admin acting on behalf of UserID, if any
+	IP     string `dynamo:",omitempty"`
+	Detail string `dynamo:",omitempty"`
 }
 
 type EventKind string
 
 const (
 	EventPaid EventKind = "paid"
+
+	EventRegister           EventKind = "register"
+	EventLogin              EventKind = "login"
+	EventLoginFailed        EventKind = "login_failed"
+	EventLogout             EventKind = "logout"
+	EventTokenCreated       EventKind = "token_created"
+	EventTokenRevoked       EventKind = "token_revoked"
+	EventPasswordChanged    EventKind = "password_changed"
+	EventPasswordReset      EventKind = "password_reset"
+	EventEmailChanged       EventKind = "email_changed"
+	EventTrackDeleted       EventKind = "track_deleted"
+	EventPlanChanged        EventKind = "plan_changed"
+	EventImpersonationStart EventKind = "impersonation_start"
+	EventImpersonationStop  EventKind = "impersonation_stop"
+	EventAdminAction        EventKind = "admin"
+	EventExportRequested    EventKind = "export"
+	EventAccountDeleted     EventKind = "account_deleted"
+	EventReferralCredited   EventKind = "referral_credited"
+	EventGiftPurchased      EventKind = "gift_purchased"
+	EventGiftRedeemed       EventKind = "gift_redeemed"
+	EventRestrictionsSet    EventKind = "restrictions_set"
+	EventNewDevice          EventKind = "new_device"
+	EventSessionsRevoked    EventKind = "sessions_revoked"
+	EventEncryptionSet      EventKind = "encryption_set"
 )
 
+// RecordEvent appends an event to the audit log. Events are never modified.
+func RecordEvent(ctx context.Context, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = NewTimegarb(time.Now())
+	}
+	table := dbTable(tableEvents)
+	return table.Put(e).If("attribute_not_exists('UserID')").RunWithContext(ctx)
+}
+
+// GetEvents returns a user's events, newest first.
+func GetEvents(ctx context.Context, userID int, limit int64, startFrom dynamo.PagingKey) ([]Event, dynamo.PagingKey, error) {
+	table := dbTable(tableEvents)
+	q := table.Get("UserID", userID).Order(dynamo.Descending)
+	if limit > 0 {
+		q.SearchLimit(limit)
+	}
+	if startFrom != nil {
+		q.StartFrom(startFrom)
+	}
+	var events []Event
+	next, err := q.AllWithLastEvaluatedKeyContext(ctx, &events)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return events, next, err
+}
+
+// GetEventsByKind returns events of the given kind since the given time, newest first.
+func GetEventsByKind(ctx context.Context, kind EventKind, since time.Time, limit int64) ([]Event, error) {
+	table := dbTable(tableEvents)
+	q := table.Get("Kind", kind).
+		Index("Kind-Time-index").
+		Range("Time", dynamo.GreaterOrEqual, since.UTC().Format(time.RFC3339Nano)).
+		Order(dynamo.Descending)
+	if limit > 0 {
+		q.Limit(limit)
+	}
+	var events []Event
+	err := q.AllWithContext(ctx, &events)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return events, err
+}
+
+// GetEventsSince returns a user's events of the given kind after since, oldest first.
+func GetEventsSince(ctx context.Context, userID int, kind EventKind, since time.Time) ([]Event, error) {
+	table := dbTable(tableEvents)
+	var events []Event
+	err := table.Get("UserID", userID).
+		Range("Time", dynamo.Greater, since.UTC().Format(time.RFC3339Nano)).
+		Filter("'Kind' = ?", kind).
+		AllWithContext(ctx, &events)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return events, err
+}
+
 type Timegarb struct {
 	time.Time
 	Garb string
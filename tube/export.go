@@ -0,0 +1,194 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/guregu/intertube/storage"
+)
+
+const (
+	tableExports = "Exports"
+
+	// ExportTTL is how long finished export archives are kept around.
+	ExportTTL = 7 * 24 * time.Hour
+	// DownloadTTL is how long album and playlist downloads are kept around.
+	DownloadTTL = 24 * time.Hour
+)
+
+type ExportKind string
+
+const (
+	ExportTakeout ExportKind = "takeout"
+	// ExportArchive is every original file plus a manifest, split into parts of a manageable size.
+	ExportArchive ExportKind = "archive"
+	// ExportAlbum and ExportPlaylist are downloads of one album or playlist's audio.
+	ExportAlbum    ExportKind = "album"
+	ExportPlaylist ExportKind = "playlist"
+)
+
+// IsDownload reports whether this kind is a download of part of the library, instead of all of it.
+func (k ExportKind) IsDownload() bool {
+	return k == ExportAlbum || k == ExportPlaylist
+}
+
+type ExportStatus string
+
+const (
+	ExportPending ExportStatus = "pending"
+	ExportRunning ExportStatus = "running"
+	ExportDone    ExportStatus = "done"
+	ExportFailed  ExportStatus = "failed"
+)
+
+// Export is a user-requested archive of their data, built in the background.
+type Export struct {
+	UserID int    `dynamo:",hash"`
+	ID     string `dynamo:",range"`
+
+	Kind   ExportKind
+	Status ExportStatus
+	Audio  bool // include audio files in addition to metadata
+
+	// for downloads: the album (as in Subsonic album IDs) or playlist ID, and its name
+	Target string `dynamo:",omitempty"`
+	Name   string `dynamo:",omitempty"`
+
+	Keys  []string     `dynamo:",omitempty"` // storage keys of finished archives
+	Parts []ExportPart `dynamo:",omitempty"`
+	Size  int64
+	Error string `dynamo:",omitempty"`
+
+	Created  time.Time
+	Finished time.Time `dynamo:",omitempty"`
+	Expires  time.Time `dynamo:",omitempty"`
+}
+
+// ExportPart is one finished archive of an export.
+type ExportPart struct {
+	Key    string `json:"-"`
+	Size   int64
+	SHA256 string // hex, to check resumed downloads
+}
+
+func NewExport(userID int, kind ExportKind) Export {
+	now := time.Now().UTC()
+	garb, err := randomString(6)
+	if err != nil {
+		panic(err)
+	}
+	return Export{
+		UserID:  userID,
+		ID:      strconv.FormatInt(now.UnixNano(), 36) + "-" + garb,
+		Kind:    kind,
+		Status:  ExportPending,
+		Created: now,
+	}
+}
+
+func (ex *Export) Create(ctx context.Context) error {
+	if ex.ID == "" {
+		return fmt.Errorf("export: missing ID")
+	}
+	table := dbTable(tableExports)
+	return table.Put(ex).If("attribute_not_exists('ID')").RunWithContext(ctx)
+}
+
+func (ex *Export) SetRunning(ctx context.Context) error {
+	table := dbTable(tableExports)
+	return table.Update("UserID", ex.UserID).Range("ID", ex.ID).
+		Set("Status", ExportRunning).
+		ValueWithContext(ctx, ex)
+}
+
+func (ex *Export) Finish(ctx context.Context, parts []ExportPart) error {
+	now := time.Now().UTC()
+	ttl := ExportTTL
+	if ex.Kind.IsDownload() {
+		ttl = DownloadTTL
+	}
+	keys := make([]string, 0, len(parts))
+	var size int64
+	for _, part := range parts {
+		keys = append(keys, part.Key)
+		size += part.Size
+	}
+	table := dbTable(tableExports)
+	return table.Update("UserID", ex.UserID).Range("ID", ex.ID).
+		Set("Status", ExportDone).
+		Set("Keys", keys).
+		Set("Parts", parts).
+		Set("Size", size).
+		Set("Finished", now).
+		Set("Expires", now.Add(ttl)).
+		ValueWithContext(ctx, ex)
+}
+
+func (ex *Export) Fail(ctx context.Context, cause error) error {
+	table := dbTable(tableExports)
+	return table.Update("UserID", ex.UserID).Range("ID", ex.ID).
+		Set("Status", ExportFailed).
+		Set("Error", cause.Error()).
+		Set("Finished", time.Now().UTC()).
+		ValueWithContext(ctx, ex)
+}
+
+// Expired reports whether this export's archives are no longer available.
+func (ex Export) Expired() bool {
+	return !ex.Expires.IsZero() && time.Now().After(ex.Expires)
+}
+
+func GetExport(ctx context.Context, userID int, id string) (Export, error) {
+	table := dbTable(tableExports)
+	var ex Export
+	err := table.Get("UserID", userID).Range("ID", dynamo.Equal, id).OneWithContext(ctx, &ex)
+	return ex, err
+}
+
+// GetExports returns a user's exports, newest first.
+func GetExports(ctx context.Context, userID int) ([]Export, error) {
+	table := dbTable(tableExports)
+	var exs []Export
+	err := table.Get("UserID", userID).Order(dynamo.Descending).AllWithContext(ctx, &exs)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return exs, err
+}
+
+// ExpireExports deletes the archives of expired exports.
+// The exports themselves are kept, so users can see what happened to them.
+func ExpireExports(ctx context.Context) error {
+	table := dbTable(tableExports)
+	iter := table.Scan().
+		Filter("'Expires' < ? AND attribute_exists('Keys')", time.Now().UTC()).
+		Iter()
+	var ex Export
+	var n int
+	for iter.NextWithContext(ctx, &ex) {
+		for _, key := range ex.Keys {
+			if err := storage.FilesBucket.Delete(key); err != nil {
+				return fmt.Errorf("export %d/%s: deleting %s: %w", ex.UserID, ex.ID, key, err)
+			}
+		}
+		err := table.Update("UserID", ex.UserID).Range("ID", ex.ID).
+			Remove("Keys", "Parts").
+			RunWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		slog.InfoContext(ctx, "export: expired", "count", n)
+	}
+	return nil
+}
@@ -1,13 +1,14 @@
 package tube
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"path"
 	"strconv"
 	"time"
 
 	"github.com/guregu/dynamo"
-	"golang.org/x/net/context"
 	// "github.com/aws/aws-sdk-go/service/cloudfront/sign"
 )
 
@@ -48,10 +49,10 @@ func NewFile(userID int, filename string, size int64) File {
 }
 
 func (f File) Create(ctx context.Context) error {
-	files := dynamoTable("Files")
-	// users := dynamoTable("Users")
+	files := dbTable("Files")
+	// users := dbTable("Users")
 
-	err := files.Put(f).If("attribute_not_exists('ID')").Run()
+	err := files.Put(f).If("attribute_not_exists('ID')").RunWithContext(ctx)
 	return err
 
 	// do this in Track instead
@@ -61,11 +62,44 @@ func (f File) Create(ctx context.Context) error {
 	// 	Run()
 }
 
+// CreateFiles saves new files in batches, for bulk uploads.
+// If any can't be saved, it tries to delete all of them,
+// so a failed batch doesn't leave stalled uploads behind.
+func CreateFiles(ctx context.Context, files []File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	table := dbTable("Files")
+	items := make([]any, len(files))
+	keys := make([]dynamo.Keyed, len(files))
+	for i, f := range files {
+		items[i] = f
+		keys[i] = dynamo.Keys{f.ID}
+	}
+	wrote, err := table.Batch("ID").Write().Put(items...).RunWithContext(ctx)
+	if err == nil {
+		return nil
+	}
+	if wrote > 0 {
+		// the request might have timed out, but we can still clean up
+		cleanup, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if _, delErr := table.Batch("ID").Write().Delete(keys...).RunWithContext(cleanup); delErr != nil {
+			slog.ErrorContext(ctx, "Failed to clean up partial file batch", "wrote", wrote, "err", delErr)
+		}
+	}
+	return fmt.Errorf("creating files: %d of %d saved: %w", wrote, len(files), err)
+}
+
+// Finish records that f was uploaded, with the type and size storage reports,
+// and that processing it has started.
 func (f *File) Finish(ctx context.Context, contentType string, size int64) error {
-	files := dynamoTable("Files")
+	now := time.Now().UTC()
+	files := dbTable("Files")
 	err := files.Update("ID", f.ID).
 		Set("Ready", true).
-		Set("Finished", time.Now().UTC()).
+		Set("Started", now).
+		Set("Finished", now).
 		Set("Size", size).
 		Set("Type", contentType).
 		If("attribute_exists('ID')").
@@ -75,42 +109,28 @@ func (f *File) Finish(ctx context.Context, contentType string, size int64) error
 
 // dont use TODO delete
 func (f File) Delete(ctx context.Context) error {
-	files := dynamoTable("Files")
-	users := dynamoTable("Users")
+	files := dbTable("Files")
+	users := dbTable("Users")
 	// tx := db.WriteTx()
 	// tx.Delete(files.Delete("ID", f.ID))
 	err := files.Update("ID", f.ID).
 		Set("Deleted", true).
-		If("attribute_exists('ID')").Run()
+		If("attribute_exists('ID')").RunWithContext(ctx)
 	if err != nil {
 		return err
 	}
 	return users.Update("ID", f.UserID).
-		SetExpr("'Usage' = 'Usage' - ?", f.Size).
-		If("attribute_exists('ID')").Run()
-}
-
-func (f *File) SetTrackID(tID string) error {
-	files := dynamoTable("Files")
-	return files.Update("ID", f.ID).
-		Set("TrackID", tID).
-		Value(f)
+		Add("Usage", -f.Size).
+		If("attribute_exists('ID')").RunWithContext(ctx)
 }
 
 func (f *File) SetQueued(ctx context.Context, at time.Time) error {
-	files := dynamoTable("Files")
+	files := dbTable("Files")
 	return files.Update("ID", f.ID).
 		Set("Queued", at).
 		ValueWithContext(ctx, f)
 }
 
-func (f *File) SetStarted(ctx context.Context, at time.Time) error {
-	files := dynamoTable("Files")
-	return files.Update("ID", f.ID).
-		Set("Started", at).
-		ValueWithContext(ctx, f)
-}
-
 func (f File) Path() string {
 	return "up/" + f.ID
 }
@@ -128,6 +148,12 @@ func (f File) Status() string {
 	}
 }
 
+// Stalled reports whether this file never finished processing
+// despite being uploaded before cutoff.
+func (f File) Stalled(cutoff time.Time) bool {
+	return !f.Ready && !f.Deleted && f.Time.Before(cutoff)
+}
+
 func (f File) Glyph() string {
 	switch f.Type {
 	case "audio/mpeg", "audio/ogg", "audio/aac", "audio/opus", "audio/wave", "audio/wav",
@@ -148,9 +174,9 @@ func (f File) Glyph() string {
 }
 
 func GetFile(ctx context.Context, id string) (File, error) {
-	table := dynamoTable("Files")
+	table := dbTable("Files")
 	var f File
-	err := table.Get("ID", id).Consistent(true).One(&f)
+	err := table.Get("ID", id).Consistent(true).OneWithContext(ctx, &f)
 	return f, err
 }
 
@@ -158,7 +184,7 @@ func GetFiles(ctx context.Context, ids ...string) ([]File, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
-	table := dynamoTable("Files")
+	table := dbTable("Files")
 	var files []File
 	batch := table.Batch("ID").Get()
 	for _, id := range ids {
@@ -168,7 +194,7 @@ func GetFiles(ctx context.Context, ids ...string) ([]File, error) {
 	var f File
 	for iter.Next(&f) {
 		if f.Deleted {
-			fmt.Println("SKIPPING FILE", f)
+			slog.DebugContext(ctx, "skipping deleted file", "file", f.ID)
 			continue
 		}
 		files = append(files, f)
@@ -180,8 +206,8 @@ func GetFiles(ctx context.Context, ids ...string) ([]File, error) {
 	return files, err
 }
 
-func GetFilesByUser(ctx context.Context, userID string) ([]File, error) {
-	table := dynamoTable("Files")
+func GetFilesByUser(ctx context.Context, userID int) ([]File, error) {
+	table := dbTable("Files")
 	var files []File
 	err := table.Get("UserID", userID).
 		Index("UserID-ID-index").
@@ -193,3 +219,58 @@ func GetFilesByUser(ctx context.Context, userID string) ([]File, error) {
 	}
 	return files, err
 }
+
+// FileFilter narrows down a listing of files.
+type FileFilter string
+
+const (
+	FilesAll        FileFilter = ""
+	FilesUnfinished FileFilter = "unfinished" // not processed (yet)
+	FilesFailed     FileFilter = "failed"     // unfinished and uploaded before the cutoff, see Stalled
+)
+
+// Match reports whether f passes the filter.
+func (ff FileFilter) Match(f File, cutoff time.Time) bool {
+	switch ff {
+	case FilesUnfinished:
+		return !f.Ready
+	case FilesFailed:
+		return f.Stalled(cutoff)
+	}
+	return true
+}
+
+// GetFilesPage returns a page of a user's files, newest first.
+// Filtered pages can come back short or even empty while there's still a next page.
+func GetFilesPage(ctx context.Context, userID int, filter FileFilter, cutoff time.Time, limit int64, startFrom dynamo.PagingKey) ([]File, dynamo.PagingKey, error) {
+	table := dbTable("Files")
+	q := table.Get("UserID", userID).
+		Index("UserID-ID-index").
+		Filter("Deleted <> ?", true).
+		Order(dynamo.Descending)
+	switch filter {
+	case FilesUnfinished:
+		q.Filter("Ready <> ?", true)
+	case FilesFailed:
+		q.Filter("Ready <> ? AND 'Time' < ?", true, cutoff)
+	}
+	if limit > 0 {
+		q.SearchLimit(limit)
+	}
+	if startFrom != nil {
+		q.StartFrom(startFrom)
+	}
+	var files []File
+	next, err := q.AllWithLastEvaluatedKeyContext(ctx, &files)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return files, next, err
+}
+
+func GetAllFiles(ctx context.Context) ([]File, error) {
+	table := dbTable("Files")
+	var files []File
+	err := table.Scan().Filter("Deleted <> ?", true).AllWithContext(ctx, &files)
+	return files, err
+}
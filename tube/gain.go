@@ -0,0 +1,21 @@
+package tube
+
+// ReplayGain is loudness normalization data from a track's tags.
+// Gains are in dB, relative to ReplayGain 2.0's reference of -18 LUFS.
+// Peaks are linear, where 1 is full scale.
+type ReplayGain struct {
+	TrackGain float64
+	TrackPeak float64 `dynamo:",omitempty"`
+	AlbumGain float64 `dynamo:",omitempty"`
+	AlbumPeak float64 `dynamo:",omitempty"`
+	// AlbumGain is set; it could legitimately be 0 dB
+	HasAlbum bool `dynamo:",omitempty"`
+}
+
+type LoudnessOpt string
+
+const (
+	LoudnessOff   LoudnessOpt = ""
+	LoudnessTrack LoudnessOpt = "track" // every track equally loud, good for shuffling
+	LoudnessAlbum LoudnessOpt = "album" // keep the differences between tracks of an album
+)
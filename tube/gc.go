@@ -0,0 +1,218 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/guregu/intertube/storage"
+)
+
+// DeleteOrphans makes the scheduled garbage collection delete orphaned objects.
+// Otherwise, it only reports them.
+var DeleteOrphans bool
+
+// orphanGrace is how old an object must be before it's considered orphaned,
+// so uploads and tracks that are still being processed are left alone.
+const orphanGrace = 24 * time.Hour
+
+// GCReport describes stored objects and records that don't match up.
+type GCReport struct {
+	DryRun bool
+	// objects with no live record, deleted unless this is a dry run
+	Orphans []string
+	Bytes   int64
+	// records whose object is missing, which are only reported
+	MissingTracks []string
+	MissingFiles  []string
+	// uploads that never finished processing, discarded unless this is a dry run
+	FailedUploads []string
+}
+
+func (r GCReport) String() string {
+	verb := "deleted"
+	if r.DryRun {
+		verb = "would delete"
+	}
+	return fmt.Sprintf("%s %d orphaned object(s) (%d bytes) and %d failed upload(s), %d track(s) and %d upload(s) missing their object",
+		verb, len(r.Orphans), r.Bytes, len(r.FailedUploads), len(r.MissingTracks), len(r.MissingFiles))
+}
+
+// CollectGarbage cross-checks the files and uploads buckets against the database.
+// Track audio and album art (and its thumbnails) with no track, even in the trash,
+// and uploads with no live file, are orphans.
+// Objects newer than a day, or whose age the backend can't tell us, are skipped.
+// Uploads that still haven't been processed after a day have failed, and are discarded;
+// their owners get a notification.
+func CollectGarbage(ctx context.Context, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-orphanGrace)
+
+	tracks := make(map[string]struct{})
+	pics := make(map[string]struct{})
+	picIDs := make(map[string]struct{})
+	iter := GetALLTracks(ctx)
+	var t Track
+	for iter.NextWithContext(ctx, &t) {
+		tracks[t.StorageKey()] = struct{}{}
+		if t.Picture.ID != "" {
+			pics[t.Picture.StorageKey()] = struct{}{}
+			picIDs[t.Picture.ID] = struct{}{}
+		}
+		t = Track{}
+	}
+	if err := iter.Err(); err != nil {
+		return report, err
+	}
+	// trashed tracks can still be restored, so their audio and art are live too
+	trashed := make(map[string]struct{})
+	iter = dbTable(tableTrash).Scan().Iter()
+	var tt TrashedTrack
+	for iter.NextWithContext(ctx, &tt) {
+		if strings.HasPrefix(tt.Key, "trash/") {
+			trashed[tt.Key] = struct{}{}
+		} else {
+			tracks[tt.Key] = struct{}{}
+		}
+		if tt.Track.Picture.ID != "" {
+			pics[tt.Track.Picture.StorageKey()] = struct{}{}
+			picIDs[tt.Track.Picture.ID] = struct{}{}
+		}
+		tt = TrashedTrack{}
+	}
+	if err := iter.Err(); err != nil {
+		return report, err
+	}
+
+	files, err := GetAllFiles(ctx)
+	if err != nil {
+		return report, err
+	}
+	uploads := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		uploads[f.Path()] = struct{}{}
+	}
+
+	for _, scan := range []struct {
+		bucket storage.Bucket
+		prefix string
+		live   map[string]struct{}
+	}{
+		{storage.FilesBucket, "u/tracks/", tracks},
+		{storage.FilesBucket, "pic/", pics},
+		{storage.FilesBucket, "trash/", trashed},
+		{storage.UploadsBucket, "up/", uploads},
+	} {
+		objs, err := scan.bucket.List(scan.prefix)
+		if err != nil {
+			return report, fmt.Errorf("listing %s: %w", scan.prefix, err)
+		}
+		for key, info := range objs {
+			if _, ok := scan.live[key]; ok {
+				// whatever's left over afterwards has no object
+				delete(scan.live, key)
+				continue
+			}
+			if id, ok := thumbPictureID(key); ok {
+				if _, live := picIDs[id]; live {
+					continue
+				}
+			}
+			if info.Modified.IsZero() || info.Modified.After(cutoff) {
+				continue
+			}
+			if !dryRun {
+				if err := scan.bucket.Delete(key); err != nil {
+					return report, fmt.Errorf("deleting %s: %w", key, err)
+				}
+			}
+			report.Orphans = append(report.Orphans, key)
+			report.Bytes += info.Size
+		}
+	}
+
+	for key := range tracks {
+		report.MissingTracks = append(report.MissingTracks, key)
+	}
+	for _, f := range files {
+		if _, ok := uploads[f.Path()]; !ok {
+			continue
+		}
+		// processed uploads may be cleaned up by a bucket lifecycle rule
+		if f.Ready || f.Time.After(cutoff) {
+			continue
+		}
+		report.MissingFiles = append(report.MissingFiles, f.Path())
+	}
+
+	failed := make(map[int]int)
+	for _, f := range files {
+		if !f.Stalled(cutoff) {
+			continue
+		}
+		if !dryRun {
+			err := discardUpload(ctx, f)
+			if dynamo.IsCondCheckFailed(err) {
+				// finished processing after all
+				continue
+			}
+			if err != nil {
+				return report, fmt.Errorf("discarding %s: %w", f.Path(), err)
+			}
+		}
+		report.FailedUploads = append(report.FailedUploads, f.Path())
+		failed[f.UserID]++
+	}
+	if !dryRun {
+		for userID, n := range failed {
+			note, err := NewNotification(userID, "gc", "notification_gc", strconv.Itoa(n))
+			if err == nil {
+				note.Link = "/upload"
+				err = note.Create(ctx)
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "gc: failed to notify", "user_id", userID, "err", err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// discardUpload deletes a failed upload's object and marks its file deleted.
+// Unlike File.Delete, usage is left alone, because it only counts processed tracks.
+func discardUpload(ctx context.Context, f File) error {
+	files := dbTable("Files")
+	err := files.Update("ID", f.ID).
+		Set("Deleted", true).
+		If("attribute_exists('ID') AND 'Ready' <> ?", true).
+		RunWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	return storage.UploadsBucket.Delete(f.Path())
+}
+
+// CollectGarbageJob is the scheduled garbage collection.
+// It only deletes orphans if DeleteOrphans is set.
+func CollectGarbageJob(ctx context.Context) error {
+	report, err := CollectGarbage(ctx, !DeleteOrphans)
+	if err != nil {
+		return err
+	}
+	for _, key := range report.Orphans {
+		slog.InfoContext(ctx, "gc: orphan", "key", key)
+	}
+	for _, key := range report.FailedUploads {
+		slog.InfoContext(ctx, "gc: failed upload", "key", key)
+	}
+	for _, key := range append(report.MissingTracks, report.MissingFiles...) {
+		slog.WarnContext(ctx, "gc: missing", "key", key)
+	}
+	slog.InfoContext(ctx, "gc: done", "report", report)
+	return nil
+}
@@ -0,0 +1,86 @@
+package tube
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+const (
+	tableGifts = "Gifts"
+
+	GiftMaxMonths = 12
+)
+
+// Gift is a prepaid code redeemable for some months of a plan.
+type Gift struct {
+	Code      string `dynamo:",hash"`
+	Plan      PlanKind
+	Months    int
+	Buyer     int
+	SessionID string `index:"SessionID-index,hash"` // stripe checkout session
+	Created   time.Time
+
+	Redeemed   time.Time `dynamo:",omitempty"`
+	RedeemedBy int       `dynamo:",omitempty"`
+}
+
+func NewGift(buyer int, plan PlanKind, months int, sessionID string) (Gift, error) {
+	code := make([]byte, 10)
+	if _, err := rand.Read(code); err != nil {
+		return Gift{}, err
+	}
+	return Gift{
+		Code:      base32.StdEncoding.EncodeToString(code),
+		Plan:      plan,
+		Months:    months,
+		Buyer:     buyer,
+		SessionID: sessionID,
+		Created:   time.Now().UTC(),
+	}, nil
+}
+
+func (g Gift) Create(ctx context.Context) error {
+	table := dbTable(tableGifts)
+	return table.Put(g).If("attribute_not_exists('Code')").RunWithContext(ctx)
+}
+
+// Redeem claims the gift for userID. Returns a conditional check error if already claimed.
+func (g *Gift) Redeem(ctx context.Context, userID int) error {
+	table := dbTable(tableGifts)
+	return table.Update("Code", g.Code).
+		Set("Redeemed", time.Now().UTC()).
+		Set("RedeemedBy", userID).
+		If("attribute_exists('Code') AND attribute_not_exists('Redeemed')").
+		ValueWithContext(ctx, g)
+}
+
+// Unredeem releases a claimed gift, for when applying it failed.
+func (g *Gift) Unredeem(ctx context.Context) error {
+	table := dbTable(tableGifts)
+	return table.Update("Code", g.Code).
+		Remove("Redeemed").
+		Remove("RedeemedBy").
+		ValueWithContext(ctx, g)
+}
+
+func (g Gift) IsRedeemed() bool {
+	return !g.Redeemed.IsZero()
+}
+
+func GetGift(ctx context.Context, code string) (Gift, error) {
+	code = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	table := dbTable(tableGifts)
+	var g Gift
+	err := table.Get("Code", code).Consistent(true).OneWithContext(ctx, &g)
+	return g, err
+}
+
+func GetGiftBySession(ctx context.Context, sessionID string) (Gift, error) {
+	table := dbTable(tableGifts)
+	var g Gift
+	err := table.Get("SessionID", sessionID).Index("SessionID-index").OneWithContext(ctx, &g)
+	return g, err
+}
@@ -0,0 +1,100 @@
+package tube
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+const tableInvites = "Invites"
+
+// Invite is a registration code for invite-only mode.
+type Invite struct {
+	Code      string `dynamo:",hash"`
+	CreatedBy int
+	Created   time.Time
+	Note      string `dynamo:",omitempty"`
+
+	MaxUses int // 0 = unlimited
+	Uses    int
+	UsedBy  []int     `dynamo:",set"`
+	Expires time.Time `dynamo:",omitempty"`
+}
+
+func NewInvite(createdBy int, maxUses int, expires time.Time, note string) (Invite, error) {
+	code := make([]byte, 5)
+	if _, err := rand.Read(code); err != nil {
+		return Invite{}, err
+	}
+	return Invite{
+		Code:      base32.StdEncoding.EncodeToString(code),
+		CreatedBy: createdBy,
+		Created:   time.Now().UTC(),
+		Note:      note,
+		MaxUses:   maxUses,
+		Expires:   expires,
+	}, nil
+}
+
+func (inv Invite) Create(ctx context.Context) error {
+	table := dbTable(tableInvites)
+	return table.Put(inv).If("attribute_not_exists('Code')").RunWithContext(ctx)
+}
+
+// Valid reports whether this invite can still be redeemed.
+func (inv Invite) Valid(now time.Time) bool {
+	if !inv.Expires.IsZero() && !now.Before(inv.Expires) {
+		return false
+	}
+	return inv.MaxUses == 0 || inv.Uses < inv.MaxUses
+}
+
+// Redeem atomically uses up one slot of the invite.
+// Returns a conditional check error if the invite is expired or full.
+func (inv *Invite) Redeem(ctx context.Context) error {
+	now := time.Now().UTC()
+	table := dbTable(tableInvites)
+	return table.Update("Code", inv.Code).
+		Add("Uses", 1).
+		If("attribute_exists('Code')").
+		If("(MaxUses = ? OR Uses < MaxUses)", 0).
+		If("(attribute_not_exists('Expires') OR 'Expires' > ?)", now).
+		ValueWithContext(ctx, inv)
+}
+
+// AddUser records userID as having registered with this invite.
+func (inv *Invite) AddUser(ctx context.Context, userID int) error {
+	table := dbTable(tableInvites)
+	return table.Update("Code", inv.Code).
+		AddIntsToSet("UsedBy", userID).
+		ValueWithContext(ctx, inv)
+}
+
+func (inv *Invite) SetLimits(ctx context.Context, maxUses int, expires time.Time) error {
+	table := dbTable(tableInvites)
+	update := table.Update("Code", inv.Code).
+		Set("MaxUses", maxUses).
+		If("attribute_exists('Code')")
+	if expires.IsZero() {
+		update.Remove("Expires")
+	} else {
+		update.Set("Expires", expires)
+	}
+	return update.ValueWithContext(ctx, inv)
+}
+
+func GetInvite(ctx context.Context, code string) (Invite, error) {
+	table := dbTable(tableInvites)
+	var inv Invite
+	err := table.Get("Code", strings.ToUpper(strings.TrimSpace(code))).Consistent(true).OneWithContext(ctx, &inv)
+	return inv, err
+}
+
+func GetAllInvites(ctx context.Context) ([]Invite, error) {
+	table := dbTable(tableInvites)
+	var invs []Invite
+	err := table.Scan().AllWithContext(ctx, &invs)
+	return invs, err
+}
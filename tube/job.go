@@ -0,0 +1,168 @@
+package tube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+const tableJobs = "Jobs"
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a unit of background work. The queue only carries its key;
+// this record holds the payload and tracks its progress.
+// Jobs that don't belong to anyone have a UserID of 0.
+type Job struct {
+	UserID int    `dynamo:",hash"`
+	ID     string `dynamo:",range"`
+
+	Kind    string
+	Payload []byte `dynamo:",omitempty" json:"-"`
+	Status  JobStatus
+
+	Attempts int
+	Error    string `dynamo:",omitempty"` // from the last failed attempt
+
+	Created  time.Time
+	Updated  time.Time
+	RunAfter time.Time `dynamo:",omitempty"` // next retry
+}
+
+func NewJob(userID int, kind string, payload any) (Job, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	now := time.Now().UTC()
+	garb, err := randomString(6)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{
+		UserID:  userID,
+		ID:      strconv.FormatInt(now.UnixNano(), 36) + "-" + garb,
+		Kind:    kind,
+		Payload: raw,
+		Status:  JobQueued,
+		Created: now,
+		Updated: now,
+	}, nil
+}
+
+// Decode unmarshals the job's payload into v.
+func (j Job) Decode(v any) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Finished reports whether the job won't run again.
+func (j Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+func (j *Job) Create(ctx context.Context) error {
+	if j.ID == "" {
+		return fmt.Errorf("job: missing ID")
+	}
+	table := dbTable(tableJobs)
+	return table.Put(j).If("attribute_not_exists('ID')").RunWithContext(ctx)
+}
+
+// Start marks the job as running and counts the attempt.
+// It fails with a ConditionalCheckFailedException if the job is already finished,
+// so duplicate deliveries don't run it again.
+func (j *Job) Start(ctx context.Context) error {
+	table := dbTable(tableJobs)
+	return table.Update("UserID", j.UserID).Range("ID", j.ID).
+		Set("Status", JobRunning).
+		Set("Updated", time.Now().UTC()).
+		Add("Attempts", 1).
+		If("attribute_exists('ID') AND 'Status' <> ? AND 'Status' <> ?", JobDone, JobFailed).
+		ValueWithContext(ctx, j)
+}
+
+func (j *Job) Finish(ctx context.Context) error {
+	table := dbTable(tableJobs)
+	return table.Update("UserID", j.UserID).Range("ID", j.ID).
+		Set("Status", JobDone).
+		Set("Updated", time.Now().UTC()).
+		Remove("RunAfter").
+		ValueWithContext(ctx, j)
+}
+
+// Retry records a failed attempt that will be tried again at the given time.
+func (j *Job) Retry(ctx context.Context, cause error, at time.Time) error {
+	table := dbTable(tableJobs)
+	return table.Update("UserID", j.UserID).Range("ID", j.ID).
+		Set("Status", JobQueued).
+		Set("Error", cause.Error()).
+		Set("Updated", time.Now().UTC()).
+		Set("RunAfter", at.UTC()).
+		ValueWithContext(ctx, j)
+}
+
+// Fail gives up on the job.
+func (j *Job) Fail(ctx context.Context, cause error) error {
+	table := dbTable(tableJobs)
+	return table.Update("UserID", j.UserID).Range("ID", j.ID).
+		Set("Status", JobFailed).
+		Set("Error", cause.Error()).
+		Set("Updated", time.Now().UTC()).
+		Remove("RunAfter").
+		ValueWithContext(ctx, j)
+}
+
+// Requeue resets a failed job so it can be tried again from scratch.
+func (j *Job) Requeue(ctx context.Context) error {
+	table := dbTable(tableJobs)
+	return table.Update("UserID", j.UserID).Range("ID", j.ID).
+		Set("Status", JobQueued).
+		Set("Attempts", 0).
+		Set("Updated", time.Now().UTC()).
+		If("'Status' = ?", JobFailed).
+		ValueWithContext(ctx, j)
+}
+
+func GetJob(ctx context.Context, userID int, id string) (Job, error) {
+	table := dbTable(tableJobs)
+	var j Job
+	err := table.Get("UserID", userID).Range("ID", dynamo.Equal, id).Consistent(true).OneWithContext(ctx, &j)
+	return j, err
+}
+
+// GetJobs returns a user's jobs, newest first.
+func GetJobs(ctx context.Context, userID int, limit int64) ([]Job, error) {
+	table := dbTable(tableJobs)
+	var jobs []Job
+	q := table.Get("UserID", userID).Order(dynamo.Descending)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	err := q.AllWithContext(ctx, &jobs)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return jobs, err
+}
+
+// GetJobsByStatus scans every job with the given status.
+func GetJobsByStatus(ctx context.Context, status JobStatus) ([]Job, error) {
+	table := dbTable(tableJobs)
+	var jobs []Job
+	err := table.Scan().Filter("'Status' = ?", status).AllWithContext(ctx, &jobs)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return jobs, err
+}
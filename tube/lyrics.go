@@ -0,0 +1,73 @@
+package tube
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+const tableLyrics = "Lyrics"
+
+// LyricsRetry is how long to wait before looking for lyrics that weren't found last time.
+const LyricsRetry = 30 * 24 * time.Hour
+
+const (
+	LyricsEmbedded = "embedded" // from the file's tags
+	LyricsUser     = "user"     // written or corrected by the user
+)
+
+// Lyrics are the words to a track, kept apart from it since they can be long.
+// A Lyrics with no Source is a lookup that came up empty, saved so it isn't tried every time.
+type Lyrics struct {
+	UserID  int    `dynamo:",hash"`
+	TrackID string `dynamo:",range"`
+
+	Text string `dynamo:",omitempty"`
+	// Text is in LRC format, with timestamps
+	Synced       bool `dynamo:",omitempty"`
+	Instrumental bool `dynamo:",omitempty"`
+	// LyricsEmbedded, LyricsUser, or the name of the provider they were fetched from
+	Source  string `dynamo:",omitempty"`
+	Updated time.Time
+}
+
+// Found reports whether these are actual lyrics, not a failed lookup.
+func (l Lyrics) Found() bool {
+	return l.Source != ""
+}
+
+// Stale reports whether it's time to look again for lyrics that weren't found.
+func (l Lyrics) Stale(now time.Time) bool {
+	return !l.Found() && now.Sub(l.Updated) > LyricsRetry
+}
+
+func (l *Lyrics) Save(ctx context.Context) error {
+	l.Updated = time.Now().UTC()
+	table := dbTable(tableLyrics)
+	return table.Put(l).RunWithContext(ctx)
+}
+
+// SaveUnedited saves lyrics from tags or a provider, unless the user has written their own.
+// It reports whether they were saved.
+func (l *Lyrics) SaveUnedited(ctx context.Context) (bool, error) {
+	l.Updated = time.Now().UTC()
+	table := dbTable(tableLyrics)
+	err := table.Put(l).If("attribute_not_exists('Source') OR 'Source' <> ?", LyricsUser).RunWithContext(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func GetLyrics(ctx context.Context, userID int, trackID string) (Lyrics, error) {
+	table := dbTable(tableLyrics)
+	var l Lyrics
+	err := table.Get("UserID", userID).Range("TrackID", dynamo.Equal, trackID).OneWithContext(ctx, &l)
+	return l, err
+}
+
+func DeleteLyrics(ctx context.Context, userID int, trackID string) error {
+	table := dbTable(tableLyrics)
+	return table.Delete("UserID", userID).Range("TrackID", trackID).RunWithContext(ctx)
+}
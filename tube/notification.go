@@ -0,0 +1,80 @@
+package tube
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+const tableNotifications = "Notifications"
+
+// Notification tells a user how something running in the background turned out.
+type Notification struct {
+	UserID int    `dynamo:",hash"`
+	ID     string `dynamo:",range"`
+
+	Kind string
+	// Message is the ID of a translated string, filled in with Args
+	Message string
+	Args    []string `dynamo:",omitempty"`
+	// where to go to see more
+	Link string `dynamo:",omitempty"`
+
+	Created time.Time
+	Read    time.Time `dynamo:",omitempty"`
+}
+
+func NewNotification(userID int, kind, message string, args ...string) (Notification, error) {
+	now := time.Now().UTC()
+	garb, err := randomString(6)
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{
+		UserID:  userID,
+		ID:      strconv.FormatInt(now.UnixNano(), 36) + "-" + garb,
+		Kind:    kind,
+		Message: message,
+		Args:    args,
+		Created: now,
+	}, nil
+}
+
+func (n Notification) Create(ctx context.Context) error {
+	table := dbTable(tableNotifications)
+	return table.Put(n).If("attribute_not_exists('ID')").RunWithContext(ctx)
+}
+
+func (n Notification) Unread() bool {
+	return n.Read.IsZero()
+}
+
+// MarkRead marks the notification as read, if it isn't already.
+func (n *Notification) MarkRead(ctx context.Context, at time.Time) error {
+	table := dbTable(tableNotifications)
+	err := table.Update("UserID", n.UserID).Range("ID", n.ID).
+		Set("Read", at.UTC()).
+		If("attribute_exists('ID') AND attribute_not_exists('Read')").
+		ValueWithContext(ctx, n)
+	if dynamo.IsCondCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// GetNotifications returns the user's newest notifications, newest first.
+func GetNotifications(ctx context.Context, userID int, limit int64) ([]Notification, error) {
+	table := dbTable(tableNotifications)
+	var ns []Notification
+	q := table.Get("UserID", userID).Order(dynamo.Descending)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	err := q.AllWithContext(ctx, &ns)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return ns, err
+}
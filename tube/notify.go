@@ -0,0 +1,72 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+// EmailCategory is a kind of e-mail notification users can opt out of.
+type EmailCategory string
+
+const (
+	EmailQuota    EmailCategory = "quota"    // storage is nearly full
+	EmailImport   EmailCategory = "import"   // queued uploads finished processing
+	EmailBilling  EmailCategory = "billing"  // payment failed
+	EmailSecurity EmailCategory = "security" // new logins, password and e-mail changes
+)
+
+var EmailCategories = []EmailCategory{EmailQuota, EmailImport, EmailBilling, EmailSecurity}
+
+func (cat EmailCategory) String() string {
+	return string(cat)
+}
+
+// WantsEmail reports whether the user hasn't opted out of cat.
+func (u User) WantsEmail(cat EmailCategory) bool {
+	return !slices.Contains(u.EmailOptOut, string(cat))
+}
+
+// SetEmailOptOut replaces the categories the user doesn't want e-mail about.
+func (u *User) SetEmailOptOut(ctx context.Context, cats []EmailCategory) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		If("attribute_exists('ID')")
+	if len(cats) == 0 {
+		update.Remove("EmailOptOut")
+	} else {
+		optout := make([]string, 0, len(cats))
+		for _, cat := range cats {
+			optout = append(optout, string(cat))
+		}
+		update.Set("EmailOptOut", optout)
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
+// ClaimQuotaNotice records that a quota warning is about to be sent.
+// It returns false if one was already sent after since, so only one goes out.
+func (u *User) ClaimQuotaNotice(ctx context.Context, now, since time.Time) (bool, error) {
+	return u.claimNotice(ctx, "QuotaNotified", now, since)
+}
+
+// ClaimImportNotice is like ClaimQuotaNotice, for import finished notices.
+func (u *User) ClaimImportNotice(ctx context.Context, now, since time.Time) (bool, error) {
+	return u.claimNotice(ctx, "ImportNotified", now, since)
+}
+
+func (u *User) claimNotice(ctx context.Context, attr string, now, since time.Time) (bool, error) {
+	users := dbTable(tableUsers)
+	err := users.Update("ID", u.ID).
+		Set(attr, now.UTC()).
+		If("attribute_exists('ID')").
+		If(fmt.Sprintf("attribute_not_exists('%s') OR '%s' < ?", attr, attr), since.UTC()).
+		ValueWithContext(ctx, u)
+	if dynamo.IsCondCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,131 @@
+package tube
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+const (
+	tablePairings = "Pairings"
+
+	// PairingTTL is how long a pairing code can be approved for.
+	PairingTTL = 10 * time.Minute
+
+	// easy to read off a screen and type in: no 0/O, 1/I/L
+	pairingAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	pairingCodeLen  = 8
+)
+
+// Pairing is a device waiting for a logged-in user to approve it,
+// usually by scanning a QR code the device shows.
+// Once approved, the device picks up its device token with Secret.
+type Pairing struct {
+	Code    string `dynamo:",hash"`
+	Secret  string
+	Name    string
+	Expires time.Time `dynamo:",unixtime"`
+
+	UserID int    `dynamo:",omitempty"`
+	Token  string `dynamo:",omitempty"` // device token, handed over once
+}
+
+// NewPairing starts pairing the device called name.
+func NewPairing(ctx context.Context, name string) (Pairing, error) {
+	code, err := pairingCode()
+	if err != nil {
+		return Pairing{}, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return Pairing{}, err
+	}
+	p := Pairing{
+		Code:    code,
+		Secret:  secret,
+		Name:    name,
+		Expires: time.Now().UTC().Add(PairingTTL),
+	}
+	table := dbTable(tablePairings)
+	err = table.Put(p).If("attribute_not_exists('Code')").RunWithContext(ctx)
+	return p, err
+}
+
+func pairingCode() (string, error) {
+	data := make([]byte, pairingCodeLen)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	for i, b := range data {
+		// slightly biased, but there's plenty of room
+		data[i] = pairingAlphabet[int(b)%len(pairingAlphabet)]
+	}
+	return string(data), nil
+}
+
+// NormalizePairingCode cleans up a code typed in by hand.
+func NormalizePairingCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(pairingAlphabet, r) {
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// GetPairing returns the pairing with the given code, or ErrNotFound if it's expired.
+func GetPairing(ctx context.Context, code string) (Pairing, error) {
+	table := dbTable(tablePairings)
+	var p Pairing
+	if err := table.Get("Code", code).Consistent(true).OneWithContext(ctx, &p); err != nil {
+		return Pairing{}, err
+	}
+	if time.Now().After(p.Expires) {
+		return Pairing{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (p Pairing) Approved() bool {
+	return p.UserID != 0
+}
+
+// Approve hands the device a token for userID.
+// It fails with ErrNotFound if the pairing was already approved.
+func (p *Pairing) Approve(ctx context.Context, userID int, token string) error {
+	table := dbTable(tablePairings)
+	err := table.Update("Code", p.Code).
+		Set("UserID", userID).
+		Set("Token", token).
+		If("attribute_exists('Code') AND attribute_not_exists('UserID')").
+		ValueWithContext(ctx, p)
+	if dynamo.IsCondCheckFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Claim checks the device's secret and, if the pairing has been approved,
+// removes it so the token can only be picked up once.
+// It reports whether the device was approved.
+func (p Pairing) Claim(ctx context.Context, secret string) (bool, error) {
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(p.Secret)) != 1 {
+		return false, ErrNotFound
+	}
+	if !p.Approved() {
+		return false, nil
+	}
+	table := dbTable(tablePairings)
+	err := table.Delete("Code", p.Code).
+		If("'Secret' = ? AND attribute_exists('Token')", secret).
+		RunWithContext(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		return false, ErrNotFound
+	}
+	return err == nil, err
+}
@@ -13,8 +13,13 @@ const (
 	PlanKindSmall PlanKind = "small"
 	PlanKindBig   PlanKind = "big"
 	PlanKindHuge  PlanKind = "huge"
+	// billed per GB stored instead of a fixed quota
+	PlanKindMetered PlanKind = "metered"
 )
 
+// MeteredUnit is the unit of storage billed for metered plans.
+const MeteredUnit = 1024 * 1024 * 1024 // 1GB
+
 func (pk PlanKind) Msg() string {
 	return "plan_" + string(pk)
 }
@@ -23,6 +28,9 @@ type Plan struct {
 	Kind    PlanKind
 	Quota   int64
 	PriceID string
+	Metered bool
+	// monthly download allowance in bytes; 0 is unlimited
+	EgressCap int64
 }
 
 // TODO: make configurable
@@ -54,9 +62,49 @@ var plans = map[PlanKind]Plan{
 		// PriceID: "price_1I1G5gKpetgr0YLEj0xgvqiw",
 		PriceID: "price_1I9ky7Kpetgr0YLEXAiN8Kfy",
 	},
+	PlanKindMetered: {
+		Kind:    PlanKindMetered,
+		Quota:   0, // unlimited
+		Metered: true,
+		// PriceID is set by SetPlanPrice
+	},
+}
+
+// SetPlanPrice sets the Stripe price for a plan.
+// Plans without a price aren't offered.
+func SetPlanPrice(kind PlanKind, priceID string) {
+	plan := plans[kind]
+	plan.PriceID = priceID
+	plans[kind] = plan
+}
+
+// SetPlanEgressCap sets how much a plan's users can download each month. 0 is unlimited.
+func SetPlanEgressCap(kind PlanKind, limit int64) error {
+	plan, ok := plans[kind]
+	if !ok {
+		return fmt.Errorf("no such plan: %q", kind)
+	}
+	plan.EgressCap = limit
+	plans[kind] = plan
+	return nil
+}
+
+// plansDisabled is set when running without billing: every account gets the default plan.
+var plansDisabled bool
+
+// DisablePlans gives every account the default plan with the given quota,
+// for self-hosted installs without billing. A quota of 0 is unlimited.
+func DisablePlans(quota int64) {
+	plansDisabled = true
+	plan := plans[PlanKindNone]
+	plan.Quota = quota
+	plans[PlanKindNone] = plan
 }
 
 func GetPlan(kind PlanKind) Plan {
+	if plansDisabled {
+		kind = PlanKindNone
+	}
 	plan, ok := plans[kind]
 	if !ok {
 		panic(fmt.Errorf("no such plan: %v", kind))
@@ -65,14 +113,21 @@ func GetPlan(kind PlanKind) Plan {
 }
 
 func GetPlans() []Plan {
+	if plansDisabled {
+		return nil
+	}
 	var all []Plan
 	for _, p := range plans {
-		if p.Kind == PlanKindNone {
+		if p.Kind == PlanKindNone || p.PriceID == "" {
 			continue
 		}
 		all = append(all, p)
 	}
 	sort.Slice(all, func(i, j int) bool {
+		// metered (unlimited) last
+		if all[i].Metered != all[j].Metered {
+			return all[j].Metered
+		}
 		return all[i].Quota < all[j].Quota
 	})
 	return all
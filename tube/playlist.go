@@ -45,14 +45,14 @@ func (p *Playlist) Create(ctx context.Context) error {
 	p.Date = time.Now().UTC()
 	p.LastMod = p.Date
 
-	table := dynamoTable("Playlists")
-	return table.Put(p).If("attribute_not_exists('ID')").Run()
+	table := dbTable("Playlists")
+	return table.Put(p).If("attribute_not_exists('ID')").RunWithContext(ctx)
 }
 
 func (p *Playlist) Save(ctx context.Context) error {
 	p.LastMod = time.Now().UTC()
-	table := dynamoTable("Playlists")
-	return table.Put(p).Run()
+	table := dbTable("Playlists")
+	return table.Put(p).RunWithContext(ctx)
 }
 
 func (p *Playlist) With(tracks []Track) {
@@ -84,8 +84,8 @@ func (p *Playlist) With(tracks []Track) {
 
 func GetPlaylist(ctx context.Context, userID int, id int) (Playlist, error) {
 	var p Playlist
-	table := dynamoTable("Playlists")
-	err := table.Get("UserID", userID).Range("ID", dynamo.Equal, id).One(&p)
+	table := dbTable("Playlists")
+	err := table.Get("UserID", userID).Range("ID", dynamo.Equal, id).OneWithContext(ctx, &p)
 	return p, err
 }
 
@@ -99,8 +99,8 @@ func GetPlaylist(ctx context.Context, userID int, id int) (Playlist, error) {
 
 func GetPlaylists(ctx context.Context, userID int) ([]Playlist, error) {
 	var pp []Playlist
-	table := dynamoTable("Playlists")
-	err := table.Get("UserID", userID).All(&pp)
+	table := dbTable("Playlists")
+	err := table.Get("UserID", userID).AllWithContext(ctx, &pp)
 	if err == ErrNotFound {
 		err = nil
 	}
@@ -108,8 +108,8 @@ func GetPlaylists(ctx context.Context, userID int) ([]Playlist, error) {
 }
 
 func DeletePlaylist(ctx context.Context, userID int, id int) error {
-	table := dynamoTable("Playlists")
-	return table.Delete("UserID", userID).Range("ID", id).Run()
+	table := dbTable("Playlists")
+	return table.Delete("UserID", userID).Range("ID", id).RunWithContext(ctx)
 }
 
 // func DeletePlaylistBySSID(ctx context.Context, userID int, ssid SSID) error {
@@ -0,0 +1,91 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Preferences are settings that follow a user across browsers and devices.
+// The theme is kept in User.Theme.
+type Preferences struct {
+	// BCP 47 tag, used instead of the browser's Accept-Language
+	Language string `dynamo:",omitempty"`
+	// preferred streaming bitrate in kbps for clients that transcode; 0 means original quality
+	Bitrate int        `dynamo:",omitempty"`
+	Shuffle ShuffleOpt `dynamo:",omitempty"`
+	// how the web player evens out loudness between tracks with ReplayGain tags
+	Loudness LoudnessOpt `dynamo:",omitempty"`
+	// sections shown on the home screen, in order; up to the client
+	Home []string `dynamo:",omitempty"`
+}
+
+type ShuffleOpt string
+
+const (
+	ShuffleDefault ShuffleOpt = ""   // start with shuffle off
+	ShuffleOn      ShuffleOpt = "on" // start with shuffle on
+)
+
+const (
+	maxHomeSections   = 16
+	maxHomeSectionLen = 32
+)
+
+// Bitrates are the allowed values of Preferences.Bitrate.
+var Bitrates = []int{0, 64, 96, 128, 192, 256, 320}
+
+// Normalize validates p, canonicalizing the language tag.
+func (p Preferences) Normalize() (Preferences, error) {
+	if p.Language != "" {
+		tag, err := language.Parse(p.Language)
+		if err != nil {
+			return p, fmt.Errorf("invalid language: %q", p.Language)
+		}
+		p.Language = tag.String()
+	}
+	if !slices.Contains(Bitrates, p.Bitrate) {
+		return p, fmt.Errorf("invalid bitrate: %d (want one of %v)", p.Bitrate, Bitrates)
+	}
+	switch p.Shuffle {
+	case ShuffleDefault, ShuffleOn:
+	default:
+		return p, fmt.Errorf("invalid shuffle option: %q", p.Shuffle)
+	}
+	switch p.Loudness {
+	case LoudnessOff, LoudnessTrack, LoudnessAlbum:
+	default:
+		return p, fmt.Errorf("invalid loudness option: %q", p.Loudness)
+	}
+	if len(p.Home) > maxHomeSections {
+		return p, fmt.Errorf("too many home sections (max %d)", maxHomeSections)
+	}
+	for _, section := range p.Home {
+		if section == "" || len(section) > maxHomeSectionLen {
+			return p, fmt.Errorf("invalid home section: %q", section)
+		}
+	}
+	return p, nil
+}
+
+func (p Preferences) Empty() bool {
+	return p.Language == "" && p.Bitrate == 0 && p.Shuffle == ShuffleDefault && p.Loudness == LoudnessOff && len(p.Home) == 0
+}
+
+// SetPreferences replaces the user's theme and preferences.
+func (u *User) SetPreferences(ctx context.Context, theme string, prefs Preferences) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		Set("Theme", theme).
+		Set("LastMod", time.Now().UTC()).
+		If("attribute_exists('ID')")
+	if prefs.Empty() {
+		update.Remove("Prefs")
+	} else {
+		update.Set("Prefs", prefs)
+	}
+	return update.ValueWithContext(ctx, u)
+}
@@ -0,0 +1,161 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/guregu/intertube/storage"
+)
+
+// AccountGracePeriod is how long a deleted account is kept before its data is purged.
+const AccountGracePeriod = 14 * 24 * time.Hour
+
+// ScheduleDeletion disables the account and schedules it to be purged after the grace period.
+func (u *User) ScheduleDeletion(ctx context.Context, at time.Time) error {
+	at = at.UTC()
+	users := dbTable(tableUsers)
+	return users.Update("ID", u.ID).
+		Set("Deleted", at).
+		Set("PurgeAfter", at.Add(AccountGracePeriod)).
+		Set("LastMod", at).
+		If("attribute_exists('ID') AND attribute_not_exists('Deleted')").
+		ValueWithContext(ctx, u)
+}
+
+// GetUsersToPurge returns deleted accounts whose grace period has passed.
+func GetUsersToPurge(ctx context.Context, now time.Time) ([]User, error) {
+	users := dbTable(tableUsers)
+	var u []User
+	err := users.Scan().Filter("'PurgeAfter' <= ?", now.UTC()).AllWithContext(ctx, &u)
+	return u, err
+}
+
+// PurgeUser permanently deletes all of a user's records and stored objects.
+// Album art is content-addressed and shared between users, so it is left alone.
+// Purging is idempotent; if it fails partway through it can simply be run again.
+func PurgeUser(ctx context.Context, u User) error {
+	if !u.Deleting() {
+		return fmt.Errorf("purge: user %d is not scheduled for deletion", u.ID)
+	}
+
+	for _, prefix := range []string{
+		fmt.Sprintf("u/tracks/%d/", u.ID),
+		fmt.Sprintf("export/%d/", u.ID),
+		fmt.Sprintf("trash/%d/", u.ID),
+	} {
+		if err := purgeObjects(storage.FilesBucket, prefix); err != nil {
+			return err
+		}
+	}
+	if storage.IsCacheEnabled() {
+		if err := storage.CacheBucket.Delete(Dump{UserID: u.ID}.Key()); err != nil {
+			return err
+		}
+	}
+
+	var files []File
+	err := dbTable("Files").Get("UserID", u.ID).Index("UserID-ID-index").AllWithContext(ctx, &files)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	for _, f := range files {
+		if err := storage.UploadsBucket.Delete(f.Path()); err != nil {
+			return err
+		}
+		if err := dbTable("Files").Delete("ID", f.ID).RunWithContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := purgeRange(ctx, "Tracks", "UserID", "ID", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, tableTrash, "UserID", "ID", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, tableTombstones, "UserID", "ID", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, "Playlists", "UserID", "ID", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, "Stars", "UserID", "SSID", u.ID); err != nil {
+		return err
+	}
+	if err := ClearPlayQueue(ctx, u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, tableExports, "UserID", "ID", u.ID); err != nil {
+		return err
+	}
+	tokens, err := GetDeviceTokens(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, dt := range tokens {
+		if err := dt.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	shares, err := GetShares(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		if err := s.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	if err := purgeRange(ctx, tableLyrics, "UserID", "TrackID", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, tableNotifications, "UserID", "ID", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, tableTrackAccesses, "UserID", "Time", u.ID); err != nil {
+		return err
+	}
+	if err := purgeRange(ctx, tableEvents, "UserID", "Time", u.ID); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "purge: deleting user", "user_id", u.ID)
+	return dbTable(tableUsers).Delete("ID", u.ID).RunWithContext(ctx)
+}
+
+func purgeObjects(bucket storage.Bucket, prefix string) error {
+	objs, err := bucket.List(prefix)
+	if err != nil {
+		return err
+	}
+	for key := range objs {
+		if err := bucket.Delete(key); err != nil {
+			return fmt.Errorf("purge: delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// purgeRange deletes every item under the given hash key.
+func purgeRange(ctx context.Context, tableName, hashKey, rangeKey string, id int) error {
+	table := dbTable(tableName)
+	iter := table.Get(hashKey, id).Project(hashKey, rangeKey).Iter()
+	var keys []dynamo.Keyed
+	var item map[string]interface{}
+	for iter.NextWithContext(ctx, &item) {
+		keys = append(keys, dynamo.Keys{item[hashKey], item[rangeKey]})
+		item = nil
+	}
+	if err := iter.Err(); err != nil && err != ErrNotFound {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := table.Batch(hashKey, rangeKey).Write().Delete(keys...).RunWithContext(ctx)
+	return err
+}
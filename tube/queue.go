@@ -0,0 +1,52 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const tablePlayQueues = "PlayQueues"
+
+// MaxQueueLen is the most tracks a saved play queue can have.
+const MaxQueueLen = 5000
+
+// PlayQueue is what a user is listening to, saved so that it survives a refresh
+// and can be picked up on another device.
+type PlayQueue struct {
+	UserID int `dynamo:",hash"`
+	// all tracks in the queue, in order, including Current
+	Tracks  []string `dynamo:",omitempty"`
+	Current string   `dynamo:",omitempty"`
+	// seconds into Current
+	Position float64
+	// whether Current was playing (not paused) when saved
+	Playing bool `dynamo:",omitempty"`
+	Changed time.Time
+	// the client that saved it
+	ChangedBy string `dynamo:",omitempty"`
+}
+
+// SavePlayQueue replaces the user's play queue.
+func SavePlayQueue(ctx context.Context, q PlayQueue) error {
+	if len(q.Tracks) > MaxQueueLen {
+		return fmt.Errorf("play queue too long: %d tracks (max %d)", len(q.Tracks), MaxQueueLen)
+	}
+	q.Changed = time.Now().UTC()
+	table := dbTable(tablePlayQueues)
+	return table.Put(q).RunWithContext(ctx)
+}
+
+// GetPlayQueue returns the user's saved play queue, or ErrNotFound.
+func GetPlayQueue(ctx context.Context, userID int) (PlayQueue, error) {
+	table := dbTable(tablePlayQueues)
+	var q PlayQueue
+	err := table.Get("UserID", userID).OneWithContext(ctx, &q)
+	return q, err
+}
+
+// ClearPlayQueue deletes the user's saved play queue.
+func ClearPlayQueue(ctx context.Context, userID int) error {
+	table := dbTable(tablePlayQueues)
+	return table.Delete("UserID", userID).RunWithContext(ctx)
+}
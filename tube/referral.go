@@ -0,0 +1,89 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+// ReferralBonus is the extra storage granted to both the referrer and the
+// referred user once the referred user starts paying.
+const ReferralBonus = 10 * 1024 * 1024 * 1024 // 10GB
+
+// EnsureReferralCode gives the user a referral code if they don't have one yet.
+// Codes are prefixed with the user's ID so they can be looked up without an index.
+func (u *User) EnsureReferralCode(ctx context.Context) error {
+	if u.ReferralCode != "" {
+		return nil
+	}
+	garb, err := randomString(6)
+	if err != nil {
+		return err
+	}
+	code := strconv.FormatInt(int64(u.ID), 36) + "-" + garb
+	users := dbTable(tableUsers)
+	err = users.Update("ID", u.ID).
+		Set("ReferralCode", code).
+		If("attribute_exists('ID') AND attribute_not_exists('ReferralCode')").
+		ValueWithContext(ctx, u)
+	if dynamo.IsCondCheckFailed(err) {
+		// someone else beat us to it
+		*u, err = GetUser(ctx, u.ID)
+	}
+	return err
+}
+
+// GetUserByReferralCode finds the user who owns the given referral code.
+func GetUserByReferralCode(ctx context.Context, code string) (User, error) {
+	idpart, _, ok := strings.Cut(code, "-")
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	id, err := strconv.ParseInt(idpart, 36, 64)
+	if err != nil {
+		return User{}, ErrNotFound
+	}
+	u, err := GetUser(ctx, int(id))
+	if err != nil {
+		return User{}, err
+	}
+	if u.ReferralCode != code || u.Deleting() {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// CreditReferral grants the referral bonus to u and whoever referred them.
+// It only succeeds once per user; subsequent calls return false.
+func (u *User) CreditReferral(ctx context.Context) (bool, error) {
+	if u.ReferredBy == 0 || !u.ReferralCredited.IsZero() {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	users := dbTable(tableUsers)
+	tx := db.WriteTx()
+	tx.Update(users.Update("ID", u.ID).
+		Set("ReferralCredited", now).
+		Add("BonusQuota", ReferralBonus).
+		If("attribute_exists('ID') AND attribute_not_exists('ReferralCredited')"))
+	tx.Update(users.Update("ID", u.ReferredBy).
+		Add("BonusQuota", ReferralBonus).
+		Add("Referrals", 1).
+		If("attribute_exists('ID')"))
+	err := tx.RunWithContext(ctx)
+	forgetUser(u.ID)
+	forgetUser(u.ReferredBy)
+	if dynamo.IsCondCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("credit referral: %w", err)
+	}
+	u.ReferralCredited = now
+	u.BonusQuota += ReferralBonus
+	return true, nil
+}
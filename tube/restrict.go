@@ -0,0 +1,109 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Restrictions limits where a user's music can be streamed or downloaded from.
+// Empty lists allow everything.
+type Restrictions struct {
+	CIDRs     []string `dynamo:",omitempty"`
+	Countries []string `dynamo:",omitempty"` // ISO 3166-1 alpha-2 codes
+}
+
+// ParseRestrictions parses comma or space separated CIDR ranges and country codes.
+// Bare IP addresses are treated as single-address ranges.
+func ParseRestrictions(cidrs, countries string) (Restrictions, error) {
+	var rs Restrictions
+	for _, cidr := range splitList(cidrs) {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return rs, fmt.Errorf("invalid IP address: %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return rs, fmt.Errorf("invalid IP range: %s", cidr)
+		}
+		rs.CIDRs = append(rs.CIDRs, ipnet.String())
+	}
+	for _, cc := range splitList(countries) {
+		if len(cc) != 2 {
+			return rs, fmt.Errorf("invalid country code: %s", cc)
+		}
+		rs.Countries = append(rs.Countries, strings.ToUpper(cc))
+	}
+	return rs, nil
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+}
+
+func (rs Restrictions) Equal(other Restrictions) bool {
+	return slices.Equal(rs.CIDRs, other.CIDRs) && slices.Equal(rs.Countries, other.Countries)
+}
+
+func (rs Restrictions) Empty() bool {
+	return len(rs.CIDRs) == 0 && len(rs.Countries) == 0
+}
+
+// Allowed checks a client's IP and country (empty if unknown) against the restrictions.
+func (rs Restrictions) Allowed(ip net.IP, country string) bool {
+	if len(rs.CIDRs) > 0 {
+		if ip == nil || !rs.containsIP(ip) {
+			return false
+		}
+	}
+	if len(rs.Countries) > 0 {
+		if country == "" || !rs.containsCountry(country) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs Restrictions) containsIP(ip net.IP) bool {
+	for _, cidr := range rs.CIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs Restrictions) containsCountry(country string) bool {
+	for _, cc := range rs.Countries {
+		if strings.EqualFold(cc, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) SetRestrictions(ctx context.Context, rs Restrictions) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		Set("LastMod", time.Now().UTC()).
+		If("attribute_exists('ID')")
+	if rs.Empty() {
+		update.Remove("Restrict")
+	} else {
+		update.Set("Restrict", rs)
+	}
+	return update.ValueWithContext(ctx, u)
+}
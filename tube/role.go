@@ -0,0 +1,59 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleGuest   Role = "guest"   // read-only: can listen but not change anything
+	RoleUser    Role = "user"    // regular account
+	RoleSupport Role = "support" // read-only access to the admin tools
+	RoleAdmin   Role = "admin"
+)
+
+// legacyAdminID is the account that was the admin before roles existed.
+const legacyAdminID = 2
+
+var roleRanks = map[Role]int{
+	RoleGuest:   0,
+	RoleUser:    1,
+	RoleSupport: 2,
+	RoleAdmin:   3,
+}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleRanks[role]; !ok {
+		return RoleUser, fmt.Errorf("invalid role: %q", s)
+	}
+	return role, nil
+}
+
+// AtLeast reports whether this role has all the privileges of min.
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+// GetRole returns the user's role. Accounts from before roles are regular users, except the original admin.
+func (u User) GetRole() Role {
+	if u.Role == "" {
+		if u.ID == legacyAdminID {
+			return RoleAdmin
+		}
+		return RoleUser
+	}
+	return u.Role
+}
+
+func (u *User) SetRole(ctx context.Context, role Role) error {
+	users := dbTable(tableUsers)
+	return users.Update("ID", u.ID).
+		Set("Role", role).
+		Set("LastMod", time.Now().UTC()).
+		If("attribute_exists('ID')").
+		ValueWithContext(ctx, u)
+}
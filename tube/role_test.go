@@ -0,0 +1,65 @@
+package tube
+
+import "testing"
+
+func TestRoles(t *testing.T) {
+	tests := []struct {
+		role Role
+		min  Role
+		want bool
+	}{
+		{RoleGuest, RoleGuest, true},
+		{RoleGuest, RoleUser, false},
+		{RoleUser, RoleUser, true},
+		{RoleUser, RoleSupport, false},
+		{RoleSupport, RoleUser, true},
+		{RoleSupport, RoleAdmin, false},
+		{RoleAdmin, RoleSupport, true},
+		// unknown roles get nothing more than guests
+		{Role("superuser"), RoleUser, false},
+	}
+	for _, test := range tests {
+		if got := test.role.AtLeast(test.min); got != test.want {
+			t.Errorf("%s.AtLeast(%s) = %v, want %v", test.role, test.min, got, test.want)
+		}
+	}
+
+	if _, err := ParseRole("superuser"); err == nil {
+		t.Error("ParseRole accepted an unknown role")
+	}
+	if role, err := ParseRole("support"); err != nil || role != RoleSupport {
+		t.Errorf("ParseRole(support) = %v, %v", role, err)
+	}
+
+	// accounts from before roles existed
+	if got := (User{ID: 1}).GetRole(); got != RoleUser {
+		t.Errorf("legacy user: %s, want user", got)
+	}
+	if got := (User{ID: legacyAdminID}).GetRole(); got != RoleAdmin {
+		t.Errorf("legacy admin: %s, want admin", got)
+	}
+	if got := (User{ID: legacyAdminID, Role: RoleGuest}).GetRole(); got != RoleGuest {
+		t.Errorf("legacy admin demoted to guest: %s", got)
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	ctx := testDB(t)
+	u := testUser(t, ctx)
+	if err := u.SetRole(ctx, RoleSupport); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetUser(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetRole() != RoleSupport {
+		t.Errorf("role after SetRole: %s, want support", got.GetRole())
+	}
+
+	// doesn't create users
+	missing := User{ID: u.ID + 100}
+	if err := missing.SetRole(ctx, RoleAdmin); err == nil {
+		t.Error("SetRole on a missing user: no error")
+	}
+}
@@ -10,14 +10,23 @@ import (
 const (
 	tableSessions = "Sessions"
 
-	sessionTTL = time.Hour * 24 * 7
+	sessionTTL       = time.Hour * 24 * 7
+	impersonationTTL = time.Hour
 )
 
 type Session struct {
-	Token   string `dynamo:",hash"`
-	UserID  int
+	Token   string    `dynamo:",hash"`
+	UserID  int       `index:"UserID-index,hash"`
 	Expires time.Time `dynamo:",unixtime"`
 	IP      string
+
+	// Impersonator is the ID of the admin who created this session
+	// on behalf of UserID, or 0 for regular sessions.
+	Impersonator int `dynamo:",omitempty"`
+}
+
+func (s Session) Impersonated() bool {
+	return s.Impersonator != 0
 }
 
 func CreateSession(ctx context.Context, userID int, ipaddr string) (Session, error) {
@@ -32,21 +41,76 @@ func CreateSession(ctx context.Context, userID int, ipaddr string) (Session, err
 		Expires: time.Now().UTC().Add(sessionTTL),
 		IP:      ipaddr,
 	}
-	sessions := dynamoTable(tableSessions)
-	err = sessions.Put(sesh).If("attribute_not_exists('Token')").Run()
+	sessions := dbTable(tableSessions)
+	err = sessions.Put(sesh).If("attribute_not_exists('Token')").RunWithContext(ctx)
 	if err != nil {
 		return Session{}, err
 	}
 	return sesh, nil
 }
 
-func GetSession(ctx context.Context, token string) (Session, error) {
-	sessions := dynamoTable(tableSessions)
-	var sesh Session
-	err := sessions.Get("Token", token).One(&sesh)
+// CreateImpersonationSession creates a short-lived session for userID
+// that is flagged as belonging to adminID.
+func CreateImpersonationSession(ctx context.Context, adminID, userID int, ipaddr string) (Session, error) {
+	token, err := randomString(64)
+	if err != nil {
+		return Session{}, err
+	}
+
+	sesh := Session{
+		Token:        token,
+		UserID:       userID,
+		Expires:      time.Now().UTC().Add(impersonationTTL),
+		IP:           ipaddr,
+		Impersonator: adminID,
+	}
+	sessions := dbTable(tableSessions)
+	err = sessions.Put(sesh).If("attribute_not_exists('Token')").RunWithContext(ctx)
 	if err != nil {
 		return Session{}, err
 	}
+	return sesh, nil
+}
+
+func DeleteSession(ctx context.Context, token string) error {
+	defer forgetSession(token)
+	sessions := dbTable(tableSessions)
+	return sessions.Delete("Token", token).RunWithContext(ctx)
+}
+
+// DeleteUserSessions signs a user out everywhere.
+func DeleteUserSessions(ctx context.Context, userID int) error {
+	sessions := dbTable(tableSessions)
+	var tokens []struct{ Token string }
+	err := sessions.Get("UserID", userID).Index("UserID-index").Project("Token").AllWithContext(ctx, &tokens)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		err := sessions.Delete("Token", t.Token).RunWithContext(ctx)
+		forgetSession(t.Token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSession returns the session for token.
+// With the cache on, sessions deleted by another server can still be returned
+// for up to the cache TTL (cache_seconds); ones deleted by this server are gone right away.
+func GetSession(ctx context.Context, token string) (Session, error) {
+	sesh, ok := cachedSession(token)
+	if !ok {
+		sessions := dbTable(tableSessions)
+		if err := sessions.Get("Token", token).OneWithContext(ctx, &sesh); err != nil {
+			return Session{}, err
+		}
+		cacheSession(sesh)
+	}
 	if time.Now().After(sesh.Expires) {
 		return Session{}, ErrNotFound
 	}
@@ -0,0 +1,42 @@
+package tube
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+	ctx := testDB(t)
+	ttl := userCacheTTL
+	EnableCache(100, time.Hour)
+	t.Cleanup(func() { readCache, userCacheTTL = nil, ttl })
+	u := testUser(t, ctx)
+
+	tests := []struct {
+		name    string
+		signOut func(Session) error
+	}{
+		{"DeleteSession", func(s Session) error { return DeleteSession(ctx, s.Token) }},
+		{"DeleteUserSessions", func(s Session) error { return DeleteUserSessions(ctx, s.UserID) }},
+		{"RevokeAccess", func(Session) error { return u.RevokeAccess(ctx) }},
+	}
+	for _, test := range tests {
+		sesh, err := CreateSession(ctx, u.ID, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// read it once so it's cached
+		if _, err := GetSession(ctx, sesh.Token); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cachedSession(sesh.Token); !ok {
+			t.Fatalf("%s: session wasn't cached", test.name)
+		}
+		if err := test.signOut(sesh); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetSession(ctx, sesh.Token); err != ErrNotFound {
+			t.Errorf("%s: GetSession after signing out: %v, want ErrNotFound", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package tube
+
+import (
+	"context"
+	"time"
+)
+
+const tableShares = "Shares"
+
+// Share is a public link to one of a user's tracks.
+// Anyone with the link can listen to the track, without logging in.
+type Share struct {
+	ID      string `dynamo:",hash" index:"UserID-ID-index,range"`
+	UserID  int    `index:"UserID-ID-index,hash"`
+	TrackID string
+	Created time.Time
+}
+
+func NewShare(userID int, trackID string) (Share, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return Share{}, err
+	}
+	return Share{
+		ID:      id,
+		UserID:  userID,
+		TrackID: trackID,
+		Created: time.Now().UTC(),
+	}, nil
+}
+
+func (s Share) Create(ctx context.Context) error {
+	table := dbTable(tableShares)
+	return table.Put(s).If("attribute_not_exists('ID')").RunWithContext(ctx)
+}
+
+// Delete revokes the share link.
+func (s Share) Delete(ctx context.Context) error {
+	table := dbTable(tableShares)
+	return table.Delete("ID", s.ID).If("'UserID' = ?", s.UserID).RunWithContext(ctx)
+}
+
+func GetShare(ctx context.Context, id string) (Share, error) {
+	table := dbTable(tableShares)
+	var s Share
+	err := table.Get("ID", id).OneWithContext(ctx, &s)
+	return s, err
+}
+
+// GetShares returns all of a user's share links.
+func GetShares(ctx context.Context, userID int) ([]Share, error) {
+	table := dbTable(tableShares)
+	var shares []Share
+	err := table.Get("UserID", userID).Index("UserID-ID-index").AllWithContext(ctx, &shares)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return shares, err
+}
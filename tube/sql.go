@@ -0,0 +1,1606 @@
+package tube
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/XSAM/otelsql"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	_ "modernc.org/sqlite"
+)
+
+// SQL databases keep each item as a JSON document in the same format DynamoDB uses,
+// next to copies of its key attributes. Table and index keys get their own columns,
+// so lookups, range queries, and sorting are done by the database.
+// Conditions and filters are evaluated by us.
+
+type sqlDialect struct {
+	driver string
+	// bind parameter number n (1-based)
+	placeholder func(n int) string
+	// column types for keys and item documents
+	keyType, docType string
+	// appended to SELECT to lock rows we are about to change
+	forUpdate string
+	// adjusts the connection string, if set
+	dsn func(dsn string) string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {
+		driver:      "pgx",
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		keyType:     `TEXT COLLATE "C"`, // sort by bytes like DynamoDB
+		docType:     "JSONB",
+		forUpdate:   " FOR UPDATE",
+	},
+	"sqlite": {
+		driver:      "sqlite",
+		placeholder: func(int) string { return "?" },
+		keyType:     "TEXT",
+		docType:     "TEXT",
+		// no row locks, transactions lock the database instead
+		dsn: sqliteDSN,
+	},
+}
+
+// sqliteDSN turns a file path into a connection string that lets
+// readers and a writer work at the same time, and makes writers wait their turn.
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn
+	}
+	return "file:" + dsn + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+}
+
+// errCondCheck is returned when a condition fails,
+// so dynamo.IsCondCheckFailed works the same with every backend.
+var errCondCheck = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "tube: conditional check failed", nil)
+
+// errSQLConflict means someone else created the item we were creating; try again.
+var errSQLConflict = errors.New("tube: concurrent insert")
+
+// how many items a scan reads at a time
+const sqlScanPage = 1000
+
+type sqlDB struct {
+	*sql.DB
+	dialect sqlDialect
+	tables  map[string]*sqlSchema
+}
+
+// InitSQL connects to a SQL database instead of DynamoDB.
+// kind is "postgres" or "sqlite". dsn is a connection string or URL,
+// or for SQLite, the database file's path.
+func InitSQL(kind, dsn, prefix string) error {
+	dialect, ok := sqlDialects[kind]
+	if !ok {
+		return fmt.Errorf("tube: unsupported database type %q", kind)
+	}
+	if dialect.dsn != nil {
+		dsn = dialect.dsn(dsn)
+	}
+	conn, err := otelsql.Open(dialect.driver, dsn,
+		otelsql.WithAttributes(semconv.DBSystemKey.String(kind)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			OmitConnectorConnect: true,
+		}))
+	if err != nil {
+		return err
+	}
+	if err := conn.Ping(); err != nil {
+		return err
+	}
+	dbPrefix = prefix
+	sdb := &sqlDB{
+		DB:      conn,
+		dialect: dialect,
+		tables:  make(map[string]*sqlSchema, len(dynamoTables)),
+	}
+	for name, model := range dynamoTables {
+		schema, err := sqlSchemaOf(dbPrefix+name, model)
+		if err != nil {
+			return err
+		}
+		sdb.tables[schema.name] = schema
+	}
+	db = sdb
+	return nil
+}
+
+func (d *sqlDB) Table(name string) table {
+	schema, ok := d.tables[name]
+	if !ok {
+		panic("tube: unknown table " + name)
+	}
+	return sqlTable{db: d, sqlSchema: schema}
+}
+
+func (d *sqlDB) WriteTx() writeTx {
+	return &sqlWriteTx{db: d}
+}
+
+func (d *sqlDB) ping(ctx context.Context) error {
+	return d.PingContext(ctx)
+}
+
+func (d *sqlDB) createTables(ctx context.Context) error {
+	slog.InfoContext(ctx, "Checking SQL tables...", "prefix", dbPrefix)
+	for _, schema := range d.tables {
+		// the table, then key columns for indexes added since it was made, then the indexes
+		stmts := schema.ddl(d.dialect)
+		if _, err := d.ExecContext(ctx, stmts[0]); err != nil {
+			return fmt.Errorf("tube: creating %s: %w", schema.name, err)
+		}
+		if err := d.addCols(ctx, schema); err != nil {
+			return fmt.Errorf("tube: adding columns to %s: %w", schema.name, err)
+		}
+		for _, stmt := range stmts[1:] {
+			if _, err := d.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("tube: creating %s: %w", schema.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addCols adds the key columns an existing table is missing, and fills them in from each item.
+func (d *sqlDB) addCols(ctx context.Context, s *sqlSchema) error {
+	rows, err := d.QueryContext(ctx, "SELECT * FROM "+quoteIdent(s.name)+" WHERE 1 = 0")
+	if err != nil {
+		return err
+	}
+	have, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, col := range s.cols {
+		if !slices.Contains(have, col) {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	slog.InfoContext(ctx, "Adding SQL columns", "table", s.name, "columns", missing)
+	keyCols := s.keyCols()
+	var sets []string
+	for _, col := range missing {
+		sets = append(sets, quoteIdent(col)+" = ?")
+	}
+	update := d.rebind("UPDATE " + quoteIdent(s.name) + " SET " + strings.Join(sets, ", ") +
+		" WHERE " + sqlTable{sqlSchema: s}.keyWhere())
+	return d.inTx(ctx, func(tx *sql.Tx) error {
+		for _, col := range missing {
+			if _, err := tx.ExecContext(ctx, "ALTER TABLE "+quoteIdent(s.name)+" ADD COLUMN "+quoteIdent(col)+" "+d.dialect.keyType); err != nil {
+				return err
+			}
+		}
+		// a page at a time, as a transaction can't write while it's reading
+		var last []any
+		for {
+			query := "SELECT doc FROM " + quoteIdent(s.name)
+			if last != nil {
+				params := strings.TrimSuffix(strings.Repeat("?, ", len(keyCols)), ", ")
+				query += " WHERE (" + quoteIdents(keyCols) + ") > (" + params + ")"
+			}
+			query += " ORDER BY " + quoteIdents(keyCols) + " LIMIT " + strconv.Itoa(sqlScanPage)
+			items, err := queryDocs(ctx, tx, d.rebind(query), last...)
+			if err != nil {
+				return err
+			}
+			for _, it := range items {
+				vals, err := s.keyValues(it, missing)
+				if err != nil {
+					return err
+				}
+				keys, err := s.keyValues(it, keyCols)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, update, append(vals, keys...)...); err != nil {
+					return err
+				}
+			}
+			if len(items) < sqlScanPage {
+				return nil
+			}
+			if last, err = s.keyValues(items[len(items)-1], keyCols); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func queryDocs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]item, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []item
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		it, err := decodeDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// rebind replaces ? with the dialect's bind parameters.
+func (d *sqlDB) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(d.dialect.placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// inTx runs fn in a transaction, retrying if it raced to create an item.
+func (d *sqlDB) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	for tries := 0; ; tries++ {
+		tx, err := d.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		err = fn(tx)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err == errSQLConflict && tries < 5 {
+			continue
+		}
+		return err
+	}
+}
+
+// sqlSchema describes a table's keys, taken from the model's struct tags.
+type sqlSchema struct {
+	name      string
+	hash, rng string
+	indexes   map[string]sqlIndex
+	// key columns: hash key, range key, then indexed attributes
+	cols []string
+}
+
+type sqlIndex struct {
+	hash, rng string
+}
+
+func sqlSchemaOf(name string, model any) (*sqlSchema, error) {
+	rt := reflect.TypeOf(model)
+	s := &sqlSchema{name: name, indexes: make(map[string]sqlIndex)}
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		attr, opts, _ := strings.Cut(field.Tag.Get("dynamo"), ",")
+		if attr == "-" || !field.IsExported() {
+			continue
+		}
+		if attr == "" {
+			attr = field.Name
+		}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "hash":
+				s.hash = attr
+			case "range":
+				s.rng = attr
+			}
+		}
+		for _, tag := range tagValues(field.Tag, "index") {
+			idxName, kind, _ := strings.Cut(tag, ",")
+			idx := s.indexes[idxName]
+			switch kind {
+			case "hash":
+				idx.hash = attr
+			case "range":
+				idx.rng = attr
+			}
+			s.indexes[idxName] = idx
+		}
+	}
+	if s.hash == "" {
+		return nil, fmt.Errorf("tube: table %s has no hash key", name)
+	}
+
+	s.addCol(s.hash)
+	s.addCol(s.rng)
+	names := make([]string, 0, len(s.indexes))
+	for name := range s.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.addCol(s.indexes[name].hash)
+		s.addCol(s.indexes[name].rng)
+	}
+	return s, nil
+}
+
+func (s *sqlSchema) addCol(attr string) {
+	if attr == "" || s.hasCol(attr) {
+		return
+	}
+	s.cols = append(s.cols, attr)
+}
+
+func (s *sqlSchema) hasCol(attr string) bool {
+	for _, col := range s.cols {
+		if col == attr {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sqlSchema) keyCols() []string {
+	if s.rng == "" {
+		return []string{s.hash}
+	}
+	return []string{s.hash, s.rng}
+}
+
+func (s *sqlSchema) ddl(dialect sqlDialect) []string {
+	var cols []string
+	for _, col := range s.cols {
+		def := quoteIdent(col) + " " + dialect.keyType
+		if col == s.hash || col == s.rng {
+			def += " NOT NULL"
+		}
+		cols = append(cols, def)
+	}
+	cols = append(cols, "doc "+dialect.docType+" NOT NULL")
+	cols = append(cols, "PRIMARY KEY ("+quoteIdents(s.keyCols())+")")
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS " + quoteIdent(s.name) + " (" + strings.Join(cols, ", ") + ")",
+	}
+	for name, idx := range s.indexes {
+		cols := []string{idx.hash}
+		if idx.rng != "" {
+			cols = append(cols, idx.rng)
+		}
+		stmts = append(stmts, "CREATE INDEX IF NOT EXISTS "+quoteIdent(s.name+"."+name)+
+			" ON "+quoteIdent(s.name)+" ("+quoteIdents(cols)+")")
+	}
+	return stmts
+}
+
+// keyValues returns the encoded values of cols for it.
+func (s *sqlSchema) keyValues(it item, cols []string) ([]any, error) {
+	vals := make([]any, len(cols))
+	for i, col := range cols {
+		v, err := sqlKey(it[col])
+		if err != nil {
+			return nil, fmt.Errorf("tube: %s.%s: %w", s.name, col, err)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// sqlKey encodes a key attribute so it sorts the way DynamoDB sorts it.
+func sqlKey(av *dynamodb.AttributeValue) (any, error) {
+	switch {
+	case av == nil:
+		return nil, nil
+	case av.S != nil:
+		return *av.S, nil
+	case av.N != nil:
+		n, err := strconv.ParseInt(*av.N, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("unsupported numeric key %s", *av.N)
+		}
+		return fmt.Sprintf("%020d", n), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", avType(av))
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// tagValues returns every value of key in tag, which can appear more than once.
+func tagValues(tag reflect.StructTag, key string) []string {
+	var vals []string
+	for tag != "" {
+		tag = reflect.StructTag(strings.TrimLeft(string(tag), " "))
+		name, rest, ok := strings.Cut(string(tag), `:"`)
+		if !ok {
+			break
+		}
+		end := 0
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			break
+		}
+		if name == key {
+			if v, err := strconv.Unquote(`"` + rest[:end] + `"`); err == nil {
+				vals = append(vals, v)
+			}
+		}
+		tag = reflect.StructTag(rest[end+1:])
+	}
+	return vals
+}
+
+type sqlTable struct {
+	db *sqlDB
+	*sqlSchema
+}
+
+func (t sqlTable) Name() string {
+	return t.name
+}
+
+func (t sqlTable) Get(name string, value any) tableQuery {
+	q := &sqlQuery{t: t, hashName: name, order: dynamo.Ascending}
+	q.hashVal, q.err = dynamo.Marshal(value)
+	return q
+}
+
+func (t sqlTable) Put(it any) tablePut {
+	p := &sqlPut{t: t}
+	p.item, p.err = dynamo.MarshalItem(it)
+	return p
+}
+
+func (t sqlTable) Update(hashKey string, value any) Update {
+	u := &sqlUpdate{t: t, key: make(item)}
+	u.Range(hashKey, value)
+	return u
+}
+
+func (t sqlTable) Delete(name string, value any) tableDelete {
+	d := &sqlDelete{t: t, key: make(item)}
+	d.Range(name, value)
+	return d
+}
+
+func (t sqlTable) Scan() tableScan {
+	return &sqlScan{q: &sqlQuery{t: t, order: dynamo.Ascending}}
+}
+
+func (t sqlTable) Batch(hashAndRangeKeyName ...string) tableBatch {
+	return sqlBatch{t: t}
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// load returns the item with the given primary key, or nil if it doesn't exist.
+func (t sqlTable) load(ctx context.Context, tx querier, key item, lock bool) (item, error) {
+	vals, err := t.keyValues(key, t.keyCols())
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT doc FROM " + quoteIdent(t.name) + " WHERE " + t.keyWhere()
+	if lock {
+		query += t.db.dialect.forUpdate
+	}
+	var doc []byte
+	err = tx.QueryRowContext(ctx, t.db.rebind(query), vals...).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeDoc(doc)
+}
+
+func (t sqlTable) keyWhere() string {
+	var where []string
+	for _, col := range t.keyCols() {
+		where = append(where, quoteIdent(col)+" = ?")
+	}
+	return strings.Join(where, " AND ")
+}
+
+// write stores it, replacing old. If old is nil, it fails with errSQLConflict if the item exists.
+func (t sqlTable) write(ctx context.Context, tx *sql.Tx, old, it item) error {
+	vals, err := t.keyValues(it, t.cols)
+	if err != nil {
+		return err
+	}
+	doc, err := encodeDoc(it)
+	if err != nil {
+		return err
+	}
+	vals = append(vals, doc)
+
+	if old != nil {
+		var sets []string
+		for _, col := range t.cols {
+			sets = append(sets, quoteIdent(col)+" = ?")
+		}
+		sets = append(sets, "doc = ?")
+		keys, err := t.keyValues(old, t.keyCols())
+		if err != nil {
+			return err
+		}
+		query := "UPDATE " + quoteIdent(t.name) + " SET " + strings.Join(sets, ", ") + " WHERE " + t.keyWhere()
+		_, err = tx.ExecContext(ctx, t.db.rebind(query), append(vals, keys...)...)
+		return err
+	}
+
+	query := t.insert() + " ON CONFLICT DO NOTHING"
+	res, err := tx.ExecContext(ctx, t.db.rebind(query), vals...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errSQLConflict
+	}
+	return nil
+}
+
+func (t sqlTable) insert() string {
+	params := strings.Repeat("?, ", len(t.cols)) + "?"
+	return "INSERT INTO " + quoteIdent(t.name) + " (" + quoteIdents(t.cols) + ", doc) VALUES (" + params + ")"
+}
+
+// upsert stores it without looking at what was there before.
+func (t sqlTable) upsert(ctx context.Context, tx execer, it item) error {
+	vals, err := t.keyValues(it, t.cols)
+	if err != nil {
+		return err
+	}
+	doc, err := encodeDoc(it)
+	if err != nil {
+		return err
+	}
+	var sets []string
+	for _, col := range t.cols {
+		sets = append(sets, quoteIdent(col)+" = excluded."+quoteIdent(col))
+	}
+	sets = append(sets, "doc = excluded.doc")
+	query := t.insert() + " ON CONFLICT (" + quoteIdents(t.keyCols()) + ") DO UPDATE SET " + strings.Join(sets, ", ")
+	_, err = tx.ExecContext(ctx, t.db.rebind(query), append(vals, doc)...)
+	return err
+}
+
+func (t sqlTable) remove(ctx context.Context, tx *sql.Tx, key item) error {
+	vals, err := t.keyValues(key, t.keyCols())
+	if err != nil {
+		return err
+	}
+	query := "DELETE FROM " + quoteIdent(t.name) + " WHERE " + t.keyWhere()
+	_, err = tx.ExecContext(ctx, t.db.rebind(query), vals...)
+	return err
+}
+
+// modify replaces the item at key with the result of fn, all in tx.
+// fn gets nil if there is no item, and returns nil to delete it.
+func (t sqlTable) modify(ctx context.Context, tx *sql.Tx, key item, fn func(old item) (item, error)) (old, updated item, err error) {
+	old, err = t.load(ctx, tx, key, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	updated, err = fn(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case updated != nil:
+		err = t.write(ctx, tx, old, updated)
+	case old != nil:
+		err = t.remove(ctx, tx, key)
+	}
+	return old, updated, err
+}
+
+type sqlQuery struct {
+	t         sqlTable
+	hashName  string
+	hashVal   *dynamodb.AttributeValue
+	index     string
+	rangeName string
+	rangeOp   dynamo.Operator
+	rangeVals []any
+	filters   []sqlFilter
+	limit     int64
+	search    int64
+	order     dynamo.Order
+	startFrom dynamo.PagingKey
+	err       error
+}
+
+func (q *sqlQuery) Range(name string, op dynamo.Operator, values ...any) tableQuery {
+	q.rangeName, q.rangeOp, q.rangeVals = name, op, values
+	return q
+}
+
+func (q *sqlQuery) Index(name string) tableQuery {
+	q.index = name
+	return q
+}
+
+// Project does nothing; we always read whole items.
+func (q *sqlQuery) Project(paths ...string) tableQuery {
+	return q
+}
+
+func (q *sqlQuery) Filter(expr string, args ...any) tableQuery {
+	q.filters = append(q.filters, sqlFilter{expr, args})
+	return q
+}
+
+// Consistent does nothing; SQL reads are always consistent.
+func (q *sqlQuery) Consistent(on bool) tableQuery {
+	return q
+}
+
+func (q *sqlQuery) Limit(limit int64) tableQuery {
+	q.limit = limit
+	return q
+}
+
+func (q *sqlQuery) SearchLimit(limit int64) tableQuery {
+	q.search = limit
+	return q
+}
+
+func (q *sqlQuery) Order(order dynamo.Order) tableQuery {
+	q.order = order
+	return q
+}
+
+func (q *sqlQuery) StartFrom(key dynamo.PagingKey) tableQuery {
+	q.startFrom = key
+	return q
+}
+
+func (q *sqlQuery) One(out any) error {
+	return q.OneWithContext(context.Background(), out)
+}
+
+func (q *sqlQuery) OneWithContext(ctx context.Context, out any) error {
+	items, _, err := q.run(ctx)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return ErrNotFound
+	}
+	return dynamo.UnmarshalItem(items[0], out)
+}
+
+func (q *sqlQuery) All(out any) error {
+	return q.AllWithContext(context.Background(), out)
+}
+
+func (q *sqlQuery) AllWithContext(ctx context.Context, out any) error {
+	_, err := q.AllWithLastEvaluatedKeyContext(ctx, out)
+	return err
+}
+
+func (q *sqlQuery) AllWithLastEvaluatedKey(out any) (dynamo.PagingKey, error) {
+	return q.AllWithLastEvaluatedKeyContext(context.Background(), out)
+}
+
+func (q *sqlQuery) AllWithLastEvaluatedKeyContext(ctx context.Context, out any) (dynamo.PagingKey, error) {
+	items, next, err := q.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return next, unmarshalAll(items, out)
+}
+
+func (q *sqlQuery) Count() (int64, error) {
+	return q.CountWithContext(context.Background())
+}
+
+func (q *sqlQuery) CountWithContext(ctx context.Context) (int64, error) {
+	if len(q.filters) > 0 || q.limit > 0 || q.search > 0 {
+		items, _, err := q.run(ctx)
+		return int64(len(items)), err
+	}
+	query, args, _, err := q.build("count(*)")
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = q.t.db.QueryRowContext(ctx, q.t.db.rebind(query), args...).Scan(&n)
+	return n, err
+}
+
+func (q *sqlQuery) Iter() dynamo.PagingIter {
+	return &sqlIter{q: q}
+}
+
+// orderCols returns the columns results are sorted by.
+// Table keys break ties, so every row has a distinct position to page from.
+func (q *sqlQuery) orderCols() ([]string, error) {
+	var cols []string
+	add := func(col string) {
+		if col == "" || col == q.hashName {
+			return
+		}
+		for _, c := range cols {
+			if c == col {
+				return
+			}
+		}
+		cols = append(cols, col)
+	}
+	if q.index != "" {
+		idx, ok := q.t.indexes[q.index]
+		if !ok {
+			return nil, fmt.Errorf("tube: %s has no index %s", q.t.name, q.index)
+		}
+		add(idx.rng)
+	}
+	add(q.t.hash)
+	add(q.t.rng)
+	return cols, nil
+}
+
+func (q *sqlQuery) build(selectExpr string) (query string, args []any, order []string, err error) {
+	if q.err != nil {
+		return "", nil, nil, q.err
+	}
+	var where []string
+	if q.hashName != "" {
+		if !q.t.hasCol(q.hashName) {
+			return "", nil, nil, fmt.Errorf("tube: %s.%s is not a key", q.t.name, q.hashName)
+		}
+		v, err := sqlKey(q.hashVal)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		where = append(where, quoteIdent(q.hashName)+" = ?")
+		args = append(args, v)
+	}
+
+	order, err = q.orderCols()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if q.index != "" && q.t.indexes[q.index].rng != "" {
+		// items without the index's range key aren't in the index
+		where = append(where, quoteIdent(q.t.indexes[q.index].rng)+" IS NOT NULL")
+	}
+
+	if q.rangeName != "" {
+		if !q.t.hasCol(q.rangeName) {
+			return "", nil, nil, fmt.Errorf("tube: %s.%s is not a key", q.t.name, q.rangeName)
+		}
+		var vals []any
+		for _, v := range q.rangeVals {
+			av, err := dynamo.Marshal(v)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			k, err := sqlKey(av)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			vals = append(vals, k)
+		}
+		cond, err := rangeCond(quoteIdent(q.rangeName), q.rangeOp, vals)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		where = append(where, cond)
+		args = append(args, vals...)
+	}
+
+	if q.startFrom != nil && len(order) > 0 {
+		vals, err := q.t.keyValues(q.startFrom, order)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		cmp := " > "
+		if q.order == dynamo.Descending {
+			cmp = " < "
+		}
+		params := strings.TrimSuffix(strings.Repeat("?, ", len(order)), ", ")
+		where = append(where, "("+quoteIdents(order)+")"+cmp+"("+params+")")
+		args = append(args, vals...)
+	}
+
+	query = "SELECT " + selectExpr + " FROM " + quoteIdent(q.t.name)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if selectExpr == "count(*)" {
+		return query, args, order, nil
+	}
+	if len(order) > 0 {
+		dir := " ASC"
+		if q.order == dynamo.Descending {
+			dir = " DESC"
+		}
+		sorts := make([]string, len(order))
+		for i, col := range order {
+			sorts[i] = quoteIdent(col) + dir
+		}
+		query += " ORDER BY " + strings.Join(sorts, ", ")
+	}
+	if q.search > 0 {
+		query += " LIMIT " + strconv.FormatInt(q.search, 10)
+	}
+	return query, args, order, nil
+}
+
+func rangeCond(col string, op dynamo.Operator, vals []any) (string, error) {
+	want := 1
+	var cond string
+	switch op {
+	case dynamo.Equal:
+		cond = col + " = ?"
+	case dynamo.NotEqual:
+		cond = col + " <> ?"
+	case dynamo.Less:
+		cond = col + " < ?"
+	case dynamo.LessOrEqual:
+		cond = col + " <= ?"
+	case dynamo.Greater:
+		cond = col + " > ?"
+	case dynamo.GreaterOrEqual:
+		cond = col + " >= ?"
+	case dynamo.BeginsWith:
+		if len(vals) == 1 {
+			prefix, ok := vals[0].(string)
+			if !ok {
+				return "", fmt.Errorf("tube: begins_with needs a string")
+			}
+			cond = "substr(" + col + ", 1, " + strconv.Itoa(utf8.RuneCountInString(prefix)) + ") = ?"
+		}
+	case dynamo.Between:
+		cond = col + " BETWEEN ? AND ?"
+		want = 2
+	default:
+		return "", fmt.Errorf("tube: unsupported range operator %s", op)
+	}
+	if len(vals) != want {
+		return "", fmt.Errorf("tube: range operator %s takes %d values, got %d", op, want, len(vals))
+	}
+	return cond, nil
+}
+
+// run executes the query, returning matching items and the key to continue from.
+func (q *sqlQuery) run(ctx context.Context) ([]item, dynamo.PagingKey, error) {
+	query, args, order, err := q.build("doc")
+	if err != nil {
+		return nil, nil, err
+	}
+	filter, err := parseExprs(q.filters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := q.t.db.QueryContext(ctx, q.t.db.rebind(query), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var items []item
+	var last item
+	var evaluated int64
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, nil, err
+		}
+		it, err := decodeDoc(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		evaluated++
+		last = it
+		if !filter.eval(it) {
+			continue
+		}
+		items = append(items, it)
+		if q.limit > 0 && int64(len(items)) == q.limit {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next dynamo.PagingKey
+	hitLimit := q.limit > 0 && int64(len(items)) == q.limit
+	if last != nil && (hitLimit || (q.search > 0 && evaluated == q.search)) {
+		next = make(dynamo.PagingKey)
+		for _, col := range append(order, q.hashName) {
+			if av := last[col]; av != nil {
+				next[col] = av
+			}
+		}
+	}
+	return items, next, nil
+}
+
+// sqlIter iterates over query results, fetching more pages for scans.
+type sqlIter struct {
+	q      *sqlQuery
+	paged  bool
+	items  []item
+	next   dynamo.PagingKey
+	done   bool
+	err    error
+	loaded bool
+}
+
+func (it *sqlIter) Next(out any) bool {
+	return it.NextWithContext(context.Background(), out)
+}
+
+func (it *sqlIter) NextWithContext(ctx context.Context, out any) bool {
+	for len(it.items) == 0 {
+		if it.err != nil || it.done {
+			return false
+		}
+		if it.loaded {
+			if !it.paged || it.next == nil {
+				it.done = true
+				return false
+			}
+			it.q.startFrom = it.next
+		}
+		it.items, it.next, it.err = it.q.run(ctx)
+		it.loaded = true
+	}
+	current := it.items[0]
+	it.items = it.items[1:]
+	if err := dynamo.UnmarshalItem(current, out); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+func (it *sqlIter) Err() error {
+	return it.err
+}
+
+func (it *sqlIter) LastEvaluatedKey() dynamo.PagingKey {
+	return it.next
+}
+
+type sqlScan struct {
+	q *sqlQuery
+}
+
+func (s *sqlScan) Filter(expr string, args ...any) tableScan {
+	s.q.Filter(expr, args...)
+	return s
+}
+
+func (s *sqlScan) Consistent(on bool) tableScan {
+	return s
+}
+
+func (s *sqlScan) All(out any) error {
+	return s.AllWithContext(context.Background(), out)
+}
+
+func (s *sqlScan) AllWithContext(ctx context.Context, out any) error {
+	iter := s.Iter()
+	var items []item
+	for {
+		var it item
+		if !iter.NextWithContext(ctx, &it) {
+			break
+		}
+		items = append(items, it)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return unmarshalAll(items, out)
+}
+
+func (s *sqlScan) Iter() dynamo.PagingIter {
+	s.q.search = sqlScanPage
+	return &sqlIter{q: s.q, paged: true}
+}
+
+type sqlPut struct {
+	t     sqlTable
+	item  item
+	conds []sqlFilter
+	err   error
+}
+
+func (p *sqlPut) If(expr string, args ...any) tablePut {
+	p.conds = append(p.conds, sqlFilter{expr, args})
+	return p
+}
+
+func (p *sqlPut) Run() error {
+	return p.RunWithContext(context.Background())
+}
+
+func (p *sqlPut) RunWithContext(ctx context.Context) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.conds) == 0 {
+		return p.t.upsert(ctx, p.t.db, p.item)
+	}
+	_, err := p.run(ctx)
+	return err
+}
+
+func (p *sqlPut) OldValue(out any) error {
+	return p.OldValueWithContext(context.Background(), out)
+}
+
+func (p *sqlPut) OldValueWithContext(ctx context.Context, out any) error {
+	old, err := p.run(ctx)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNotFound
+	}
+	return dynamo.UnmarshalItem(old, out)
+}
+
+func (p *sqlPut) run(ctx context.Context) (item, error) {
+	var old item
+	err := p.t.db.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		old, err = p.apply(ctx, tx)
+		return err
+	})
+	return old, err
+}
+
+// apply runs the put in tx, returning the item it replaced.
+func (p *sqlPut) apply(ctx context.Context, tx *sql.Tx) (item, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	cond, err := parseExprs(p.conds)
+	if err != nil {
+		return nil, err
+	}
+	old, _, err := p.t.modify(ctx, tx, p.item, func(old item) (item, error) {
+		if !cond.eval(orEmpty(old)) {
+			return nil, errCondCheck
+		}
+		return p.item, nil
+	})
+	return old, err
+}
+
+type sqlUpdate struct {
+	t     sqlTable
+	key   item
+	ops   []func(it item) error
+	conds []sqlFilter
+	err   error
+}
+
+func (u *sqlUpdate) setErr(err error) {
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *sqlUpdate) Range(name string, value any) Update {
+	av, err := dynamo.Marshal(value)
+	u.setErr(err)
+	u.key[name] = av
+	return u
+}
+
+func (u *sqlUpdate) Set(path string, value any) Update {
+	av, err := dynamo.Marshal(value)
+	if err != nil {
+		u.setErr(err)
+		return u
+	}
+	if av == nil {
+		// like dynamo, empty values remove the attribute
+		return u.Remove(path)
+	}
+	return u.op(path, func(it item, segs []string) error {
+		return setPath(it, segs, av)
+	})
+}
+
+func (u *sqlUpdate) Add(path string, value any) Update {
+	av, err := dynamo.Marshal(value)
+	if err != nil {
+		u.setErr(err)
+		return u
+	}
+	return u.op(path, func(it item, segs []string) error {
+		return addPath(it, segs, av)
+	})
+}
+
+func (u *sqlUpdate) AddStringsToSet(path string, values ...string) Update {
+	set := make([]*string, len(values))
+	for i := range values {
+		set[i] = &values[i]
+	}
+	return u.op(path, func(it item, segs []string) error {
+		return addPath(it, segs, &dynamodb.AttributeValue{SS: set})
+	})
+}
+
+func (u *sqlUpdate) AddIntsToSet(path string, values ...int) Update {
+	set := make([]*string, len(values))
+	for i, v := range values {
+		n := strconv.Itoa(v)
+		set[i] = &n
+	}
+	return u.op(path, func(it item, segs []string) error {
+		return addPath(it, segs, &dynamodb.AttributeValue{NS: set})
+	})
+}
+
+func (u *sqlUpdate) Remove(paths ...string) Update {
+	for _, path := range paths {
+		u.op(path, func(it item, segs []string) error {
+			removePath(it, segs)
+			return nil
+		})
+	}
+	return u
+}
+
+func (u *sqlUpdate) op(path string, fn func(it item, segs []string) error) Update {
+	segs, err := parsePath(path)
+	if err != nil {
+		u.setErr(err)
+		return u
+	}
+	u.ops = append(u.ops, func(it item) error {
+		return fn(it, segs)
+	})
+	return u
+}
+
+func (u *sqlUpdate) If(expr string, args ...any) Update {
+	u.conds = append(u.conds, sqlFilter{expr, args})
+	return u
+}
+
+func (u *sqlUpdate) Run() error {
+	return u.RunWithContext(context.Background())
+}
+
+func (u *sqlUpdate) RunWithContext(ctx context.Context) error {
+	_, err := u.run(ctx)
+	return err
+}
+
+func (u *sqlUpdate) Value(out any) error {
+	return u.ValueWithContext(context.Background(), out)
+}
+
+func (u *sqlUpdate) ValueWithContext(ctx context.Context, out any) error {
+	updated, err := u.run(ctx)
+	if err != nil {
+		return err
+	}
+	return dynamo.UnmarshalItem(updated, out)
+}
+
+func (u *sqlUpdate) run(ctx context.Context) (item, error) {
+	var updated item
+	err := u.t.db.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		updated, err = u.apply(ctx, tx)
+		return err
+	})
+	return updated, err
+}
+
+// apply runs the update in tx. Like DynamoDB, updating a missing item creates it.
+func (u *sqlUpdate) apply(ctx context.Context, tx *sql.Tx) (item, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	cond, err := parseExprs(u.conds)
+	if err != nil {
+		return nil, err
+	}
+	_, updated, err := u.t.modify(ctx, tx, u.key, func(old item) (item, error) {
+		if !cond.eval(orEmpty(old)) {
+			return nil, errCondCheck
+		}
+		it := make(item, len(old)+len(u.key))
+		if old != nil {
+			// round trip to copy nested values too
+			doc, err := encodeDoc(old)
+			if err != nil {
+				return nil, err
+			}
+			if it, err = decodeDoc([]byte(doc)); err != nil {
+				return nil, err
+			}
+		}
+		for k, v := range u.key {
+			it[k] = v
+		}
+		for _, op := range u.ops {
+			if err := op(it); err != nil {
+				return nil, err
+			}
+		}
+		return it, nil
+	})
+	return updated, err
+}
+
+type sqlDelete struct {
+	t     sqlTable
+	key   item
+	conds []sqlFilter
+	err   error
+}
+
+func (d *sqlDelete) Range(name string, value any) tableDelete {
+	av, err := dynamo.Marshal(value)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	d.key[name] = av
+	return d
+}
+
+func (d *sqlDelete) If(expr string, args ...any) tableDelete {
+	d.conds = append(d.conds, sqlFilter{expr, args})
+	return d
+}
+
+func (d *sqlDelete) Run() error {
+	return d.RunWithContext(context.Background())
+}
+
+func (d *sqlDelete) RunWithContext(ctx context.Context) error {
+	return d.t.db.inTx(ctx, func(tx *sql.Tx) error {
+		return d.apply(ctx, tx)
+	})
+}
+
+// apply runs the delete in tx.
+func (d *sqlDelete) apply(ctx context.Context, tx *sql.Tx) error {
+	if d.err != nil {
+		return d.err
+	}
+	cond, err := parseExprs(d.conds)
+	if err != nil {
+		return err
+	}
+	_, _, err = d.t.modify(ctx, tx, d.key, func(old item) (item, error) {
+		if !cond.eval(orEmpty(old)) {
+			return nil, errCondCheck
+		}
+		return nil, nil
+	})
+	return err
+}
+
+type sqlBatch struct {
+	t sqlTable
+}
+
+func (b sqlBatch) Get(keys ...dynamo.Keyed) tableBatchGet {
+	return &sqlBatchGet{t: b.t, keys: keys}
+}
+
+func (b sqlBatch) Write() tableBatchWrite {
+	return &sqlBatchWrite{t: b.t}
+}
+
+// key returns the primary key item for k.
+func (t sqlTable) key(k dynamo.Keyed) (item, error) {
+	key := make(item, 2)
+	hash, err := dynamo.Marshal(k.HashKey())
+	if err != nil {
+		return nil, err
+	}
+	key[t.hash] = hash
+	if t.rng != "" {
+		rng, err := dynamo.Marshal(k.RangeKey())
+		if err != nil {
+			return nil, err
+		}
+		key[t.rng] = rng
+	}
+	return key, nil
+}
+
+type sqlBatchGet struct {
+	t    sqlTable
+	keys []dynamo.Keyed
+}
+
+func (b *sqlBatchGet) And(keys ...dynamo.Keyed) tableBatchGet {
+	b.keys = append(b.keys, keys...)
+	return b
+}
+
+func (b *sqlBatchGet) All(out any) error {
+	return b.AllWithContext(context.Background(), out)
+}
+
+func (b *sqlBatchGet) AllWithContext(ctx context.Context, out any) error {
+	items, err := b.run(ctx)
+	if err != nil {
+		return err
+	}
+	return unmarshalAll(items, out)
+}
+
+func (b *sqlBatchGet) Iter() dynamo.Iter {
+	items, err := b.run(context.Background())
+	return &sqlIter{items: items, err: err, loaded: true}
+}
+
+// run fetches every key, failing with ErrNotFound if none of them exist.
+func (b *sqlBatchGet) run(ctx context.Context) ([]item, error) {
+	var items []item
+	for _, k := range b.keys {
+		key, err := b.t.key(k)
+		if err != nil {
+			return nil, err
+		}
+		it, err := b.t.load(ctx, b.t.db, key, false)
+		if err != nil {
+			return nil, err
+		}
+		if it != nil {
+			items = append(items, it)
+		}
+	}
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+	return items, nil
+}
+
+type sqlBatchWrite struct {
+	t       sqlTable
+	puts    []item
+	deletes []dynamo.Keyed
+	err     error
+}
+
+func (b *sqlBatchWrite) Put(items ...any) tableBatchWrite {
+	for _, it := range items {
+		encoded, err := dynamo.MarshalItem(it)
+		if err != nil && b.err == nil {
+			b.err = err
+		}
+		b.puts = append(b.puts, encoded)
+	}
+	return b
+}
+
+func (b *sqlBatchWrite) Delete(keys ...dynamo.Keyed) tableBatchWrite {
+	b.deletes = append(b.deletes, keys...)
+	return b
+}
+
+func (b *sqlBatchWrite) Run() (int, error) {
+	return b.RunWithContext(context.Background())
+}
+
+func (b *sqlBatchWrite) RunWithContext(ctx context.Context) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	err := b.t.db.inTx(ctx, func(tx *sql.Tx) error {
+		for _, it := range b.puts {
+			if err := b.t.upsert(ctx, tx, it); err != nil {
+				return err
+			}
+		}
+		for _, k := range b.deletes {
+			key, err := b.t.key(k)
+			if err != nil {
+				return err
+			}
+			if err := b.t.remove(ctx, tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b.puts) + len(b.deletes), nil
+}
+
+type sqlWriteTx struct {
+	db  *sqlDB
+	ops []func(ctx context.Context, tx *sql.Tx) error
+}
+
+func (tx *sqlWriteTx) Put(p tablePut) writeTx {
+	put := p.(*sqlPut)
+	tx.ops = append(tx.ops, func(ctx context.Context, sqltx *sql.Tx) error {
+		_, err := put.apply(ctx, sqltx)
+		return err
+	})
+	return tx
+}
+
+func (tx *sqlWriteTx) Update(u Update) writeTx {
+	update := unwrapUpdate(u).(*sqlUpdate)
+	tx.ops = append(tx.ops, func(ctx context.Context, sqltx *sql.Tx) error {
+		_, err := update.apply(ctx, sqltx)
+		return err
+	})
+	return tx
+}
+
+func (tx *sqlWriteTx) Delete(d tableDelete) writeTx {
+	tx.ops = append(tx.ops, d.(*sqlDelete).apply)
+	return tx
+}
+
+func (tx *sqlWriteTx) Run() error {
+	return tx.RunWithContext(context.Background())
+}
+
+func (tx *sqlWriteTx) RunWithContext(ctx context.Context) error {
+	return tx.db.inTx(ctx, func(sqltx *sql.Tx) error {
+		for _, op := range tx.ops {
+			if err := op(ctx, sqltx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func orEmpty(it item) item {
+	if it == nil {
+		return item{}
+	}
+	return it
+}
+
+// unmarshalAll appends items to out, a pointer to a slice.
+func unmarshalAll(items []item, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("tube: can't unmarshal to %T, need pointer to slice", out)
+	}
+	slice := rv.Elem()
+	for _, it := range items {
+		elem := reflect.New(slice.Type().Elem())
+		if err := dynamo.UnmarshalItem(it, elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+// docValue is an attribute value in DynamoDB's JSON format, without the empty fields.
+type docValue struct {
+	S    *string               `json:"S,omitempty"`
+	N    *string               `json:"N,omitempty"`
+	B    []byte                `json:"B,omitempty"`
+	BOOL *bool                 `json:"BOOL,omitempty"`
+	NULL *bool                 `json:"NULL,omitempty"`
+	SS   []*string             `json:"SS,omitempty"`
+	NS   []*string             `json:"NS,omitempty"`
+	BS   [][]byte              `json:"BS,omitempty"`
+	L    *[]*docValue          `json:"L,omitempty"`
+	M    *map[string]*docValue `json:"M,omitempty"`
+}
+
+func encodeDoc(it item) (string, error) {
+	doc := make(map[string]*docValue, len(it))
+	for k, av := range it {
+		doc[k] = toDocValue(av)
+	}
+	data, err := json.Marshal(doc)
+	return string(data), err
+}
+
+func decodeDoc(data []byte) (item, error) {
+	var doc map[string]*docValue
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	it := make(item, len(doc))
+	for k, v := range doc {
+		it[k] = fromDocValue(v)
+	}
+	return it, nil
+}
+
+func toDocValue(av *dynamodb.AttributeValue) *docValue {
+	v := &docValue{S: av.S, N: av.N, B: av.B, BOOL: av.BOOL, NULL: av.NULL, SS: av.SS, NS: av.NS, BS: av.BS}
+	if av.L != nil {
+		l := make([]*docValue, len(av.L))
+		for i, elem := range av.L {
+			l[i] = toDocValue(elem)
+		}
+		v.L = &l
+	}
+	if av.M != nil {
+		m := make(map[string]*docValue, len(av.M))
+		for k, elem := range av.M {
+			m[k] = toDocValue(elem)
+		}
+		v.M = &m
+	}
+	return v
+}
+
+func fromDocValue(v *docValue) *dynamodb.AttributeValue {
+	av := &dynamodb.AttributeValue{S: v.S, N: v.N, B: v.B, BOOL: v.BOOL, NULL: v.NULL, SS: v.SS, NS: v.NS, BS: v.BS}
+	if v.L != nil {
+		av.L = make([]*dynamodb.AttributeValue, len(*v.L))
+		for i, elem := range *v.L {
+			av.L[i] = fromDocValue(elem)
+		}
+	}
+	if v.M != nil {
+		av.M = make(map[string]*dynamodb.AttributeValue, len(*v.M))
+		for k, elem := range *v.M {
+			av.M[k] = fromDocValue(elem)
+		}
+	}
+	return av
+}
@@ -0,0 +1,60 @@
+package tube
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSQLAddCols(t *testing.T) {
+	ctx := testDB(t)
+	sdb := db.(*sqlDB)
+
+	type before struct {
+		ID   string `dynamo:",hash"`
+		Kind string
+	}
+	type after struct {
+		ID   string `dynamo:",hash"`
+		Kind string `index:"Kind-ID-index,hash"`
+	}
+	use := func(model any) {
+		t.Helper()
+		schema, err := sqlSchemaOf(dbPrefix+"Things", model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sdb.tables[schema.name] = schema
+		if err := CreateTables(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	use(before{})
+	// more than a page, to check it picks up where it left off
+	for i := 0; i < sqlScanPage+5; i++ {
+		kind := "odd"
+		if i%2 == 0 {
+			kind = "even"
+		}
+		thing := before{ID: fmt.Sprintf("%04d", i), Kind: kind}
+		if err := dbTable("Things").Put(thing).RunWithContext(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	use(after{})
+	var even []after
+	if err := dbTable("Things").Get("Kind", "even").Index("Kind-ID-index").AllWithContext(ctx, &even); err != nil {
+		t.Fatal(err)
+	}
+	if want := (sqlScanPage + 5 + 1) / 2; len(even) != want {
+		t.Errorf("even things: %d, want %d", len(even), want)
+	}
+	if !slices.IsSortedFunc(even, func(a, b after) int { return strings.Compare(a.ID, b.ID) }) {
+		t.Error("not sorted by ID")
+	}
+	// running again leaves it alone
+	use(after{})
+}
@@ -0,0 +1,542 @@
+package tube
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+// item is a DynamoDB item, the way SQL databases store it too.
+type item = map[string]*dynamodb.AttributeValue
+
+// sqlExpr is a condition or filter evaluated against an item.
+// It supports the subset of DynamoDB's expression syntax that we use:
+// comparisons, attribute_exists, attribute_not_exists, begins_with, AND, OR, NOT, and parentheses.
+type sqlExpr interface {
+	eval(it item) bool
+}
+
+// parseExprs parses several expressions that must all be true.
+func parseExprs(exprs []sqlFilter) (sqlExpr, error) {
+	var all andExpr
+	for _, f := range exprs {
+		e, err := parseExpr(f.expr, f.args)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, e)
+	}
+	return all, nil
+}
+
+type sqlFilter struct {
+	expr string
+	args []any
+}
+
+func parseExpr(expr string, args []any) (sqlExpr, error) {
+	p := &exprParser{toks: lexExpr(expr), args: args}
+	e, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("tube: bad expression %q: %w", expr, err)
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("tube: bad expression %q: unexpected %q", expr, tok.text)
+	}
+	return e, nil
+}
+
+// parsePath parses a document path like Info.Artist or Info.'Comment'.
+func parsePath(path string) ([]string, error) {
+	p := &exprParser{toks: lexExpr(path)}
+	segs, err := p.path()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tube: bad path %q: %w", path, err)
+	}
+	return segs, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokName // 'quoted'
+	tokArg  // ?
+	tokOp
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func lexExpr(expr string) []token {
+	var toks []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '\'':
+			end := strings.IndexByte(expr[i+1:], '\'')
+			if end == -1 {
+				end = len(expr) - i - 1
+			}
+			toks = append(toks, token{tokName, expr[i+1 : i+1+end]})
+			i += end + 2
+		case c == '?':
+			toks = append(toks, token{tokArg, "?"})
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '.':
+			toks = append(toks, token{tokPunct, string(c)})
+			i++
+		case c == '=' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				op += string(expr[i+1])
+			}
+			toks = append(toks, token{tokOp, op})
+			i += len(op)
+		default:
+			start := i
+			for i < len(expr) && isIdentByte(expr[i]) {
+				i++
+			}
+			if i == start {
+				toks = append(toks, token{tokPunct, string(c)})
+				i++
+				continue
+			}
+			toks = append(toks, token{tokIdent, expr[start:i]})
+		}
+	}
+	return toks
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type exprParser struct {
+	toks []token
+	pos  int
+	args []any
+	argn int
+}
+
+func (p *exprParser) peek() token {
+	if p.pos >= len(p.toks) {
+		return token{kind: tokEOF}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *exprParser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokIdent && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(punct string) error {
+	if tok := p.next(); tok.kind != tokPunct || tok.text != punct {
+		return fmt.Errorf("expected %q, got %q", punct, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) or() (sqlExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) and() (sqlExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) not() (sqlExpr, error) {
+	if p.keyword("NOT") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (sqlExpr, error) {
+	if tok := p.peek(); tok.kind == tokPunct && tok.text == "(" {
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+
+	for _, fn := range []string{"attribute_exists", "attribute_not_exists", "begins_with"} {
+		if len(p.toks) > p.pos+1 && p.toks[p.pos+1].text == "(" && p.keyword(fn) {
+			p.next()
+			path, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			var e sqlExpr
+			switch fn {
+			case "attribute_exists":
+				e = existsExpr{path, true}
+			case "attribute_not_exists":
+				e = existsExpr{path, false}
+			case "begins_with":
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				prefix, err := p.operand()
+				if err != nil {
+					return nil, err
+				}
+				e = beginsWithExpr{pathOperand(path), prefix}
+			}
+			return e, p.expect(")")
+		}
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected comparison, got %q", op.text)
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return cmpExpr{op.text, left, right}, nil
+}
+
+func (p *exprParser) operand() (operand, error) {
+	if p.peek().kind == tokArg {
+		p.next()
+		if p.argn >= len(p.args) {
+			return nil, fmt.Errorf("not enough arguments")
+		}
+		av, err := dynamo.Marshal(p.args[p.argn])
+		p.argn++
+		if err != nil {
+			return nil, err
+		}
+		return valueOperand{av}, nil
+	}
+	path, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand(path), nil
+}
+
+func (p *exprParser) path() ([]string, error) {
+	var segs []string
+	for {
+		tok := p.next()
+		if tok.kind != tokIdent && tok.kind != tokName {
+			return nil, fmt.Errorf("expected attribute name, got %q", tok.text)
+		}
+		segs = append(segs, tok.text)
+		if next := p.peek(); next.kind != tokPunct || next.text != "." {
+			return segs, nil
+		}
+		p.next()
+	}
+}
+
+type operand interface {
+	value(it item) *dynamodb.AttributeValue
+}
+
+type pathOperand []string
+
+func (path pathOperand) value(it item) *dynamodb.AttributeValue {
+	return lookupPath(it, path)
+}
+
+type valueOperand struct {
+	av *dynamodb.AttributeValue
+}
+
+func (v valueOperand) value(item) *dynamodb.AttributeValue {
+	return v.av
+}
+
+type andExpr []sqlExpr
+
+func (e andExpr) eval(it item) bool {
+	for _, sub := range e {
+		if !sub.eval(it) {
+			return false
+		}
+	}
+	return true
+}
+
+type orExpr []sqlExpr
+
+func (e orExpr) eval(it item) bool {
+	for _, sub := range e {
+		if sub.eval(it) {
+			return true
+		}
+	}
+	return false
+}
+
+type notExpr struct {
+	sqlExpr
+}
+
+func (e notExpr) eval(it item) bool {
+	return !e.sqlExpr.eval(it)
+}
+
+type existsExpr struct {
+	path   []string
+	exists bool
+}
+
+func (e existsExpr) eval(it item) bool {
+	return (lookupPath(it, e.path) != nil) == e.exists
+}
+
+type beginsWithExpr struct {
+	str, prefix operand
+}
+
+func (e beginsWithExpr) eval(it item) bool {
+	str, prefix := e.str.value(it), e.prefix.value(it)
+	if str == nil || prefix == nil || str.S == nil || prefix.S == nil {
+		return false
+	}
+	return strings.HasPrefix(*str.S, *prefix.S)
+}
+
+type cmpExpr struct {
+	op          string
+	left, right operand
+}
+
+func (e cmpExpr) eval(it item) bool {
+	left, right := e.left.value(it), e.right.value(it)
+	if left == nil || right == nil {
+		return e.op == "<>" && left != right
+	}
+	cmp, ok := compareAV(left, right)
+	if !ok {
+		return e.op == "<>"
+	}
+	switch e.op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareAV compares two values of the same type.
+// Only strings and numbers are ordered; other types are only equal or not.
+func compareAV(a, b *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.N != nil && b.N != nil:
+		x, okx := new(big.Float).SetString(*a.N)
+		y, oky := new(big.Float).SetString(*b.N)
+		if !okx || !oky {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case a.BOOL != nil && b.BOOL != nil:
+		if *a.BOOL == *b.BOOL {
+			return 0, true
+		}
+		return 1, true
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	if avType(a) != avType(b) {
+		return 0, false
+	}
+	return 1, true
+}
+
+func avType(av *dynamodb.AttributeValue) string {
+	switch {
+	case av.S != nil:
+		return "S"
+	case av.N != nil:
+		return "N"
+	case av.B != nil:
+		return "B"
+	case av.BOOL != nil:
+		return "BOOL"
+	case av.NULL != nil:
+		return "NULL"
+	case av.SS != nil:
+		return "SS"
+	case av.NS != nil:
+		return "NS"
+	case av.BS != nil:
+		return "BS"
+	case av.L != nil:
+		return "L"
+	case av.M != nil:
+		return "M"
+	}
+	return ""
+}
+
+func lookupPath(it item, path []string) *dynamodb.AttributeValue {
+	av := it[path[0]]
+	for _, seg := range path[1:] {
+		if av == nil || av.M == nil {
+			return nil
+		}
+		av = av.M[seg]
+	}
+	return av
+}
+
+// parentOf returns the map holding the last element of path.
+func parentOf(it item, path []string) (item, error) {
+	parent := it
+	for _, seg := range path[:len(path)-1] {
+		av := parent[seg]
+		if av == nil || av.M == nil {
+			return nil, fmt.Errorf("tube: invalid document path %s", strings.Join(path, "."))
+		}
+		parent = av.M
+	}
+	return parent, nil
+}
+
+func setPath(it item, path []string, av *dynamodb.AttributeValue) error {
+	parent, err := parentOf(it, path)
+	if err != nil {
+		return err
+	}
+	parent[path[len(path)-1]] = av
+	return nil
+}
+
+func removePath(it item, path []string) {
+	if parent, err := parentOf(it, path); err == nil {
+		delete(parent, path[len(path)-1])
+	}
+}
+
+// addPath adds a number to a number or values to a set, like DynamoDB's ADD action.
+func addPath(it item, path []string, av *dynamodb.AttributeValue) error {
+	parent, err := parentOf(it, path)
+	if err != nil {
+		return err
+	}
+	name := path[len(path)-1]
+	old := parent[name]
+	switch {
+	case old == nil:
+		parent[name] = av
+	case old.N != nil && av.N != nil:
+		sum, err := addNumbers(*old.N, *av.N)
+		if err != nil {
+			return err
+		}
+		parent[name] = &dynamodb.AttributeValue{N: &sum}
+	case old.SS != nil && av.SS != nil:
+		parent[name] = &dynamodb.AttributeValue{SS: union(old.SS, av.SS)}
+	case old.NS != nil && av.NS != nil:
+		parent[name] = &dynamodb.AttributeValue{NS: union(old.NS, av.NS)}
+	default:
+		return fmt.Errorf("tube: can't add %s to %s at %s", avType(av), avType(old), name)
+	}
+	return nil
+}
+
+func addNumbers(a, b string) (string, error) {
+	x, errx := strconv.ParseInt(a, 10, 64)
+	y, erry := strconv.ParseInt(b, 10, 64)
+	if errx == nil && erry == nil {
+		return strconv.FormatInt(x+y, 10), nil
+	}
+	fx, okx := new(big.Float).SetString(a)
+	fy, oky := new(big.Float).SetString(b)
+	if !okx || !oky {
+		return "", fmt.Errorf("tube: can't add %s and %s", a, b)
+	}
+	return fx.Add(fx, fy).Text('f', -1), nil
+}
+
+func union(a, b []*string) []*string {
+	seen := make(map[string]bool, len(a))
+	out := make([]*string, 0, len(a)+len(b))
+	for _, set := range [][]*string{a, b} {
+		for _, v := range set {
+			if seen[*v] {
+				continue
+			}
+			seen[*v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,324 @@
+package tube
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/guregu/dynamo"
+)
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		expr string
+		args []any
+		ok   bool
+	}{
+		{"'Plays' > ?", []any{1}, true},
+		{"Plays >= ? AND Plays <= ?", []any{1, 2}, true},
+		{"NOT (A = ? OR B <> ?)", []any{1, 2}, true},
+		{"Info.Artist = ?", []any{"x"}, true},
+		{"Info.'Comment' = ?", []any{"x"}, true},
+		{"attribute_exists('ID')", nil, true},
+		{"attribute_not_exists(Info.Artist)", nil, true},
+		{"begins_with('Title', ?)", []any{"a"}, true},
+		{"begins_with(Title, Prefix)", nil, true},
+		{"A = ?", nil, false},
+		{"A = ? B", []any{1}, false},
+		{"A ?", []any{1}, false},
+		{"(A = ?", []any{1}, false},
+		{"attribute_exists(?)", []any{"ID"}, false},
+		{"begins_with(Title ?)", []any{"a"}, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		_, err := parseExpr(test.expr, test.args)
+		if (err == nil) != test.ok {
+			t.Errorf("parseExpr(%q): err = %v, want ok: %v", test.expr, err, test.ok)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"Plays", []string{"Plays"}},
+		{"'Plays'", []string{"Plays"}},
+		{"Info.Artist", []string{"Info", "Artist"}},
+		{"Info.'Comment'", []string{"Info", "Comment"}},
+		{"Info.", nil},
+		{"Info Artist", nil},
+	}
+	for _, test := range tests {
+		got, err := parsePath(test.path)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parsePath(%q) = %v, want error", test.path, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsePath(%q) = %v, %v; want %v", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestEvalExpr(t *testing.T) {
+	it, err := dynamo.MarshalItem(map[string]any{
+		"ID":     "abc",
+		"Title":  "Hello World",
+		"Plays":  10,
+		"Rating": 2.5,
+		"Cold":   true,
+		"Tags":   []string{"rock"},
+		"Info":   map[string]any{"Artist": "Someone", "Year": 1999},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		args []any
+		want bool
+	}{
+		{"ID = ?", []any{"abc"}, true},
+		{"ID <> ?", []any{"abc"}, false},
+		{"Plays > ?", []any{9}, true},
+		{"Plays >= ? AND Plays <= ?", []any{10, 10}, true},
+		{"Plays < ?", []any{9}, false},
+		// numbers compare as numbers, not strings
+		{"Plays > ?", []any{9.5}, true},
+		{"Rating < ?", []any{10}, true},
+		{"Title < ?", []any{"Help"}, true},
+		{"Cold = ?", []any{true}, true},
+		{"Cold <> ?", []any{false}, true},
+		{"Info.Artist = ?", []any{"Someone"}, true},
+		{"Info.Year > ?", []any{2000}, false},
+		{"NOT Plays = ?", []any{10}, false},
+		{"Plays = ? OR ID = ?", []any{1, "abc"}, true},
+		{"NOT (Plays = ? OR ID = ?)", []any{1, "abc"}, false},
+		{"Plays = ? AND (ID = ? OR ID = ?)", []any{10, "x", "abc"}, true},
+		{"Plays = ? AND ID = ? OR ID = ?", []any{1, "x", "abc"}, true},
+
+		// comparing different types is never equal
+		{"Plays = ?", []any{"10"}, false},
+		{"Plays <> ?", []any{"10"}, true},
+		{"Plays > ?", []any{"1"}, false},
+
+		// missing attributes fail every comparison but <>
+		{"Missing = ?", []any{1}, false},
+		{"Missing <> ?", []any{1}, true},
+		{"Missing < ?", []any{1}, false},
+		{"Missing >= ?", []any{1}, false},
+		{"Info.Missing = ?", []any{"x"}, false},
+		{"ID.Missing = ?", []any{"x"}, false},
+		{"NOT Missing = ?", []any{1}, true},
+
+		{"attribute_exists('ID')", nil, true},
+		{"attribute_exists(Info.Artist)", nil, true},
+		{"attribute_exists(Info.Missing)", nil, false},
+		{"attribute_exists(Missing.Artist)", nil, false},
+		{"attribute_not_exists(ID)", nil, false},
+		{"attribute_not_exists(Missing)", nil, true},
+		{"attribute_exists(ID) AND attribute_not_exists(Missing)", nil, true},
+
+		{"begins_with(Title, ?)", []any{"Hello"}, true},
+		{"begins_with(Title, ?)", []any{"World"}, false},
+		{"begins_with(Title, ?)", []any{"Hello World"}, true},
+		{"begins_with(Title, ID)", nil, false},
+		{"begins_with(Missing, ?)", []any{"x"}, false},
+		// only strings have prefixes
+		{"begins_with(Plays, ?)", []any{"1"}, false},
+	}
+	for _, test := range tests {
+		e, err := parseExpr(test.expr, test.args)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", test.expr, err)
+			continue
+		}
+		if got := e.eval(it); got != test.want {
+			t.Errorf("%q %v = %v, want %v", test.expr, test.args, got, test.want)
+		}
+	}
+}
+
+func TestSQLUpdate(t *testing.T) {
+	ctx := testDB(t)
+	table := dbTable(tableTombstones)
+
+	type result struct {
+		Plays int
+		Name  string
+		Tags  []string `dynamo:",set"`
+		Info  map[string]string
+	}
+	get := func() result {
+		t.Helper()
+		var got result
+		if err := table.Get("UserID", 1).Range("ID", dynamo.Equal, "x").Consistent(true).OneWithContext(ctx, &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name     string
+		update   func(Update) Update
+		want     result
+		condFail bool
+	}{
+		{
+			name:   "ADD to a missing item creates it",
+			update: func(u Update) Update { return u.Add("Plays", 1) },
+			want:   result{Plays: 1},
+		},
+		{
+			name:   "ADD to a number",
+			update: func(u Update) Update { return u.Add("Plays", 2) },
+			want:   result{Plays: 3},
+		},
+		{
+			name:   "ADD a negative number",
+			update: func(u Update) Update { return u.Add("Plays", -5) },
+			want:   result{Plays: -2},
+		},
+		{
+			name: "SET",
+			update: func(u Update) Update {
+				return u.Set("Plays", 1).Set("Name", "a").Set("Info", map[string]string{"Artist": "b"})
+			},
+			want: result{Plays: 1, Name: "a", Info: map[string]string{"Artist": "b"}},
+		},
+		{
+			name:   "SET a nested path",
+			update: func(u Update) Update { return u.Set("Info.Album", "c") },
+			want:   result{Plays: 1, Name: "a", Info: map[string]string{"Artist": "b", "Album": "c"}},
+		},
+		{
+			name:   "SET an empty value removes it",
+			update: func(u Update) Update { return u.Set("Name", "") },
+			want:   result{Plays: 1, Info: map[string]string{"Artist": "b", "Album": "c"}},
+		},
+		{
+			name:   "ADD to a set",
+			update: func(u Update) Update { return u.AddStringsToSet("Tags", "rock", "pop") },
+			want:   result{Plays: 1, Tags: []string{"rock", "pop"}, Info: map[string]string{"Artist": "b", "Album": "c"}},
+		},
+		{
+			name:   "ADD to a set skips duplicates",
+			update: func(u Update) Update { return u.AddStringsToSet("Tags", "pop", "jazz") },
+			want:   result{Plays: 1, Tags: []string{"rock", "pop", "jazz"}, Info: map[string]string{"Artist": "b", "Album": "c"}},
+		},
+		{
+			name:   "REMOVE",
+			update: func(u Update) Update { return u.Remove("Tags", "Info.Artist") },
+			want:   result{Plays: 1, Info: map[string]string{"Album": "c"}},
+		},
+		{
+			name:   "REMOVE a missing attribute",
+			update: func(u Update) Update { return u.Remove("Missing", "Missing.Nested") },
+			want:   result{Plays: 1, Info: map[string]string{"Album": "c"}},
+		},
+		{
+			name:   "passing condition",
+			update: func(u Update) Update { return u.Add("Plays", 1).If("Plays = ? AND attribute_exists(Info.Album)", 1) },
+			want:   result{Plays: 2, Info: map[string]string{"Album": "c"}},
+		},
+		{
+			name:     "failing condition",
+			update:   func(u Update) Update { return u.Add("Plays", 1).If("Plays = ?", 1) },
+			want:     result{Plays: 2, Info: map[string]string{"Album": "c"}},
+			condFail: true,
+		},
+		{
+			name:     "failing condition on a missing attribute",
+			update:   func(u Update) Update { return u.Set("Name", "z").If("Missing = ?", 1) },
+			want:     result{Plays: 2, Info: map[string]string{"Album": "c"}},
+			condFail: true,
+		},
+		{
+			name:     "every condition has to pass",
+			update:   func(u Update) Update { return u.Set("Name", "z").If("Plays = ?", 2).If("attribute_not_exists(Info)") },
+			want:     result{Plays: 2, Info: map[string]string{"Album": "c"}},
+			condFail: true,
+		},
+	}
+	for _, test := range tests {
+		err := test.update(table.Update("UserID", 1).Range("ID", "x")).RunWithContext(ctx)
+		if test.condFail != dynamo.IsCondCheckFailed(err) || (!test.condFail && err != nil) {
+			t.Fatalf("%s: err = %v, want condition failure: %v", test.name, err, test.condFail)
+		}
+		if got := get(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	// ADD can't mix types, and a failed update doesn't change anything
+	err := table.Update("UserID", 1).Range("ID", "x").Add("Plays", 1).Add("Info", 1).RunWithContext(ctx)
+	if err == nil {
+		t.Error("adding a number to a map: no error")
+	}
+	if got := get(); got.Plays != 2 {
+		t.Errorf("Plays after a failed update: %d, want 2", got.Plays)
+	}
+}
+
+func TestSQLConditionalWrites(t *testing.T) {
+	ctx := testDB(t)
+	table := dbTable(tableTombstones)
+
+	tests := []struct {
+		name     string
+		run      func() error
+		condFail bool
+	}{
+		{
+			name: "put if not exists",
+			run: func() error {
+				return table.Put(Tombstone{UserID: 1, ID: "x"}).If("attribute_not_exists('ID')").RunWithContext(ctx)
+			},
+		},
+		{
+			name: "put if not exists again",
+			run: func() error {
+				return table.Put(Tombstone{UserID: 1, ID: "x"}).If("attribute_not_exists('ID')").RunWithContext(ctx)
+			},
+			condFail: true,
+		},
+		{
+			name: "update if exists",
+			run: func() error {
+				return table.Update("UserID", 1).Range("ID", "missing").Set("Plays", 1).If("attribute_exists('ID')").RunWithContext(ctx)
+			},
+			condFail: true,
+		},
+		{
+			name: "delete if exists",
+			run: func() error {
+				return table.Delete("UserID", 1).Range("ID", "missing").If("attribute_exists('ID')").RunWithContext(ctx)
+			},
+			condFail: true,
+		},
+		{
+			name: "delete",
+			run: func() error {
+				return table.Delete("UserID", 1).Range("ID", "x").If("attribute_exists('ID')").RunWithContext(ctx)
+			},
+		},
+	}
+	for _, test := range tests {
+		err := test.run()
+		if test.condFail != dynamo.IsCondCheckFailed(err) || (!test.condFail && err != nil) {
+			t.Errorf("%s: err = %v, want condition failure: %v", test.name, err, test.condFail)
+		}
+	}
+
+	// a failed update doesn't create the item
+	var tomb Tombstone
+	err := table.Get("UserID", 1).Range("ID", dynamo.Equal, "missing").OneWithContext(ctx, &tomb)
+	if err != ErrNotFound {
+		t.Errorf("item after failed conditional update: %v, want ErrNotFound", err)
+	}
+}
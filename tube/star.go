@@ -12,21 +12,21 @@ type Star struct {
 }
 
 func SetStar(ctx context.Context, userID int, ssid SSID, date time.Time) error {
-	table := dynamoTable("Stars")
+	table := dbTable("Stars")
 	return table.Put(Star{
 		UserID: userID,
 		SSID:   ssid,
 		Date:   date,
-	}).Run()
+	}).RunWithContext(ctx)
 }
 
 func DeleteStar(ctx context.Context, userID int, ssid string) error {
-	table := dynamoTable("Stars")
-	return table.Delete("UserID", userID).Range("SSID", ssid).Run()
+	table := dbTable("Stars")
+	return table.Delete("UserID", userID).Range("SSID", ssid).RunWithContext(ctx)
 }
 
 func GetStars(ctx context.Context, userID int) (map[SSID]Star, error) {
-	table := dynamoTable("Stars")
+	table := dbTable("Stars")
 	iter := table.Get("UserID", userID).Iter()
 	stars := make(map[SSID]Star)
 	var s Star
@@ -0,0 +1,342 @@
+package tube
+
+import (
+	"context"
+
+	"github.com/guregu/dynamo"
+)
+
+// database is where tube keeps its data.
+// The API mirrors the parts of github.com/guregu/dynamo that we use,
+// so models read the same regardless of backend.
+type database interface {
+	Table(name string) table
+	WriteTx() writeTx
+	createTables(ctx context.Context) error
+	ping(ctx context.Context) error
+}
+
+type table interface {
+	Name() string
+	Get(name string, value any) tableQuery
+	Put(item any) tablePut
+	Update(hashKey string, value any) Update
+	Delete(name string, value any) tableDelete
+	Scan() tableScan
+	Batch(hashAndRangeKeyName ...string) tableBatch
+}
+
+type tableQuery interface {
+	Range(name string, op dynamo.Operator, values ...any) tableQuery
+	Index(name string) tableQuery
+	Project(paths ...string) tableQuery
+	Filter(expr string, args ...any) tableQuery
+	Consistent(on bool) tableQuery
+	Limit(limit int64) tableQuery
+	SearchLimit(limit int64) tableQuery
+	Order(order dynamo.Order) tableQuery
+	StartFrom(key dynamo.PagingKey) tableQuery
+
+	One(out any) error
+	OneWithContext(ctx context.Context, out any) error
+	All(out any) error
+	AllWithContext(ctx context.Context, out any) error
+	AllWithLastEvaluatedKey(out any) (dynamo.PagingKey, error)
+	AllWithLastEvaluatedKeyContext(ctx context.Context, out any) (dynamo.PagingKey, error)
+	Count() (int64, error)
+	CountWithContext(ctx context.Context) (int64, error)
+	Iter() dynamo.PagingIter
+}
+
+type tableScan interface {
+	Filter(expr string, args ...any) tableScan
+	Consistent(on bool) tableScan
+
+	All(out any) error
+	AllWithContext(ctx context.Context, out any) error
+	Iter() dynamo.PagingIter
+}
+
+type tablePut interface {
+	If(expr string, args ...any) tablePut
+
+	Run() error
+	RunWithContext(ctx context.Context) error
+	OldValue(out any) error
+	OldValueWithContext(ctx context.Context, out any) error
+}
+
+// Update is a request to change an item, created with table.Update.
+type Update interface {
+	Range(name string, value any) Update
+	Set(path string, value any) Update
+	Add(path string, value any) Update
+	AddStringsToSet(path string, values ...string) Update
+	AddIntsToSet(path string, values ...int) Update
+	Remove(paths ...string) Update
+	If(expr string, args ...any) Update
+
+	Run() error
+	RunWithContext(ctx context.Context) error
+	Value(out any) error
+	ValueWithContext(ctx context.Context, out any) error
+}
+
+type tableDelete interface {
+	Range(name string, value any) tableDelete
+	If(expr string, args ...any) tableDelete
+
+	Run() error
+	RunWithContext(ctx context.Context) error
+}
+
+type tableBatch interface {
+	Get(keys ...dynamo.Keyed) tableBatchGet
+	Write() tableBatchWrite
+}
+
+type tableBatchGet interface {
+	And(keys ...dynamo.Keyed) tableBatchGet
+
+	All(out any) error
+	AllWithContext(ctx context.Context, out any) error
+	Iter() dynamo.Iter
+}
+
+type tableBatchWrite interface {
+	Put(items ...any) tableBatchWrite
+	Delete(keys ...dynamo.Keyed) tableBatchWrite
+
+	Run() (int, error)
+	RunWithContext(ctx context.Context) (int, error)
+}
+
+type writeTx interface {
+	Put(p tablePut) writeTx
+	Update(u Update) writeTx
+	Delete(d tableDelete) writeTx
+
+	Run() error
+	RunWithContext(ctx context.Context) error
+}
+
+// DynamoDB
+
+type dynamoDB struct {
+	*dynamo.DB
+}
+
+func (d dynamoDB) Table(name string) table {
+	return dynamoTable{d.DB.Table(name)}
+}
+
+func (d dynamoDB) WriteTx() writeTx {
+	return dynamoWriteTx{d.DB.WriteTx()}
+}
+
+type dynamoTable struct {
+	dynamo.Table
+}
+
+func (t dynamoTable) Get(name string, value any) tableQuery {
+	return dynamoQuery{t.Table.Get(name, value)}
+}
+
+func (t dynamoTable) Put(item any) tablePut {
+	return dynamoPut{t.Table.Put(item)}
+}
+
+func (t dynamoTable) Update(hashKey string, value any) Update {
+	return dynamoUpdate{t.Table.Update(hashKey, value)}
+}
+
+func (t dynamoTable) Delete(name string, value any) tableDelete {
+	return dynamoDelete{t.Table.Delete(name, value)}
+}
+
+func (t dynamoTable) Scan() tableScan {
+	return dynamoScan{t.Table.Scan()}
+}
+
+func (t dynamoTable) Batch(hashAndRangeKeyName ...string) tableBatch {
+	return dynamoBatch{t.Table.Batch(hashAndRangeKeyName...)}
+}
+
+type dynamoQuery struct {
+	*dynamo.Query
+}
+
+func (q dynamoQuery) Range(name string, op dynamo.Operator, values ...any) tableQuery {
+	q.Query.Range(name, op, values...)
+	return q
+}
+
+func (q dynamoQuery) Index(name string) tableQuery {
+	q.Query.Index(name)
+	return q
+}
+
+func (q dynamoQuery) Project(paths ...string) tableQuery {
+	q.Query.Project(paths...)
+	return q
+}
+
+func (q dynamoQuery) Filter(expr string, args ...any) tableQuery {
+	q.Query.Filter(expr, args...)
+	return q
+}
+
+func (q dynamoQuery) Consistent(on bool) tableQuery {
+	q.Query.Consistent(on)
+	return q
+}
+
+func (q dynamoQuery) Limit(limit int64) tableQuery {
+	q.Query.Limit(limit)
+	return q
+}
+
+func (q dynamoQuery) SearchLimit(limit int64) tableQuery {
+	q.Query.SearchLimit(limit)
+	return q
+}
+
+func (q dynamoQuery) Order(order dynamo.Order) tableQuery {
+	q.Query.Order(order)
+	return q
+}
+
+func (q dynamoQuery) StartFrom(key dynamo.PagingKey) tableQuery {
+	q.Query.StartFrom(key)
+	return q
+}
+
+type dynamoScan struct {
+	*dynamo.Scan
+}
+
+func (s dynamoScan) Filter(expr string, args ...any) tableScan {
+	s.Scan.Filter(expr, args...)
+	return s
+}
+
+func (s dynamoScan) Consistent(on bool) tableScan {
+	s.Scan.Consistent(on)
+	return s
+}
+
+type dynamoPut struct {
+	*dynamo.Put
+}
+
+func (p dynamoPut) If(expr string, args ...any) tablePut {
+	p.Put.If(expr, args...)
+	return p
+}
+
+type dynamoUpdate struct {
+	*dynamo.Update
+}
+
+func (u dynamoUpdate) Range(name string, value any) Update {
+	u.Update.Range(name, value)
+	return u
+}
+
+func (u dynamoUpdate) Set(path string, value any) Update {
+	u.Update.Set(path, value)
+	return u
+}
+
+func (u dynamoUpdate) Add(path string, value any) Update {
+	u.Update.Add(path, value)
+	return u
+}
+
+func (u dynamoUpdate) AddStringsToSet(path string, values ...string) Update {
+	u.Update.AddStringsToSet(path, values...)
+	return u
+}
+
+func (u dynamoUpdate) AddIntsToSet(path string, values ...int) Update {
+	u.Update.AddIntsToSet(path, values...)
+	return u
+}
+
+func (u dynamoUpdate) Remove(paths ...string) Update {
+	u.Update.Remove(paths...)
+	return u
+}
+
+func (u dynamoUpdate) If(expr string, args ...any) Update {
+	u.Update.If(expr, args...)
+	return u
+}
+
+type dynamoDelete struct {
+	*dynamo.Delete
+}
+
+func (d dynamoDelete) Range(name string, value any) tableDelete {
+	d.Delete.Range(name, value)
+	return d
+}
+
+func (d dynamoDelete) If(expr string, args ...any) tableDelete {
+	d.Delete.If(expr, args...)
+	return d
+}
+
+type dynamoBatch struct {
+	dynamo.Batch
+}
+
+func (b dynamoBatch) Get(keys ...dynamo.Keyed) tableBatchGet {
+	return dynamoBatchGet{b.Batch.Get(keys...)}
+}
+
+func (b dynamoBatch) Write() tableBatchWrite {
+	return dynamoBatchWrite{b.Batch.Write()}
+}
+
+type dynamoBatchGet struct {
+	*dynamo.BatchGet
+}
+
+func (b dynamoBatchGet) And(keys ...dynamo.Keyed) tableBatchGet {
+	b.BatchGet.And(keys...)
+	return b
+}
+
+type dynamoBatchWrite struct {
+	*dynamo.BatchWrite
+}
+
+func (b dynamoBatchWrite) Put(items ...any) tableBatchWrite {
+	b.BatchWrite.Put(items...)
+	return b
+}
+
+func (b dynamoBatchWrite) Delete(keys ...dynamo.Keyed) tableBatchWrite {
+	b.BatchWrite.Delete(keys...)
+	return b
+}
+
+type dynamoWriteTx struct {
+	*dynamo.WriteTx
+}
+
+func (tx dynamoWriteTx) Put(p tablePut) writeTx {
+	tx.WriteTx.Put(p.(dynamoPut).Put)
+	return tx
+}
+
+func (tx dynamoWriteTx) Update(u Update) writeTx {
+	tx.WriteTx.Update(unwrapUpdate(u).(dynamoUpdate).Update)
+	return tx
+}
+
+func (tx dynamoWriteTx) Delete(d tableDelete) writeTx {
+	tx.WriteTx.Delete(d.(dynamoDelete).Delete)
+	return tx
+}
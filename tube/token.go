@@ -0,0 +1,168 @@
+package tube
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tableDeviceTokens = "DeviceTokens"
+
+// lengths of a device token's parts: 9 and 32 random bytes, in unpadded base64
+const (
+	deviceTokenIDLen     = 12
+	deviceTokenSecretLen = 43
+)
+
+// DeviceToken lets a paired device, like a TV running a Subsonic client, log in without the password.
+// The token handed to the device is "<ID>.<secret>"; only a hash of the secret is kept.
+type DeviceToken struct {
+	ID      string `dynamo:",hash" index:"UserID-ID-index,range"`
+	UserID  int    `index:"UserID-ID-index,hash"`
+	Name    string
+	Hash    []byte `json:"-"`
+	Created time.Time
+}
+
+// CreateDeviceToken makes a new token for the user's device called name.
+// The returned string is the token itself, which can't be recovered later.
+func CreateDeviceToken(ctx context.Context, userID int, name string) (DeviceToken, string, error) {
+	id, err := randomString(9)
+	if err != nil {
+		return DeviceToken{}, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return DeviceToken{}, "", err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	dt := DeviceToken{
+		ID:      id,
+		UserID:  userID,
+		Name:    name,
+		Hash:    hash[:],
+		Created: time.Now().UTC(),
+	}
+	table := dbTable(tableDeviceTokens)
+	if err := table.Put(dt).If("attribute_not_exists('ID')").RunWithContext(ctx); err != nil {
+		return DeviceToken{}, "", err
+	}
+	return dt, id + "." + secret, nil
+}
+
+// IsDeviceToken reports whether s is shaped like a device token, so it can be told apart from a password.
+func IsDeviceToken(s string) bool {
+	id, secret, ok := strings.Cut(s, ".")
+	return ok && len(id) == deviceTokenIDLen && len(secret) == deviceTokenSecretLen &&
+		isBase64URL(id) && isBase64URL(secret)
+}
+
+func isBase64URL(s string) bool {
+	for _, r := range s {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckDeviceToken returns the device token matching token, or ErrNotFound.
+func CheckDeviceToken(ctx context.Context, token string) (DeviceToken, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return DeviceToken{}, ErrNotFound
+	}
+	table := dbTable(tableDeviceTokens)
+	var dt DeviceToken
+	if err := table.Get("ID", id).OneWithContext(ctx, &dt); err != nil {
+		return DeviceToken{}, err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], dt.Hash) != 1 {
+		return DeviceToken{}, ErrNotFound
+	}
+	return dt, nil
+}
+
+// GetDeviceTokens returns all of a user's device tokens.
+func GetDeviceTokens(ctx context.Context, userID int) ([]DeviceToken, error) {
+	table := dbTable(tableDeviceTokens)
+	var tokens []DeviceToken
+	err := table.Get("UserID", userID).Index("UserID-ID-index").AllWithContext(ctx, &tokens)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return tokens, err
+}
+
+// DeleteDeviceTokens unpairs all of a user's devices.
+func DeleteDeviceTokens(ctx context.Context, userID int) error {
+	tokens, err := GetDeviceTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, dt := range tokens {
+		if err := dt.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete revokes the token.
+func (dt DeviceToken) Delete(ctx context.Context) error {
+	table := dbTable(tableDeviceTokens)
+	return table.Delete("ID", dt.ID).If("'UserID' = ?", dt.UserID).RunWithContext(ctx)
+}
+
+// SetStatusToken makes a new token for reading the user's now-playing status, replacing the old one.
+// The token is "<user ID>.<secret>"; only a hash of the secret is kept.
+func (u *User) SetStatusToken(ctx context.Context) (string, error) {
+	secret, err := randomString(24)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	users := dbTable(tableUsers)
+	err = users.Update("ID", u.ID).
+		Set("StatusToken", hash[:]).
+		If("attribute_exists('ID')").
+		ValueWithContext(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(u.ID) + "." + secret, nil
+}
+
+// RemoveStatusToken turns off the user's now-playing status.
+func (u *User) RemoveStatusToken(ctx context.Context) error {
+	users := dbTable(tableUsers)
+	return users.Update("ID", u.ID).
+		Remove("StatusToken").
+		If("attribute_exists('ID')").
+		ValueWithContext(ctx, u)
+}
+
+// CheckStatusToken returns the user a status token belongs to, or ErrNotFound.
+func CheckStatusToken(ctx context.Context, token string) (User, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return User{}, ErrNotFound
+	}
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return User{}, ErrNotFound
+	}
+	u, err := GetUser(ctx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if len(u.StatusToken) == 0 || subtle.ConstantTimeCompare(hash[:], u.StatusToken) != 1 {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
@@ -0,0 +1,40 @@
+package tube
+
+import "testing"
+
+func TestDeviceTokens(t *testing.T) {
+	ctx := testDB(t)
+	u := testUser(t, ctx)
+
+	dt, token, err := CreateDeviceToken(ctx, u.ID, "TV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsDeviceToken(token) {
+		t.Errorf("IsDeviceToken(%q) = false", token)
+	}
+	for _, pw := range []string{"", "hunter2", "a.b", token + "x", "AAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA!"} {
+		if IsDeviceToken(pw) {
+			t.Errorf("IsDeviceToken(%q) = true", pw)
+		}
+	}
+
+	got, err := CheckDeviceToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != dt.ID || got.UserID != u.ID {
+		t.Errorf("CheckDeviceToken: got %+v, want %+v", got, dt)
+	}
+	if _, err := CheckDeviceToken(ctx, dt.ID+".wrong"); err != ErrNotFound {
+		t.Errorf("wrong secret: %v, want ErrNotFound", err)
+	}
+
+	// "this wasn't me" unpairs everything
+	if err := u.RevokeAccess(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckDeviceToken(ctx, token); err != ErrNotFound {
+		t.Errorf("after RevokeAccess: %v, want ErrNotFound", err)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 	"path"
 	"sort"
 	"strings"
@@ -23,7 +23,7 @@ const (
 )
 
 type Track struct {
-	UserID int       `dynamo:",hash" index:"UserID-SortID-index,hash" index:"UserID-Date-index,hash"`
+	UserID int       `dynamo:",hash" index:"UserID-SortID-index,hash" index:"UserID-Date-index,hash" index:"UserID-Genre-index,hash"`
 	ID     string    `dynamo:",range"`
 	SortID string    `index:"UserID-SortID-index,range" badgerhold:"index"`
 	Date   time.Time `index:"UserID-Date-index,range"`
@@ -37,7 +37,7 @@ type Track struct {
 	Album       string
 	AlbumArtist string
 	Composer    string
-	Genre       string
+	Genre       string `index:"UserID-Genre-index,range"`
 	Comment     string
 
 	Number  int
@@ -48,11 +48,14 @@ type Track struct {
 	Picture Picture  `dynamo:",omitempty"`
 	Tags    []string `dynamo:",set"` // user-defined tags
 
-	Filename string
-	Filetype string
-	UploadID string
-	Size     int
-	Duration int // seconds
+	Filename  string
+	Filetype  string
+	UploadID  string
+	Size      int
+	Duration  int  // seconds
+	Encrypted bool `dynamo:",omitempty"` // with the user's DataKey, see storage.Seal
+	// from the tags, if they had any
+	ReplayGain *ReplayGain `dynamo:",omitempty" json:",omitempty"`
 
 	TagFormat string
 	Metadata  map[string]interface{} // IDv3 tags
@@ -65,6 +68,12 @@ type Track struct {
 	LastPlayed time.Time
 	Resume     float64   // seconds
 	ResumeMod  time.Time `dynamo:",omitempty"`
+	// saved for offline listening by the web player, at
+	Pinned time.Time `dynamo:",omitempty"`
+
+	// cold storage tiering, see FreezeColdTracks
+	Cold    time.Time `dynamo:",omitempty"` // moved to cold storage at
+	Thawing time.Time `dynamo:",omitempty"` // last restore request
 
 	Deleted bool
 
@@ -139,9 +148,9 @@ func (t *Track) Create(ctx context.Context) error {
 	t.Date = time.Now().UTC()
 	t.SortID = t.SortKey()
 
-	tracks := dynamoTable("Tracks")
+	tracks := dbTable("Tracks")
 	var old Track
-	err := tracks.Put(t).OldValue(&old)
+	err := tracks.Put(t).OldValueWithContext(ctx, &old)
 	if err == ErrNotFound {
 		// new file, so inc usage
 		_, err := AddUsage(ctx, t.UserID, int64(t.Size), 1)
@@ -150,36 +159,50 @@ func (t *Track) Create(ctx context.Context) error {
 	return err
 }
 
-func (t *Track) Save(ctx context.Context) error {
+// CreateFromUpload saves a track made from the upload f.
+// Then, in one transaction, f is linked to it and the user's last modified time is bumped,
+// along with their usage if the track is new.
+func (t *Track) CreateFromUpload(ctx context.Context, f *File) error {
+	t.Date = time.Now().UTC()
 	t.SortID = t.SortKey()
 
-	tracks := dynamoTable("Tracks")
-	return tracks.Put(t).Run()
-}
-
-func (t *Track) Delete(ctx context.Context) error {
-	size := t.Size
-	if size == 0 {
-		f, err := GetFile(ctx, t.UploadID)
-		if err != nil {
-			return err
-		}
-		size = int(f.Size)
+	tracks := dbTable("Tracks")
+	var old Track
+	err := tracks.Put(t).OldValueWithContext(ctx, &old)
+	isNew := err == ErrNotFound
+	if err != nil && !isNew {
+		return err
 	}
 
-	tracks := dynamoTable("Tracks")
-	if err := tracks.Delete("UserID", t.UserID).Range("ID", t.ID).Run(); err != nil {
-		return err
+	files := dbTable("Files")
+	users := dbTable(tableUsers)
+	userUpdate := users.Update("ID", t.UserID).
+		Set("LastMod", time.Now().UTC().Truncate(time.Second)).
+		If("attribute_exists('ID')")
+	if isNew {
+		userUpdate = userUpdate.Add("Usage", int64(t.Size)).Add("Tracks", 1)
 	}
-	users := dynamoTable(tableUsers)
-	return users.Update("ID", t.UserID).
-		Add("Usage", -size).
-		Add("Tracks", -1).
-		Run()
+	tx := db.WriteTx()
+	tx.Update(files.Update("ID", f.ID).Set("TrackID", t.ID))
+	tx.Update(userUpdate)
+	err = tx.RunWithContext(ctx)
+	forgetUser(t.UserID)
+	if err != nil {
+		return fmt.Errorf("link upload %s to track: %w", f.ID, err)
+	}
+	f.TrackID = t.ID
+	return nil
+}
+
+func (t *Track) Save(ctx context.Context) error {
+	t.SortID = t.SortKey()
+
+	tracks := dbTable("Tracks")
+	return tracks.Put(t).RunWithContext(ctx)
 }
 
 func (t *Track) IncPlays(ctx context.Context) error {
-	tracks := dynamoTable("Tracks")
+	tracks := dbTable("Tracks")
 	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
 		Add("Plays", 1).
 		Set("LastPlayed", time.Now().UTC()).
@@ -187,7 +210,7 @@ func (t *Track) IncPlays(ctx context.Context) error {
 }
 
 func (t *Track) SetResume(ctx context.Context, secs float64, modTime time.Time) error {
-	tracks := dynamoTable("Tracks")
+	tracks := dbTable("Tracks")
 	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
 		Set("Resume", secs).
 		Set("ResumeMod", modTime).
@@ -195,8 +218,21 @@ func (t *Track) SetResume(ctx context.Context, secs float64, modTime time.Time)
 		Value(t)
 }
 
+// SetPinned marks the track to be kept for offline listening, or not.
+func (t *Track) SetPinned(ctx context.Context, pinned bool) error {
+	tracks := dbTable("Tracks")
+	update := tracks.Update("UserID", t.UserID).Range("ID", t.ID).
+		Set("LastMod", time.Now().UTC())
+	if pinned {
+		update = update.Set("Pinned", time.Now().UTC())
+	} else {
+		update = update.Remove("Pinned")
+	}
+	return update.If("attribute_exists('ID')").ValueWithContext(ctx, t)
+}
+
 func (t *Track) SetDuration(ctx context.Context, secs int) error {
-	tracks := dynamoTable("Tracks")
+	tracks := dbTable("Tracks")
 	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
 		Set("Duration", secs).
 		If("attribute_not_exists('Duration') OR 'Duration' <= ?", secs).
@@ -204,7 +240,7 @@ func (t *Track) SetDuration(ctx context.Context, secs int) error {
 }
 
 func (t *Track) RefreshSortID(ctx context.Context) error {
-	tracks := dynamoTable("Tracks")
+	tracks := dbTable("Tracks")
 	return tracks.Update("UserID", t.UserID).Range("ID", t.ID).
 		Set("SortID", t.SortKey()).
 		Value(t)
@@ -490,34 +526,76 @@ func (p Picture) StorageKey() string {
 	return fmt.Sprintf("pic/%s.%s", p.ID, p.Ext)
 }
 
+// ThumbKey is where p scaled down to size is stored.
+// Pictures that might have transparency are kept as PNG, and everything else becomes JPEG.
+func (p Picture) ThumbKey(size int) string {
+	switch strings.ToLower(p.Ext) {
+	case "png", "gif":
+		return fmt.Sprintf("pic/%d/%s.png", size, p.ID)
+	}
+	return fmt.Sprintf("pic/%d/%s.jpg", size, p.ID)
+}
+
+// thumbPictureID returns the picture ID of a ThumbKey.
+func thumbPictureID(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "pic/")
+	if !ok {
+		return "", false
+	}
+	_, file, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(file, path.Ext(file)), true
+}
+
 func (u User) GetTracks(ctx context.Context) (Tracks, error) {
 	if useDump {
 		if d, err := u.GetDump(); err == nil {
-			log.Println("using dump for", u.ID, "@", d.Time, d.Key())
+			slog.DebugContext(ctx, "using dump", "user_id", u.ID, "time", d.Time, "key", d.Key())
 			return d.Tracks, nil
 		}
 	}
-	tracks, _, err := GetTracksPartialSorted(ctx, u.ID, 0, nil)
-	return tracks, err
+	tracks, err := Cached(ModKey(u, "tracks"), func() (Tracks, error) {
+		tracks, _, err := GetTracksPartialSorted(ctx, u.ID, 0, nil)
+		return tracks, err
+	})
+	// callers sort and modify their copy
+	return append(Tracks(nil), tracks...), err
 }
 
 func GetTracks(ctx context.Context, userID int) (Tracks, error) {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	var tracks Tracks
-	err := table.Get("UserID", userID).Consistent(true).All(&tracks)
+	err := table.Get("UserID", userID).Consistent(true).AllWithContext(ctx, &tracks)
+	sort.Sort(tracks)
+	return tracks, err
+}
+
+// GetTracksByGenre returns the user's tracks in genre, ignoring case.
+func GetTracksByGenre(ctx context.Context, userID int, genre string) (Tracks, error) {
+	table := dbTable("Tracks")
+	var tracks Tracks
+	err := table.Get("UserID", userID).
+		Range("Genre", dynamo.Equal, strings.ToLower(genre)).
+		Index("UserID-Genre-index").
+		AllWithContext(ctx, &tracks)
+	if err == ErrNotFound {
+		err = nil
+	}
 	sort.Sort(tracks)
 	return tracks, err
 }
 
 func GetTracksInfo(ctx context.Context, userID int) (Tracks, error) {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	var tracks []Track
-	err := table.Get("UserID", userID).Project("ID", "UserID", "Info").All(&tracks)
+	err := table.Get("UserID", userID).Project("ID", "UserID", "Info").AllWithContext(ctx, &tracks)
 	return tracks, err
 }
 
 func GetTracksPartial(ctx context.Context, userID int, limit int64, startFrom dynamo.PagingKey) (Tracks, dynamo.PagingKey, error) {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	var tracks Tracks
 	q := table.Get("UserID", userID)
 	if limit > 0 {
@@ -526,12 +604,12 @@ func GetTracksPartial(ctx context.Context, userID int, limit int64, startFrom dy
 	if startFrom != nil {
 		q.StartFrom(startFrom)
 	}
-	next, err := q.AllWithLastEvaluatedKey(&tracks)
+	next, err := q.AllWithLastEvaluatedKeyContext(ctx, &tracks)
 	return tracks, next, err
 }
 
 func GetTracksPartialSorted(ctx context.Context, userID int, limit int64, startFrom dynamo.PagingKey) (Tracks, dynamo.PagingKey, error) {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	var tracks Tracks
 	q := table.Get("UserID", userID)
 	q.Index("UserID-SortID-index")
@@ -541,48 +619,48 @@ func GetTracksPartialSorted(ctx context.Context, userID int, limit int64, startF
 	if startFrom != nil {
 		q.StartFrom(startFrom)
 	}
-	next, err := q.AllWithLastEvaluatedKey(&tracks)
+	next, err := q.AllWithLastEvaluatedKeyContext(ctx, &tracks)
 	return tracks, next, err
 }
 
 func GetTracksBatch(ctx context.Context, userID int, trackIDs []string) (Tracks, error) {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	batch := table.Batch("UserID", "ID").Get()
 	for _, id := range trackIDs {
 		batch.And(dynamo.Keys{userID, id})
 	}
 	var tracks Tracks
-	err := batch.All(&tracks)
+	err := batch.AllWithContext(ctx, &tracks)
 	return tracks, err
 }
 
 func GetTrack(ctx context.Context, userID int, trackID string) (Track, error) {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	var track Track
-	err := table.Get("UserID", userID).Range("ID", dynamo.Equal, trackID).One(&track)
+	err := table.Get("UserID", userID).Range("ID", dynamo.Equal, trackID).OneWithContext(ctx, &track)
 	return track, err
 }
 
 func GetALLTracks(ctx context.Context) dynamo.Iter {
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 	return table.Scan().Iter()
 }
 
 func CountTracks(ctx context.Context, userID int) (int64, error) {
-	table := dynamoTable("Tracks")
-	ct, err := table.Get("UserID", userID).Count()
+	table := dbTable("Tracks")
+	ct, err := table.Get("UserID", userID).CountWithContext(ctx)
 	return ct, err
 }
 
 func CountTracks2(ctx context.Context, userID int) (int64, error) {
-	table := dynamoTable("Tracks")
-	ct, err := table.Get("UserID", userID).Index("UserID-SortID-index").Count()
+	table := dbTable("Tracks")
+	ct, err := table.Get("UserID", userID).Index("UserID-SortID-index").CountWithContext(ctx)
 	return ct, err
 }
 
-func MassUpdateTracks(ctx context.Context, userID int, trackIDs []string, mutator func(*dynamo.Update)) error {
+func MassUpdateTracks(ctx context.Context, userID int, trackIDs []string, mutator func(Update)) error {
 	// TODO: rewrite
-	table := dynamoTable("Tracks")
+	table := dbTable("Tracks")
 
 	var wg sync.WaitGroup
 	for _, id := range trackIDs {
@@ -592,14 +670,15 @@ func MassUpdateTracks(ctx context.Context, userID int, trackIDs []string, mutato
 			defer wg.Done()
 			u := table.Update("UserID", userID).Range("ID", id)
 			mutator(u)
+			u.Set("LastMod", time.Now().UTC())
 			u.If("attribute_exists('ID')")
 			var t Track
-			if err := u.Value(&t); err != nil {
-				fmt.Println("mass err:", err)
+			if err := u.ValueWithContext(ctx, &t); err != nil {
+				slog.ErrorContext(ctx, "mass update failed", "track", id, "err", err)
 				return
 			}
 			if err := t.RefreshSortID(ctx); err != nil {
-				fmt.Println("mass sid err:", err)
+				slog.ErrorContext(ctx, "mass update: refresh sort ID failed", "track", id, "err", err)
 				return
 			}
 		}()
@@ -616,6 +695,65 @@ func DeleteTrack(ctx context.Context, userID int, trackID string) error {
 	return track.Delete(ctx)
 }
 
+// TrackChanges lists the IDs of tracks a user added, edited, or deleted since a point in time.
+type TrackChanges struct {
+	Created []string
+	Updated []string
+	Deleted []string
+}
+
+const tableTombstones = "Tombstones"
+
+// Tombstone records that a track was deleted, for GetTrackChanges.
+// It's written in the same transaction as the delete.
+type Tombstone struct {
+	UserID  int    `dynamo:",hash"`
+	ID      string `dynamo:",range"` // the track's ID
+	Deleted time.Time
+}
+
+// GetTrackChanges returns what changed in u's library after since.
+// Deletions are found in tombstones. With a zero since, every track is new.
+func (u User) GetTrackChanges(ctx context.Context, since time.Time) (TrackChanges, error) {
+	changes := TrackChanges{
+		Created: []string{},
+		Updated: []string{},
+		Deleted: []string{},
+	}
+	tracks, err := u.GetTracks(ctx)
+	if err != nil && err != ErrNotFound {
+		return changes, err
+	}
+	exists := make(map[string]bool, len(tracks))
+	for _, t := range tracks {
+		exists[t.ID] = true
+		switch {
+		case t.Date.After(since):
+			changes.Created = append(changes.Created, t.ID)
+		case t.LastModOrDate().After(since):
+			changes.Updated = append(changes.Updated, t.ID)
+		}
+	}
+
+	if since.IsZero() {
+		return changes, nil
+	}
+	var deleted []Tombstone
+	tombstones := dbTable(tableTombstones)
+	err = tombstones.Get("UserID", u.ID).Consistent(true).AllWithContext(ctx, &deleted)
+	if err != nil && err != ErrNotFound {
+		return changes, err
+	}
+	for _, ts := range deleted {
+		// restored since, or deleted before
+		if exists[ts.ID] || !ts.Deleted.After(since) {
+			continue
+		}
+		changes.Deleted = append(changes.Deleted, ts.ID)
+	}
+	return changes, nil
+}
+
 func IncTotalPlays(ctx context.Context, secs int) error {
 	_, err := NextID(ctx, "TotalPlays")
 	if err != nil {
@@ -624,7 +762,7 @@ func IncTotalPlays(ctx context.Context, secs int) error {
 	if secs <= 0 {
 		return nil
 	}
-	table := dynamoTable("Counters")
+	table := dbTable("Counters")
 	return table.Update("ID", "TotalTime").
 		Add("Count", secs).
 		Run()
@@ -0,0 +1,150 @@
+package tube
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/guregu/intertube/storage"
+)
+
+// testStorage sets up local buckets for the test.
+func testStorage(t *testing.T) {
+	t.Helper()
+	storage.FilesBucket = storage.FSBucket{Name: "files", Root: t.TempDir()}
+	storage.UploadsBucket = storage.FSBucket{Name: "uploads", Root: t.TempDir()}
+	t.Cleanup(func() {
+		storage.FilesBucket = nil
+		storage.UploadsBucket = nil
+	})
+}
+
+// testTrack adds a track with some audio to u's library.
+func testTrack(t *testing.T, ctx context.Context, u User, id string) Track {
+	t.Helper()
+	track := Track{
+		UserID:   u.ID,
+		ID:       id,
+		Filename: id + ".mp3",
+		Size:     100,
+		Date:     time.Now().UTC(),
+	}
+	if err := storage.FilesBucket.Put("audio/mpeg", track.StorageKey(), bytes.NewReader(make([]byte, track.Size))); err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddUsage(ctx, u.ID, int64(track.Size), 1); err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+func TestTrackChanges(t *testing.T) {
+	ctx := testDB(t)
+	testStorage(t)
+	u := testUser(t, ctx)
+
+	kept := testTrack(t, ctx, u, "kept")
+	gone := testTrack(t, ctx, u, "gone")
+	since := time.Now().UTC()
+	time.Sleep(time.Millisecond)
+	added := testTrack(t, ctx, u, "added")
+
+	all, err := u.GetTrackChanges(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(all.Created)
+	if !slices.Equal(all.Created, []string{added.ID, gone.ID, kept.ID}) {
+		t.Errorf("first sync: created %v", all.Created)
+	}
+
+	if err := gone.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := u.GetTrackChanges(ctx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Created, []string{added.ID}) {
+		t.Errorf("created: %v, want [%s]", changes.Created, added.ID)
+	}
+	if !slices.Equal(changes.Deleted, []string{gone.ID}) {
+		t.Errorf("deleted: %v, want [%s]", changes.Deleted, gone.ID)
+	}
+
+	// already seen
+	later := time.Now().UTC()
+	changes, err = u.GetTrackChanges(ctx, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Created)+len(changes.Updated)+len(changes.Deleted) > 0 {
+		t.Errorf("nothing changed, got %+v", changes)
+	}
+
+	// tombstones don't depend on the audit log, so purging from the trash keeps them
+	tt, err := GetTrashedTrack(ctx, u.ID, gone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = u.GetTrackChanges(ctx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Deleted, []string{gone.ID}) {
+		t.Errorf("deleted after purge: %v, want [%s]", changes.Deleted, gone.ID)
+	}
+}
+
+func TestDeleteTwice(t *testing.T) {
+	ctx := testDB(t)
+	testStorage(t)
+	u := testUser(t, ctx)
+	track := testTrack(t, ctx, u, "once")
+
+	if err := track.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Delete(ctx); err == nil {
+		t.Error("deleting a deleted track worked")
+	}
+	got, err := GetUser(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Usage != 0 || got.Tracks != 0 {
+		t.Errorf("usage after deleting: %d bytes, %d tracks; want 0", got.Usage, got.Tracks)
+	}
+}
+
+func TestGetTracksByGenre(t *testing.T) {
+	ctx := testDB(t)
+	u := testUser(t, ctx)
+	for id, genre := range map[string]string{"a": "Shoegaze", "b": "shoegaze", "c": "Jazz", "d": ""} {
+		track := Track{UserID: u.ID, ID: id}
+		track.ApplyInfo(TrackInfo{Title: id, Genre: genre})
+		if err := track.Save(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracks, err := GetTracksByGenre(ctx, u.ID, "SHOEGAZE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, track := range tracks {
+		got = append(got, track.ID)
+	}
+	slices.Sort(got)
+	if want := []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("shoegaze tracks: %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/guregu/intertube/storage"
+)
+
+const (
+	tableTrash = "Trash"
+
+	// TrashTTL is how long deleted tracks can be restored before they're gone for good.
+	TrashTTL = 30 * 24 * time.Hour
+)
+
+// TrashedTrack is a deleted track that can still be restored.
+// Its audio is moved under trash/, except for cold tracks, which stay where they are
+// because they can't be copied without restoring them first.
+// Key only points into the library for cold tracks.
+type TrashedTrack struct {
+	UserID int    `dynamo:",hash"`
+	ID     string `dynamo:",range"` // the track's ID
+	Track  Track
+	// where the audio is kept in the meantime
+	Key string
+
+	Deleted time.Time
+	Expires time.Time `dynamo:",unixtime"`
+}
+
+func trashKey(t Track) string {
+	return fmt.Sprintf("trash/%d/%s%s", t.UserID, t.ID, path.Ext(t.Filename))
+}
+
+// Delete moves the track to the trash. Trashed tracks don't count towards usage.
+// The audio is moved first, so the trash never points at audio that's still in the library;
+// if that fails, nothing is deleted.
+func (t *Track) Delete(ctx context.Context) error {
+	size := t.Size
+	if size == 0 {
+		f, err := GetFile(ctx, t.UploadID)
+		if err != nil {
+			return err
+		}
+		size = int(f.Size)
+	}
+
+	key := t.StorageKey()
+	if !t.IsCold() {
+		key = trashKey(*t)
+		if err := moveObject(t.StorageKey(), key); err != nil {
+			return fmt.Errorf("trash: moving audio: %w", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	trashed := TrashedTrack{
+		UserID:  t.UserID,
+		ID:      t.ID,
+		Track:   *t,
+		Key:     key,
+		Deleted: now,
+		Expires: now.Add(TrashTTL),
+	}
+	// the tombstone goes in with the delete, so syncing clients can't miss it
+	trash := dbTable(tableTrash)
+	tracks := dbTable("Tracks")
+	tombstones := dbTable(tableTombstones)
+	users := dbTable(tableUsers)
+	tx := db.WriteTx()
+	tx.Put(trash.Put(trashed))
+	tx.Delete(tracks.Delete("UserID", t.UserID).Range("ID", t.ID).If("attribute_exists('ID')"))
+	tx.Put(tombstones.Put(Tombstone{UserID: t.UserID, ID: t.ID, Deleted: now}))
+	tx.Update(users.Update("ID", t.UserID).
+		Add("Usage", -size).
+		Add("Tracks", -1))
+	err := tx.RunWithContext(ctx)
+	forgetUser(t.UserID)
+	if err != nil && key != t.StorageKey() {
+		// put the audio back, since the track is still there
+		if err := moveObject(key, t.StorageKey()); err != nil {
+			slog.ErrorContext(ctx, "trash: failed to move audio back", "key", key, "err", err)
+		}
+	}
+	return err
+}
+
+// Restore puts a trashed track back in the library, along with its audio.
+// It fails with a ConditionalCheckFailedException if the library already has a track with the same ID,
+// such as when the same file was uploaded again.
+func (tt TrashedTrack) Restore(ctx context.Context) (Track, error) {
+	t := tt.Track
+	t.LastMod = time.Now().UTC()
+	t.SortID = t.SortKey()
+	tracks := dbTable("Tracks")
+	if err := tracks.Put(t).If("attribute_not_exists('ID')").RunWithContext(ctx); err != nil {
+		return t, err
+	}
+	if tt.Key != t.StorageKey() {
+		if err := copyObject(tt.Key, t.StorageKey()); err != nil {
+			if err := tracks.Delete("UserID", t.UserID).Range("ID", t.ID).RunWithContext(ctx); err != nil {
+				slog.ErrorContext(ctx, "trash: failed to undo restore", "track_id", t.ID, "err", err)
+			}
+			return t, err
+		}
+	}
+	if _, err := AddUsage(ctx, t.UserID, int64(t.Size), 1); err != nil {
+		return t, err
+	}
+	forgetUser(t.UserID)
+	trash := dbTable(tableTrash)
+	if err := trash.Delete("UserID", tt.UserID).Range("ID", tt.ID).RunWithContext(ctx); err != nil {
+		return t, err
+	}
+	if tt.Key != t.StorageKey() {
+		if err := storage.FilesBucket.Delete(tt.Key); err != nil {
+			slog.ErrorContext(ctx, "trash: failed to delete restored audio", "key", tt.Key, "err", err)
+		}
+	}
+	return t, nil
+}
+
+// Purge deletes a trashed track for good.
+// Cold tracks keep their audio in the library's place, so it's left alone if the track has been uploaded again.
+func (tt TrashedTrack) Purge(ctx context.Context) error {
+	keep := false
+	if tt.Key == tt.Track.StorageKey() {
+		_, err := GetTrack(ctx, tt.UserID, tt.ID)
+		switch {
+		case err == nil:
+			keep = true
+		case err != ErrNotFound:
+			return err
+		}
+	}
+	if !keep {
+		if err := storage.FilesBucket.Delete(tt.Key); err != nil {
+			return fmt.Errorf("trash: deleting %s: %w", tt.Key, err)
+		}
+	}
+	trash := dbTable(tableTrash)
+	return trash.Delete("UserID", tt.UserID).Range("ID", tt.ID).RunWithContext(ctx)
+}
+
+func GetTrashedTrack(ctx context.Context, userID int, id string) (TrashedTrack, error) {
+	var tt TrashedTrack
+	trash := dbTable(tableTrash)
+	err := trash.Get("UserID", userID).Range("ID", dynamo.Equal, id).
+		Filter("'Expires' > ?", time.Now().UTC().Unix()).
+		OneWithContext(ctx, &tt)
+	return tt, err
+}
+
+// GetTrash returns a user's trashed tracks, most recently deleted first.
+func GetTrash(ctx context.Context, userID int) ([]TrashedTrack, error) {
+	var tts []TrashedTrack
+	trash := dbTable(tableTrash)
+	err := trash.Get("UserID", userID).
+		Filter("'Expires' > ?", time.Now().UTC().Unix()).
+		AllWithContext(ctx, &tts)
+	if err == ErrNotFound {
+		err = nil
+	}
+	sort.Slice(tts, func(i, j int) bool {
+		return tts[i].Deleted.After(tts[j].Deleted)
+	})
+	return tts, err
+}
+
+// EmptyTrash deletes tracks that have been in the trash for longer than TrashTTL.
+func EmptyTrash(ctx context.Context) error {
+	trash := dbTable(tableTrash)
+	iter := trash.Scan().
+		Filter("'Expires' <= ?", time.Now().UTC().Unix()).
+		Iter()
+	var tt TrashedTrack
+	var n int
+	for iter.NextWithContext(ctx, &tt) {
+		if err := tt.Purge(ctx); err != nil {
+			return err
+		}
+		n++
+		tt = TrashedTrack{}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		slog.InfoContext(ctx, "trash: emptied", "count", n)
+	}
+	return nil
+}
+
+// moveObject moves an object within the files bucket.
+func moveObject(src, dst string) error {
+	if err := copyObject(src, dst); err != nil {
+		return err
+	}
+	return storage.FilesBucket.Delete(src)
+}
+
+func copyObject(src, dst string) error {
+	head, err := storage.FilesBucket.Head(src)
+	if err != nil {
+		return err
+	}
+	return storage.FilesBucket.CopyFromBucket(dst, storage.FilesBucket, src, head.Type, head.Disposition)
+}
@@ -0,0 +1,193 @@
+package tube
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/guregu/intertube/storage"
+)
+
+func TestTrashRestore(t *testing.T) {
+	ctx := testDB(t)
+	testStorage(t)
+	u := testUser(t, ctx)
+	track := testTrack(t, ctx, u, "oops")
+
+	if err := track.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := GetTrash(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != track.ID {
+		t.Fatalf("trash: %+v, want just %s", trash, track.ID)
+	}
+	tt := trash[0]
+	if tt.Key != trashKey(track) {
+		t.Errorf("trashed audio key: %s, want %s", tt.Key, trashKey(track))
+	}
+	if _, err := storage.FilesBucket.Head(track.StorageKey()); err == nil {
+		t.Error("audio is still in the library after deleting")
+	}
+	if _, err := storage.FilesBucket.Head(tt.Key); err != nil {
+		t.Error("audio isn't in the trash:", err)
+	}
+
+	restored, err := tt.Restore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetTrack(ctx, u.ID, track.ID); err != nil {
+		t.Error("restored track isn't in the library:", err)
+	}
+	if _, err := storage.FilesBucket.Head(restored.StorageKey()); err != nil {
+		t.Error("restored audio isn't in the library:", err)
+	}
+	if _, err := storage.FilesBucket.Head(tt.Key); err == nil {
+		t.Error("restored audio is still in the trash")
+	}
+	if _, err := GetTrashedTrack(ctx, u.ID, track.ID); err != ErrNotFound {
+		t.Errorf("GetTrashedTrack after restoring: %v, want ErrNotFound", err)
+	}
+	got, err := GetUser(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Usage != int64(track.Size) || got.Tracks != 1 {
+		t.Errorf("usage after restoring: %d bytes, %d tracks; want %d, 1", got.Usage, got.Tracks, track.Size)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	ctx := testDB(t)
+	testStorage(t)
+	u := testUser(t, ctx)
+	purged := testTrack(t, ctx, u, "purged")
+	expired := testTrack(t, ctx, u, "expired")
+	kept := testTrack(t, ctx, u, "kept")
+	for _, track := range []Track{purged, expired, kept} {
+		if err := track.Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt, err := GetTrashedTrack(ctx, u.ID, purged.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.FilesBucket.Head(tt.Key); err == nil {
+		t.Error("purged audio is still around")
+	}
+
+	// pretend this one has been in the trash for a while
+	old := dbTable(tableTrash).Update("UserID", u.ID).Range("ID", expired.ID).
+		Set("Expires", time.Now().Add(-time.Minute).Unix())
+	if err := old.RunWithContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetTrashedTrack(ctx, u.ID, expired.ID); err != ErrNotFound {
+		t.Errorf("GetTrashedTrack for an expired track: %v, want ErrNotFound", err)
+	}
+	if err := EmptyTrash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.FilesBucket.Head(trashKey(expired)); err == nil {
+		t.Error("expired audio is still around after emptying the trash")
+	}
+
+	trash, err := GetTrash(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != kept.ID {
+		t.Errorf("trash: %+v, want just %s", trash, kept.ID)
+	}
+}
+
+func TestTrashMoveFails(t *testing.T) {
+	ctx := testDB(t)
+	testStorage(t)
+	u := testUser(t, ctx)
+	track := testTrack(t, ctx, u, "stuck")
+
+	// a file where the trash directory should be, so the audio can't be moved there
+	root := storage.FilesBucket.(storage.FSBucket).Root
+	if err := os.WriteFile(filepath.Join(root, "trash"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Delete(ctx); err == nil {
+		t.Fatal("deleting worked even though the audio couldn't be moved")
+	}
+	if _, err := GetTrack(ctx, u.ID, track.ID); err != nil {
+		t.Error("track isn't in the library after a failed delete:", err)
+	}
+	if _, err := GetTrashedTrack(ctx, u.ID, track.ID); err != ErrNotFound {
+		t.Errorf("GetTrashedTrack after a failed delete: %v, want ErrNotFound", err)
+	}
+	got, err := GetUser(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Usage != int64(track.Size) || got.Tracks != 1 {
+		t.Errorf("usage after a failed delete: %d bytes, %d tracks; want %d, 1", got.Usage, got.Tracks, track.Size)
+	}
+
+	// a trash entry that points at the library, like a cold track's, can't take the live audio with it
+	tt := TrashedTrack{UserID: u.ID, ID: track.ID, Track: track, Key: track.StorageKey()}
+	if err := tt.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.FilesBucket.Head(track.StorageKey()); err != nil {
+		t.Error("purging deleted the live audio:", err)
+	}
+}
+
+func TestTrashRestoreConflict(t *testing.T) {
+	ctx := testDB(t)
+	testStorage(t)
+	u := testUser(t, ctx)
+	track := testTrack(t, ctx, u, "again")
+	if err := track.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tt, err := GetTrashedTrack(ctx, u.ID, track.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uploaded again, and edited since
+	again := testTrack(t, ctx, u, "again")
+	again.Info.Title = "newer"
+	if err := again.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tt.Restore(ctx); !dynamo.IsCondCheckFailed(err) {
+		t.Fatalf("restoring over an existing track: %v, want a condition check failure", err)
+	}
+	got, err := GetTrack(ctx, u.ID, track.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Info.Title != "newer" {
+		t.Errorf("title after a failed restore: %q, want %q", got.Info.Title, "newer")
+	}
+	user, err := GetUser(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Usage != int64(track.Size) || user.Tracks != 1 {
+		t.Errorf("usage after a failed restore: %d bytes, %d tracks; want %d, 1", user.Usage, user.Tracks, track.Size)
+	}
+	if _, err := GetTrashedTrack(ctx, u.ID, track.ID); err != nil {
+		t.Error("track isn't in the trash after a failed restore:", err)
+	}
+}
@@ -0,0 +1,128 @@
+package tube
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/guregu/intertube/storage"
+)
+
+// UsageReport compares a user's recorded usage with their tracks and stored audio.
+type UsageReport struct {
+	UserID int
+
+	Usage          int64 // recorded
+	Tracks         int   // recorded
+	ActualUsage    int64
+	ActualTracks   int
+	MissingObjects []string // tracks with no audio in storage
+	OrphanObjects  []string // stored audio with no track
+	Fixed          bool
+}
+
+// Drifted reports whether the recorded usage doesn't match.
+func (r UsageReport) Drifted() bool {
+	return r.Usage != r.ActualUsage || r.Tracks != r.ActualTracks
+}
+
+// OK reports whether everything matches.
+func (r UsageReport) OK() bool {
+	return !r.Drifted() && len(r.MissingObjects) == 0 && len(r.OrphanObjects) == 0
+}
+
+func (r UsageReport) String() string {
+	return fmt.Sprintf("user %d: usage %d -> %d, tracks %d -> %d, %d missing, %d orphaned",
+		r.UserID, r.Usage, r.ActualUsage, r.Tracks, r.ActualTracks, len(r.MissingObjects), len(r.OrphanObjects))
+}
+
+// ReconcileUsage recomputes a user's usage from their tracks and checks them against
+// the audio in storage. Usage counts the size of each track, like Track.Create does,
+// so missing and orphaned objects are only reported.
+// If fix is true, drifted usage is corrected, unless it changed while we were looking.
+func ReconcileUsage(ctx context.Context, userID int, fix bool) (UsageReport, error) {
+	u, err := GetUser(ctx, userID)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	report := UsageReport{
+		UserID: u.ID,
+		Usage:  u.Usage,
+		Tracks: u.Tracks,
+	}
+
+	tracks, err := GetTracks(ctx, u.ID)
+	if err != nil {
+		return report, err
+	}
+	objects, err := storage.WithContext(ctx, storage.FilesBucket).List(fmt.Sprintf("u/tracks/%d/", u.ID))
+	if err != nil {
+		return report, err
+	}
+	for _, t := range tracks {
+		report.ActualUsage += int64(t.Size)
+		report.ActualTracks++
+		key := t.StorageKey()
+		if _, ok := objects[key]; !ok {
+			report.MissingObjects = append(report.MissingObjects, key)
+		}
+		delete(objects, key)
+	}
+	trash, err := GetTrash(ctx, u.ID)
+	if err != nil {
+		return report, err
+	}
+	for _, tt := range trash {
+		// cold tracks stay where they are when they're trashed
+		delete(objects, tt.Key)
+	}
+	for key := range objects {
+		report.OrphanObjects = append(report.OrphanObjects, key)
+	}
+
+	if fix && report.Drifted() {
+		users := dbTable(tableUsers)
+		err := users.Update("ID", u.ID).
+			Set("Usage", report.ActualUsage).
+			Set("Tracks", report.ActualTracks).
+			If("'Usage' = ? AND 'Tracks' = ?", report.Usage, report.Tracks).
+			RunWithContext(ctx)
+		switch {
+		case dynamo.IsCondCheckFailed(err):
+			// something was uploaded or deleted, try again next time
+		case err != nil:
+			return report, err
+		default:
+			report.Fixed = true
+		}
+	}
+	return report, nil
+}
+
+// ReconcileAllUsage fixes every user's usage, logging any discrepancies.
+func ReconcileAllUsage(ctx context.Context) error {
+	users, err := GetAllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var drifted int
+	for _, u := range users {
+		if u.Deleting() {
+			continue
+		}
+		report, err := ReconcileUsage(ctx, u.ID, true)
+		if err != nil {
+			return fmt.Errorf("user %d: %w", u.ID, err)
+		}
+		if !report.OK() {
+			slog.WarnContext(ctx, "usage reconcile: drift", "report", report)
+		}
+		if report.Drifted() {
+			drifted++
+		}
+	}
+	slog.InfoContext(ctx, "usage reconcile: done", "checked", len(users), "drifted", drifted)
+	return nil
+}
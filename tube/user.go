@@ -16,6 +16,10 @@ const (
 
 var TrialDuration = 14 * time.Hour * 24
 
+// LapseGracePeriod is how long an account stays read-only after its plan
+// or trial runs out, before it's locked.
+var LapseGracePeriod = 30 * time.Hour * 24
+
 const CurrentPhase = RegPhaseEarlyAccess
 
 type User struct {
@@ -24,27 +28,73 @@ type User struct {
 	Password []byte `json:"-"`
 	Regdate  time.Time
 	Phase    RegPhase // phase at time of reg
-	Recovery string
+	Role     Role     `dynamo:",omitempty"` // use GetRole
+	Invite   string   `dynamo:",omitempty"` // invite code used to register
+	Recovery string   `json:"-"`
+
+	// devices and countries seen at login, for new login alerts
+	Devices    map[string]time.Time `dynamo:",omitempty" json:"-"`
+	Countries  []string             `dynamo:",set,omitempty"`
+	RevokeCode string               `dynamo:",omitempty" json:"-"`
 
 	Usage  int64
 	Quota  int64
 	Tracks int
 
-	CustomerID string `index:"CustomerID-index,hash"` // from stripe
-	Plan       PlanKind
-	PlanStatus PlanStatus // from stripe
-	PlanExpire time.Time  `dynamo:",omitempty"`
-	Canceled   bool
-	TrialOver  bool
+	// bytes downloaded in EgressMonth (like 2006-01), see AddEgress
+	Egress      int64  `dynamo:",omitempty"`
+	EgressMonth string `dynamo:",omitempty"`
+
+	// set by admins, takes precedence over the plan quota
+	QuotaOverride int64  `dynamo:",omitempty"`
+	QuotaNote     string `dynamo:",omitempty"`
+	BonusQuota    int64  `dynamo:",omitempty"` // added to the plan quota
+
+	// LDAP accounts: quota comes from directory group membership, synced on login
+	DirectoryDN    string `dynamo:",omitempty"`
+	DirectoryQuota int64  `dynamo:",omitempty"`
+
+	ReferralCode     string    `dynamo:",omitempty"`
+	ReferredBy       int       `dynamo:",omitempty"`
+	ReferralCredited time.Time `dynamo:",omitempty"`
+	Referrals        int       // converted referrals
+
+	CustomerID  string `index:"CustomerID-index,hash"` // from stripe
+	MeteredItem string `dynamo:",omitempty"`           // stripe subscription item for metered plans
+	Plan        PlanKind
+	PlanStatus  PlanStatus // from stripe
+	PlanExpire  time.Time  `dynamo:",omitempty"`
+	Canceled    bool
+	TrialOver   bool
 
 	Theme   string
 	Display DisplayOptions
+	Prefs   Preferences `dynamo:",omitempty"`
+	// where streaming and downloads are allowed from
+	Restrict Restrictions `dynamo:",omitempty"`
+	// encrypt new uploads with DataKey, which is wrapped by the server's master key
+	Encrypt bool   `dynamo:",omitempty"`
+	DataKey []byte `dynamo:",omitempty" json:"-"`
+	// nightly metadata backups to the user's own bucket
+	Backup Backup `dynamo:",omitempty"`
+
+	// e-mail notifications: categories opted out of, and when some were last sent
+	EmailOptOut    []string  `dynamo:",omitempty"`
+	QuotaNotified  time.Time `dynamo:",omitempty" json:"-"`
+	ImportNotified time.Time `dynamo:",omitempty" json:"-"`
+
+	// hash of the token for reading now-playing status, see SetStatusToken
+	StatusToken []byte `dynamo:",omitempty" json:"-"`
 
 	B2Token  string
 	B2Expire time.Time `dynamo:",omitempty"`
 
 	LastMod  time.Time
 	LastDump time.Time `dynamo:",omitempty"`
+
+	// account deletion: access is disabled at Deleted, data is purged after PurgeAfter
+	Deleted    time.Time `dynamo:",omitempty"`
+	PurgeAfter time.Time `dynamo:",omitempty"`
 }
 
 type DisplayOptions struct {
@@ -71,8 +121,8 @@ func (u *User) Create(ctx context.Context) error {
 		return err
 	}
 
-	users := dynamoTable(tableUsers)
-	err = users.Put(u).If("attribute_not_exists(ID)").Run()
+	users := dbTable(tableUsers)
+	err = users.Put(u).If("attribute_not_exists(ID)").RunWithContext(ctx)
 	return err
 }
 
@@ -91,7 +141,7 @@ func (u *User) SetEmail(ctx context.Context, email string) error {
 		return err
 	}
 
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Email", email).
 		Set("LastMod", time.Now().UTC()).
@@ -103,14 +153,19 @@ func (u *User) SetRandomRecovery(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Recovery", code).
 		Value(u)
 }
 
+// SetPassword changes the user's password. Paired devices are unpaired,
+// as whoever had the old password could have paired one.
 func (u *User) SetPassword(ctx context.Context, pw []byte) error {
-	users := dynamoTable(tableUsers)
+	if err := DeleteDeviceTokens(ctx, u.ID); err != nil {
+		return err
+	}
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Password", pw).
 		Remove("Recovery").
@@ -119,14 +174,14 @@ func (u *User) SetPassword(ctx context.Context, pw []byte) error {
 
 func (u *User) UpdateLastMod(ctx context.Context) error {
 	now := time.Now().UTC().Truncate(time.Second)
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("LastMod", now).
 		Value(u)
 }
 
 func (u *User) UpdateLastDump(ctx context.Context, at time.Time) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("LastDump", at).
 		If("attribute_not_exists(LastDump) OR LastDump < ?", at).
@@ -134,7 +189,7 @@ func (u *User) UpdateLastDump(ctx context.Context, at time.Time) error {
 }
 
 func (u *User) SetB2Token(ctx context.Context, token string, expire time.Time) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("B2Token", token).
 		Set("B2Expire", expire).
@@ -143,7 +198,7 @@ func (u *User) SetB2Token(ctx context.Context, token string, expire time.Time) e
 }
 
 func (u *User) SetTracks(ctx context.Context, count int) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Tracks", count).
 		Set("LastMod", time.Now().UTC()).
@@ -151,15 +206,28 @@ func (u *User) SetTracks(ctx context.Context, count int) error {
 }
 
 func (u *User) SetTheme(ctx context.Context, theme string) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Theme", theme).
 		Set("LastMod", time.Now().UTC()).
 		Value(u)
 }
 
+// SetEncrypt turns encryption of new uploads on or off.
+// dataKey is only saved if the user doesn't have one yet, so existing tracks stay readable.
+func (u *User) SetEncrypt(ctx context.Context, on bool, dataKey []byte) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		Set("Encrypt", on).
+		Set("LastMod", time.Now().UTC())
+	if len(u.DataKey) == 0 && len(dataKey) > 0 {
+		update.Set("DataKey", dataKey).If("attribute_not_exists('DataKey')")
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
 func (u *User) SetDisplayOpt(ctx context.Context, disp DisplayOptions) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Display", disp).
 		Set("LastMod", time.Now().UTC()).
@@ -167,15 +235,26 @@ func (u *User) SetDisplayOpt(ctx context.Context, disp DisplayOptions) error {
 }
 
 func (u *User) SetCustomerID(ctx context.Context, id string) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("CustomerID", id).
 		Set("LastMod", time.Now().UTC()).
 		Value(u)
 }
 
+func (u *User) SetMeteredItem(ctx context.Context, itemID string) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID)
+	if itemID == "" {
+		update.Remove("MeteredItem")
+	} else {
+		update.Set("MeteredItem", itemID)
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
 func (u *User) SetPlan(ctx context.Context, kind PlanKind, status PlanStatus, expires time.Time, canceled bool) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Set("Plan", kind).
 		Set("PlanStatus", status).
@@ -186,8 +265,42 @@ func (u *User) SetPlan(ctx context.Context, kind PlanKind, status PlanStatus, ex
 		Value(u)
 }
 
+// SetQuotaOverride sets a quota that replaces the plan's quota. Zero clears it.
+// SetDirectory links the user to a directory (LDAP) account and sets the quota granted by its groups.
+func (u *User) SetDirectory(ctx context.Context, dn string, quota int64) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		Set("DirectoryDN", dn).
+		Set("LastMod", time.Now().UTC()).
+		If("attribute_exists('ID')")
+	if quota > 0 {
+		update.Set("DirectoryQuota", quota)
+	} else {
+		update.Remove("DirectoryQuota")
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
+func (u *User) SetQuotaOverride(ctx context.Context, quota int64, note string) error {
+	users := dbTable(tableUsers)
+	update := users.Update("ID", u.ID).
+		Set("LastMod", time.Now().UTC()).
+		If("attribute_exists('ID')")
+	if quota > 0 {
+		update.Set("QuotaOverride", quota)
+	} else {
+		update.Remove("QuotaOverride")
+	}
+	if note != "" {
+		update.Set("QuotaNote", note)
+	} else {
+		update.Remove("QuotaNote")
+	}
+	return update.ValueWithContext(ctx, u)
+}
+
 func (u *User) DeletePaymentInfo(ctx context.Context) error {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	return users.Update("ID", u.ID).
 		Remove("CustomerID").
 		Remove("Plan").
@@ -204,10 +317,23 @@ func (u User) ValidPassword(password string) bool {
 }
 
 func (u User) CalcQuota() int64 {
-	if u.Grandfathered() && u.Plan == PlanKindNone && u.Quota > 0 {
-		return u.Quota
+	if u.QuotaOverride > 0 {
+		return u.QuotaOverride
+	}
+	if u.DirectoryDN != "" {
+		return u.DirectoryQuota
+	}
+	// old accounts keep the quota they signed up with, unless plans are disabled:
+	// then everyone gets the self-hosted quota, and admins can override it to keep the old one
+	if u.Grandfathered() && u.Plan == PlanKindNone && u.Quota > 0 && !plansDisabled {
+		return u.Quota + u.BonusQuota
 	}
-	return GetPlan(u.Plan).Quota
+	quota := GetPlan(u.Plan).Quota
+	if quota == 0 {
+		// unlimited
+		return 0
+	}
+	return quota + u.BonusQuota
 }
 
 func (u User) UsageDesc() string {
@@ -243,6 +369,36 @@ func (u User) Expired() bool {
 	return u.TimeRemaining() <= 0
 }
 
+// Deleting reports whether this account has been scheduled for deletion.
+func (u User) Deleting() bool {
+	return !u.Deleted.IsZero()
+}
+
+type AccessLevel int
+
+const (
+	AccessFull     AccessLevel = iota
+	AccessReadOnly             // lapsed: streaming and downloads only
+	AccessLocked               // lapsed past the grace period: account management only
+)
+
+// Access determines what a user can do based on their plan's expiration.
+// Failed payments are left to Stripe's retry schedule, which moves PlanExpire.
+func (u User) Access(now time.Time) AccessLevel {
+	if u.Grandfathered() || u.PlanExpire.IsZero() || now.Before(u.PlanExpire) {
+		return AccessFull
+	}
+	if now.Before(u.PlanExpire.Add(LapseGracePeriod)) {
+		return AccessReadOnly
+	}
+	return AccessLocked
+}
+
+// GraceEnds returns when a lapsed account will be locked.
+func (u User) GraceEnds() time.Time {
+	return u.PlanExpire.Add(LapseGracePeriod)
+}
+
 func (u User) Grandfathered() bool {
 	return u.Phase == RegPhaseAlpha
 }
@@ -252,45 +408,58 @@ func (u User) Trialing() bool {
 }
 
 func (u User) StorageFull() bool {
-	return u.Usage >= u.CalcQuota()
+	quota := u.CalcQuota()
+	return quota != 0 && u.Usage >= quota
 }
 
 func GetUser(ctx context.Context, id int) (User, error) {
-	users := dynamoTable(tableUsers)
+	if u, ok := cachedUser(id); ok {
+		return u, nil
+	}
+	users := dbTable(tableUsers)
 	var u User
-	err := users.Get("ID", id).Consistent(true).One(&u)
+	err := users.Get("ID", id).Consistent(true).OneWithContext(ctx, &u)
+	if err == nil {
+		cacheUser(u)
+	}
 	return u, err
 }
 
 func GetUserByEmail(ctx context.Context, email string) (User, error) {
 	email = strings.ToLower(email)
-	users := dynamoTable(tableUsers)
+	if u, ok := cachedUserByEmail(email); ok {
+		return u, nil
+	}
+	users := dbTable(tableUsers)
 	var u User
-	err := users.Get("Email", email).Index("Email-index").One(&u)
+	err := users.Get("Email", email).Index("Email-index").OneWithContext(ctx, &u)
+	if err == nil {
+		cacheUserByEmail(u)
+	}
 	return u, err
 }
 
 func GetUserByCustomerID(ctx context.Context, id string) (User, error) {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	var u User
-	err := users.Get("CustomerID", id).Index("CustomerID-index").One(&u)
+	err := users.Get("CustomerID", id).Index("CustomerID-index").OneWithContext(ctx, &u)
 	return u, err
 }
 
 func GetAllUsers(ctx context.Context) ([]User, error) {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	var u []User
-	err := users.Scan().All(&u)
+	err := users.Scan().AllWithContext(ctx, &u)
 	return u, err
 }
 
 func AddUsage(ctx context.Context, id int, usage int64, trackCt int) (User, error) {
-	users := dynamoTable(tableUsers)
+	users := dbTable(tableUsers)
 	var u User
 	err := users.Update("ID", id).
 		Add("Usage", usage).
 		Add("Tracks", trackCt).
-		If("attribute_exists('ID')").Value(&u)
+		If("attribute_exists('ID')").ValueWithContext(ctx, &u)
 	return u, err
 }
 
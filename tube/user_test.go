@@ -0,0 +1,33 @@
+package tube
+
+import "testing"
+
+func TestCalcQuotaSelfHosted(t *testing.T) {
+	const gb = 1 << 30
+	old := User{Quota: 5 * gb, BonusQuota: 1 * gb}
+	if !old.Grandfathered() {
+		t.Fatal("test user isn't grandfathered")
+	}
+	if got := old.CalcQuota(); got != 6*gb {
+		t.Errorf("grandfathered quota: %d, want %d", got, 6*gb)
+	}
+
+	prevPlan, prevDisabled := plans[PlanKindNone], plansDisabled
+	t.Cleanup(func() {
+		plans[PlanKindNone] = prevPlan
+		plansDisabled = prevDisabled
+	})
+
+	DisablePlans(100 * gb)
+	if got := old.CalcQuota(); got != 101*gb {
+		t.Errorf("grandfathered quota when self-hosted: %d, want the self-hosted quota plus bonus, %d", got, 101*gb)
+	}
+	DisablePlans(0)
+	if got := old.CalcQuota(); got != 0 {
+		t.Errorf("grandfathered quota when self-hosted without a quota: %d, want 0 (unlimited)", got)
+	}
+	old.QuotaOverride = 5 * gb
+	if got := old.CalcQuota(); got != 5*gb {
+		t.Errorf("overridden quota when self-hosted: %d, want %d", got, 5*gb)
+	}
+}
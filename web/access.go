@@ -0,0 +1,41 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// accessLevel is the user's access, which is always full when payment is disabled.
+func accessLevel(u tube.User) tube.AccessLevel {
+	if !UseStripe {
+		return tube.AccessFull
+	}
+	return u.Access(time.Now())
+}
+
+// requireWritable blocks uploads for lapsed accounts.
+func requireWritable(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	u, ok := userFrom(ctx)
+	if !ok || accessLevel(u) == tube.AccessFull {
+		return ctx
+	}
+	http.Error(w, "your subscription has expired, so your account is read-only", http.StatusPaymentRequired)
+	return nil
+}
+
+// requireUnlocked blocks access to the library for accounts past the lapse grace period.
+func requireUnlocked(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	u, ok := userFrom(ctx)
+	if !ok || accessLevel(u) != tube.AccessLocked {
+		return ctx
+	}
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, "/settings#sub", http.StatusSeeOther)
+		return nil
+	}
+	http.Error(w, "your subscription has expired", http.StatusPaymentRequired)
+	return nil
+}
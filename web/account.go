@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/guregu/intertube/job"
+	"github.com/guregu/intertube/tube"
+)
+
+type deleteAccountFormData struct {
+	User      tube.User
+	GraceDays int
+	ErrorMsg  string
+}
+
+func deleteAccountForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	u, _ := userFrom(ctx)
+	data := deleteAccountFormData{
+		User:      u,
+		GraceDays: int(tube.AccountGracePeriod / (24 * time.Hour)),
+	}
+	renderTemplate(ctx, w, "settings-delete", data, http.StatusOK)
+}
+
+// POST /settings/delete
+// Disables the account right away and queues cancelling billing.
+// The actual data is purged by the scheduled job once the grace period is over.
+func deleteAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+
+	if confirmed, err := checkLogin(ctx, r, u.Email, r.FormValue("password")); err != nil || confirmed.ID != u.ID {
+		data := deleteAccountFormData{
+			User:      u,
+			GraceDays: int(tube.AccountGracePeriod / (24 * time.Hour)),
+			ErrorMsg:  "password is incorrect",
+		}
+		renderTemplate(ctx, w, "settings-delete", data, http.StatusOK)
+		return nil
+	}
+
+	if err := u.ScheduleDeletion(ctx, time.Now()); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "account deleted", "purge_after", u.PurgeAfter)
+	audit(ctx, r, u.ID, tube.EventAccountDeleted, "purge after "+u.PurgeAfter.Format(time.RFC3339))
+
+	// the account is already gone, so a failure here is for support to clean up rather than the user
+	if UseStripe && u.CustomerID != "" {
+		if _, err := job.Enqueue(ctx, u.ID, jobCancelBilling, cancelBillingJob{CustomerID: u.CustomerID}); err != nil {
+			slog.ErrorContext(ctx, "account deleted: failed to queue billing cancellation", "customer_id", u.CustomerID, "err", err)
+		}
+	}
+
+	for _, cookie := range expiredAuthCookies() {
+		http.SetCookie(w, cookie)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+type cancelBillingJob struct {
+	CustomerID string
+}
+
+func runCancelBillingJob(ctx context.Context, j *tube.Job) error {
+	var payload cancelBillingJob
+	if err := j.Decode(&payload); err != nil {
+		return err
+	}
+	if err := cancelSubscriptions(payload.CustomerID); err != nil {
+		if j.Attempts >= job.MaxAttempts {
+			slog.ErrorContext(ctx, "account deleted: giving up cancelling billing", "user_id", j.UserID, "customer_id", payload.CustomerID, "err", err)
+		}
+		return err
+	}
+	return nil
+}
@@ -2,16 +2,39 @@ package web
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/guregu/intertube/tube"
 )
 
-func adminIndex(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+const (
+	adminSearchLimit  = 50
+	adminMetricsDays  = 30
+	adminMaxMetricDay = 365
+)
+
+func init() {
+	kami.Get("/admin/api/metrics", handle(adminMetrics))
+	kami.Get("/admin/api/users", handle(adminSearchUsers))
+	kami.Get("/admin/api/users/:id", handle(adminUserDetail))
+	kami.Post("/admin/api/users/:id/quota", handle(adminSetQuota))
+	kami.Post("/admin/api/users/:id/role", handle(adminSetRole))
+	kami.Post("/admin/api/users/:id/usage", handle(adminReconcileUsage))
+	kami.Post("/admin/api/gc", handle(adminCollectGarbage))
+}
+
+func adminIndex(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	users, err := tube.GetAllUsers(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	sort.Slice(users, func(i, j int) bool {
@@ -26,4 +49,289 @@ func adminIndex(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderTemplate(ctx, w, "admin", data, http.StatusOK)
+	return nil
+}
+
+type adminDayStat struct {
+	Date    string
+	Uploads int
+	Bytes   int64
+}
+
+type adminMetricsData struct {
+	Users         int
+	PayingUsers   int
+	Plans         map[tube.PlanKind]int
+	Tracks        int
+	Storage       int64
+	Files         int
+	FailedIngests int
+	UploadsPerDay []adminDayStat
+}
+
+// GET /admin/api/metrics?days=30
+func adminMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 {
+		days = adminMetricsDays
+	}
+	if days > adminMaxMetricDay {
+		days = adminMaxMetricDay
+	}
+
+	var users []tube.User
+	var files []tube.File
+	grp, gctx := errgroup.WithContext(ctx)
+	grp.Go(func() error {
+		var err error
+		users, err = tube.GetAllUsers(gctx)
+		return err
+	})
+	grp.Go(func() error {
+		var err error
+		files, err = tube.GetAllFiles(gctx)
+		return err
+	})
+	if err := grp.Wait(); err != nil {
+		return err
+	}
+
+	data := adminMetricsData{
+		Users: len(users),
+		Plans: make(map[tube.PlanKind]int),
+		Files: len(files),
+	}
+	for _, u := range users {
+		data.Tracks += u.Tracks
+		data.Storage += u.Usage
+		data.Plans[u.Plan]++
+		if u.Plan != tube.PlanKindNone && u.PlanStatus.Active() {
+			data.PayingUsers++
+		}
+	}
+
+	now := time.Now().UTC()
+	stalled := now.Add(-UploadTTL)
+	start := now.Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+	perDay := make([]adminDayStat, days)
+	for i := range perDay {
+		perDay[i].Date = start.AddDate(0, 0, i).Format("2006-01-02")
+	}
+	for _, f := range files {
+		if f.Stalled(stalled) {
+			data.FailedIngests++
+		}
+		if f.Time.Before(start) {
+			continue
+		}
+		idx := int(f.Time.Sub(start) / (24 * time.Hour))
+		if idx >= len(perDay) {
+			continue
+		}
+		perDay[idx].Uploads++
+		perDay[idx].Bytes += f.Size
+	}
+	data.UploadsPerDay = perDay
+
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// GET /admin/api/users?q=search
+func adminSearchUsers(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	lower := strings.ToLower(query)
+
+	users, err := tube.GetAllUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := make([]tube.User, 0, adminSearchLimit)
+	for _, u := range users {
+		if query != "" && strconv.Itoa(u.ID) != query &&
+			!strings.Contains(strings.ToLower(u.Email), lower) && u.CustomerID != query {
+			continue
+		}
+		found = append(found, u)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].LastMod.After(found[j].LastMod)
+	})
+	if len(found) > adminSearchLimit {
+		found = found[:adminSearchLimit]
+	}
+
+	data := struct {
+		Users []tube.User
+		Total int
+	}{
+		Users: found,
+		Total: len(users),
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// GET /admin/api/users/:id
+func adminUserDetail(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(kami.Param(ctx, "id"))
+	if err != nil {
+		return errBadRequest("invalid user ID")
+	}
+
+	u, err := tube.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var files []tube.File
+	var playlists []tube.Playlist
+	grp, gctx := errgroup.WithContext(ctx)
+	grp.Go(func() error {
+		var err error
+		files, err = tube.GetFilesByUser(gctx, u.ID)
+		return err
+	})
+	grp.Go(func() error {
+		var err error
+		playlists, err = tube.GetPlaylists(gctx, u.ID)
+		return err
+	})
+	if err := grp.Wait(); err != nil {
+		return err
+	}
+
+	stalled := time.Now().UTC().Add(-UploadTTL)
+	var failed []tube.File
+	var uploaded int64
+	for _, f := range files {
+		uploaded += f.Size
+		if f.Stalled(stalled) {
+			failed = append(failed, f)
+		}
+	}
+
+	data := struct {
+		User          tube.User
+		Quota         int64
+		Files         int
+		UploadedBytes int64
+		FailedIngests []tube.File
+		Playlists     int
+	}{
+		User:          u,
+		Quota:         u.CalcQuota(),
+		Files:         len(files),
+		UploadedBytes: uploaded,
+		FailedIngests: failed,
+		Playlists:     len(playlists),
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/users/:id/quota?bytes=123&note=reason
+// bytes=0 removes the override, reverting to the plan quota.
+func adminSetQuota(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	id, err := strconv.Atoi(kami.Param(ctx, "id"))
+	if err != nil {
+		return errBadRequest("invalid user ID")
+	}
+	quota, err := strconv.ParseInt(r.FormValue("bytes"), 10, 64)
+	if err != nil || quota < 0 {
+		return errBadRequest("invalid bytes")
+	}
+	note := strings.TrimSpace(r.FormValue("note"))
+
+	u, err := tube.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	prev := u.CalcQuota()
+	if err := u.SetQuotaOverride(ctx, quota, note); err != nil {
+		return err
+	}
+	detail := fmt.Sprintf("quota override user %d: %d -> %d (%s)", u.ID, prev, u.CalcQuota(), note)
+	audit(ctx, r, admin.ID, tube.EventAdminAction, detail)
+	audit(withImpersonator(ctx, admin.ID), r, u.ID, tube.EventAdminAction, fmt.Sprintf("quota set to %d", u.CalcQuota()))
+
+	data := struct {
+		User  tube.User
+		Quota int64
+	}{
+		User:  u,
+		Quota: u.CalcQuota(),
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/users/:id/role?role=support
+func adminSetRole(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	id, err := strconv.Atoi(kami.Param(ctx, "id"))
+	if err != nil {
+		return errBadRequest("invalid user ID")
+	}
+	role, err := tube.ParseRole(r.FormValue("role"))
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	if id == admin.ID {
+		return errForbidden("can't change your own role")
+	}
+
+	u, err := tube.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	prev := u.GetRole()
+	if err := u.SetRole(ctx, role); err != nil {
+		return err
+	}
+	audit(ctx, r, admin.ID, tube.EventAdminAction, fmt.Sprintf("role user %d: %s -> %s", u.ID, prev, role))
+	audit(withImpersonator(ctx, admin.ID), r, u.ID, tube.EventAdminAction, "role set to "+string(role))
+
+	renderJSON(w, u, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/users/:id/usage?fix=true
+// Reports discrepancies between a user's recorded usage and their tracks,
+// and corrects the usage if fix is set.
+func adminReconcileUsage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	id, err := strconv.Atoi(kami.Param(ctx, "id"))
+	if err != nil {
+		return errBadRequest("invalid user ID")
+	}
+	fix := r.FormValue("fix") == "true"
+
+	report, err := tube.ReconcileUsage(ctx, id, fix)
+	if err != nil {
+		return err
+	}
+	if report.Fixed {
+		audit(ctx, r, admin.ID, tube.EventAdminAction, "reconciled usage "+report.String())
+	}
+	renderJSON(w, report, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/gc?delete=true
+// Reports orphaned objects, and deletes them if delete is set.
+func adminCollectGarbage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	dryRun := r.FormValue("delete") != "true"
+	report, err := tube.CollectGarbage(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		audit(ctx, r, admin.ID, tube.EventAdminAction, "gc: "+report.String())
+	}
+	renderJSON(w, report, http.StatusOK)
+	return nil
 }
@@ -0,0 +1,56 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestAdminSearchUsers(t *testing.T) {
+	ctx, plain := testDB(t)
+	mixed := tube.User{Email: "Someone.Else@Example.COM"}
+	if err := mixed.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := mixed.SetCustomerID(ctx, "cus_AbC123"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		{"someone.else", []int{mixed.ID}},
+		{"SOMEONE.ELSE@example.com", []int{mixed.ID}},
+		{"Example.com", []int{mixed.ID, plain.ID}},
+		{strconv.Itoa(plain.ID), []int{plain.ID}},
+		// customer IDs are case-sensitive
+		{"cus_AbC123", []int{mixed.ID}},
+		{"cus_abc123", nil},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/admin/api/users?q="+url.QueryEscape(test.q), nil)
+		w := httptest.NewRecorder()
+		if err := adminSearchUsers(ctx, w, r); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Users []tube.User
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, u := range resp.Users {
+			got = append(got, u.ID)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("search %q: got users %v, want %v", test.q, got, test.want)
+		}
+	}
+}
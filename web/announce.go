@@ -0,0 +1,239 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// Announcements are shown at the top of every page and served to other clients by /api/announcements.
+// An announcement marked Maintenance also pauses writes while it's showing,
+// so deploys and migrations don't fail requests halfway: changes get a 503 with Retry-After,
+// but browsing and streaming keep working.
+
+const (
+	// how long announcements are cached by each server, so changes take up to this long to show up
+	announceCacheTTL = 30 * time.Second
+	// Retry-After for maintenance without an end time
+	maintenanceRetry   = 5 * time.Minute
+	maxAnnouncementLen = 1024
+)
+
+var announceCache struct {
+	sync.Mutex
+	list    []tube.Announcement
+	fetched time.Time
+}
+
+// subsonicWrites are the Subsonic methods that change things. Subsonic clients use GET for everything.
+var subsonicWrites = map[string]bool{
+	"scrobble":       true,
+	"star":           true,
+	"unstar":         true,
+	"createPlaylist": true,
+	"updatePlaylist": true,
+	"deletePlaylist": true,
+	"savePlayQueue":  true,
+}
+
+func init() {
+	kami.Get("/api/announcements", handle(listAnnouncements))
+
+	kami.Get("/admin/api/announcements", handle(adminListAnnouncements))
+	kami.Post("/admin/api/announcements", handle(adminCreateAnnouncement))
+	kami.Delete("/admin/api/announcements/:id", handle(adminDeleteAnnouncement))
+}
+
+// currentAnnouncements returns the announcements showing right now.
+// If they can't be loaded, the last ones that were are used.
+func currentAnnouncements(ctx context.Context) []tube.Announcement {
+	announceCache.Lock()
+	defer announceCache.Unlock()
+	if time.Since(announceCache.fetched) > announceCacheTTL {
+		list, err := tube.GetAnnouncements(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "announcements: failed to load", "err", err)
+		} else {
+			announceCache.list = list
+		}
+		// either way, don't hammer the database
+		announceCache.fetched = time.Now()
+	}
+	now := time.Now()
+	var active []tube.Announcement
+	for _, a := range announceCache.list {
+		if a.Active(now) {
+			active = append(active, a)
+		}
+	}
+	return active
+}
+
+func forgetAnnouncements() {
+	announceCache.Lock()
+	announceCache.fetched = time.Time{}
+	announceCache.Unlock()
+}
+
+// maintenance returns the announcement that put the site in maintenance mode, if any.
+func maintenance(ctx context.Context) (tube.Announcement, bool) {
+	for _, a := range currentAnnouncements(ctx) {
+		if a.Maintenance {
+			return a, true
+		}
+	}
+	return tube.Announcement{}, false
+}
+
+// pauseWrites refuses requests that change things during maintenance.
+// Logging in and out, and the admin pages (to end maintenance), still work.
+func pauseWrites(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if !isWriteRequest(r) {
+		return ctx
+	}
+	a, ok := maintenance(ctx)
+	if !ok {
+		return ctx
+	}
+	retry := maintenanceRetry
+	if !a.End.IsZero() {
+		retry = max(time.Until(a.End), time.Second)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	if isSubsonicReq(r) {
+		if f := r.FormValue("f"); f != "" {
+			ctx = withFormat(ctx, f)
+		}
+		writeSubsonic(ctx, w, r, subErr(0, "Down for maintenance, try again later"))
+		return nil
+	}
+	renderError(ctx, w, r, httpError{Code: http.StatusServiceUnavailable, Msg: "down for maintenance"})
+	return nil
+}
+
+func isWriteRequest(r *http.Request) bool {
+	if isSubsonicReq(r) {
+		return subsonicWrites[strings.TrimSuffix(path.Base(r.URL.Path), ".view")]
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	switch {
+	case r.URL.Path == "/login", r.URL.Path == "/logout", strings.HasPrefix(r.URL.Path, "/admin/"):
+		return false
+	}
+	return true
+}
+
+type announcementView struct {
+	ID          string
+	Message     string
+	Level       tube.AnnouncementLevel
+	Maintenance bool      `json:",omitempty"`
+	End         time.Time `json:",omitempty"`
+}
+
+// GET /api/announcements
+// Lists the announcements showing right now. Clients should show them, and hold off on changes
+// while one has Maintenance set.
+func listAnnouncements(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	active := currentAnnouncements(ctx)
+	views := make([]announcementView, 0, len(active))
+	for _, a := range active {
+		views = append(views, announcementView{
+			ID:          a.ID,
+			Message:     a.Message,
+			Level:       a.Level,
+			Maintenance: a.Maintenance,
+			End:         a.End,
+		})
+	}
+	renderJSON(w, views, http.StatusOK)
+	return nil
+}
+
+// GET /admin/api/announcements
+// Lists every announcement, including ones that are over or haven't started yet.
+func adminListAnnouncements(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	list, err := tube.GetAnnouncements(ctx)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = []tube.Announcement{}
+	}
+	renderJSON(w, list, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/announcements
+// {"Message": "...", "Level": "info" or "warning", "Maintenance": true, "Start": "...", "End": "..."}
+func adminCreateAnnouncement(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	var input struct {
+		Message     string
+		Level       tube.AnnouncementLevel
+		Maintenance bool
+		Start       time.Time
+		End         time.Time
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	input.Message = strings.TrimSpace(input.Message)
+	if input.Message == "" || len(input.Message) > maxAnnouncementLen {
+		return errBadRequest(fmt.Sprintf("message must be 1 to %d bytes", maxAnnouncementLen))
+	}
+	switch input.Level {
+	case "":
+		input.Level = tube.AnnouncementInfo
+	case tube.AnnouncementInfo, tube.AnnouncementWarning:
+	default:
+		return errBadRequest("level must be info or warning")
+	}
+	if !input.Start.IsZero() && !input.End.IsZero() && !input.End.After(input.Start) {
+		return errBadRequest("end must be after start")
+	}
+
+	a, err := tube.NewAnnouncement(admin.ID, input.Message)
+	if err != nil {
+		return err
+	}
+	a.Level = input.Level
+	a.Maintenance = input.Maintenance
+	a.Start = input.Start.UTC()
+	a.End = input.End.UTC()
+	if err := a.Create(ctx); err != nil {
+		return err
+	}
+	forgetAnnouncements()
+	audit(ctx, r, admin.ID, tube.EventAdminAction, "announcement "+a.ID+": "+a.Message)
+	renderJSON(w, a, http.StatusCreated)
+	return nil
+}
+
+// DELETE /admin/api/announcements/:id
+// Takes an announcement down, ending maintenance if it was for that.
+func adminDeleteAnnouncement(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	id := kami.Param(ctx, "id")
+	if err := tube.DeleteAnnouncement(ctx, id); err != nil {
+		return err
+	}
+	forgetAnnouncements()
+	audit(ctx, r, admin.ID, tube.EventAdminAction, "announcement "+id+" deleted")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -1,30 +1,49 @@
 package web
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"runtime/debug"
 	"time"
 
 	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
 )
 
 var (
-	Domain    = "inter.tube"
-	Deployed  time.Time
-	DebugMode = false
+	Domain     = "inter.tube"
+	Deployed   time.Time
+	DebugMode  = false
+	InviteOnly = false // registration requires an invite code
+	SelfHosted = false // disables billing entirely
 )
 
+// Handler serves the site.
+// Use it instead of http.DefaultServeMux, which libraries register debugging handlers with.
+func Handler() http.Handler {
+	return kami.Handler()
+}
+
 func init() {
 	kami.PanicHandler = PanicHandler
-	http.Handle("/", kami.Handler())
 
+	kami.Use("/", startTimer)
+	kami.Use("/", startSpan)
+	kami.Use("/", setDeadline)
 	kami.Use("/", discover)
+	kami.Use("/", pauseWrites)
 	kami.Use("/", allowGuest(
-		"/login", "/register", "/forgot", "/recover",
+		"/login", "/login/revoke", "/register", "/forgot", "/recover",
 		"/terms", "/privacy", "/buy/", "/subsonic",
-		"/api/v0/login",
-		"/external/stripe"))
+		"/api/v0/login", "/api/pair", "/api/pair/poll", "/api/status/nowplaying",
+		"/api/announcements",
+		"/external/stripe",
+		"/metrics", "/healthz", "/readyz", "/art/*", "/debug/*",
+		"/manifest.webmanifest", "/sw.js", "/s/*",
+		storage.LocalPrefix+"*"))
 	kami.Use("/", requireLogin)
 
 	kami.Get("/", homepage)
@@ -32,7 +51,7 @@ func init() {
 	kami.Get("/privacy", privacyPolicy)
 
 	kami.Get("/login", loginForm)
-	kami.Post("/login", login)
+	kami.Post("/login", handle(login))
 	kami.Post("/logout", logout)
 
 	kami.Get("/register", registerForm)
@@ -41,61 +60,102 @@ func init() {
 	kami.Get("/forgot", forgotForm)
 	kami.Post("/forgot", forgot)
 
-	kami.Get("/recover", recoverForm)
+	kami.Get("/recover", handle(recoverForm))
 	kami.Post("/recover", doRecover)
 
-	kami.Get("/upload", uploadForm)
-	kami.Post("/upload/track", uploadStart)
-	kami.Post("/upload/tracks", uploadStart2)
-	kami.Post("/upload/track/:id", uploadFinish)
-
-	kami.Get("/sync", syncForm)
+	// guests are read-only
+	kami.Use("/upload", forbidGuests)
+	kami.Use("/upload/", forbidGuests)
+	kami.Use("/sync", forbidGuests)
+	kami.Use("/track/:id", forbidGuests)
+	kami.Use("/track/:id/edit", forbidGuests)
+	kami.Use("/playlist/", forbidGuests)
+	kami.Use("/buy/checkout", forbidGuests)
+	kami.Use("/buy/gift/checkout", forbidGuests)
+	kami.Use("/buy/gift/redeem", forbidGuests)
+	kami.Use("/settings/password", forbidGuests)
+	kami.Use("/settings/payment", forbidGuests)
+	kami.Use("/settings/delete", forbidGuests)
+
+	kami.Use("/upload", requireUnlocked)
+	kami.Use("/upload/", requireWritable)
+	kami.Get("/upload", handle(uploadForm))
+	kami.Post("/upload/track", handle(uploadStart))
+	kami.Post("/upload/tracks", handle(uploadStart2))
+	kami.Post("/upload/check", handle(checkUploadQuota))
+	kami.Post("/upload/track/:id", handle(uploadFinish))
+	kami.Post("/upload/simple", handle(uploadSimple))
+
+	kami.Get("/sync", handle(syncForm))
+
+	kami.Use("/sync", requireUnlocked)
+	kami.Use("/music", requireUnlocked)
+	kami.Use("/music/", requireUnlocked)
+	kami.Use("/track/", requireUnlocked)
+	kami.Use("/dl/", requireUnlocked)
+	kami.Use("/dl/", requireAllowedLocation)
+	kami.Use("/sync", requireAllowedLocation)
+	kami.Use("/playlist/", requireUnlocked)
 
 	kami.Use("/music", cacheHeaders)
-	kami.Get("/music", showMusic)
+	kami.Get("/music", handle(showMusic))
 	kami.Head("/music", showMusicHead)
 	kami.Use("/music/", cacheHeaders)
-	kami.Get("/music/:kind", showMusic)
+	kami.Get("/music/:kind", handle(showMusic))
 	kami.Head("/music/:kind", showMusicHead)
 
-	kami.Delete("/track/:id", deleteTrack)
-	kami.Post("/track/:id/played", incPlays)
-	kami.Post("/track/:id/resume", setResume)
-	kami.Get("/track/:id/edit", editTrackForm)
-	kami.Post("/track/:id/edit", editTrack)
+	kami.Delete("/track/:id", handle(deleteTrack))
+	kami.Post("/track/:id/played", handle(incPlays))
+	kami.Post("/track/:id/resume", handle(setResume))
+	kami.Get("/track/:id/edit", handle(editTrackForm))
+	kami.Post("/track/:id/edit", handle(editTrack))
 
-	kami.Get("/dl/tracks/:id", downloadTrack)
+	kami.Get("/dl/tracks/:id", handle(downloadTrack))
 
-	kami.Get("/playlist/", createPlaylistForm)
-	kami.Post("/playlist/", createPlaylist)
-	kami.Get("/playlist/:id", createPlaylistForm)
-	kami.Post("/playlist/:id", createPlaylist)
+	kami.Get("/playlist/", handle(createPlaylistForm))
+	kami.Post("/playlist/", handle(createPlaylist))
+	kami.Get("/playlist/:id", handle(createPlaylistForm))
+	kami.Post("/playlist/:id", handle(createPlaylist))
 
-	kami.Post("/cache/reset", resetCache)
+	kami.Post("/cache/reset", handle(resetCache))
 
 	kami.Get("/more", moreStuff)
 	kami.Get("/subsonic", subsonicHelp)
 
+	kami.Use("/buy/", requirePayment)
+	kami.Use("/settings/payment", requirePayment)
+	kami.Use("/external/stripe", requirePayment)
+
+	kami.Use("/settings/password", forbidImpersonation)
+	kami.Use("/settings/payment", forbidImpersonation)
+	kami.Use("/buy/", forbidImpersonation)
+	kami.Use("/api/account/export", forbidImpersonation)
+	kami.Use("/api/account/export/", forbidImpersonation)
+	kami.Use("/settings/delete", forbidImpersonation)
+
 	kami.Use("/settings", ensureCustomer)
-	kami.Get("/settings", settingsForm)
+	kami.Get("/settings", handle(settingsForm))
 	kami.Post("/settings", settings)
 	kami.Get("/settings/password", changePasswordForm)
 	kami.Post("/settings/password", changePassword)
 	kami.Use("/settings/payment", ensureCustomer)
-	kami.Get("/settings/payment", stripePortal)
+	kami.Get("/settings/payment", handle(stripePortal))
+	kami.Get("/settings/delete", deleteAccountForm)
+	kami.Post("/settings/delete", handle(deleteAccount))
 
 	kami.Use("/buy/", ensureCustomer)
-	kami.Get("/buy/", buyForm)
-	kami.Post("/buy/checkout", stripeCheckout)
-	kami.Get("/buy/success", stripeCheckoutResult)
+	kami.Get("/buy/", handle(buyForm))
+	kami.Post("/buy/checkout", handle(stripeCheckout))
+	kami.Get("/buy/success", handle(stripeCheckoutResult))
 
 	// kami.Use("/payment/", requireLogin)
-	// kami.Get("/payment/", stripePortal)
+	// kami.Get("/payment/", handle(stripePortal))
 
-	kami.Use("/admin/", requireAdmin)
-	kami.Get("/admin/", adminIndex)
+	kami.Use("/admin/", requireRole(tube.RoleSupport))
+	kami.Use("/admin/api/", requireAdminWrites)
+	kami.Get("/admin/", handle(adminIndex))
 
-	kami.Post("/external/stripe", stripeWebhook)
+	kami.Post("/external/stripe", handle(stripeWebhook))
 }
 
 func init() {
@@ -120,15 +180,18 @@ func init() {
 	Deployed = time.Now().UTC()
 }
 
-func Load() {
-	log.Println("Loading templates...")
+func Load() error {
+	slog.Info("loading templates")
 	templates = parseTemplates()
 
-	log.Println("Loading translations...")
-	loadTranslations()
+	slog.Info("loading translations")
+	if err := loadTranslations(); err != nil {
+		return fmt.Errorf("loading translations: %w", err)
+	}
 
-	log.Println("Checking optional features...")
-	initStripe()
+	slog.Info("checking optional features")
+	InitStripe()
 
-	log.Println("Loaded up")
+	slog.Info("loaded up")
+	return nil
 }
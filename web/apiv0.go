@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/guregu/dynamo"
 	"github.com/guregu/kami"
@@ -12,40 +13,43 @@ import (
 )
 
 func init() {
-	kami.Post("/api/v0/login", loginV0)
+	kami.Post("/api/v0/login", handle(loginV0))
 
 	kami.Use("/api/v0/tracks/", requireLogin)
-	kami.Get("/api/v0/tracks/", listTracksV0)
+	kami.Use("/api/v0/tracks/", requireUnlocked)
+	kami.Use("/api/v0/tracks/", requireAllowedLocation)
+	kami.Get("/api/v0/tracks/", handle(listTracksV0))
 }
 
-func loginV0(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func loginV0(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	var req struct {
 		Email    string
 		Password string
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		panic(err)
+		return err
 	}
 
 	email := req.Email
 	pass := req.Password
 
-	user, err := tube.GetUserByEmail(ctx, email)
-	if err == tube.ErrNotFound {
-		panic("no user with that email")
+	user, err := checkLogin(ctx, r, email, pass)
+	if err == tube.ErrNotFound || (err == nil && user.Deleting()) {
+		return httpError{Code: http.StatusUnauthorized, Msg: "no user with that email"}
 	}
-	if err != nil {
-		panic(err)
+	if err == errBadPassword {
+		audit(ctx, r, user.ID, tube.EventLoginFailed, "api")
+		return httpError{Code: http.StatusUnauthorized, Msg: "bad password"}
 	}
-
-	if !user.ValidPassword(pass) {
-		panic("bad password")
+	if err != nil {
+		return err
 	}
 
-	sesh, err := tube.CreateSession(ctx, user.ID, ipAddress(r))
+	sesh, err := tube.CreateSession(ctx, user.ID, clientIP(r).String())
 	if err != nil {
-		panic(err)
+		return err
 	}
+	audit(ctx, r, user.ID, tube.EventTokenCreated, "api")
 
 	http.SetCookie(w, validAuthCookie(sesh))
 
@@ -56,10 +60,19 @@ func loginV0(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderJSON(w, data, http.StatusOK)
+	return nil
 }
 
-func listTracksV0(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// tracks per page of /api/v0/tracks/, and per read when streaming
+const tracksPageSize = 500
+
+// GET /api/v0/tracks/?start=...
+// With Accept: application/x-ndjson (or ?format=ndjson), every track is streamed instead, one per line.
+func listTracksV0(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
+	if wantsNDJSON(r) {
+		return streamTracksV0(ctx, w, r, u)
+	}
 
 	var startFrom dynamo.PagingKey
 	if start := r.URL.Query().Get("start"); start != "" {
@@ -77,18 +90,66 @@ func listTracksV0(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		Next   string
 	}{}
 
-	tracks, next, err := tube.GetTracksPartial(ctx, u.ID, 500, startFrom)
+	tracks, next, err := tube.GetTracksPartial(ctx, u.ID, tracksPageSize, startFrom)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	data.Tracks = tracks
+	country := clientCountry(r)
 	for i, t := range data.Tracks {
-		t.DL = presignTrackDL(u, t)
-		data.Tracks[i] = t
+		data.Tracks[i] = withDL(u, t, country)
 	}
 	if next != nil {
 		data.Next = *next["ID"].S
 	}
 
 	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// streamTracksV0 writes tracks as newline-delimited JSON as they're read,
+// so a big library doesn't have to fit in memory.
+// Errors after the first page cut the response short.
+func streamTracksV0(ctx context.Context, w http.ResponseWriter, r *http.Request, u tube.User) error {
+	country := clientCountry(r)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var startFrom dynamo.PagingKey
+	for page := 0; ; page++ {
+		tracks, next, err := tube.GetTracksPartial(ctx, u.ID, tracksPageSize, startFrom)
+		if err != nil && err != tube.ErrNotFound {
+			return err
+		}
+		if page == 0 {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			setCacheHeaders(w)
+			w.WriteHeader(http.StatusOK)
+		}
+		for _, t := range tracks {
+			if err := enc.Encode(withDL(u, t, country)); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if next == nil {
+			return nil
+		}
+		startFrom = next
+	}
+}
+
+// withDL adds a direct download link if the track can use one.
+// Clients fall back to FileURL, which can decrypt and thaw.
+func withDL(u tube.User, t tube.Track, country string) tube.Track {
+	if directDL(u, t) {
+		t.DL = presignTrackDL(u, t, country)
+	}
+	return t
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	return r.FormValue("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
 }
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
+)
+
+// pictures are named by a hash of their contents, so their URLs never change meaning
+const artCacheControl = "public, max-age=31536000, immutable"
+
+var validArtFile = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[A-Za-z0-9]{1,5}$`)
+
+func init() {
+	kami.Get("/art/:file", handle(getArt))
+}
+
+// artURL is p's permanent URL. A new picture gets a new URL,
+// so browsers and CDNs can cache old ones forever.
+func artURL(p tube.Picture) string {
+	return "/art/" + p.ID + "." + p.Ext
+}
+
+// GET /art/:id.:ext
+// Anyone with the URL can see the picture, like the presigned links it replaces.
+func getArt(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	file := kami.Param(ctx, "file")
+	if !validArtFile.MatchString(file) {
+		return errNotFound("not found")
+	}
+	ext := path.Ext(file)
+	pic := tube.Picture{ID: strings.TrimSuffix(file, ext), Ext: ext[1:]}
+	etag := `"` + pic.ID + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("Cache-Control", artCacheControl)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	bucket := storage.WithContext(ctx, storage.FilesBucket)
+	key := pic.StorageKey()
+	if !bucket.Exists(key) {
+		return errNotFound("not found")
+	}
+	obj, err := bucket.Get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Cache-Control", artCacheControl)
+	w.Header().Set("ETag", etag)
+	_, err = io.Copy(w, obj)
+	return err
+}
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/guregu/dynamo"
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+const (
+	activityPageSize = 100
+	adminEventsLimit = 500
+)
+
+func init() {
+	kami.Get("/api/account/activity", handle(accountActivity))
+	kami.Get("/admin/api/events", handle(adminEvents))
+}
+
+// audit records a security-relevant event in userID's audit log.
+// Failure to record is logged but does not interrupt the request.
+// r may be nil for events that don't originate from the user (e.g. webhooks).
+func audit(ctx context.Context, r *http.Request, userID int, kind tube.EventKind, detail string) {
+	e := tube.Event{
+		UserID: userID,
+		Time:   tube.NewTimegarb(time.Now()),
+		Kind:   kind,
+		Detail: detail,
+	}
+	if adminID, ok := impersonatorFrom(ctx); ok {
+		e.Actor = adminID
+	}
+	if r != nil {
+		e.IP = clientIP(r).String()
+	}
+	if err := tube.RecordEvent(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "audit: failed to record event", "kind", kind, "for", userID, "err", err)
+	}
+}
+
+// GET /api/account/activity?start=...
+func accountActivity(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+
+	var startFrom dynamo.PagingKey
+	if start := r.URL.Query().Get("start"); start != "" {
+		startFrom = dynamo.PagingKey{
+			"UserID": {N: aws.String(strconv.Itoa(u.ID))},
+			"Time":   {S: aws.String(start)},
+		}
+	}
+
+	events, next, err := tube.GetEvents(ctx, u.ID, activityPageSize, startFrom)
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		Events []tube.Event
+		Next   string `json:",omitempty"`
+	}{
+		Events: events,
+	}
+	if next != nil {
+		data.Next = pagingAttr(next, "Time")
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// GET /admin/api/events?user=123
+// GET /admin/api/events?kind=login&since=2006-01-02
+func adminEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+
+	var events []tube.Event
+	var err error
+	switch {
+	case q.Get("user") != "":
+		var id int
+		id, err = strconv.Atoi(q.Get("user"))
+		if err != nil {
+			return errBadRequest("invalid user ID")
+		}
+		events, _, err = tube.GetEvents(ctx, id, adminEventsLimit, nil)
+	case q.Get("kind") != "":
+		since := time.Now().UTC().AddDate(0, 0, -7)
+		if raw := q.Get("since"); raw != "" {
+			since, err = time.Parse("2006-01-02", raw)
+			if err != nil {
+				return errBadRequest("invalid since date (want YYYY-MM-DD)")
+			}
+		}
+		events, err = tube.GetEventsByKind(ctx, tube.EventKind(q.Get("kind")), since, adminEventsLimit)
+	default:
+		return errBadRequest("user or kind parameter required")
+	}
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		Events []tube.Event
+	}{
+		Events: events,
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+func pagingAttr(key dynamo.PagingKey, name string) string {
+	av, ok := key[name]
+	if !ok {
+		return ""
+	}
+	if av.S != nil {
+		return *av.S
+	}
+	if av.N != nil {
+		return *av.N
+	}
+	return ""
+}
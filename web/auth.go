@@ -5,7 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/mail"
 	"net/url"
@@ -13,15 +13,27 @@ import (
 	"strings"
 	"time"
 
+	"github.com/guregu/dynamo"
+
 	mailer "github.com/guregu/intertube/email"
+	"github.com/guregu/intertube/ldap"
 	"github.com/guregu/intertube/tube"
 )
 
-const sessionCookie = "sesh"
+const (
+	sessionCookie      = "sesh"
+	adminSessionCookie = "sesh-admin" // stashed admin session during impersonation
+)
 
+// allowGuest skips the login requirement for the given paths.
+// A path ending in * matches everything with that prefix.
 func allowGuest(path ...string) func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 		for _, p := range path {
+			if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(r.URL.Path, prefix) {
+				ctx = withBypass(ctx, true)
+				return ctx
+			}
 			if r.URL.Path == p {
 				ctx = withBypass(ctx, true)
 				return ctx
@@ -58,7 +70,7 @@ func requireLogin(ctx context.Context, w http.ResponseWriter, r *http.Request) c
 	}
 
 	user, err := tube.GetUser(ctx, sesh.UserID)
-	if err != nil {
+	if err != nil || user.Deleting() {
 		for _, cookie := range expiredAuthCookies() {
 			http.SetCookie(w, cookie)
 		}
@@ -69,7 +81,16 @@ func requireLogin(ctx context.Context, w http.ResponseWriter, r *http.Request) c
 	// 	panic(err)
 	// }
 
+	if sesh.Impersonated() {
+		slog.InfoContext(ctx, "impersonation: request", "admin", sesh.Impersonator, "user_id", user.ID, "method", r.Method, "uri", r.URL.RequestURI())
+		w.Header().Set("Tube-Impersonator", strconv.Itoa(sesh.Impersonator))
+		ctx = withImpersonator(ctx, sesh.Impersonator)
+	}
+
 	ctx = withUser(ctx, user)
+	if user.Prefs.Language != "" {
+		ctx = localize(ctx, w, user.Prefs.Language, r.Header.Get("Accept-Language"))
+	}
 	return ctx
 }
 
@@ -81,10 +102,41 @@ func redirectLogin(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, "/login"+q, http.StatusTemporaryRedirect)
 }
 
-func requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
-	u, _ := userFrom(ctx)
-	if u.ID != 2 {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// requireRole blocks users without at least the given role.
+func requireRole(role tube.Role) func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+		u, ok := userFrom(ctx)
+		if ok && u.GetRole().AtLeast(role) {
+			return ctx
+		}
+		if isSubsonicReq(r) {
+			writeSubsonic(ctx, w, r, subErr(50, "User is not authorized for the given operation."))
+			return nil
+		}
+		if r.Method == http.MethodGet {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+}
+
+// forbidGuests blocks read-only guest accounts.
+var forbidGuests = requireRole(tube.RoleUser)
+
+// requireAdminWrites makes the admin API read-only for support staff.
+func requireAdminWrites(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ctx
+	}
+	return requireRole(tube.RoleAdmin)(ctx, w, r)
+}
+
+// forbidImpersonation blocks account-sensitive pages while an admin is impersonating.
+func forbidImpersonation(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if _, ok := impersonatorFrom(ctx); ok {
+		http.Error(w, "not allowed while impersonating", http.StatusForbidden)
 		return nil
 	}
 	return ctx
@@ -116,13 +168,13 @@ func loginForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 }
 
 // TODO: friendly error messages
-func login(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func login(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	emailaddr := r.FormValue("email")
 	pass := r.FormValue("password")
 	jump := r.FormValue("jump")
 
 	if jump != "" && (jump[0] != '/' || strings.HasPrefix(jump, `//`)) {
-		log.Println("invalid jump:", jump)
+		slog.Warn("invalid jump", "jump", jump)
 		jump = "/"
 	}
 	if jump == "" {
@@ -139,43 +191,72 @@ func login(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		renderTemplate(ctx, w, "login", data, http.StatusOK)
 	}
 
-	user, err := tube.GetUserByEmail(ctx, emailaddr)
+	user, err := checkLogin(ctx, r, emailaddr, pass)
 	switch {
 	case errors.Is(err, tube.ErrNotFound):
 		renderError("error_no_user")
-		return
+		return nil
+	case errors.Is(err, errBadPassword):
+		audit(ctx, r, user.ID, tube.EventLoginFailed, "")
+		renderError("error_bad_password")
+		return nil
+	case errors.Is(err, ldap.ErrNoGroup):
+		renderError("error_ldap_nogroup")
+		return nil
 	case err != nil:
-		panic(err)
+		return err
 	}
 
-	if !user.ValidPassword(pass) {
-		renderError("error_bad_password")
-		return
+	if user.Deleting() {
+		renderError("error_account_deleted")
+		return nil
 	}
 
-	sesh, err := tube.CreateSession(ctx, user.ID, ipAddress(r))
+	sesh, err := tube.CreateSession(ctx, user.ID, clientIP(r).String())
 	if err != nil {
-		panic(err)
+		return err
 	}
+	audit(ctx, r, user.ID, tube.EventLogin, "")
+	trackDevice(ctx, w, r, &user)
 
 	http.SetCookie(w, validAuthCookie(sesh))
 	http.Redirect(w, r, jump, http.StatusSeeOther)
+	return nil
 }
 
 func logout(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if u, ok := userFrom(ctx); ok {
+		audit(ctx, r, u.ID, tube.EventLogout, "")
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := tube.DeleteSession(ctx, cookie.Value); err != nil {
+			slog.ErrorContext(ctx, "logout: failed to delete session", "err", err)
+		}
+	}
 	for _, cookie := range expiredAuthCookies() {
 		http.SetCookie(w, cookie)
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+type registerFormData struct {
+	Email      string
+	Invite     string
+	InviteOnly bool
+	Referral   string
+	ErrorMsg   string
+}
+
 func registerForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	var data = struct {
-		Email    string
-		Invite   string
-		ErrorMsg string
-	}{
-		Invite: r.URL.Query().Get("invite"),
+	if ldap.Enabled() {
+		// accounts are created on first login
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	var data = registerFormData{
+		Invite:     r.URL.Query().Get("invite"),
+		InviteOnly: InviteOnly,
+		Referral:   r.URL.Query().Get("ref"),
 	}
 	renderTemplate(ctx, w, "register", data, http.StatusOK)
 }
@@ -184,22 +265,26 @@ func register(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	email := r.FormValue("email")
 	pass := r.FormValue("password")
 	conf := r.FormValue("password-confirm")
-	// secret := r.FormValue("secret")
+	code := strings.TrimSpace(r.FormValue("invite"))
+	ref := r.FormValue("ref")
 	agree := r.FormValue("agree") == "on"
 
 	renderError := func(err error) {
-		var data = struct {
-			Email    string
-			Invite   string
-			ErrorMsg string
-		}{
-			Email: email,
-			// Invite:   secret,
-			ErrorMsg: err.Error(),
+		var data = registerFormData{
+			Email:      email,
+			Invite:     code,
+			InviteOnly: InviteOnly,
+			Referral:   ref,
+			ErrorMsg:   err.Error(),
 		}
 		renderTemplate(ctx, w, "register", data, http.StatusOK)
 	}
 
+	if ldap.Enabled() {
+		renderError(fmt.Errorf("registration is disabled, log in with your directory account"))
+		return
+	}
+
 	if _, err := mail.ParseAddress(email); err != nil {
 		renderError(fmt.Errorf("invalid e-mail address: %w", err))
 		return
@@ -210,11 +295,6 @@ func register(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if secret != registerSecret {
-	// 	renderError(fmt.Errorf("invalid invite code"))
-	// 	return
-	// }
-
 	if !agree {
 		renderError(fmt.Errorf("you must agree to the terms"))
 		return
@@ -230,6 +310,35 @@ func register(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var invite tube.Invite
+	if InviteOnly {
+		invite, err = tube.GetInvite(ctx, code)
+		if err == tube.ErrNotFound || (err == nil && !invite.Valid(time.Now())) {
+			renderError(fmt.Errorf("invalid invite code"))
+			return
+		}
+		if err != nil {
+			renderError(err)
+			return
+		}
+		if err := invite.Redeem(ctx); dynamo.IsCondCheckFailed(err) {
+			renderError(fmt.Errorf("invalid invite code"))
+			return
+		} else if err != nil {
+			renderError(err)
+			return
+		}
+	}
+
+	var referrer tube.User
+	if ref != "" {
+		// bad referral codes aren't worth failing registration over
+		referrer, err = tube.GetUserByReferralCode(ctx, ref)
+		if err != nil {
+			slog.WarnContext(ctx, "register: invalid referral code", "code", ref, "err", err)
+		}
+	}
+
 	pwhash, err := tube.HashPassword(pass)
 	if err != nil {
 		renderError(err)
@@ -237,19 +346,28 @@ func register(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	user = tube.User{
-		Email:    email,
-		Password: pwhash,
+		Email:      email,
+		Password:   pwhash,
+		Invite:     invite.Code,
+		ReferredBy: referrer.ID,
 	}
 	if err := user.Create(ctx); err != nil {
 		renderError(err)
 		return
 	}
+	if invite.Code != "" {
+		if err := invite.AddUser(ctx, user.ID); err != nil {
+			slog.ErrorContext(ctx, "invite: failed to record use", "code", invite.Code, "user_id", user.ID, "err", err)
+		}
+	}
+	audit(ctx, r, user.ID, tube.EventRegister, invite.Code)
 
-	sesh, err := tube.CreateSession(ctx, user.ID, ipAddress(r))
+	sesh, err := tube.CreateSession(ctx, user.ID, clientIP(r).String())
 	if err != nil {
 		renderError(err)
 		return
 	}
+	trackDevice(ctx, w, r, &user)
 
 	http.SetCookie(w, validAuthCookie(sesh))
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -275,7 +393,7 @@ func forgot(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	u, err := tube.GetUserByEmail(ctx, email)
-	if err == tube.ErrNotFound {
+	if err == tube.ErrNotFound || (err == nil && u.Deleting()) {
 		renderError(fmt.Errorf("there is no account with that e-mail address"))
 		return
 	}
@@ -283,6 +401,10 @@ func forgot(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		renderError(err)
 		return
 	}
+	if u.DirectoryDN != "" {
+		renderError(errDirectoryPassword)
+		return
+	}
 
 	if err := u.SetRandomRecovery(ctx); err != nil {
 		renderError(err)
@@ -309,17 +431,17 @@ func forgot(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	renderTemplate(ctx, w, "forgot-sent", data, http.StatusOK)
 }
 
-func recoverForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func recoverForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
 	token := r.URL.Query().Get("token")
 
 	u, err := tube.GetUser(ctx, id)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if u.Recovery == "" || u.Recovery != token {
-		panic("invalid token")
+		return errBadRequest("invalid token")
 	}
 
 	var data = struct {
@@ -334,6 +456,7 @@ func recoverForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderTemplate(ctx, w, "recover", data, http.StatusOK)
+	return nil
 }
 
 func doRecover(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -384,8 +507,9 @@ func doRecover(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		renderError(err)
 		return
 	}
+	audit(ctx, r, u.ID, tube.EventPasswordReset, "")
 
-	sesh, err := tube.CreateSession(ctx, u.ID, ipAddress(r))
+	sesh, err := tube.CreateSession(ctx, u.ID, clientIP(r).String())
 	if err != nil {
 		renderError(err)
 		return
@@ -396,12 +520,16 @@ func doRecover(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 }
 
 func validAuthCookie(sesh tube.Session) *http.Cookie {
+	return namedAuthCookie(sessionCookie, sesh)
+}
+
+func namedAuthCookie(name string, sesh tube.Session) *http.Cookie {
 	domain := "." + Domain
 	if DebugMode {
 		domain = ""
 	}
 	return &http.Cookie{
-		Name:     sessionCookie,
+		Name:     name,
 		Domain:   domain,
 		Path:     "/",
 		Value:    sesh.Token,
@@ -441,11 +569,6 @@ func expiredAuthCookies() []*http.Cookie {
 	}
 }
 
-// TODO: don't use this if not behind load balancer
-func ipAddress(r *http.Request) string {
-	return r.Header.Get("X-Forwarded-For")
-}
-
 func encodeRedirect(href *url.URL) string {
 	uri := strings.TrimPrefix(href.RequestURI(), "/")
 	return base64.RawURLEncoding.EncodeToString([]byte(uri))
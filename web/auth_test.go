@@ -0,0 +1,64 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		role   tube.Role
+		guard  func(context.Context, http.ResponseWriter, *http.Request) context.Context
+		method string
+		path   string
+		ok     bool
+		status int
+	}{
+		{tube.RoleGuest, forbidGuests, "GET", "/upload", false, http.StatusSeeOther},
+		{tube.RoleGuest, forbidGuests, "POST", "/api/share", false, http.StatusForbidden},
+		{tube.RoleUser, forbidGuests, "POST", "/api/share", true, 0},
+		{tube.RoleUser, requireRole(tube.RoleSupport), "GET", "/admin/", false, http.StatusSeeOther},
+		{tube.RoleSupport, requireRole(tube.RoleSupport), "GET", "/admin/", true, 0},
+		{tube.RoleAdmin, requireRole(tube.RoleSupport), "GET", "/admin/", true, 0},
+
+		// support staff can look but not touch
+		{tube.RoleSupport, requireAdminWrites, "GET", "/admin/api/users", true, 0},
+		{tube.RoleSupport, requireAdminWrites, "POST", "/admin/api/users/1/role", false, http.StatusForbidden},
+		{tube.RoleAdmin, requireAdminWrites, "POST", "/admin/api/users/1/role", true, 0},
+	}
+	for _, test := range tests {
+		ctx := withUser(context.Background(), tube.User{ID: 1, Role: test.role})
+		r := httptest.NewRequest(test.method, test.path, nil)
+		w := httptest.NewRecorder()
+		ok := test.guard(ctx, w, r) != nil
+		if ok != test.ok {
+			t.Errorf("%s %s %s: allowed = %v, want %v", test.role, test.method, test.path, ok, test.ok)
+			continue
+		}
+		if !ok && w.Code != test.status {
+			t.Errorf("%s %s %s: status %d, want %d", test.role, test.method, test.path, w.Code, test.status)
+		}
+	}
+
+	// nobody logged in
+	r := httptest.NewRequest("POST", "/api/share", nil)
+	if forbidGuests(context.Background(), httptest.NewRecorder(), r) != nil {
+		t.Error("forbidGuests let an anonymous request through")
+	}
+
+	// Subsonic clients get a Subsonic error
+	ctx := withUser(context.Background(), tube.User{ID: 1, Role: tube.RoleGuest})
+	r = httptest.NewRequest("GET", "/rest/star.view", nil)
+	w := httptest.NewRecorder()
+	if forbidGuests(ctx, w, r) != nil {
+		t.Fatal("forbidGuests let a guest star a track")
+	}
+	if body := w.Body.String(); !strings.Contains(body, `code="50"`) {
+		t.Errorf("Subsonic guest: got %s, want error 50", body)
+	}
+}
@@ -0,0 +1,275 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/job"
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
+)
+
+// Users can have their metadata copied to their own bucket every night.
+// Each run overwrites the JSON files from the last one; turn on versioning in the bucket to keep history.
+
+const backupDir = "intertube-backup/"
+
+var (
+	validBackupRegion  = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	validBackupAccount = regexp.MustCompile(`^[a-f0-9]{32}$`)
+)
+
+func init() {
+	kami.Use("/api/account/backup", forbidGuests)
+	kami.Use("/api/account/backup", forbidImpersonation)
+	kami.Use("/api/account/backup/", forbidGuests)
+	kami.Use("/api/account/backup/", forbidImpersonation)
+	kami.Get("/api/account/backup", handle(getBackup))
+	kami.Put("/api/account/backup", handle(putBackup))
+	kami.Delete("/api/account/backup", handle(deleteBackup))
+	kami.Post("/api/account/backup/run", handle(runBackupNow))
+}
+
+type backupJob struct{}
+
+// openBackupBucket connects to a user's backup bucket with their credentials.
+// Endpoints are checked again on every connection, as DNS can change after checkBackup.
+func openBackupBucket(b tube.Backup) (storage.Bucket, error) {
+	return storage.OpenS3(storage.Config{
+		Type:            storage.StorageType(b.Type),
+		Region:          b.Region,
+		Endpoint:        b.Endpoint,
+		CFAccountID:     b.AccountID,
+		AccessKeyID:     b.AccessKeyID,
+		AccessKeySecret: b.AccessKeySecret,
+		PublicOnly:      true,
+	}, b.Bucket)
+}
+
+// checkBackup validates backup settings from a user.
+// As the server connects to wherever they point, custom endpoints must be public HTTPS servers.
+func checkBackup(b *tube.Backup) error {
+	b.Bucket = strings.TrimSpace(b.Bucket)
+	b.Prefix = strings.TrimPrefix(strings.TrimSpace(b.Prefix), "/")
+	if b.Prefix != "" && !strings.HasSuffix(b.Prefix, "/") {
+		b.Prefix += "/"
+	}
+	if b.Bucket == "" {
+		return errBadRequest("missing bucket")
+	}
+	if b.AccessKeyID == "" || b.AccessKeySecret == "" {
+		return errBadRequest("missing credentials")
+	}
+	switch storage.StorageType(b.Type) {
+	case storage.StorageTypeS3:
+		if b.Region == "" {
+			b.Region = "us-east-1"
+		}
+	case storage.StorageTypeB2:
+		if b.Region == "" {
+			return errBadRequest("missing region")
+		}
+	case storage.StorageTypeR2:
+		if !validBackupAccount.MatchString(b.AccountID) {
+			return errBadRequest("invalid account ID")
+		}
+	case storage.StorageTypeWasabi:
+	default:
+		return errBadRequest("type must be one of s3, b2, r2, or wasabi")
+	}
+	if b.Region != "" && !validBackupRegion.MatchString(b.Region) {
+		return errBadRequest("invalid region")
+	}
+	if b.Endpoint != "" {
+		if err := checkBackupEndpoint(b.Endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBackupEndpoint(endpoint string) error {
+	href, err := url.Parse(endpoint)
+	if err != nil || href.Scheme != "https" || href.Host == "" || strings.Contains(href.Host, "{") {
+		return errBadRequest("endpoint must be an https:// URL")
+	}
+	ips, err := net.LookupIP(href.Hostname())
+	if err != nil {
+		return errBadRequest("can't resolve endpoint: " + href.Hostname())
+	}
+	for _, ip := range ips {
+		if !storage.PublicIP(ip) {
+			return errBadRequest("endpoint must be a public server")
+		}
+	}
+	return nil
+}
+
+// backupView is the API view of tube.Backup, without the secret.
+type backupView struct {
+	tube.Backup
+	Enabled bool
+}
+
+// GET /api/account/backup
+func getBackup(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	renderJSON(w, backupView{Backup: u.Backup, Enabled: u.Backup.Enabled()}, http.StatusOK)
+	return nil
+}
+
+// PUT /api/account/backup
+// Turns on backups: {"Type": "s3", "Bucket": "...", "Region": "...", "AccessKeyID": "...", "AccessKeySecret": "..."}.
+// A test file is written to the bucket first, so bad settings are caught right away.
+func putBackup(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var input struct {
+		tube.Backup
+		AccessKeySecret string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	b := tube.Backup{
+		Type:            input.Type,
+		Bucket:          input.Bucket,
+		Prefix:          input.Prefix,
+		Region:          input.Region,
+		Endpoint:        input.Endpoint,
+		AccountID:       input.AccountID,
+		AccessKeyID:     input.AccessKeyID,
+		AccessKeySecret: input.AccessKeySecret,
+	}
+	if b.AccessKeySecret == "" && b.AccessKeyID == u.Backup.AccessKeyID {
+		// keep the old secret when only other settings change
+		b.AccessKeySecret = u.Backup.AccessKeySecret
+	}
+	if err := checkBackup(&b); err != nil {
+		return err
+	}
+
+	bucket, err := openBackupBucket(b)
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	readme := fmt.Sprintf("This folder has nightly backups of your %s library's metadata.\n", Domain)
+	if err := bucket.Put("text/plain", b.Prefix+backupDir+"README.txt", strings.NewReader(readme)); err != nil {
+		return errBadRequest("couldn't write to the bucket: " + err.Error())
+	}
+
+	if err := u.SetBackup(ctx, b); err != nil {
+		return err
+	}
+	renderJSON(w, backupView{Backup: u.Backup, Enabled: true}, http.StatusOK)
+	return nil
+}
+
+// DELETE /api/account/backup
+// Turns off backups. What's already in the bucket stays there.
+func deleteBackup(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	if err := u.SetBackup(ctx, tube.Backup{}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// POST /api/account/backup/run
+// Backs up now instead of waiting for tonight.
+func runBackupNow(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	if !u.Backup.Enabled() {
+		return errNotFound("backups aren't turned on")
+	}
+	j, err := job.Enqueue(ctx, u.ID, jobBackup, backupJob{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/api/jobs/"+j.ID)
+	renderJSON(w, j, http.StatusAccepted)
+	return nil
+}
+
+// ScheduleBackups queues a backup for everyone who hasn't had one for a day.
+// It's run by the hourly cron.
+func ScheduleBackups(ctx context.Context) error {
+	users, err := tube.GetUsersWithBackups(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	// a little early, so the hourly cron doesn't push it back an hour every day
+	since := now.Add(-tube.BackupInterval + time.Hour)
+	for _, u := range users {
+		if u.Deleting() || accessLevel(u) == tube.AccessLocked {
+			continue
+		}
+		ok, err := u.ScheduleBackup(ctx, now, since)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, err := job.Enqueue(ctx, u.ID, jobBackup, backupJob{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runBackupJob(ctx context.Context, j *tube.Job) error {
+	u, err := tube.GetUser(ctx, j.UserID)
+	if err != nil {
+		return err
+	}
+	if !u.Backup.Enabled() {
+		return nil
+	}
+	backupErr := backupMetadata(ctx, u)
+	if err := u.SetBackupResult(ctx, time.Now(), backupErr); err != nil {
+		slog.ErrorContext(ctx, "backup: failed to save result", "user_id", u.ID, "err", err)
+	}
+	if backupErr != nil && j.Attempts >= job.MaxAttempts {
+		postNotification(ctx, u.ID, jobBackup, "/api/account/backup", "notification_backup_failed", backupErr.Error())
+	}
+	return backupErr
+}
+
+// backupMetadata writes all of u's metadata to their backup bucket.
+func backupMetadata(ctx context.Context, u tube.User) error {
+	bucket, err := openBackupBucket(u.Backup)
+	if err != nil {
+		return err
+	}
+	files, _, err := userMetadata(ctx, u)
+	if err != nil {
+		return err
+	}
+	dir := u.Backup.Prefix + backupDir
+	for _, file := range files {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(file.data); err != nil {
+			return err
+		}
+		if err := bucket.Put("application/json", dir+file.name, bytes.NewReader(buf.Bytes())); err != nil {
+			return fmt.Errorf("backup: writing %s: %w", file.name, err)
+		}
+	}
+	slog.InfoContext(ctx, "backup: done", "user_id", u.ID, "bucket", u.Backup.Bucket)
+	return nil
+}
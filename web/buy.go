@@ -10,24 +10,23 @@ import (
 	"github.com/guregu/intertube/tube"
 )
 
-func buyForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func buyForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	if !UseStripe {
-		http.Error(w, "payment is disabled", http.StatusForbidden)
-		return
+		return errForbidden("payment is disabled")
 	}
 
 	u, loggedIn := userFrom(ctx)
 	plans := tube.GetPlans()
 	prices, err := getStripePrices(plans)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	var hasSub bool
 	if loggedIn {
 		cust, err := getCustomer(u.CustomerID)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		// spew.Dump(cust)
 		hasSub = cust.Subscriptions != nil && len(cust.Subscriptions.Data) > 0
@@ -48,6 +47,7 @@ func buyForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderTemplate(ctx, w, "buy", data, http.StatusOK)
+	return nil
 }
 
 // func buySuccess(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/klauspost/compress/gzhttp"
+)
+
+// types of responses worth compressing; downloads and artwork already are
+var compressTypes = []string{
+	"application/json",
+	"application/x-ndjson",
+}
+
+// Compress gzips JSON responses for clients that accept it.
+// Lambda responses aren't binary-safe, so leave compression to API Gateway or CloudFront there.
+func Compress(h http.Handler) (http.Handler, error) {
+	wrap, err := gzhttp.NewWrapper(gzhttp.ContentTypes(compressTypes))
+	if err != nil {
+		return nil, err
+	}
+	return wrap(h), nil
+}
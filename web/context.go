@@ -7,6 +7,7 @@ import (
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 
+	"github.com/guregu/intertube/logging"
 	"github.com/guregu/intertube/tube"
 )
 
@@ -15,16 +16,25 @@ type langkey struct{}
 type userkey struct{}
 type pathkey struct{}
 type bypasskey struct{}
+type impersonatorkey struct{}
+type devicekey struct{}
 
 func discover(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
-	acceptlang := r.Header.Get("Accept-Language")
-	localizer := i18n.NewLocalizer(translations, acceptlang)
-	ctx = withLocalizer(ctx, localizer)
-	ctx = withLanguage(ctx, acceptlang)
+	w.Header().Add("Vary", "Accept-Language")
+	ctx = localize(ctx, w, r.Header.Get("Accept-Language"))
 	ctx = withPath(ctx, r.URL.Path)
 	return ctx
 }
 
+// localize sets the language of the response to the best match for langs.
+// See negotiateLanguage.
+func localize(ctx context.Context, w http.ResponseWriter, langs ...string) context.Context {
+	lang := negotiateLanguage(langs...)
+	w.Header().Set("Content-Language", lang)
+	ctx = withLocalizer(ctx, i18n.NewLocalizer(translations, lang))
+	return withLanguage(ctx, lang)
+}
+
 func cacheHeaders(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
 	// w.Header().Set("Cache-Control", "no-cache, must-revalidate")
@@ -74,12 +84,13 @@ func withLanguage(ctx context.Context, langs ...string) context.Context {
 func languageFrom(ctx context.Context) string {
 	lang, ok := ctx.Value(langkey{}).(string)
 	if !ok {
-		return "ja"
+		return "en"
 	}
 	return lang
 }
 
 func withUser(ctx context.Context, user tube.User) context.Context {
+	ctx = logging.With(ctx, "user_id", user.ID)
 	return context.WithValue(ctx, userkey{}, user)
 }
 
@@ -106,3 +117,24 @@ func bypassFrom(ctx context.Context) bool {
 	ok, _ := ctx.Value(bypasskey{}).(bool)
 	return ok
 }
+
+func withImpersonator(ctx context.Context, adminID int) context.Context {
+	return context.WithValue(ctx, impersonatorkey{}, adminID)
+}
+
+// impersonatorFrom returns the ID of the admin driving this request,
+// if the current session is an impersonation session.
+func impersonatorFrom(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(impersonatorkey{}).(int)
+	return id, ok && id != 0
+}
+
+func withDevice(ctx context.Context, dt tube.DeviceToken) context.Context {
+	return context.WithValue(ctx, devicekey{}, dt)
+}
+
+// deviceFrom returns the paired device making this request, if it logged in with a device token.
+func deviceFrom(ctx context.Context) (tube.DeviceToken, bool) {
+	dt, ok := ctx.Value(devicekey{}).(tube.DeviceToken)
+	return dt, ok
+}
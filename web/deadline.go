@@ -0,0 +1,48 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Limits on how long a request's database and storage calls can take, set by the configuration.
+// Streaming a download isn't bound by them.
+var (
+	RequestTimeout = 30 * time.Second
+	// for processing uploads, admin maintenance, and profiling
+	SlowRequestTimeout = 10 * time.Minute
+)
+
+type cancelkey struct{}
+
+// setDeadline bounds the request's context, so a hung database or storage call
+// fails with a timeout instead of holding up the request forever.
+// The deadline is released by observeRequest.
+func setDeadline(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	timeout := requestTimeout(r)
+	if timeout <= 0 {
+		return ctx
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return context.WithValue(ctx, cancelkey{}, cancel)
+}
+
+func requestTimeout(r *http.Request) time.Duration {
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/track/"),
+		r.Method == http.MethodPost && r.URL.Path == "/upload/simple",
+		strings.HasPrefix(r.URL.Path, "/admin/api/"),
+		// CPU profiles and traces take ?seconds=
+		strings.HasPrefix(r.URL.Path, "/debug/pprof/"):
+		return SlowRequestTimeout
+	}
+	return RequestTimeout
+}
+
+func releaseDeadline(ctx context.Context) {
+	if cancel, ok := ctx.Value(cancelkey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+}
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// DebugToken lets /debug/pprof/ and /debug/vars be used with an "Authorization: Bearer" header.
+// Admins can always use them.
+var DebugToken string
+
+// Importing net/http/pprof and expvar registers their handlers with http.DefaultServeMux,
+// which isn't served (see Handler), so they're only reachable through these routes.
+func init() {
+	kami.Use("/debug/", requireDebugAccess)
+	kami.Get("/debug/vars", expvar.Handler())
+	kami.Get("/debug/pprof/", pprof.Index)
+	kami.Get("/debug/pprof/cmdline", pprof.Cmdline)
+	kami.Get("/debug/pprof/profile", pprof.Profile)
+	kami.Get("/debug/pprof/symbol", pprof.Symbol)
+	kami.Post("/debug/pprof/symbol", pprof.Symbol)
+	kami.Get("/debug/pprof/trace", pprof.Trace)
+	// heap, goroutine, block, etc.
+	kami.Get("/debug/pprof/:name", pprof.Index)
+}
+
+func requireDebugAccess(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if u, ok := userFrom(ctx); ok && u.GetRole().AtLeast(tube.RoleAdmin) {
+		return ctx
+	}
+	if hasBearerToken(r, DebugToken) {
+		return ctx
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="debug"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return nil
+}
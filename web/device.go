@@ -0,0 +1,200 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/kami"
+
+	mailer "github.com/guregu/intertube/email"
+	"github.com/guregu/intertube/tube"
+)
+
+const (
+	deviceCookie    = "device"
+	deviceCookieTTL = 2 * 365 * 24 * time.Hour
+
+	// double-submitted with the "this wasn't me" form
+	revokeCookie    = "revoke"
+	revokeCookieTTL = time.Hour
+)
+
+func init() {
+	kami.Get("/login/revoke", handle(revokeLoginForm))
+	kami.Post("/login/revoke", handle(revokeLogin))
+}
+
+// trackDevice remembers the device and country of a new login,
+// sending an alert if either hasn't been seen before.
+func trackDevice(ctx context.Context, w http.ResponseWriter, r *http.Request, u *tube.User) {
+	var device string
+	if cookie, err := r.Cookie(deviceCookie); err == nil {
+		device = cookie.Value
+	} else {
+		var err error
+		device, err = tube.NewDeviceID()
+		if err != nil {
+			slog.ErrorContext(ctx, "device: failed to make device ID", "user_id", u.ID, "err", err)
+			return
+		}
+	}
+	http.SetCookie(w, newDeviceCookie(device))
+
+	country := clientCountry(r)
+	// no history to compare against for brand new accounts or accounts from before this existed
+	first := len(u.Devices) == 0
+	suspicious := !u.KnownDevice(device) || (country != "" && !u.KnownCountry(country))
+	if err := u.AddDevice(ctx, device, country, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "device: failed to record device", "user_id", u.ID, "err", err)
+		return
+	}
+	if first || !suspicious {
+		return
+	}
+
+	audit(ctx, r, u.ID, tube.EventNewDevice, country)
+	if !mailer.IsEnabled() || !u.WantsEmail(tube.EmailSecurity) {
+		return
+	}
+	if err := sendLoginAlert(ctx, r, u, country); err != nil {
+		slog.ErrorContext(ctx, "device: failed to send login alert", "user_id", u.ID, "err", err)
+	}
+}
+
+func sendLoginAlert(ctx context.Context, r *http.Request, u *tube.User, country string) error {
+	if err := u.SetRevokeCode(ctx); err != nil {
+		return err
+	}
+	if country == "" {
+		country = "unknown"
+	}
+	data := struct {
+		Time      string
+		IP        string
+		Country   string
+		Browser   string
+		RevokeURL string
+	}{
+		Time:      time.Now().UTC().Format(time.RFC1123),
+		IP:        clientIP(r).String(),
+		Country:   country,
+		Browser:   r.UserAgent(),
+		RevokeURL: fmt.Sprintf("https://%s/login/revoke?id=%d&code=%s", Domain, u.ID, u.RevokeCode),
+	}
+	return notify(ctx, *u, tube.EmailSecurity, "login", data)
+}
+
+func newDeviceCookie(device string) *http.Cookie {
+	domain := "." + Domain
+	if DebugMode {
+		domain = ""
+	}
+	return &http.Cookie{
+		Name:     deviceCookie,
+		Domain:   domain,
+		Path:     "/",
+		Value:    device,
+		Expires:  time.Now().Add(deviceCookieTTL),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   !DebugMode,
+	}
+}
+
+// checkRevokeCode returns the user a "this wasn't me" link is for.
+func checkRevokeCode(ctx context.Context, r *http.Request) (tube.User, error) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	code := r.FormValue("code")
+	u, err := tube.GetUser(ctx, id)
+	if err == tube.ErrNotFound || (err == nil && (u.RevokeCode == "" ||
+		subtle.ConstantTimeCompare([]byte(u.RevokeCode), []byte(code)) != 1)) {
+		return u, errBadRequest("invalid or expired link")
+	}
+	return u, err
+}
+
+// GET /login/revoke?id=123&code=...
+// The "this wasn't me" link from login alerts. It only asks for confirmation,
+// as mail scanners and link previews follow links on their own.
+func revokeLoginForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, err := checkRevokeCode(ctx, r)
+	if err != nil {
+		return err
+	}
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	csrf := base64.RawURLEncoding.EncodeToString(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     revokeCookie,
+		Path:     "/login/revoke",
+		Value:    csrf,
+		Expires:  time.Now().Add(revokeCookieTTL),
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   !DebugMode,
+	})
+	data := struct {
+		ID   int
+		Code string
+		CSRF string
+	}{
+		ID:   u.ID,
+		Code: u.RevokeCode,
+		CSRF: csrf,
+	}
+	renderTemplate(ctx, w, "login-revoke", data, http.StatusOK)
+	return nil
+}
+
+// POST /login/revoke
+// Signs the user out everywhere, unpairs their devices, and has them choose a new password.
+func revokeLogin(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(revokeCookie)
+	if err != nil || cookie.Value == "" ||
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.FormValue("csrf"))) != 1 {
+		return errForbidden("invalid or expired link")
+	}
+	u, err := checkRevokeCode(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	if err := u.RevokeAccess(ctx); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "device: revoked all sessions")
+	audit(ctx, r, u.ID, tube.EventSessionsRevoked, "")
+	for _, cookie := range expiredAuthCookies() {
+		http.SetCookie(w, cookie)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    revokeCookie,
+		Path:    "/login/revoke",
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+
+	// the new password is set right here, keeping the recovery token out of URLs
+	data := struct {
+		UserID int
+		Email  string
+		Token  string
+	}{
+		UserID: u.ID,
+		Email:  u.Email,
+	}
+	if u.DirectoryDN == "" {
+		data.Token = u.Recovery
+	}
+	renderTemplate(ctx, w, "login-revoked", data, http.StatusOK)
+	return nil
+}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestRevokeLogin(t *testing.T) {
+	ctx, u := testDB(t)
+	templates = template.Must(template.New("root").Parse(
+		`{{define "login-revoke.gohtml"}}{{$.CSRF}}{{end}}` +
+			`{{define "login-revoked.gohtml"}}{{$.Token}}{{end}}`))
+	t.Cleanup(func() { templates = nil })
+
+	if err := u.SetRevokeCode(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sesh, err := tube.CreateSession(ctx, u.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := url.Values{"id": {strconv.Itoa(u.ID)}, "code": {u.RevokeCode}}
+	stillLoggedIn := func() bool {
+		_, err := tube.GetSession(ctx, sesh.Token)
+		return err == nil
+	}
+
+	// following the link only asks
+	r := httptest.NewRequest("GET", "/login/revoke?"+link.Encode(), nil)
+	w := httptest.NewRecorder()
+	if err := revokeLoginForm(ctx, w, r); err != nil {
+		t.Fatal(err)
+	}
+	if !stillLoggedIn() {
+		t.Fatal("GET revoked access")
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == revokeCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value == "" || w.Body.String() != cookie.Value {
+		t.Fatalf("form token %q doesn't match cookie %v", w.Body.String(), cookie)
+	}
+
+	bad := httptest.NewRequest("GET", "/login/revoke?id="+strconv.Itoa(u.ID)+"&code=nope", nil)
+	if err := revokeLoginForm(ctx, httptest.NewRecorder(), bad); err == nil {
+		t.Error("wrong code: no error")
+	}
+
+	post := func(form url.Values, cookie *http.Cookie) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest("POST", "/login/revoke", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		return w, revokeLogin(ctx, w, r)
+	}
+	withCSRF := func(csrf string) url.Values {
+		form := url.Values{"csrf": {csrf}}
+		for k, v := range link {
+			form[k] = v
+		}
+		return form
+	}
+
+	// a form posted from elsewhere has no cookie, or can't know its value
+	if _, err := post(withCSRF(cookie.Value), nil); err == nil {
+		t.Error("POST without the cookie worked")
+	}
+	if _, err := post(withCSRF("guess"), cookie); err == nil {
+		t.Error("POST with the wrong token worked")
+	}
+	if !stillLoggedIn() {
+		t.Fatal("rejected POST revoked access")
+	}
+
+	w, err = post(withCSRF(cookie.Value), cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stillLoggedIn() {
+		t.Error("still logged in after revoking")
+	}
+	got, err := tube.GetUser(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Recovery == "" || w.Body.String() != got.Recovery {
+		t.Error("POST response doesn't let the user set a new password")
+	}
+	// the link only works once
+	if _, err := post(withCSRF(cookie.Value), cookie); err == nil {
+		t.Error("revoking twice worked")
+	}
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// Plans can have a monthly download allowance (see tube.Plan.EgressCap).
+// Users with a cap don't get direct links: their tracks and exports are streamed through
+// intertube, which counts every byte it sends. Past the cap, downloads are
+// either refused until next month or, if EgressThrottle is set, slowed down.
+
+// EgressThrottle is how fast downloads past the monthly cap are sent, in bytes per second.
+// 0 refuses them instead.
+var EgressThrottle int64
+
+// egressBlocked refuses the request if u has used up this month's downloads and they aren't throttled.
+func egressBlocked(ctx context.Context, w http.ResponseWriter, r *http.Request, u tube.User) bool {
+	now := time.Now()
+	if EgressThrottle > 0 || !u.EgressCapped(now) {
+		return false
+	}
+	egressExceeded(ctx, w, r, now)
+	return true
+}
+
+// egressExceeded tells the client to come back next month.
+func egressExceeded(ctx context.Context, w http.ResponseWriter, r *http.Request, now time.Time) {
+	retry := tube.EgressResets(now).Sub(now)
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	if isSubsonicReq(r) {
+		writeSubsonic(ctx, w, r, subErr(0, "Monthly download limit reached, it resets at the start of next month"))
+		return
+	}
+	renderError(ctx, w, r, httpError{Code: http.StatusTooManyRequests, Msg: "monthly download limit reached"})
+}
+
+// metered wraps w to count what's sent through it against u's monthly allowance,
+// and slows it down if u is already past the cap. Call done once the response is written.
+// Only the bytes actually sent count, so range requests for parts of a file
+// add up to what was downloaded, no more and no less.
+func metered(ctx context.Context, w http.ResponseWriter, r *http.Request, u tube.User) (mw http.ResponseWriter, done func()) {
+	if EgressThrottle > 0 && u.EgressCapped(time.Now()) {
+		w = throttle(w, r, EgressThrottle)
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	return cw, func() {
+		if _, ok := impersonatorFrom(ctx); ok {
+			return
+		}
+		// the request's deadline may have passed while streaming
+		addEgress(context.WithoutCancel(ctx), u, cw.n)
+	}
+}
+
+// countingWriter counts the bytes of the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// addEgress counts n bytes against u's monthly allowance, if u has one.
+// Failure is logged but does not interrupt the request.
+func addEgress(ctx context.Context, u tube.User, n int64) {
+	if u.EgressCap() == 0 || n <= 0 {
+		return
+	}
+	if err := u.AddEgress(ctx, time.Now(), n); err != nil {
+		slog.ErrorContext(ctx, "egress: failed to count download", "bytes", n, "err", err)
+	}
+}
+
+// throttledWriter sends at most rate bytes per second.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func throttle(w http.ResponseWriter, r *http.Request, rate int64) *throttledWriter {
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            r.Context(),
+		rate:           rate,
+		start:          time.Now(),
+	}
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	// a quarter second's worth at a time keeps it smooth
+	chunk := max(int(w.rate/4), 1)
+	var total int
+	for len(p) > 0 {
+		n, err := w.ResponseWriter.Write(p[:min(len(p), chunk)])
+		total += n
+		w.sent += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		due := w.start.Add(time.Duration(float64(w.sent) / float64(w.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-w.ctx.Done():
+				return total, w.ctx.Err()
+			}
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// testDB sets up a fresh SQLite database for the test, with one user.
+func testDB(t *testing.T) (context.Context, tube.User) {
+	t.Helper()
+	if err := tube.InitSQL("sqlite", filepath.Join(t.TempDir(), "tube.db"), "Test-"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := tube.CreateTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	u := tube.User{Email: "test@example.com"}
+	if err := u.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx, u
+}
+
+func TestMeteredCountsBytesSent(t *testing.T) {
+	ctx, u := testDB(t)
+	if err := tube.SetPlanEgressCap(tube.PlanKindNone, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tube.SetPlanEgressCap(tube.PlanKindNone, 0) })
+
+	file := bytes.Repeat([]byte("x"), 1000)
+	serve := func(ctx context.Context, rng string) {
+		r := httptest.NewRequest("GET", "/dl/track.mp3", nil)
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		mw, done := metered(ctx, w, r, u)
+		http.ServeContent(mw, r, "", time.Time{}, bytes.NewReader(file))
+		done()
+	}
+	used := func() int64 {
+		t.Helper()
+		got, err := tube.GetUser(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.EgressUsed(time.Now())
+	}
+
+	serve(ctx, "")
+	if got := used(); got != 1000 {
+		t.Fatalf("whole file: %d, want 1000", got)
+	}
+	// skipping the first byte used to dodge counting
+	serve(ctx, "bytes=1-")
+	if got := used(); got != 1999 {
+		t.Fatalf("after bytes=1-: %d, want 1999", got)
+	}
+	// a file fetched in pieces counts once in total
+	serve(ctx, "bytes=0-499")
+	serve(ctx, "bytes=500-999")
+	if got := used(); got != 2999 {
+		t.Fatalf("after two halves: %d, want 2999", got)
+	}
+	// admins looking around don't use up the user's allowance
+	serve(withImpersonator(ctx, 1), "")
+	if got := used(); got != 2999 {
+		t.Fatalf("after impersonation: %d, want 2999", got)
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	tw := throttle(w, r, 4000)
+	start := time.Now()
+	if _, err := tw.Write(make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Errorf("2000 bytes at 4000/s took %v, want about 500ms", took)
+	}
+	if w.Body.Len() != 2000 {
+		t.Errorf("wrote %d bytes, want 2000", w.Body.Len())
+	}
+}
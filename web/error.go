@@ -1,15 +1,146 @@
 package web
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
+	"github.com/guregu/dynamo"
 	"github.com/guregu/kami"
-	"golang.org/x/net/context"
+	"github.com/zenazn/goji/web/mutil"
+
+	"github.com/guregu/intertube/tube"
 )
 
+// httpError is an error with a status code.
+// Msg is shown to the client, and Err (if any) is only logged.
+type httpError struct {
+	Code int
+	Msg  string
+	Err  error
+}
+
+func (e httpError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Code, e.Msg, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Msg)
+}
+
+func (e httpError) Unwrap() error {
+	return e.Err
+}
+
+func errBadRequest(msg string) error {
+	return httpError{Code: http.StatusBadRequest, Msg: msg}
+}
+
+func errUnauthorized(msg string) error {
+	return httpError{Code: http.StatusUnauthorized, Msg: msg}
+}
+
+func errForbidden(msg string) error {
+	return httpError{Code: http.StatusForbidden, Msg: msg}
+}
+
+func errNotFound(msg string) error {
+	return httpError{Code: http.StatusNotFound, Msg: msg}
+}
+
+func errConflict(msg string) error {
+	return httpError{Code: http.StatusConflict, Msg: msg}
+}
+
+// errorResponse is the body of API errors.
+type errorResponse struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// handler is a handler that returns its errors instead of panicking.
+type handler func(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+
+// handle adapts h for kami, rendering any error it returns with renderError.
+func handle(h handler) kami.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if err := h(ctx, w, r); err != nil {
+			renderError(ctx, w, r, err)
+		}
+	}
+}
+
+// renderError responds with err's status code and message:
+// JSON for the API, and plain text otherwise.
+// Server errors are logged and their details aren't shown.
+func renderError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	code, msg := errorStatus(err)
+	if code >= 500 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// whatever failed, it's because we ran out of time
+		code, msg = http.StatusGatewayTimeout, "timed out"
+	}
+	msg = translateError(ctx, msg)
+	if code >= 500 && code != http.StatusServiceUnavailable { // 503s are on purpose, like during maintenance
+		slog.ErrorContext(ctx, "request failed", "status", code, "err", err)
+	} else {
+		slog.DebugContext(ctx, "request failed", "status", code, "err", err)
+	}
+
+	if wp, ok := w.(mutil.WriterProxy); ok && wp.Status() != 0 {
+		// too late to change the response
+		return
+	}
+	if wantsJSON(r) {
+		renderJSON(w, errorResponse{
+			Error:     msg,
+			Status:    code,
+			RequestID: requestIDFrom(ctx),
+		}, code)
+		return
+	}
+	renderText(w, msg, code)
+}
+
+// errorStatus maps err to a status code and a message that's safe to show.
+func errorStatus(err error) (int, string) {
+	var herr httpError
+	var numErr *strconv.NumError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &herr):
+		return herr.Code, herr.Msg
+	case errors.Is(err, tube.ErrNotFound):
+		return http.StatusNotFound, "not found"
+	case dynamo.IsCondCheckFailed(err):
+		// writes are conditional on the item existing and belonging to the user,
+		// handlers that can hit a real conflict check for it themselves
+		return http.StatusNotFound, "not found"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timed out"
+	case errors.As(err, &numErr):
+		return http.StatusBadRequest, "invalid number: " + strconv.Quote(numErr.Num)
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return http.StatusBadRequest, "invalid JSON"
+	}
+	return http.StatusInternalServerError, "internal server error"
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") ||
+		strings.HasPrefix(r.URL.Path, "/admin/api/") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// PanicHandler renders panics like errors returned from handlers.
+// Handlers return their errors (see handle and subsonicHandle); panics are only expected
+// from startup code and bugs, and this keeps the latter from taking the server down.
 func PanicHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	if isSubsonicReq(r) {
 		subsonicPanicHandler(ctx, w, r)
@@ -17,10 +148,13 @@ func PanicHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	ex := kami.Exception(ctx)
-	log.Println("Panic!", ex)
-	debug.PrintStack()
-
-	w.WriteHeader(http.StatusInternalServerError)
-
-	fmt.Fprintln(w, "Panic!", ex)
+	err, ok := ex.(error)
+	if !ok {
+		err = fmt.Errorf("panic: %v", ex)
+	}
+	// renderError logs the error too, but not where it came from
+	if code, _ := errorStatus(err); code >= 500 {
+		slog.ErrorContext(ctx, "panic", "err", ex, "stack", string(debug.Stack()))
+	}
+	renderError(ctx, w, r, err)
 }
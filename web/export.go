@@ -0,0 +1,611 @@
+package web
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/job"
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
+)
+
+var (
+	// ExportLinkTTL is how long links to finished exports work.
+	ExportLinkTTL = 6 * time.Hour
+	// ArchivePartSize is about how big each part of a whole-library archive gets,
+	// keeping them well under S3's 5 GB limit for a single upload.
+	ArchivePartSize int64 = 2 << 30
+)
+
+func init() {
+	kami.Get("/api/account/export", handle(listExports))
+	kami.Post("/api/account/export", handle(requestExport))
+	kami.Get("/api/account/export/:id", handle(getExport))
+	kami.Get("/api/account/export/:id/:n", handle(downloadExport))
+}
+
+type exportView struct {
+	tube.Export
+	// signed links, left out for users with a monthly download cap
+	Links []string `json:",omitempty"`
+	// permanent links to each part, which redirect to fresh signed links
+	Downloads []string `json:",omitempty"`
+}
+
+func newExportView(u tube.User, ex tube.Export) (exportView, error) {
+	view := exportView{Export: ex}
+	if ex.Status != tube.ExportDone || ex.Expired() {
+		return view, nil
+	}
+	for _, key := range ex.Keys {
+		if u.EgressCap() > 0 {
+			break
+		}
+		href, err := storage.FilesBucket.PresignGet(key, ExportLinkTTL)
+		if err != nil {
+			return view, err
+		}
+		view.Links = append(view.Links, href)
+	}
+	for i := range ex.Parts {
+		view.Downloads = append(view.Downloads, fmt.Sprintf("/api/account/export/%s/%d", ex.ID, i+1))
+	}
+	return view, nil
+}
+
+// POST /api/account/export?audio=true
+// POST /api/account/export?kind=archive
+// POST /api/account/export?kind=album&album=...
+// POST /api/account/export?kind=playlist&playlist=...
+// An archive is everything: every original file, the metadata, and a manifest, in as many parts as it takes.
+// Album (by its Subsonic album ID) and playlist downloads are a zip of their audio, kept for a day.
+func requestExport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	kind := tube.ExportTakeout
+	var target string
+	switch r.FormValue("kind") {
+	case "", string(tube.ExportTakeout):
+	case string(tube.ExportArchive):
+		kind = tube.ExportArchive
+	case string(tube.ExportAlbum):
+		kind = tube.ExportAlbum
+		target = r.FormValue("album")
+	case string(tube.ExportPlaylist):
+		kind = tube.ExportPlaylist
+		target = r.FormValue("playlist")
+	default:
+		return errBadRequest("kind must be takeout, archive, album, or playlist")
+	}
+
+	exs, err := tube.GetExports(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, ex := range exs {
+		if ex.Kind == kind && ex.Target == target && (ex.Status == tube.ExportPending || ex.Status == tube.ExportRunning) {
+			view, err := newExportView(u, ex)
+			if err != nil {
+				return err
+			}
+			renderJSON(w, view, http.StatusAccepted)
+			return nil
+		}
+	}
+
+	// no use making a zip that can't be downloaded until next month
+	if kind.IsDownload() && egressBlocked(ctx, w, r, u) {
+		return nil
+	}
+
+	ex := tube.NewExport(u.ID, kind)
+	ex.Audio = kind != tube.ExportTakeout || r.FormValue("audio") == "true"
+	if kind.IsDownload() {
+		ex.Target = target
+		_, ex.Name, err = downloadTracks(ctx, u, ex)
+		if err != nil {
+			return err
+		}
+	}
+	if err := ex.Create(ctx); err != nil {
+		return err
+	}
+	audit(ctx, r, u.ID, tube.EventExportRequested, strings.TrimSpace(string(ex.Kind)+" "+ex.Name))
+
+	if _, err := job.Enqueue(ctx, u.ID, jobTakeout, takeoutJob{ExportID: ex.ID}); err != nil {
+		return err
+	}
+
+	view, err := newExportView(u, ex)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/api/account/export/"+ex.ID)
+	renderJSON(w, view, http.StatusAccepted)
+	return nil
+}
+
+// GET /api/account/export
+func listExports(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	exs, err := tube.GetExports(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	views := make([]exportView, 0, len(exs))
+	for _, ex := range exs {
+		view, err := newExportView(u, ex)
+		if err != nil {
+			return err
+		}
+		views = append(views, view)
+	}
+	renderJSON(w, views, http.StatusOK)
+	return nil
+}
+
+// GET /api/account/export/:id
+func getExport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	ex, err := tube.GetExport(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	view, err := newExportView(u, ex)
+	if err != nil {
+		return err
+	}
+	renderJSON(w, view, http.StatusOK)
+	return nil
+}
+
+// GET /api/account/export/:id/:n
+// Redirects to a signed link for part n (starting from 1).
+// Signed links expire, but this doesn't, so download managers can come back here to resume.
+// Every part's SHA256 is listed in the export, to check the result.
+// Users with a monthly download cap are streamed the part instead, counting it like a track.
+func downloadExport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	ex, err := tube.GetExport(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(kami.Param(ctx, "n"))
+	if err != nil || n < 1 || n > len(ex.Parts) {
+		return errNotFound("no such part")
+	}
+	if ex.Status != tube.ExportDone || ex.Expired() {
+		return errNotFound("export isn't available")
+	}
+	part := ex.Parts[n-1]
+	if u.EgressCap() > 0 {
+		if egressBlocked(ctx, w, r, u) {
+			return nil
+		}
+		mw, done := metered(ctx, w, r, u)
+		defer done()
+		rs := storage.NewStreamReader(storage.FilesBucket, part.Key, part.Size)
+		defer rs.Close()
+		mw.Header().Set("Content-Type", "application/zip")
+		mw.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+escapeFilename(exportFilename(ex, n)))
+		mw.Header().Set("Cache-Control", "private")
+		http.ServeContent(mw, r, "", ex.Created, rs)
+		return nil
+	}
+	href, err := storage.FilesBucket.PresignGet(part.Key, ExportLinkTTL)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, href, http.StatusFound)
+	return nil
+}
+
+func exportKey(ex tube.Export, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("export/%d/%s.zip", ex.UserID, ex.ID)
+	}
+	return fmt.Sprintf("export/%d/%s-%d.zip", ex.UserID, ex.ID, n)
+}
+
+// exportFilename is what part n of ex is saved as when downloaded.
+func exportFilename(ex tube.Export, n int) string {
+	if ex.Kind.IsDownload() {
+		return ex.Name + ".zip"
+	}
+	name := "intertube-" + ex.Created.Format("2006-01-02")
+	if ex.Kind == tube.ExportArchive {
+		name += fmt.Sprintf("-%d", n)
+	}
+	return name + ".zip"
+}
+
+// exportFile is an archive being written to a temporary file.
+type exportFile struct {
+	*zip.Writer
+	tmp  *os.File
+	hash hash.Hash
+}
+
+func newExportFile() (*exportFile, error) {
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	return &exportFile{
+		Writer: zip.NewWriter(io.MultiWriter(tmp, h)),
+		tmp:    tmp,
+		hash:   h,
+	}, nil
+}
+
+// upload finishes the archive and saves it as part n of ex.
+func (f *exportFile) upload(ex tube.Export, n int) (tube.ExportPart, error) {
+	if err := f.Close(); err != nil {
+		return tube.ExportPart{}, err
+	}
+	size, err := f.tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return tube.ExportPart{}, err
+	}
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return tube.ExportPart{}, err
+	}
+	key := exportKey(ex, n)
+	info := storage.ObjectInfo{
+		Type:        "application/zip",
+		Disposition: "attachment; filename*=UTF-8''" + escapeFilename(exportFilename(ex, n)),
+	}
+	if err := storage.FilesBucket.PutObject(key, info, f.tmp); err != nil {
+		return tube.ExportPart{}, err
+	}
+	return tube.ExportPart{
+		Key:    key,
+		Size:   size,
+		SHA256: hex.EncodeToString(f.hash.Sum(nil)),
+	}, nil
+}
+
+func (f *exportFile) remove() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
+
+// thawTracks starts restoring any cold tracks, failing until they're all readable.
+func thawTracks(ctx context.Context, tracks tube.Tracks) error {
+	var cold int
+	for i := range tracks {
+		if !tracks[i].IsCold() {
+			continue
+		}
+		ready, err := tracks[i].Thaw(ctx)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			cold++
+		}
+	}
+	if cold > 0 {
+		return fmt.Errorf("%d track(s) are warming up from cold storage, try again in a few hours", cold)
+	}
+	return nil
+}
+
+func runTakeout(ctx context.Context, u tube.User, ex *tube.Export) error {
+	if err := ex.SetRunning(ctx); err != nil {
+		return err
+	}
+
+	zw, err := newExportFile()
+	if err != nil {
+		return err
+	}
+	defer zw.remove()
+
+	tracks, err := writeTakeoutMetadata(ctx, zw.Writer, u)
+	if err != nil {
+		return err
+	}
+	if ex.Audio {
+		if err := thawTracks(ctx, tracks); err != nil {
+			return err
+		}
+		for _, t := range tracks {
+			if err := writeZipTrack(zw.Writer, path.Join("audio", t.VirtualPath()), u, t); err != nil {
+				return fmt.Errorf("track %s: %w", t.ID, err)
+			}
+		}
+	}
+
+	part, err := zw.upload(*ex, 0)
+	if err != nil {
+		return err
+	}
+	return ex.Finish(ctx, []tube.ExportPart{part})
+}
+
+// downloadTracks finds the tracks of an album or playlist download, and what to call it.
+func downloadTracks(ctx context.Context, u tube.User, ex tube.Export) ([]tube.Track, string, error) {
+	lib, err := getLibrary(ctx, u)
+	if err != nil {
+		return nil, "", err
+	}
+	switch ex.Kind {
+	case tube.ExportAlbum:
+		album, ok := lib.albums[ex.Target]
+		if !ok {
+			return nil, "", errNotFound("no such album")
+		}
+		name := cmp.Or(album.name, tube.UnknownAlbum)
+		if album.artist != "" {
+			name = album.artist + " - " + name
+		}
+		return album.tracks, name, nil
+	case tube.ExportPlaylist:
+		id, err := strconv.Atoi(ex.Target)
+		if err != nil {
+			return nil, "", errNotFound("no such playlist")
+		}
+		pl, err := tube.GetPlaylist(ctx, u.ID, id)
+		if err != nil {
+			return nil, "", err
+		}
+		tracks, err := playlistTracks(lib, pl)
+		return tracks, cmp.Or(pl.Name, "playlist"), err
+	}
+	return nil, "", fmt.Errorf("export: not a download: %s", ex.Kind)
+}
+
+// runDownload zips up the audio of an album or playlist.
+// Playlist tracks are numbered by their position in the playlist.
+func runDownload(ctx context.Context, u tube.User, ex *tube.Export) error {
+	if err := ex.SetRunning(ctx); err != nil {
+		return err
+	}
+	tracks, _, err := downloadTracks(ctx, u, *ex)
+	if err != nil {
+		return err
+	}
+	if err := thawTracks(ctx, tracks); err != nil {
+		return err
+	}
+
+	zw, err := newExportFile()
+	if err != nil {
+		return err
+	}
+	defer zw.remove()
+	for i, t := range tracks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := path.Base(t.VirtualPath())
+		if ex.Kind == tube.ExportPlaylist {
+			name = fmt.Sprintf("%03d %s", i+1, name)
+		}
+		if err := writeZipTrack(zw.Writer, name, u, t); err != nil {
+			return fmt.Errorf("track %s: %w", t.ID, err)
+		}
+	}
+
+	part, err := zw.upload(*ex, 0)
+	if err != nil {
+		return err
+	}
+	return ex.Finish(ctx, []tube.ExportPart{part})
+}
+
+// archiveManifest is manifest.json in every part of a whole-library archive.
+// It says which part each file is in, so the parts can be checked and put back together.
+type archiveManifest struct {
+	Export  string
+	Created time.Time
+	Parts   int
+	Files   []archiveEntry
+}
+
+type archiveEntry struct {
+	Path    string
+	Part    int
+	Size    int64  `json:",omitempty"`
+	TrackID string `json:",omitempty"`
+}
+
+// runArchive packs all of u's original files, plus their metadata and a manifest,
+// into parts of about ArchivePartSize each.
+func runArchive(ctx context.Context, u tube.User, ex *tube.Export) error {
+	if err := ex.SetRunning(ctx); err != nil {
+		return err
+	}
+
+	files, tracks, err := userMetadata(ctx, u)
+	if err != nil {
+		return err
+	}
+	if err := thawTracks(ctx, tracks); err != nil {
+		return err
+	}
+
+	// split the tracks up front, so every part's manifest can list all of them
+	manifest := archiveManifest{
+		Export:  ex.ID,
+		Created: time.Now().UTC(),
+		Parts:   1,
+	}
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, archiveEntry{Path: file.name, Part: 1})
+	}
+	plan := make([][]tube.Track, 1)
+	var partSize int64
+	for _, t := range tracks {
+		size := int64(t.Size)
+		if partSize > 0 && partSize+size > ArchivePartSize {
+			plan = append(plan, nil)
+			partSize = 0
+		}
+		n := len(plan)
+		plan[n-1] = append(plan[n-1], t)
+		partSize += size
+		manifest.Files = append(manifest.Files, archiveEntry{
+			Path:    path.Join("audio", t.VirtualPath()),
+			Part:    n,
+			Size:    size,
+			TrackID: t.ID,
+		})
+	}
+	manifest.Parts = len(plan)
+
+	parts := make([]tube.ExportPart, 0, len(plan))
+	for i, partTracks := range plan {
+		n := i + 1
+		part, err := writeArchivePart(ctx, u, *ex, n, manifest, files, partTracks)
+		if err != nil {
+			return fmt.Errorf("part %d: %w", n, err)
+		}
+		parts = append(parts, part)
+	}
+	return ex.Finish(ctx, parts)
+}
+
+func writeArchivePart(ctx context.Context, u tube.User, ex tube.Export, n int, manifest archiveManifest, files []metadataFile, tracks []tube.Track) (tube.ExportPart, error) {
+	zw, err := newExportFile()
+	if err != nil {
+		return tube.ExportPart{}, err
+	}
+	defer zw.remove()
+
+	if n == 1 {
+		if err := writeZipJSON(zw.Writer, files...); err != nil {
+			return tube.ExportPart{}, err
+		}
+	}
+	if err := writeZipJSON(zw.Writer, metadataFile{"manifest.json", manifest}); err != nil {
+		return tube.ExportPart{}, err
+	}
+	for _, t := range tracks {
+		if err := ctx.Err(); err != nil {
+			return tube.ExportPart{}, err
+		}
+		if err := writeZipTrack(zw.Writer, path.Join("audio", t.VirtualPath()), u, t); err != nil {
+			return tube.ExportPart{}, fmt.Errorf("track %s: %w", t.ID, err)
+		}
+	}
+	return zw.upload(ex, n)
+}
+
+// metadataFile is one of the JSON files in a takeout or backup.
+type metadataFile struct {
+	name string
+	data any
+}
+
+// writeTakeoutMetadata writes all of a user's metadata as JSON files into zw,
+// returning their tracks for further use.
+func writeTakeoutMetadata(ctx context.Context, zw *zip.Writer, u tube.User) (tube.Tracks, error) {
+	files, tracks, err := userMetadata(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeZipJSON(zw, files...); err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+// writeZipJSON writes each file into zw as indented JSON.
+func writeZipJSON(zw *zip.Writer, files ...metadataFile) error {
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userMetadata gathers everything about a user's account and library, except the audio.
+func userMetadata(ctx context.Context, u tube.User) ([]metadataFile, tube.Tracks, error) {
+	tracks, err := tube.GetTracks(ctx, u.ID)
+	if err != nil && err != tube.ErrNotFound {
+		return nil, nil, err
+	}
+	playlists, err := tube.GetPlaylists(ctx, u.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	stars, err := tube.GetStars(ctx, u.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	starList := make([]tube.Star, 0, len(stars))
+	for _, s := range stars {
+		starList = append(starList, s)
+	}
+	files, err := tube.GetFilesByUser(ctx, u.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var history []tube.Event
+	var next dynamo.PagingKey
+	for {
+		events, nextKey, err := tube.GetEvents(ctx, u.ID, 0, next)
+		if err != nil {
+			return nil, nil, err
+		}
+		history = append(history, events...)
+		if nextKey == nil {
+			break
+		}
+		next = nextKey
+	}
+
+	return []metadataFile{
+		{"account.json", u},
+		{"tracks.json", tracks},
+		{"playlists.json", playlists},
+		{"stars.json", starList},
+		{"uploads.json", files},
+		{"activity.json", history},
+	}, tracks, nil
+}
+
+// writeZipTrack copies a track's audio into zw without recompressing it.
+func writeZipTrack(zw *zip.Writer, name string, u tube.User, t tube.Track) error {
+	r, err := openTrack(u, t)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
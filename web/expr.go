@@ -98,20 +98,12 @@ func NewExprEnv(t tube.Track) ExprEnv {
 
 type datetime struct{}
 
-func (datetime) Date(s string) time.Time {
-	t, err := time.Parse("2006-01-02", s)
-	if err != nil {
-		panic(err)
-	}
-	return t
+func (datetime) Date(s string) (time.Time, error) {
+	return time.Parse("2006-01-02", s)
 }
 
-func (datetime) Duration(s string) time.Duration {
-	d, err := time.ParseDuration(s)
-	if err != nil {
-		panic(err)
-	}
-	return d
+func (datetime) Duration(s string) (time.Duration, error) {
+	return time.ParseDuration(s)
 }
 
 func (datetime) Days(n int) time.Duration {
@@ -3,7 +3,11 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
@@ -11,21 +15,43 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/guregu/kami"
+	"github.com/karlseguin/ccache/v2"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/guregu/intertube/cdn"
+	"github.com/guregu/intertube/job"
+	"github.com/guregu/intertube/metrics"
 	"github.com/guregu/intertube/storage"
 	"github.com/guregu/intertube/tube"
 )
 
-const (
-	maxFileSize = 1024 * 1024 * 1024 // 1GB
+// Limits, set by the configuration.
+var (
+	MaxFileSize int64 = 1024 * 1024 * 1024 // 1GB
 
-	fileDownloadTTL      = 1 * time.Hour
-	thumbnailDownloadTTL = 1 * time.Hour
-	uploadTTL            = 4 * time.Hour
+	FileDownloadTTL      = 1 * time.Hour
+	ThumbnailDownloadTTL = 1 * time.Hour
+	UploadTTL            = 4 * time.Hour
 )
 
-func downloadTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// how many files in a batch upload are set up at once
+const uploadStartWorkers = 16
+
+// largest file that can be sent straight to uploadSimple, instead of to storage
+const maxSimpleUploadSize = 100 << 20 // 100MB
+
+// how many uploads this server processes at once;
+// each one can hold a whole file in memory
+const ingestWorkers = 4
+
+var ingestSlots = make(chan struct{}, ingestWorkers)
+
+// restoring from Glacier takes 3-5 hours
+const warmingUpRetry = 1 * time.Hour
+
+func downloadTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	id := kami.Param(ctx, "id")
@@ -34,31 +60,123 @@ func downloadTrack(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	f, err := tube.GetTrack(ctx, u.ID, id)
-	if err == tube.ErrNotFound {
-		http.NotFound(w, r)
-		return
-	}
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if egressBlocked(ctx, w, r, u) {
+		return nil
 	}
 
-	href, err := storage.FilesBucket.PresignGet(f.StorageKey(), fileDownloadTTL)
+	if f.IsCold() {
+		ready, err := f.Thaw(ctx)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			warmingUp(ctx, w, r)
+			return nil
+		}
+	}
+
+	recordAccess(ctx, r, u, f)
+	return sendTrack(ctx, w, r, u, f)
+}
+
+// sendTrack redirects to a track's audio, or streams it if storage can't serve it as-is.
+// Owners with a monthly download cap are always streamed it, so it can be counted (see metered).
+// So are owners with location restrictions, as a signed link works from anywhere.
+func sendTrack(ctx context.Context, w http.ResponseWriter, r *http.Request, owner tube.User, track tube.Track) error {
+	if owner.EgressCap() > 0 {
+		mw, done := metered(ctx, w, r, owner)
+		defer done()
+		return streamTrack(mw, r, owner, track)
+	}
+	if track.Encrypted || !owner.Restrict.Empty() {
+		return streamTrack(w, r, owner, track)
+	}
+	href, err := signDL(track.StorageKey(), FileDownloadTTL, clientCountry(r))
 	if err != nil {
-		panic(err)
+		return err
 	}
+	// signed links expire, and shares can be revoked
+	setCacheHeaders(w)
 	http.Redirect(w, r, href, http.StatusTemporaryRedirect)
+	return nil
+}
+
+func streamTrack(w http.ResponseWriter, r *http.Request, owner tube.User, track tube.Track) error {
+	if track.Encrypted {
+		return streamEncrypted(w, r, owner, track)
+	}
+	return streamPlain(w, r, track)
+}
+
+// warmingUp tells the client that a track is being restored from cold storage.
+func warmingUp(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(warmingUpRetry.Seconds())))
+	w.Header().Set("Tube-Track-Status", "warming up")
+	if isSubsonicReq(r) {
+		writeSubsonic(ctx, w, r, subErr(0, "This track is being restored from cold storage, try again in a few hours"))
+		return
+	}
+	http.Error(w, "this track is warming up from cold storage, try again in a few hours", http.StatusServiceUnavailable)
 }
 
-func uploadStart(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// streamEncrypted decrypts a track on the fly, as storage can't do it for us.
+func streamEncrypted(w http.ResponseWriter, r *http.Request, u tube.User, track tube.Track) error {
+	dec, err := storage.OpenEncrypted(storage.FilesBucket, track.StorageKey(), u.DataKey, int64(track.Size))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	if mimetype := mime.TypeByExtension(path.Ext(track.Filename)); mimetype != "" {
+		w.Header().Set("Content-Type", mimetype)
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+escapeFilename(track.Filename))
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", track.LastMod, dec)
+	return nil
+}
+
+// streamPlain serves an unencrypted track through intertube instead of redirecting to storage.
+func streamPlain(w http.ResponseWriter, r *http.Request, track tube.Track) error {
+	rs := storage.NewStreamReader(storage.FilesBucket, track.StorageKey(), int64(track.Size))
+	defer rs.Close()
+	if mimetype := mime.TypeByExtension(path.Ext(track.Filename)); mimetype != "" {
+		w.Header().Set("Content-Type", mimetype)
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+escapeFilename(track.Filename))
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", track.LastMod, rs)
+	return nil
+}
+
+// directDL reports whether clients can download a track straight from storage,
+// instead of going through downloadTrack.
+// Downloads by users with a monthly cap need to be counted, so they can't.
+// Neither can users with IP or country restrictions, as signed links work from anywhere.
+func directDL(u tube.User, track tube.Track) bool {
+	return !track.Encrypted && !track.IsCold() && u.EgressCap() == 0 && u.Restrict.Empty()
+}
+
+// openTrack returns a track's audio, decrypted if necessary.
+func openTrack(u tube.User, track tube.Track) (io.ReadCloser, error) {
+	if track.Encrypted {
+		return storage.OpenEncrypted(storage.FilesBucket, track.StorageKey(), u.DataKey, int64(track.Size))
+	}
+	return storage.FilesBucket.Get(track.StorageKey())
+}
+
+func uploadStart(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	name := r.FormValue("name")
 	filetype := r.FormValue("type")
 	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if size == 0 {
-		panic("missing file size")
+		return errBadRequest("missing file size")
 	}
 	var localMod int64
 	if msec, err := strconv.ParseInt(r.FormValue("lastmod"), 10, 64); err == nil {
@@ -67,50 +185,51 @@ func uploadStart(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Tube-Upload-Usage", strconv.FormatInt(u.Usage, 10))
 	w.Header().Set("Tube-Upload-Quota", strconv.FormatInt(u.CalcQuota(), 10))
-	if size > maxFileSize {
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "file too big. max size is "+strconv.FormatInt(maxFileSize/1000/1000, 10)+"MB")
-		return
+	if size > MaxFileSize {
+		return errTooBig()
 	}
 	if (u.CalcQuota() != 0) && (u.Usage+size > u.CalcQuota()) {
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "upload quota exceeded")
-		return
+		metrics.QuotaRejected()
+		return errBadRequest("upload quota exceeded")
 	}
 
 	zf := tube.NewFile(u.ID, name, size)
 	zf.Type = filetype // TODO
 	zf.LocalMod = localMod
 	if err := zf.Create(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
-	if storage.UploadsBucket.Exists(zf.Path()) {
-		panic("already exists?!")
+	if storage.WithContext(ctx, storage.UploadsBucket).Exists(zf.Path()) {
+		return fmt.Errorf("upload %s already exists", zf.ID)
 	}
 
 	disp := encodeContentDisp(name)
-	url, err := storage.UploadsBucket.PresignPut(zf.Path(), size, disp, uploadTTL)
+	url, err := storage.UploadsBucket.PresignPut(zf.Path(), size, disp, UploadTTL)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	metrics.UploadStarted()
 
 	var data = struct {
-		ID    string
-		CD    string
-		URL   string
-		Token string
+		ID      string
+		CD      string
+		URL     string
+		Token   string
+		Headers map[string]string `json:",omitempty"`
 	}{
-		ID:  zf.ID,
-		CD:  disp,
-		URL: url,
+		ID:      zf.ID,
+		CD:      disp,
+		URL:     url,
+		Headers: storage.PutHeaders(storage.UploadsBucket),
 	}
 
 	w.Header().Set("Tube-Upload-ID", zf.ID)
 	renderJSON(w, data, http.StatusOK)
+	return nil
 }
 
-func uploadStart2(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func uploadStart2(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	var input []struct {
@@ -120,152 +239,338 @@ func uploadStart2(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		LocalMod int64 `json:"lastmod"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		panic(err)
+		return err
 	}
 
 	type meta struct {
-		ID  string
-		CD  string
-		URL string
+		ID      string
+		CD      string
+		URL     string
+		Headers map[string]string `json:",omitempty"`
 	}
-	output := make([]meta, 0, len(input))
 
+	// check the whole batch before creating anything
 	var totalsize int64
 	for _, f := range input {
 		if f.Size == 0 {
-			panic("missing file size")
+			return errBadRequest("missing file size")
 		}
-		if f.Size > maxFileSize {
-			w.WriteHeader(400)
-			fmt.Fprintln(w, "file too big. max size is "+strconv.FormatInt(maxFileSize/1024/1024, 10)+"MB")
-			return
+		if f.Size > MaxFileSize {
+			return errTooBig()
 		}
 		totalsize += f.Size
+	}
+	if quota := u.CalcQuota(); quota != 0 {
+		if u.Usage+totalsize > quota {
+			metrics.QuotaRejected()
+			return errBadRequest("file would exceed upload quota")
+		}
+	}
 
+	files := make([]tube.File, len(input))
+	for i, f := range input {
 		zf := tube.NewFile(u.ID, f.Name, f.Size)
 		zf.Type = f.Type
 		zf.LocalMod = f.LocalMod
-		if err := zf.Create(ctx); err != nil {
-			panic(err)
-		}
+		files[i] = zf
+	}
+	if err := tube.CreateFiles(ctx, files); err != nil {
+		return err
+	}
+
+	headers := storage.PutHeaders(storage.UploadsBucket)
+	output := make([]meta, len(input))
+	grp, gctx := errgroup.WithContext(ctx)
+	grp.SetLimit(uploadStartWorkers)
+	for i, f := range input {
+		i, f, zf := i, f, files[i]
+		grp.Go(func() error {
+			if storage.WithContext(gctx, storage.UploadsBucket).Exists(zf.Path()) {
+				return fmt.Errorf("upload %s already exists", zf.ID)
+			}
+
+			disp := encodeContentDisp(f.Name)
+			url, err := storage.UploadsBucket.PresignPut(zf.Path(), f.Size, disp, UploadTTL)
+			if err != nil {
+				return err
+			}
+			metrics.UploadStarted()
+
+			output[i] = meta{
+				ID:      zf.ID,
+				CD:      disp,
+				URL:     url,
+				Headers: headers,
+			}
+			return nil
+		})
+	}
+	if err := grp.Wait(); err != nil {
+		return err
+	}
 
-		if storage.UploadsBucket.Exists(zf.Path()) {
-			panic("already exists?! " + zf.ID)
-		}
+	w.Header().Set("Tube-Upload-Usage", strconv.FormatInt(u.Usage, 10))
+	w.Header().Set("Tube-Upload-Quota", strconv.FormatInt(u.CalcQuota(), 10))
+	renderJSON(w, output, http.StatusOK)
+	return nil
+}
 
-		disp := encodeContentDisp(f.Name)
-		url, err := storage.UploadsBucket.PresignPut(zf.Path(), f.Size, disp, uploadTTL)
-		if err != nil {
-			panic(err)
-		}
+// quotaCheck says whether a batch of files would fit before it's uploaded.
+// Quota and Remaining are 0 when there's no quota.
+type quotaCheck struct {
+	Fits      bool // every file can be uploaded
+	Usage     int64
+	Quota     int64
+	Remaining int64
+	Files     []quotaVerdict
+}
 
-		output = append(output, meta{
-			ID:  zf.ID,
-			CD:  disp,
-			URL: url,
-		})
+type quotaVerdict struct {
+	Name    string
+	Size    int64
+	OK      bool
+	Verdict string // "ok", "empty", "too_big", or "over_quota"
+	Reason  string `json:",omitempty"`
+}
+
+// POST /upload/check
+// [{"Name": "...", "Size": 123}, ...]
+// Checks a batch of files against the size limit and the remaining quota, without uploading anything,
+// so the uploader can warn about files that would be rejected.
+// Files are counted in order, and ones that don't fit don't take up room for the rest.
+func checkUploadQuota(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var input []struct {
+		Name string
+		Size int64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
 	}
 
-	if quota := u.CalcQuota(); quota != 0 {
-		if u.Usage+totalsize > quota {
-			renderText(w, "file would exceed upload quota", http.StatusBadRequest)
-			return
+	quota := u.CalcQuota()
+	check := quotaCheck{
+		Fits:  true,
+		Usage: u.Usage,
+		Quota: quota,
+		Files: make([]quotaVerdict, 0, len(input)),
+	}
+	if quota != 0 {
+		check.Remaining = max(quota-u.Usage, 0)
+	}
+	usage := u.Usage
+	for _, f := range input {
+		v := quotaVerdict{
+			Name:    f.Name,
+			Size:    f.Size,
+			Verdict: "ok",
 		}
+		switch {
+		case f.Size <= 0:
+			v.Verdict, v.Reason = "empty", "missing file size"
+		case f.Size > MaxFileSize:
+			v.Verdict, v.Reason = "too_big", tooBigMsg()
+		case quota != 0 && usage+f.Size > quota:
+			v.Verdict, v.Reason = "over_quota", "file would exceed upload quota"
+		default:
+			v.OK = true
+			usage += f.Size
+		}
+		v.Reason = translateError(ctx, v.Reason)
+		check.Fits = check.Fits && v.OK
+		check.Files = append(check.Files, v)
 	}
+	renderJSON(w, check, http.StatusOK)
+	return nil
+}
 
-	w.Header().Set("Tube-Upload-Usage", strconv.FormatInt(u.Usage, 10))
-	w.Header().Set("Tube-Upload-Quota", strconv.FormatInt(u.CalcQuota(), 10))
-	renderJSON(w, output, http.StatusOK)
+func errTooBig() error {
+	return httpError{
+		Code: http.StatusRequestEntityTooLarge,
+		Msg:  tooBigMsg(),
+	}
 }
 
-func ProcessUpload(ctx context.Context, f *tube.File, u tube.User, uploadPath string) (tube.Track, error) {
-	if f.Deleted || f.UserID != u.ID {
-		return tube.Track{}, fmt.Errorf("forbidden")
+func tooBigMsg() string {
+	return "file too big. max size is " + humanize.IBytes(uint64(MaxFileSize))
+}
+
+// uploadCheck is what the client says it uploaded, if it says.
+type uploadCheck struct {
+	Size   int64  `json:",omitempty"`
+	SHA256 string `json:",omitempty"` // hex
+}
+
+func parseUploadCheck(r *http.Request) (uploadCheck, error) {
+	var check uploadCheck
+	if size := r.FormValue("size"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return check, err
+		}
+		check.Size = n
 	}
+	check.SHA256 = r.FormValue("sha256")
+	return check, nil
+}
 
-	if err := f.SetStarted(ctx, time.Now().UTC()); err != nil {
-		return tube.Track{}, err
+// ProcessUpload turns an uploaded file into a track.
+// The upload is checked against check with the same Head call that gets its size,
+// and the database is only written to three times: before, during, and after.
+func ProcessUpload(ctx context.Context, f *tube.File, u tube.User, uploadPath string, check uploadCheck) (tube.Track, error) {
+	if f.Deleted || f.UserID != u.ID {
+		return tube.Track{}, errForbidden("forbidden")
 	}
 
-	head, err := storage.UploadsBucket.Head(f.Path())
+	head, err := storage.Traced(ctx, storage.UploadsBucket).Head(f.Path())
 	if err != nil {
-		return tube.Track{}, fmt.Errorf("file not found in storage")
+		return tube.Track{}, httpError{Code: http.StatusNotFound, Msg: "file not found in storage", Err: err}
+	}
+	if check.Size != 0 && check.Size != head.Size {
+		return tube.Track{}, errBadRequest(fmt.Sprintf("upload incomplete: got %d of %d bytes, try uploading it again", head.Size, check.Size))
 	}
 	if err := f.Finish(ctx, head.Type, head.Size); err != nil {
 		return tube.Track{}, err
 	}
-	if head.Size > maxFileSize {
-		storage.FilesBucket.Delete(f.Path())
-		return tube.Track{}, fmt.Errorf("file too big")
+	if head.Size > MaxFileSize {
+		storage.Traced(ctx, storage.FilesBucket).Delete(f.Path())
+		return tube.Track{}, errTooBig()
 	}
 
-	track, err := handleUpload(ctx, f.Path(), u, uploadPath)
-	if err != nil {
-		return track, err
+	select {
+	case ingestSlots <- struct{}{}:
+		defer func() { <-ingestSlots }()
+	case <-ctx.Done():
+		return tube.Track{}, ctx.Err()
 	}
-	if err := u.UpdateLastMod(ctx); err != nil {
-		return track, err
+	track, err := handleUpload(ctx, f, head.Size, u, uploadPath, check)
+	metrics.Ingested(head.Size, err)
+	if err == nil {
+		notifyQuota(ctx, u, head.Size)
 	}
-	return track, nil
+	return track, err
 }
 
-func uploadFinish(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func uploadFinish(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, ok := userFrom(ctx)
 	if !ok {
-		panic("no account")
+		return errForbidden("not logged in")
 	}
 	bID := r.URL.Query().Get("bid")
 	if bID == "" {
-		panic("no bid")
+		return errBadRequest("missing bid parameter")
+	}
+	check, err := parseUploadCheck(r)
+	if err != nil {
+		return err
 	}
 
 	id := kami.Param(ctx, "id")
 	f, err := tube.GetFile(ctx, id)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if f.Ready && f.TrackID != "" {
 		track, err := tube.GetTrack(ctx, u.ID, f.TrackID)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if err := json.NewEncoder(w).Encode(&track); err != nil {
-			panic(err)
-		}
-		return
+		return json.NewEncoder(w).Encode(&track)
 	}
 
-	if !storage.UsingQueue() {
-		track, err := ProcessUpload(ctx, &f, u, bID)
+	if !job.UsingSQS() {
+		track, err := ProcessUpload(ctx, &f, u, bID, check)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if err := json.NewEncoder(w).Encode(&track); err != nil {
-			panic(err)
-		}
-		return
+		return json.NewEncoder(w).Encode(&track)
 	}
 
 	if f.Queued.IsZero() {
-		err = storage.EnqueueFile(storage.FileEvent{
+		_, err := job.Enqueue(ctx, u.ID, jobUpload, uploadJob{
 			FileID: f.ID,
-			UserID: u.ID,
 			Path:   bID,
+			Check:  check,
 		})
 		if err != nil {
-			panic(err)
+			return err
 		}
 		if err := f.SetQueued(ctx, time.Now().UTC()); err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	w.Header().Set("Tube-Upload-Status", f.Status())
 	w.WriteHeader(http.StatusAccepted)
-	if err := json.NewEncoder(w).Encode(f); err != nil {
-		panic(err)
+	return json.NewEncoder(w).Encode(f)
+}
+
+// POST /upload/simple
+// Uploads and processes a small file in one go, for scripts and share sheets:
+// a multipart/form-data POST with the audio as "file", plus optional "lastmod" (in msec) and "sha256".
+// Responds with the new track.
+func uploadSimple(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	limit := min(MaxFileSize, maxSimpleUploadSize)
+	// leave room for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			return httpError{
+				Code: http.StatusRequestEntityTooLarge,
+				Msg:  "file too big for a simple upload. max size is " + humanize.IBytes(uint64(limit)),
+			}
+		}
+		if errors.Is(err, http.ErrMissingFile) {
+			return errBadRequest("missing file")
+		}
+		return errBadRequest("expected multipart/form-data")
+	}
+	defer file.Close()
+	check, err := parseUploadCheck(r)
+	if err != nil {
+		return err
+	}
+
+	size := fh.Size
+	if size == 0 {
+		return errBadRequest("missing file size")
+	}
+	if size > limit {
+		return errTooBig()
+	}
+	if quota := u.CalcQuota(); quota != 0 && u.Usage+size > quota {
+		metrics.QuotaRejected()
+		return errBadRequest("upload quota exceeded")
+	}
+
+	zf := tube.NewFile(u.ID, fh.Filename, size)
+	zf.Type = fh.Header.Get("Content-Type")
+	if msec, err := strconv.ParseInt(r.FormValue("lastmod"), 10, 64); err == nil {
+		zf.LocalMod = msec
+	}
+	if err := zf.Create(ctx); err != nil {
+		return err
+	}
+	metrics.UploadStarted()
+	info := storage.ObjectInfo{
+		Type:        zf.Type,
+		Size:        size,
+		Disposition: encodeContentDisp(fh.Filename),
+	}
+	if err := storage.Traced(ctx, storage.UploadsBucket).PutObject(zf.Path(), info, file); err != nil {
+		return err
 	}
+
+	track, err := ProcessUpload(ctx, &zf, u, zf.ID, check)
+	if err != nil {
+		return err
+	}
+	renderJSON(w, track, http.StatusCreated)
+	return nil
 }
 
 func encodeContentDisp(filename string) string {
@@ -278,17 +583,58 @@ func encodeContentDisp(filename string) string {
 
 func copyUploadToFiles(ctx context.Context, dstPath string, fileID string, f tube.File) error {
 	disp := "attachment; filename*=UTF-8''" + escapeFilename(f.Name)
-	return storage.FilesBucket.CopyFromBucket(dstPath, storage.UploadsBucket, f.Path(), f.Type, disp)
+	return storage.Traced(ctx, storage.FilesBucket).CopyFromBucket(dstPath, storage.UploadsBucket, f.Path(), f.Type, disp)
 }
 
-func presignTrackDL(_ tube.User, track tube.Track) string {
-	href, err := storage.FilesBucket.PresignGet(track.StorageKey(), fileDownloadTTL*2)
+// country picks the nearest replica, if any.
+// If signing fails, it falls back to FileURL like tracks that can't be downloaded directly.
+func presignTrackDL(u tube.User, track tube.Track, country string) string {
+	if !directDL(u, track) {
+		return track.FileURL()
+	}
+	href, err := signDL(track.StorageKey(), FileDownloadTTL*2, country)
 	if err != nil {
-		panic(err)
+		slog.Error("failed to sign download", "track_id", track.ID, "err", err)
+		return track.FileURL()
 	}
 	return href
 }
 
+const signCacheSize = 10000
+
+// signed download links are reused for half their lifetime,
+// so every link handed out is good for at least ttl/2
+var signCache = ccache.New(ccache.Configure().MaxSize(signCacheSize))
+
+// signDL returns a URL to download key from the files bucket,
+// through the CDN if there is one.
+// The same URL is returned for repeated calls until it's halfway to expiring.
+func signDL(key string, ttl time.Duration, country string) (string, error) {
+	cacheKey := fmt.Sprintf("%s/%d/%s", key, ttl, country)
+	if item := signCache.Get(cacheKey); item != nil && !item.Expired() {
+		return item.Value().(string), nil
+	}
+	href, err := presignDL(key, ttl, country)
+	if err != nil {
+		return "", err
+	}
+	signCache.Set(cacheKey, href, ttl/2)
+	return href, nil
+}
+
+// presignDL signs a download URL for key.
+// If the CDN key can't be loaded right now, storage is used instead.
+func presignDL(key string, ttl time.Duration, country string) (string, error) {
+	if cdn.Enabled() {
+		href, err := cdn.Sign(key, ttl)
+		if err == nil {
+			return href, nil
+		}
+		slog.Warn("CDN signing failed, falling back to storage", "err", err)
+	}
+	return storage.PresignGetNear(storage.FilesBucket, key, ttl, country)
+}
+
 func escapeFilename(name string) string {
 	const illegal = `<>@,;:\"/+[]?={} 	`
 	name = strings.Map(func(r rune) rune {
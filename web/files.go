@@ -0,0 +1,113 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/guregu/dynamo"
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+const filesPageSize = 100
+
+func init() {
+	kami.Get("/api/account/files", handle(listFiles))
+}
+
+// GET /api/account/files?sort=date|size|name&filter=unfinished|failed&start=...
+// Lists the user's uploads a page at a time: newest, biggest, or alphabetically first.
+// Pass Next back as start for the next page.
+func listFiles(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	q := r.URL.Query()
+
+	filter := tube.FileFilter(q.Get("filter"))
+	switch filter {
+	case tube.FilesAll, tube.FilesUnfinished, tube.FilesFailed:
+	default:
+		return errBadRequest("invalid filter")
+	}
+	cutoff := time.Now().UTC().Add(-UploadTTL)
+
+	data := struct {
+		Files []tube.File
+		Next  string `json:",omitempty"`
+	}{
+		Files: []tube.File{},
+	}
+	var err error
+	switch q.Get("sort") {
+	case "", "date":
+		var startFrom dynamo.PagingKey
+		if start := q.Get("start"); start != "" {
+			startFrom = dynamo.PagingKey{
+				"UserID": {N: aws.String(strconv.Itoa(u.ID))},
+				"ID":     {S: aws.String(start)},
+			}
+		}
+		var files []tube.File
+		var next dynamo.PagingKey
+		files, next, err = tube.GetFilesPage(ctx, u.ID, filter, cutoff, filesPageSize, startFrom)
+		if files != nil {
+			data.Files = files
+		}
+		if next != nil {
+			data.Next = pagingAttr(next, "ID")
+		}
+	case "size", "name":
+		data.Files, data.Next, err = sortedFilesPage(ctx, u, filter, cutoff, q.Get("sort"), q.Get("start"))
+	default:
+		return errBadRequest("invalid sort")
+	}
+	if err != nil {
+		return err
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+// sortedFilesPage sorts all of a user's files in memory, as the database can only sort by date.
+// start is the offset of the page.
+func sortedFilesPage(ctx context.Context, u tube.User, filter tube.FileFilter, cutoff time.Time, by, start string) ([]tube.File, string, error) {
+	offset := 0
+	if start != "" {
+		var err error
+		offset, err = strconv.Atoi(start)
+		if err != nil || offset < 0 {
+			return nil, "", errBadRequest("invalid start")
+		}
+	}
+
+	all, err := tube.GetFilesByUser(ctx, u.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	files := make([]tube.File, 0, len(all))
+	for _, f := range all {
+		if filter.Match(f, cutoff) {
+			files = append(files, f)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if by == "size" {
+			return files[i].Size > files[j].Size
+		}
+		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
+	})
+
+	if offset >= len(files) {
+		return []tube.File{}, "", nil
+	}
+	files = files[offset:]
+	if len(files) <= filesPageSize {
+		return files, "", nil
+	}
+	return files[:filesPageSize], strconv.Itoa(offset + filesPageSize), nil
+}
@@ -0,0 +1,317 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/guregu/kami"
+	"github.com/stripe/stripe-go/v72"
+	checkoutsession "github.com/stripe/stripe-go/v72/checkout/session"
+	stripeprice "github.com/stripe/stripe-go/v72/price"
+	"github.com/stripe/stripe-go/v72/sub"
+
+	mailer "github.com/guregu/intertube/email"
+	"github.com/guregu/intertube/tube"
+)
+
+func init() {
+	kami.Get("/buy/gift", handle(giftForm))
+	kami.Post("/buy/gift/checkout", handle(giftCheckout))
+	kami.Get("/buy/gift/success", handle(giftCheckoutResult))
+	kami.Post("/buy/gift/redeem", handle(redeemGift))
+}
+
+type giftFormData struct {
+	StripeKey string
+	Plans     []tube.Plan
+	Prices    map[tube.PlanKind]*stripe.Price
+	MaxMonths int
+	Gift      tube.Gift
+	Code      string
+	Redeemed  bool
+	User      tube.User
+	ErrorMsg  string
+}
+
+func newGiftFormData(u tube.User) (giftFormData, error) {
+	plans := tube.GetPlans()
+	prices, err := getStripePrices(plans)
+	if err != nil {
+		return giftFormData{}, err
+	}
+	return giftFormData{
+		StripeKey: stripePublicKey,
+		Plans:     plans,
+		Prices:    prices,
+		MaxMonths: tube.GiftMaxMonths,
+		User:      u,
+	}, nil
+}
+
+func giftForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if !UseStripe {
+		return errForbidden("payment is disabled")
+	}
+	u, _ := userFrom(ctx)
+	data, err := newGiftFormData(u)
+	if err != nil {
+		return err
+	}
+	data.Code = r.URL.Query().Get("code")
+	renderTemplate(ctx, w, "gift", data, http.StatusOK)
+	return nil
+}
+
+// POST /buy/gift/checkout?plan=small&months=3
+// Gifts are a one-time payment of the plan's monthly price times the number of months.
+func giftCheckout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	kind := tube.PlanKind(r.FormValue("plan"))
+	months, err := strconv.Atoi(r.FormValue("months"))
+	if err != nil || months < 1 || months > tube.GiftMaxMonths {
+		return errBadRequest("invalid months")
+	}
+	var plan tube.Plan
+	for _, p := range tube.GetPlans() {
+		if p.Kind == kind && !p.Metered {
+			plan = p
+		}
+	}
+	if plan.PriceID == "" {
+		return errBadRequest("invalid plan")
+	}
+	price, err := stripeprice.Get(plan.PriceID, nil)
+	if err != nil {
+		return err
+	}
+
+	var email, customerID *string
+	if u.CustomerID != "" {
+		customerID = stripe.String(u.CustomerID)
+	} else {
+		email = stripe.String(u.Email)
+	}
+	params := &stripe.CheckoutSessionParams{
+		SuccessURL:         stripe.String(fmt.Sprintf("https://%s/buy/gift/success?session_id={CHECKOUT_SESSION_ID}", Domain)),
+		CancelURL:          stripe.String(fmt.Sprintf("https://%s/buy/gift?cancel", Domain)),
+		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
+		PaymentMethodTypes: []*string{stripe.String("card")},
+
+		ClientReferenceID: stripe.String(strconv.Itoa(u.ID)),
+		CustomerEmail:     email,
+		Customer:          customerID,
+
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+					Currency:   stripe.String(string(price.Currency)),
+					UnitAmount: stripe.Int64(price.UnitAmount * int64(months)),
+					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+						Name: stripe.String(fmt.Sprintf("%s gift: %s × %d month(s)", Domain, plan.Kind, months)),
+					},
+				},
+				Quantity: stripe.Int64(1),
+			},
+		},
+	}
+	params.AddMetadata("gift_plan", string(plan.Kind))
+	params.AddMetadata("gift_months", strconv.Itoa(months))
+	resp, err := checkoutsession.New(params)
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		SessionID string
+	}{
+		SessionID: resp.ID,
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+func giftCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	sesh, err := checkoutsession.Get(r.URL.Query().Get("session_id"), nil)
+	if err != nil {
+		return err
+	}
+	if sesh.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		data := struct {
+			Status string
+		}{
+			Status: string(sesh.PaymentStatus),
+		}
+		renderTemplate(ctx, w, "checkout-unpaid", data, http.StatusOK)
+		return nil
+	}
+
+	gift, err := fulfillGift(ctx, sesh)
+	if err != nil {
+		return err
+	}
+	if gift.Buyer != u.ID {
+		http.NotFound(w, r)
+		return nil
+	}
+	data, err := newGiftFormData(u)
+	if err != nil {
+		return err
+	}
+	data.Gift = gift
+	renderTemplate(ctx, w, "gift", data, http.StatusOK)
+	return nil
+}
+
+// fulfillGift creates the gift for a paid checkout session.
+// Called from both the success page and the webhook, so it must be idempotent.
+func fulfillGift(ctx context.Context, sesh *stripe.CheckoutSession) (tube.Gift, error) {
+	if gift, err := tube.GetGiftBySession(ctx, sesh.ID); err == nil {
+		return gift, nil
+	} else if err != tube.ErrNotFound {
+		return gift, err
+	}
+
+	buyer, err := strconv.Atoi(sesh.ClientReferenceID)
+	if err != nil {
+		return tube.Gift{}, fmt.Errorf("gift: bad client reference ID: %q", sesh.ClientReferenceID)
+	}
+	months, err := strconv.Atoi(sesh.Metadata["gift_months"])
+	if err != nil {
+		return tube.Gift{}, fmt.Errorf("gift: bad months: %q", sesh.Metadata["gift_months"])
+	}
+	gift, err := tube.NewGift(buyer, tube.PlanKind(sesh.Metadata["gift_plan"]), months, sesh.ID)
+	if err != nil {
+		return gift, err
+	}
+	if err := gift.Create(ctx); err != nil {
+		return gift, err
+	}
+	slog.InfoContext(ctx, "gift: created", "code", gift.Code, "buyer", buyer, "plan", gift.Plan, "months", gift.Months)
+	audit(ctx, nil, buyer, tube.EventGiftPurchased, fmt.Sprintf("%s × %d", gift.Plan, gift.Months))
+
+	if u, err := tube.GetUser(ctx, buyer); err == nil && mailer.IsEnabled() {
+		body := fmt.Sprintf(`Thank you for purchasing a gift subscription to %s!<br><br>
+Gift code: <b>%s</b> (%s plan, %d month(s))<br><br>
+The recipient can redeem it at: https://%s/buy/gift?code=%s`, Domain, gift.Code, gift.Plan, gift.Months, Domain, gift.Code)
+		if err := mailer.Send(Domain+" Gifts", u.Email, "Your "+Domain+" gift code", body); err != nil {
+			slog.ErrorContext(ctx, "gift: failed to send e-mail", "code", gift.Code, "err", err)
+		}
+	}
+	return gift, nil
+}
+
+// POST /buy/gift/redeem
+func redeemGift(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	data, err := newGiftFormData(u)
+	if err != nil {
+		return err
+	}
+	data.Code = r.FormValue("code")
+	renderError := func(err error) {
+		data.ErrorMsg = err.Error()
+		renderTemplate(ctx, w, "gift", data, http.StatusOK)
+	}
+
+	gift, err := tube.GetGift(ctx, data.Code)
+	if err == tube.ErrNotFound {
+		renderError(fmt.Errorf("invalid gift code"))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := gift.Redeem(ctx, u.ID); dynamo.IsCondCheckFailed(err) {
+		renderError(fmt.Errorf("this gift has already been redeemed"))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := applyGift(ctx, u, gift); err != nil {
+		slog.ErrorContext(ctx, "gift: failed to apply", "code", gift.Code, "user_id", u.ID, "err", err)
+		if err := gift.Unredeem(ctx); err != nil {
+			slog.ErrorContext(ctx, "gift: failed to unredeem", "code", gift.Code, "err", err)
+		}
+		renderError(err)
+		return nil
+	}
+	audit(ctx, r, u.ID, tube.EventGiftRedeemed, fmt.Sprintf("%s × %d", gift.Plan, gift.Months))
+
+	data.Redeemed = true
+	data.Gift = gift
+	renderTemplate(ctx, w, "gift", data, http.StatusOK)
+	return nil
+}
+
+// applyGift extends the user's current subscription by the gifted months,
+// or starts a new subscription to the gifted plan that is free for that long.
+// Gifts for a different plan than the current subscription's are turned down.
+// Both are implemented as a Stripe trial, so no charges happen until it ends.
+func applyGift(ctx context.Context, u tube.User, gift tube.Gift) error {
+	cust, err := getCustomer(u.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	var subs []*stripe.Subscription
+	if cust.Subscriptions != nil {
+		subs = cust.Subscriptions.Data
+	}
+	current, err := giftTarget(subs, tube.GetPlan(gift.Plan))
+	if err != nil {
+		return err
+	}
+
+	var updated *stripe.Subscription
+	if current != nil {
+		end := current.CurrentPeriodEnd
+		if current.TrialEnd > end {
+			end = current.TrialEnd
+		}
+		until := time.Unix(end, 0).AddDate(0, gift.Months, 0)
+		updated, err = sub.Update(current.ID, &stripe.SubscriptionParams{
+			TrialEnd:          stripe.Int64(until.Unix()),
+			ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorNone)),
+		})
+	} else {
+		until := time.Now().AddDate(0, gift.Months, 0)
+		updated, err = sub.New(&stripe.SubscriptionParams{
+			Customer: stripe.String(cust.ID),
+			Items: []*stripe.SubscriptionItemsParams{
+				{Price: stripe.String(tube.GetPlan(gift.Plan).PriceID)},
+			},
+			TrialEnd: stripe.Int64(until.Unix()),
+			// no payment method on file, so don't try to charge when the gift runs out
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	_, err = reconcileSub(ctx, updated)
+	return err
+}
+
+// giftTarget returns the active subscription a gift for plan would extend, or nil if there isn't one.
+// It fails if that subscription is for another plan, because extending it would give away
+// free months of a plan nobody paid for.
+func giftTarget(subs []*stripe.Subscription, plan tube.Plan) (*stripe.Subscription, error) {
+	for _, s := range subs {
+		if !tube.PlanStatus(s.Status).Active() {
+			continue
+		}
+		if s.Items == nil || len(s.Items.Data) == 0 || s.Items.Data[0].Price == nil ||
+			s.Items.Data[0].Price.ID != plan.PriceID {
+			return nil, fmt.Errorf("this gift is for the %s plan, which isn't your current plan", plan.Kind)
+		}
+		return s, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestGiftTarget(t *testing.T) {
+	small, huge := tube.GetPlan(tube.PlanKindSmall), tube.GetPlan(tube.PlanKindHuge)
+	subscribed := func(id string, status stripe.SubscriptionStatus, plan tube.Plan) *stripe.Subscription {
+		return &stripe.Subscription{
+			ID:     id,
+			Status: status,
+			Items: &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{
+				{Price: &stripe.Price{ID: plan.PriceID}},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		subs []*stripe.Subscription
+		want string // subscription ID, or "" for a new one
+		err  bool
+	}{
+		{name: "not subscribed"},
+		{
+			name: "same plan",
+			subs: []*stripe.Subscription{subscribed("sub_small", stripe.SubscriptionStatusActive, small)},
+			want: "sub_small",
+		},
+		{
+			name: "trialing the same plan",
+			subs: []*stripe.Subscription{subscribed("sub_small", stripe.SubscriptionStatusTrialing, small)},
+			want: "sub_small",
+		},
+		{
+			name: "bigger plan",
+			subs: []*stripe.Subscription{subscribed("sub_huge", stripe.SubscriptionStatusActive, huge)},
+			err:  true,
+		},
+		{
+			name: "canceled bigger plan",
+			subs: []*stripe.Subscription{subscribed("sub_huge", stripe.SubscriptionStatusCanceled, huge)},
+		},
+	}
+	for _, test := range tests {
+		got, err := giftTarget(test.subs, small)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error = %v, want error: %v", test.name, err, test.err)
+			continue
+		}
+		var id string
+		if got != nil {
+			id = got.ID
+		}
+		if id != test.want {
+			t.Errorf("%s: extends %q, want %q", test.name, id, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/cdn"
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
+)
+
+const (
+	// how long /readyz waits on the database and buckets
+	readyTimeout = 5 * time.Second
+	// object key used to test signing; it doesn't need to exist
+	pingKey = "ping"
+)
+
+func init() {
+	kami.Get("/healthz", healthz)
+	kami.Get("/readyz", readyz)
+}
+
+type healthCheck func(ctx context.Context) error
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// GET /healthz
+// Liveness: only checks what this server can check on its own,
+// so an outage elsewhere doesn't get it restarted.
+func healthz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	runHealthChecks(ctx, w, map[string]healthCheck{
+		"signing": checkSigning,
+	})
+}
+
+// GET /readyz
+// Readiness: also checks the database and buckets.
+func readyz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	checks := map[string]healthCheck{
+		"signing": checkSigning,
+		"db":      tube.Ping,
+		"files":   pingBucket(storage.FilesBucket),
+		"uploads": pingBucket(storage.UploadsBucket),
+	}
+	if storage.CacheBucket != nil {
+		checks["cache"] = pingBucket(storage.CacheBucket)
+	}
+	runHealthChecks(ctx, w, checks)
+}
+
+// runHealthChecks runs checks concurrently and responds with 503 if any failed.
+// Errors are logged rather than shown, since anyone can see the report.
+func runHealthChecks(ctx context.Context, w http.ResponseWriter, checks map[string]healthCheck) {
+	report := healthReport{
+		Status: "ok",
+		Checks: make(map[string]string, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		name, check := name, check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			if err := check(ctx); err != nil {
+				slog.ErrorContext(ctx, "health check failed", "check", name, "err", err)
+				result = "fail"
+			}
+			mu.Lock()
+			report.Checks[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, result := range report.Checks {
+		if result != "ok" {
+			report.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	renderJSON(w, report, code)
+}
+
+// checkSigning makes sure download links can be signed.
+func checkSigning(ctx context.Context) error {
+	if cdn.Enabled() {
+		if _, err := cdn.Sign(pingKey, time.Minute); err != nil {
+			return err
+		}
+	}
+	_, err := storage.FilesBucket.PresignGet(pingKey, time.Minute)
+	return err
+}
+
+func pingBucket(b storage.Bucket) healthCheck {
+	return func(ctx context.Context) error {
+		return storage.Ping(ctx, b)
+	}
+}
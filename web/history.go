@@ -0,0 +1,110 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/guregu/dynamo"
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+const (
+	historyPageSize  = 100
+	maxUserAgentLen  = 256
+	maxClientNameLen = 64
+)
+
+func init() {
+	kami.Get("/api/account/history", handle(accessHistory))
+}
+
+// startsDownload reports whether r asks for a file from the beginning,
+// as opposed to players coming back for the rest of it with range requests.
+func startsDownload(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// recordAccess adds a stream or download of t to u's access history.
+// Players ask for the rest of a track with range requests, which aren't counted again.
+// Failure to record is logged but does not interrupt the request.
+func recordAccess(ctx context.Context, r *http.Request, u tube.User, t tube.Track) {
+	if !startsDownload(r) {
+		return
+	}
+	if _, ok := impersonatorFrom(ctx); ok {
+		return
+	}
+	a := tube.TrackAccess{
+		UserID:    u.ID,
+		TrackID:   t.ID,
+		Title:     t.Info.Title,
+		Artist:    cmp.Or(t.Info.Artist, t.Info.AlbumArtist),
+		Kind:      tube.TrackStreamed,
+		IP:        clientIP(r).String(),
+		Client:    "web",
+		UserAgent: truncate(r.UserAgent(), maxUserAgentLen),
+	}
+	if isSubsonicReq(r) {
+		a.Client = truncate(r.FormValue("c"), maxClientNameLen)
+		if strings.TrimSuffix(path.Base(r.URL.Path), ".view") == "download" {
+			a.Kind = tube.TrackDownloaded
+		}
+	}
+	if dt, ok := deviceFrom(ctx); ok {
+		a.DeviceID = dt.ID
+		a.DeviceName = dt.Name
+	}
+	if err := tube.RecordTrackAccess(ctx, a); err != nil {
+		slog.ErrorContext(ctx, "history: failed to record access", "track", t.ID, "err", err)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// GET /api/account/history?start=...
+// Lists the tracks that were streamed or downloaded, newest first, with where from.
+func accessHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+
+	var startFrom dynamo.PagingKey
+	if start := r.URL.Query().Get("start"); start != "" {
+		startFrom = dynamo.PagingKey{
+			"UserID": {N: aws.String(strconv.Itoa(u.ID))},
+			"Time":   {S: aws.String(start)},
+		}
+	}
+
+	history, next, err := tube.GetTrackAccesses(ctx, u.ID, historyPageSize, startFrom)
+	if err != nil {
+		return err
+	}
+	if history == nil {
+		history = []tube.TrackAccess{}
+	}
+
+	data := struct {
+		History []tube.TrackAccess
+		Next    string `json:",omitempty"`
+	}{
+		History: history,
+	}
+	if next != nil {
+		data.Next = pagingAttr(next, "Time")
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
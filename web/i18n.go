@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"path/filepath"
 	"strconv"
 
@@ -12,18 +13,78 @@ import (
 
 var translations *i18n.Bundle
 var defaultLocalizer *i18n.Localizer
+var languages language.Matcher
 
-func loadTranslations() {
+// loadTranslations loads every assets/text/<lang>.toml.
+// English is the default, and fills in anything missing from the others.
+func loadTranslations() error {
 	here, err := osext.ExecutableFolder()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	translations = i18n.NewBundle(language.English)
-	translations.RegisterUnmarshalFunc("toml", toml.Unmarshal)
-	// TODO: walk text directory
-	translations.MustLoadMessageFile(filepath.Join(here, "assets", "text", "en.toml"))
-	// translations.MustLoadMessageFile(filepath.Join(here, "assets", "text", "ja.toml"))
-	defaultLocalizer = i18n.NewLocalizer(translations, language.Japanese.String())
+	bundle := i18n.NewBundle(language.English)
+	bundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
+	files, err := filepath.Glob(filepath.Join(here, "assets", "text", "*.toml"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := bundle.LoadMessageFile(file); err != nil {
+			return err
+		}
+	}
+	translations = bundle
+	languages = language.NewMatcher(translations.LanguageTags())
+	defaultLocalizer = i18n.NewLocalizer(translations, language.English.String())
+	return nil
+}
+
+// negotiateLanguage picks the best language we have for langs,
+// which are Accept-Language headers or language tags, most preferred first.
+func negotiateLanguage(langs ...string) string {
+	var want []language.Tag
+	for _, lang := range langs {
+		tags, _, err := language.ParseAcceptLanguage(lang)
+		if err != nil {
+			continue
+		}
+		want = append(want, tags...)
+	}
+	tag, _, _ := languages.Match(want...)
+	base, _ := tag.Base()
+	return base.String()
+}
+
+// errorMessages are the error messages that have translations, by message ID.
+// Anything else is sent as-is.
+var errorMessages = map[string]string{
+	"not found":                      "error_not_found",
+	"timed out":                      "error_timed_out",
+	"internal server error":          "error_internal",
+	"invalid JSON":                   "error_invalid_json",
+	"forbidden":                      "error_forbidden",
+	"not logged in":                  "error_not_logged_in",
+	"no user with that email":        "error_no_user",
+	"bad password":                   "error_bad_password",
+	"upload quota exceeded":          "error_quota",
+	"file would exceed upload quota": "error_quota_file",
+	"invalid or expired link":        "error_expired_link",
+	"file not found in storage":      "error_file_missing",
+	"upload doesn't match sha256, try uploading it again": "error_upload_mismatch",
+	"down for maintenance":                                "error_maintenance",
+	"monthly download limit reached":                      "error_egress",
+}
+
+func translateError(ctx context.Context, msg string) string {
+	id, ok := errorMessages[msg]
+	if !ok {
+		return msg
+	}
+	str, err := localizerFrom(ctx).Localize(&i18n.LocalizeConfig{MessageID: id})
+	if err != nil {
+		return msg
+	}
+	return str
 }
 
 func translateFunc(localizer *i18n.Localizer) interface{} {
@@ -50,6 +111,11 @@ func translateFunc(localizer *i18n.Localizer) interface{} {
 	}
 }
 
+// translate is tr for use outside of templates.
+func translate(ctx context.Context, id string, args ...interface{}) string {
+	return translateFunc(localizerFrom(ctx)).(func(string, ...interface{}) string)(id, args...)
+}
+
 func translateCountFunc(localizer *i18n.Localizer) interface{} {
 	return func(id string, ct int, args ...interface{}) string {
 		data := make(map[string]interface{}, len(args)+1)
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func init() {
+	kami.Post("/admin/api/users/:id/impersonate", handle(adminImpersonate))
+	kami.Post("/impersonate/stop", handle(stopImpersonating))
+}
+
+// POST /admin/api/users/:id/impersonate
+// Swaps the admin's session cookie for a short-lived session as the target user.
+// The admin's own session is stashed in a separate cookie so it can be restored.
+func adminImpersonate(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	if _, ok := impersonatorFrom(ctx); ok {
+		return errConflict("already impersonating")
+	}
+
+	id, err := strconv.Atoi(kami.Param(ctx, "id"))
+	if err != nil {
+		return errBadRequest("invalid user ID")
+	}
+	target, err := tube.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if target.ID == admin.ID || target.GetRole().AtLeast(tube.RoleSupport) {
+		return errForbidden("can't impersonate staff")
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return errBadRequest("missing session")
+	}
+	own, err := tube.GetSession(ctx, cookie.Value)
+	if err != nil {
+		return err
+	}
+
+	sesh, err := tube.CreateImpersonationSession(ctx, admin.ID, target.ID, clientIP(r).String())
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "impersonation: started", "target", target.ID, "expires", sesh.Expires)
+	audit(ctx, r, admin.ID, tube.EventImpersonationStart, "user "+strconv.Itoa(target.ID))
+	audit(withImpersonator(ctx, admin.ID), r, target.ID, tube.EventImpersonationStart, "")
+
+	http.SetCookie(w, namedAuthCookie(adminSessionCookie, own))
+	http.SetCookie(w, validAuthCookie(sesh))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// POST /impersonate/stop
+func stopImpersonating(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	adminID, ok := impersonatorFrom(ctx)
+	if !ok {
+		return errBadRequest("not impersonating")
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := tube.DeleteSession(ctx, cookie.Value); err != nil {
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "impersonation: stopped", "admin", adminID)
+	audit(ctx, r, u.ID, tube.EventImpersonationStop, "")
+	audit(withImpersonator(ctx, 0), r, adminID, tube.EventImpersonationStop, "user "+strconv.Itoa(u.ID))
+
+	http.SetCookie(w, namedAuthCookie(adminSessionCookie, tube.Session{Expires: time.Now().Add(-10000 * time.Hour)}))
+
+	stashed, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+	own, err := tube.GetSession(ctx, stashed.Value)
+	if err != nil || own.UserID != adminID {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+	http.SetCookie(w, validAuthCookie(own))
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	return nil
+}
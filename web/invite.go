@@ -0,0 +1,116 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func init() {
+	kami.Get("/admin/api/invites", handle(adminListInvites))
+	kami.Post("/admin/api/invites", handle(adminCreateInvite))
+	kami.Post("/admin/api/invites/:code", handle(adminUpdateInvite))
+	kami.Delete("/admin/api/invites/:code", handle(adminExpireInvite))
+}
+
+// GET /admin/api/invites
+func adminListInvites(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	invs, err := tube.GetAllInvites(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(invs, func(i, j int) bool {
+		return invs[i].Created.After(invs[j].Created)
+	})
+	renderJSON(w, invs, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/invites?max=10&expires=2006-01-02&note=beta&count=1
+func adminCreateInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	maxUses, expires, err := parseInviteLimits(r)
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	count := 1
+	if v := r.FormValue("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count < 1 || count > 100 {
+			return errBadRequest("invalid count")
+		}
+	}
+
+	invs := make([]tube.Invite, 0, count)
+	for i := 0; i < count; i++ {
+		inv, err := tube.NewInvite(admin.ID, maxUses, expires, r.FormValue("note"))
+		if err != nil {
+			return err
+		}
+		if err := inv.Create(ctx); err != nil {
+			return err
+		}
+		audit(ctx, r, admin.ID, tube.EventAdminAction, "create invite "+inv.Code)
+		invs = append(invs, inv)
+	}
+	renderJSON(w, invs, http.StatusCreated)
+	return nil
+}
+
+// POST /admin/api/invites/:code?max=10&expires=2006-01-02
+func adminUpdateInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	inv, err := tube.GetInvite(ctx, kami.Param(ctx, "code"))
+	if err != nil {
+		return err
+	}
+	maxUses, expires, err := parseInviteLimits(r)
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	if err := inv.SetLimits(ctx, maxUses, expires); err != nil {
+		return err
+	}
+	audit(ctx, r, admin.ID, tube.EventAdminAction, fmt.Sprintf("update invite %s max=%d expires=%v", inv.Code, maxUses, expires))
+	renderJSON(w, inv, http.StatusOK)
+	return nil
+}
+
+// DELETE /admin/api/invites/:code
+// Invites are expired rather than deleted so that signups can still be traced back to them.
+func adminExpireInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	inv, err := tube.GetInvite(ctx, kami.Param(ctx, "code"))
+	if err != nil {
+		return err
+	}
+	if err := inv.SetLimits(ctx, inv.MaxUses, time.Now().UTC()); err != nil {
+		return err
+	}
+	audit(ctx, r, admin.ID, tube.EventAdminAction, "expire invite "+inv.Code)
+	renderJSON(w, inv, http.StatusOK)
+	return nil
+}
+
+func parseInviteLimits(r *http.Request) (maxUses int, expires time.Time, err error) {
+	if v := r.FormValue("max"); v != "" {
+		maxUses, err = strconv.Atoi(v)
+		if err != nil || maxUses < 0 {
+			return 0, time.Time{}, fmt.Errorf("invalid max: %q", v)
+		}
+	}
+	if v := r.FormValue("expires"); v != "" {
+		expires, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid expires: %q", v)
+		}
+	}
+	return maxUses, expires, nil
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/job"
+	"github.com/guregu/intertube/tube"
+)
+
+const (
+	jobUpload        = "upload"
+	jobTakeout       = "takeout"
+	jobBackup        = "backup"
+	jobCancelBilling = "cancel-billing"
+
+	jobListLimit = 100
+)
+
+func init() {
+	job.Handle(jobUpload, runUploadJob)
+	job.Handle(jobTakeout, runTakeoutJob)
+	job.Handle(jobBackup, runBackupJob)
+	job.Handle(jobCancelBilling, runCancelBillingJob)
+
+	kami.Get("/api/jobs", handle(listJobs))
+	kami.Get("/api/jobs/:id", handle(getJob))
+
+	kami.Get("/admin/api/jobs", handle(adminListJobs))
+	kami.Post("/admin/api/jobs/:user/:id/retry", handle(adminRetryJob))
+}
+
+type uploadJob struct {
+	FileID string
+	Path   string
+	Check  uploadCheck
+}
+
+func runUploadJob(ctx context.Context, j *tube.Job) error {
+	var payload uploadJob
+	if err := j.Decode(&payload); err != nil {
+		return err
+	}
+	u, err := tube.GetUser(ctx, j.UserID)
+	if err != nil {
+		return err
+	}
+	f, err := tube.GetFile(ctx, payload.FileID)
+	if err != nil {
+		return err
+	}
+	if f.Ready {
+		return nil
+	}
+	if _, err := ProcessUpload(ctx, &f, u, payload.Path, payload.Check); err != nil {
+		if j.Attempts >= job.MaxAttempts {
+			postNotification(ctx, u.ID, jobUpload, "/upload", "notification_upload_failed", f.Name)
+		}
+		return err
+	}
+	notifyImport(ctx, u, j)
+	return nil
+}
+
+type takeoutJob struct {
+	ExportID string
+}
+
+func runTakeoutJob(ctx context.Context, j *tube.Job) error {
+	var payload takeoutJob
+	if err := j.Decode(&payload); err != nil {
+		return err
+	}
+	u, err := tube.GetUser(ctx, j.UserID)
+	if err != nil {
+		return err
+	}
+	ex, err := tube.GetExport(ctx, u.ID, payload.ExportID)
+	if err != nil {
+		return err
+	}
+	link := "/api/account/export/" + ex.ID
+	run := runTakeout
+	switch {
+	case ex.Kind == tube.ExportArchive:
+		run = runArchive
+	case ex.Kind.IsDownload():
+		run = runDownload
+	}
+	if err := run(ctx, u, &ex); err != nil {
+		if j.Attempts >= job.MaxAttempts {
+			if err := ex.Fail(ctx, err); err != nil {
+				return fmt.Errorf("export: failed to save failure: %w", err)
+			}
+			if ex.Kind.IsDownload() {
+				postNotification(ctx, u.ID, jobTakeout, link, "notification_download_failed", ex.Name)
+			} else {
+				postNotification(ctx, u.ID, jobTakeout, link, "notification_export_failed")
+			}
+		}
+		return err
+	}
+	if ex.Kind.IsDownload() {
+		// straight to the file; the link keeps working until the download expires
+		postNotification(ctx, u.ID, jobTakeout, link+"/1", "notification_download", ex.Name)
+		return nil
+	}
+	postNotification(ctx, u.ID, jobTakeout, link, "notification_export")
+	return nil
+}
+
+// GET /api/jobs
+func listJobs(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	jobs, err := tube.GetJobs(ctx, u.ID, jobListLimit)
+	if err != nil {
+		return err
+	}
+	if jobs == nil {
+		jobs = []tube.Job{}
+	}
+	renderJSON(w, jobs, http.StatusOK)
+	return nil
+}
+
+// GET /api/jobs/:id
+func getJob(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	j, err := tube.GetJob(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	renderJSON(w, j, http.StatusOK)
+	return nil
+}
+
+// GET /admin/api/jobs?status=failed
+// GET /admin/api/jobs?user=123
+func adminListJobs(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var jobs []tube.Job
+	var err error
+	if user := r.FormValue("user"); user != "" {
+		id, convErr := strconv.Atoi(user)
+		if convErr != nil {
+			return errBadRequest("invalid user ID")
+		}
+		jobs, err = tube.GetJobs(ctx, id, jobListLimit)
+	} else {
+		status := tube.JobStatus(r.FormValue("status"))
+		if status == "" {
+			status = tube.JobFailed
+		}
+		jobs, err = tube.GetJobsByStatus(ctx, status)
+	}
+	if err != nil {
+		return err
+	}
+	if jobs == nil {
+		jobs = []tube.Job{}
+	}
+	renderJSON(w, jobs, http.StatusOK)
+	return nil
+}
+
+// POST /admin/api/jobs/:user/:id/retry
+// Runs a failed job again.
+func adminRetryJob(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	admin, _ := userFrom(ctx)
+	userID, err := strconv.Atoi(kami.Param(ctx, "user"))
+	if err != nil {
+		return errBadRequest("invalid user ID")
+	}
+	j, err := tube.GetJob(ctx, userID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	if j.Status != tube.JobFailed {
+		return errConflict("job hasn't failed")
+	}
+	if err := job.Retry(ctx, &j); err != nil {
+		return err
+	}
+	audit(ctx, r, admin.ID, tube.EventAdminAction, fmt.Sprintf("retried job %d/%s (%s)", j.UserID, j.ID, j.Kind))
+	renderJSON(w, j, http.StatusAccepted)
+	return nil
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/guregu/intertube/ldap"
+	"github.com/guregu/intertube/tube"
+)
+
+var (
+	errBadPassword       = errors.New("bad password")
+	errDirectoryPassword = errors.New("this account's password is managed by your organization's directory")
+)
+
+// checkLogin verifies an e-mail and password, against the directory if LDAP is enabled.
+// Accounts that aren't linked to the directory keep using their local password.
+func checkLogin(ctx context.Context, r *http.Request, login, password string) (tube.User, error) {
+	if ldap.Enabled() {
+		user, err := ldapLogin(ctx, r, login, password)
+		switch {
+		case err == nil, errors.Is(err, ldap.ErrNoGroup):
+			return user, err
+		case !errors.Is(err, ldap.ErrInvalidCredentials):
+			slog.WarnContext(ctx, "ldap: login failed", "login", login, "err", err)
+		}
+	}
+
+	user, err := tube.GetUserByEmail(ctx, login)
+	if err != nil {
+		return user, err
+	}
+	if user.DirectoryDN != "" || !user.ValidPassword(password) {
+		return user, errBadPassword
+	}
+	return user, nil
+}
+
+// ldapLogin authenticates against the directory, creating the account on first login
+// and syncing the quota from the user's groups.
+func ldapLogin(ctx context.Context, r *http.Request, login, password string) (tube.User, error) {
+	id, err := ldap.Authenticate(login, password)
+	if err != nil {
+		return tube.User{}, err
+	}
+
+	user, err := tube.GetUserByEmail(ctx, id.Email)
+	if err == tube.ErrNotFound {
+		user = tube.User{Email: id.Email}
+		if err := user.Create(ctx); err != nil {
+			return user, err
+		}
+		slog.InfoContext(ctx, "ldap: created user", "user_id", user.ID, "dn", id.DN)
+		audit(ctx, r, user.ID, tube.EventRegister, "ldap")
+	} else if err != nil {
+		return user, err
+	}
+
+	if user.DirectoryDN != id.DN || user.DirectoryQuota != id.Quota {
+		if err := user.SetDirectory(ctx, id.DN, id.Quota); err != nil {
+			return user, err
+		}
+	}
+	return user, nil
+}
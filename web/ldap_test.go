@@ -0,0 +1,65 @@
+package web
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/intertube/ldap"
+	"github.com/guregu/intertube/tube"
+)
+
+func TestCheckLoginFallback(t *testing.T) {
+	ctx, local := testDB(t)
+	pw, err := tube.HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.SetPassword(ctx, pw); err != nil {
+		t.Fatal(err)
+	}
+	linked := tube.User{Email: "linked@example.com"}
+	if err := linked.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := linked.SetPassword(ctx, pw); err != nil {
+		t.Fatal(err)
+	}
+	if err := linked.SetDirectory(ctx, "uid=linked,dc=example,dc=com", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory that's down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	ldap.Init(ldap.Config{URL: "ldap://" + addr, BaseDN: "dc=example,dc=com"})
+	t.Cleanup(func() { ldap.Init(ldap.Config{}) })
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	tests := []struct {
+		login, password string
+		err             error
+	}{
+		// accounts that aren't in the directory keep their local password
+		{local.Email, "hunter2", nil},
+		{local.Email, "hunter3", errBadPassword},
+		// but directory accounts can't fall back to theirs
+		{linked.Email, "hunter2", errBadPassword},
+		{"nobody@example.com", "hunter2", tube.ErrNotFound},
+	}
+	for _, test := range tests {
+		u, err := checkLogin(ctx, r, test.login, test.password)
+		if !errors.Is(err, test.err) {
+			t.Errorf("checkLogin(%s, %s): err = %v, want %v", test.login, test.password, err, test.err)
+			continue
+		}
+		if err == nil && u.Email != test.login {
+			t.Errorf("checkLogin(%s): logged in as %s", test.login, u.Email)
+		}
+	}
+}
@@ -490,10 +490,32 @@ func getLibrary(ctx context.Context, u tube.User) (*Library, error) {
 	return lib, nil
 }
 
-func resetCache(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// getGenreLibrary is getLibrary with only the tracks in genre, found with the genre index.
+func getGenreLibrary(ctx context.Context, u tube.User, genre string) (*Library, error) {
+	wg, ctx := errgroup.WithContext(ctx)
+	var tracks []tube.Track
+	var stars map[tube.SSID]tube.Star
+	wg.Go(func() error {
+		var err error
+		tracks, err = tube.GetTracksByGenre(ctx, u.ID, genre)
+		return err
+	})
+	wg.Go(func() error {
+		var err error
+		stars, err = tube.GetStars(ctx, u.ID)
+		return err
+	})
+	if err := wg.Wait(); err != nil {
+		return nil, err
+	}
+	return NewLibrary(tracks, stars), nil
+}
+
+func resetCache(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	if err := tube.RecreateDump(ctx, u.ID, time.Now().UTC()); err != nil {
-		panic(err)
+		return err
 	}
 	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	return nil
 }
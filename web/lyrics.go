@@ -0,0 +1,163 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/lyrics"
+	"github.com/guregu/intertube/tube"
+)
+
+// Lyrics come from the track's tags when it's uploaded.
+// Failing that, they're fetched from the configured providers the first time they're asked for,
+// and kept, so each track is only looked up once (or once a month, if nothing was found).
+// Users can correct them, and their version is never overwritten.
+
+// maxLyricsLen is the longest lyrics users can save, in bytes.
+const maxLyricsLen = 64 << 10
+
+func init() {
+	kami.Use("/api/lyrics/", forbidGuests)
+	kami.Get("/api/lyrics/:id", handle(getLyrics))
+	kami.Put("/api/lyrics/:id", handle(putLyrics))
+	kami.Delete("/api/lyrics/:id", handle(deleteLyrics))
+}
+
+// trackLyrics returns t's lyrics, fetching them if there aren't any yet.
+// If none can be found, it returns lyrics that aren't Found.
+func trackLyrics(ctx context.Context, t tube.Track) (tube.Lyrics, error) {
+	stored, err := tube.GetLyrics(ctx, t.UserID, t.ID)
+	switch {
+	case err == nil && !stored.Stale(time.Now()):
+		return stored, nil
+	case err != nil && !errors.Is(err, tube.ErrNotFound):
+		return stored, err
+	case !lyrics.Enabled():
+		return stored, nil
+	}
+
+	found, err := lyrics.Find(ctx, lyrics.Query{
+		Title:    t.Info.Title,
+		Artist:   cmp.Or(t.Info.Artist, t.Info.AlbumArtist),
+		Album:    t.Info.Album,
+		Duration: t.Duration,
+	})
+	if err != nil && !errors.Is(err, lyrics.ErrNotFound) {
+		// providers are down or something, so try again next time
+		slog.WarnContext(ctx, "lyrics: lookup failed", "track", t.ID, "err", err)
+		return stored, nil
+	}
+	fetched := tube.Lyrics{
+		UserID:       t.UserID,
+		TrackID:      t.ID,
+		Text:         found.Text,
+		Synced:       found.Synced,
+		Instrumental: found.Instrumental,
+		Source:       found.Provider,
+	}
+	saved, err := fetched.SaveUnedited(ctx)
+	if err != nil {
+		return fetched, err
+	}
+	if !saved {
+		// edited by the user while we were looking
+		return tube.GetLyrics(ctx, t.UserID, t.ID)
+	}
+	return fetched, nil
+}
+
+// lyricsView is the API view of tube.Lyrics.
+type lyricsView struct {
+	Text         string
+	Synced       bool
+	Instrumental bool
+	Source       string
+	Updated      time.Time
+}
+
+func newLyricsView(l tube.Lyrics) lyricsView {
+	return lyricsView{
+		Text:         l.Text,
+		Synced:       l.Synced,
+		Instrumental: l.Instrumental,
+		Source:       l.Source,
+		Updated:      l.Updated,
+	}
+}
+
+// GET /api/lyrics/:id
+func getLyrics(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	t, err := tube.GetTrack(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	l, err := trackLyrics(ctx, t)
+	if err != nil {
+		return err
+	}
+	if !l.Found() {
+		return errNotFound("no lyrics for this track")
+	}
+	renderJSON(w, newLyricsView(l), http.StatusOK)
+	return nil
+}
+
+// PUT /api/lyrics/:id
+// Replaces a track's lyrics with the user's own: {"Text": "..."}.
+// Lines starting with [mm:ss.xx] timestamps are treated as synced (LRC) lyrics.
+// Saving empty text means the track has no lyrics, so they won't be fetched.
+func putLyrics(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	t, err := tube.GetTrack(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	var input struct {
+		Text string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	l, err := saveUserLyrics(ctx, t, input.Text)
+	if err != nil {
+		return err
+	}
+	renderJSON(w, newLyricsView(l), http.StatusOK)
+	return nil
+}
+
+func saveUserLyrics(ctx context.Context, t tube.Track, text string) (tube.Lyrics, error) {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if len(text) > maxLyricsLen {
+		return tube.Lyrics{}, errBadRequest("lyrics are too long")
+	}
+	l := tube.Lyrics{
+		UserID:  t.UserID,
+		TrackID: t.ID,
+		Text:    text,
+		Synced:  lyrics.IsSynced(text),
+		Source:  tube.LyricsUser,
+	}
+	err := l.Save(ctx)
+	return l, err
+}
+
+// DELETE /api/lyrics/:id
+// Throws away a track's lyrics, including the user's edits, so they're looked up again.
+func deleteLyrics(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	if err := tube.DeleteLyrics(ctx, u.ID, kami.Param(ctx, "id")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
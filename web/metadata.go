@@ -1,13 +1,16 @@
 package web
 
 import (
-	"fmt"
+	"log/slog"
+	"math"
 	"path"
 	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	"github.com/guregu/tag"
+
+	"github.com/guregu/intertube/tube"
 )
 
 type guessedMeta struct {
@@ -53,7 +56,7 @@ func guessMetadata(name string, ftype tag.FileType) tag.Metadata {
 			nsplit := strings.Split(maybeTrack, "-")
 			d, err1 := strconv.Atoi(nsplit[0])
 			n, err2 := strconv.Atoi(nsplit[1])
-			fmt.Println(d, err1, n, err2)
+			slog.Debug("metadata: disc-track prefix", "disc", d, "track", n, "disc_err", err1, "track_err", err2)
 			if err1 == nil && err2 == nil {
 				meta.disc = d
 				meta.track = n
@@ -282,3 +285,56 @@ var (
 	_ tag.Metadata = guessedMeta{}
 	_ tag.Metadata = multiMeta{}
 )
+
+// replayGain reads ReplayGain tags (or Opus's R128 gain tags) from any of m's tag formats.
+func (m multiMeta) replayGain() *tube.ReplayGain {
+	values := make(map[string]string)
+	for _, child := range m {
+		for k, v := range child.Raw() {
+			switch v := v.(type) {
+			case string:
+				values[strings.ToLower(k)] = v
+			case *tag.Comm:
+				// ID3v2 TXXX frames
+				values[strings.ToLower(v.Description)] = v.Text
+			}
+		}
+	}
+
+	// "-6.48 dB"
+	gain := func(key string) (float64, bool) {
+		str := strings.TrimSpace(values[key])
+		str = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(str, "dB"), "db"))
+		g, err := strconv.ParseFloat(str, 64)
+		return g, err == nil && !math.IsNaN(g) && !math.IsInf(g, 0)
+	}
+	peak := func(key string) float64 {
+		p, err := strconv.ParseFloat(strings.TrimSpace(values[key]), 64)
+		if err != nil || p < 0 || math.IsNaN(p) || math.IsInf(p, 0) {
+			return 0
+		}
+		return p
+	}
+	// Q7.8 fixed point dB relative to -23 LUFS, 5 dB quieter than ReplayGain's reference
+	r128 := func(key string) (float64, bool) {
+		q, err := strconv.Atoi(strings.TrimSpace(values[key]))
+		if err != nil {
+			return 0, false
+		}
+		return float64(q)/256 + 5, true
+	}
+
+	var rg tube.ReplayGain
+	var ok bool
+	if rg.TrackGain, ok = gain("replaygain_track_gain"); ok {
+		rg.TrackPeak = peak("replaygain_track_peak")
+	} else if rg.TrackGain, ok = r128("r128_track_gain"); !ok {
+		return nil
+	}
+	if rg.AlbumGain, rg.HasAlbum = gain("replaygain_album_gain"); rg.HasAlbum {
+		rg.AlbumPeak = peak("replaygain_album_peak")
+	} else {
+		rg.AlbumGain, rg.HasAlbum = r128("r128_album_gain")
+	}
+	return &rg
+}
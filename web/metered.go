@@ -0,0 +1,44 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/usagerecord"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// ReportMeteredUsage reports each metered user's storage to Stripe, in GB (rounded up).
+// Run nightly. Records use the "set" action, so the metered price should aggregate
+// with "max" or "last_during_period" rather than "sum".
+func ReportMeteredUsage(ctx context.Context) error {
+	if !UseStripe {
+		return nil
+	}
+	users, err := tube.GetAllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	var reported int
+	for _, u := range users {
+		if u.Plan != tube.PlanKindMetered || u.MeteredItem == "" || !u.PlanStatus.Active() {
+			continue
+		}
+		qty := (u.Usage + tube.MeteredUnit - 1) / tube.MeteredUnit
+		_, err := usagerecord.New(&stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String(u.MeteredItem),
+			Quantity:         stripe.Int64(qty),
+			Action:           stripe.String(stripe.UsageRecordActionSet),
+			TimestampNow:     stripe.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("metered usage for user %d: %w", u.ID, err)
+		}
+		reported++
+	}
+	slog.InfoContext(ctx, "metered: reported usage", "users", reported)
+	return nil
+}
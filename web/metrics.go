@@ -0,0 +1,113 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/guregu/kami"
+	"github.com/zenazn/goji/web/mutil"
+
+	"github.com/guregu/intertube/metrics"
+	"github.com/guregu/intertube/tube"
+)
+
+// MetricsToken lets Prometheus scrape /metrics with an "Authorization: Bearer" header.
+// Admins can always see it.
+var MetricsToken string
+
+type startKey struct{}
+
+func init() {
+	kami.LogHandler = observeRequest
+	kami.Get("/metrics", serveMetrics)
+}
+
+// startTimer is the first middleware, so request latency includes the rest of them.
+func startTimer(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	return context.WithValue(ctx, startKey{}, time.Now())
+}
+
+func observeRequest(ctx context.Context, w mutil.WriterProxy, r *http.Request) {
+	defer releaseDeadline(ctx)
+	code := w.Status()
+	if code == 0 {
+		// nothing was written, which net/http would send as a 200
+		// kami sends a 500 after this unless we beat it to it
+		code = http.StatusOK
+		w.WriteHeader(code)
+	}
+	start, ok := ctx.Value(startKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	took := time.Since(start)
+	route := routeLabel(r.URL.Path, code)
+	metrics.ObserveRequest(r.Method, route, code, took)
+	endSpan(ctx, r, route, code)
+	slog.InfoContext(ctx, "request", "status", code, "took", took)
+}
+
+// routeLabel reduces a path to its first few segments, with IDs replaced by ":id",
+// so the number of routes we report stays small.
+// Anything not found is lumped together, since it could be anything.
+func routeLabel(path string, code int) string {
+	if code == http.StatusNotFound {
+		return "404"
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	max := 2
+	if segments[0] == "api" || segments[0] == "admin" {
+		max = 3
+	}
+	if len(segments) > max {
+		segments = segments[:max]
+	}
+	for i, seg := range segments {
+		if isIDSegment(seg) {
+			segments[i] = ":id"
+		}
+		// subsonic methods work with or without it
+		segments[i] = strings.TrimSuffix(segments[i], ".view")
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func isIDSegment(seg string) bool {
+	// API versions like v0
+	if len(seg) > 1 && seg[0] == 'v' && strings.Trim(seg[1:], "0123456789") == "" {
+		return false
+	}
+	return strings.IndexFunc(seg, unicode.IsDigit) != -1
+}
+
+// GET /metrics
+func serveMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !canSeeMetrics(ctx, r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+func canSeeMetrics(ctx context.Context, r *http.Request) bool {
+	if u, ok := userFrom(ctx); ok && u.GetRole().AtLeast(tube.RoleAdmin) {
+		return true
+	}
+	return hasBearerToken(r, MetricsToken)
+}
+
+// hasBearerToken reports whether r is authorized with token.
+// An empty token never matches.
+func hasBearerToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
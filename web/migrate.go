@@ -2,7 +2,7 @@ package web
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/guregu/intertube/tube"
@@ -21,27 +21,27 @@ func MIGRATE_MAKEDUMPS() {
 		if err := tube.RecreateDump(ctx, u.ID, time.Now().UTC()); err != nil {
 			panic(err)
 		}
-		fmt.Println("dumped", u.ID, u.Email)
+		slog.Info("migrate: dumped", "user_id", u.ID, "email", u.Email)
 	}
 }
 
 func MIGRATE_SORTID() {
 	ctx := context.Background()
 
-	fmt.Println("fixing sort IDs...")
+	slog.Info("migrate: fixing sort IDs")
 
 	iter := tube.GetALLTracks(ctx)
 	var t tube.Track
 	for iter.Next(&t) {
 		if t.SortID == t.SortKey() {
-			fmt.Println("skipping", t.SortKey())
+			slog.Info("migrate: skipping", "sort_id", t.SortKey())
 			continue
 		}
 		if err := t.RefreshSortID(ctx); err != nil {
-			fmt.Println("ERROR", err, t.ID, t.UserID, t.SortKey())
+			slog.Error("migrate: failed to fix sort ID", "track", t.ID, "user_id", t.UserID, "sort_id", t.SortKey(), "err", err)
 			continue
 		}
-		fmt.Println("set", t.SortID, "/", t.UserID)
+		slog.Info("migrate: set sort ID", "sort_id", t.SortID, "user_id", t.UserID)
 	}
 	if iter.Err() != nil {
 		panic(iter.Err())
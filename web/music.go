@@ -22,7 +22,7 @@ func showMusicHead(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	// }
 }
 
-func showMusic(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func showMusic(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	lastMod := lastestMod(u.LastMod)
 
@@ -53,7 +53,7 @@ func showMusic(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil && err != tube.ErrNotFound {
-		panic(err)
+		return err
 	}
 	offset, _ := strconv.Atoi(start)
 	filter := organize{
@@ -130,10 +130,11 @@ func showMusic(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	if inline {
 		renderTemplate(ctx, w, view, data, http.StatusOK)
-		return
+		return nil
 	}
 
 	renderTemplate(ctx, w, "music", data, http.StatusOK)
+	return nil
 }
 
 // TODO: group by picture ID
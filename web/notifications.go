@@ -0,0 +1,116 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// only this many of the newest notifications are listed or counted
+const notificationsLimit = 100
+
+func init() {
+	kami.Use("/api/notifications", forbidGuests)
+	kami.Use("/api/notifications/", forbidGuests)
+	kami.Get("/api/notifications", handle(listNotifications))
+	kami.Post("/api/notifications/read", handle(readNotifications))
+}
+
+// postNotification leaves the user an in-app notification.
+// message is the ID of a translated string, filled in with args.
+func postNotification(ctx context.Context, userID int, kind, link, message string, args ...string) {
+	n, err := tube.NewNotification(userID, kind, message, args...)
+	if err == nil {
+		n.Link = link
+		err = n.Create(ctx)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to post notification", "user_id", userID, "kind", kind, "err", err)
+	}
+}
+
+// notificationView is the API view of tube.Notification, translated for the reader.
+type notificationView struct {
+	ID      string
+	Kind    string
+	Text    string
+	Link    string `json:",omitempty"`
+	Created time.Time
+	Read    bool
+}
+
+// GET /api/notifications
+// Lists the newest notifications and how many of them are unread.
+func listNotifications(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	ns, err := tube.GetNotifications(ctx, u.ID, notificationsLimit)
+	if err != nil {
+		return err
+	}
+	resp := struct {
+		Unread        int
+		Notifications []notificationView
+	}{
+		Notifications: make([]notificationView, 0, len(ns)),
+	}
+	for _, n := range ns {
+		args := make([]any, 0, len(n.Args))
+		for _, arg := range n.Args {
+			args = append(args, arg)
+		}
+		if n.Unread() {
+			resp.Unread++
+		}
+		resp.Notifications = append(resp.Notifications, notificationView{
+			ID:      n.ID,
+			Kind:    n.Kind,
+			Text:    translate(ctx, n.Message, args...),
+			Link:    n.Link,
+			Created: n.Created,
+			Read:    !n.Unread(),
+		})
+	}
+	renderJSON(w, resp, http.StatusOK)
+	return nil
+}
+
+// POST /api/notifications/read
+// Marks the notifications with the given IDs as read: {"IDs": ["..."]}.
+// Without any IDs, everything is marked as read.
+func readNotifications(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var input struct {
+		IDs []string
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			return err
+		}
+	}
+
+	ns, err := tube.GetNotifications(ctx, u.ID, notificationsLimit)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool, len(input.IDs))
+	for _, id := range input.IDs {
+		want[id] = true
+	}
+	now := time.Now().UTC()
+	for _, n := range ns {
+		if !n.Unread() || (len(want) > 0 && !want[n.ID]) {
+			continue
+		}
+		if err := n.MarkRead(ctx, now); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
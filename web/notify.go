@@ -0,0 +1,169 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+
+	mailer "github.com/guregu/intertube/email"
+	"github.com/guregu/intertube/tube"
+)
+
+const (
+	// warn when an upload brings usage to this much of the quota
+	quotaWarnPercent = 90
+	quotaNoticeEvery = 7 * 24 * time.Hour
+
+	// uploads processed in the background only count as an import if there's this many
+	importNoticeMin = 5
+	// and they were queued within this long
+	importWindow = 24 * time.Hour
+	// how many recent jobs to look through
+	importJobsLimit = 1000
+)
+
+// mailData is what the mail-* templates get.
+type mailData struct {
+	User   tube.User
+	Domain string
+	Data   any
+}
+
+// notify e-mails u the mail-<name> template, titled with the mail_<name>_subject string,
+// in the user's language. Nothing is sent if they've opted out of cat.
+func notify(ctx context.Context, u tube.User, cat tube.EmailCategory, name string, data any) error {
+	if !mailer.IsEnabled() || !u.WantsEmail(cat) {
+		return nil
+	}
+	lang := negotiateLanguage(u.Prefs.Language)
+	ctx = withLocalizer(ctx, i18n.NewLocalizer(translations, lang))
+	ctx = withLanguage(ctx, lang)
+
+	tmpl, err := getTemplate(ctx, "mail-"+name)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	err = tmpl.Execute(&body, mailData{
+		User:   u,
+		Domain: Domain,
+		Data:   data,
+	})
+	if err != nil {
+		return err
+	}
+	subject := translate(ctx, "mail_"+name+"_subject", Domain)
+	return mailer.Send(Domain, u.Email, subject, body.String())
+}
+
+// notifyQuota warns u when an upload of size bytes has nearly filled their storage.
+func notifyQuota(ctx context.Context, u tube.User, size int64) {
+	quota := u.CalcQuota()
+	if quota <= 0 || !mailer.IsEnabled() || !u.WantsEmail(tube.EmailQuota) {
+		return
+	}
+	usage := u.Usage + size
+	if usage*100 < quota*quotaWarnPercent {
+		return
+	}
+	now := time.Now().UTC()
+	if ok, err := u.ClaimQuotaNotice(ctx, now, now.Add(-quotaNoticeEvery)); err != nil || !ok {
+		if err != nil {
+			slog.ErrorContext(ctx, "notify: failed to claim quota notice", "user_id", u.ID, "err", err)
+		}
+		return
+	}
+	data := struct {
+		Usage int64
+		Quota int64
+	}{
+		Usage: usage,
+		Quota: quota,
+	}
+	if err := notify(ctx, u, tube.EmailQuota, "quota", data); err != nil {
+		slog.ErrorContext(ctx, "notify: failed to send quota notice", "user_id", u.ID, "err", err)
+	}
+}
+
+// notifyImport lets u know when the last of a batch of background uploads is done,
+// with an in-app notification and an e-mail.
+// current is the upload job that just finished successfully.
+// If the last two jobs finish at the same time, they'll each see the other as still running
+// and no e-mail goes out, which is better than two.
+func notifyImport(ctx context.Context, u tube.User, current *tube.Job) {
+	jobs, err := tube.GetJobs(ctx, u.ID, importJobsLimit)
+	if err != nil {
+		slog.ErrorContext(ctx, "notify: failed to list jobs", "user_id", u.ID, "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	since := now.Add(-importWindow)
+	if u.ImportNotified.After(since) {
+		since = u.ImportNotified
+	}
+	var done, failed int
+	start := current.Created
+	for _, j := range jobs {
+		if j.Kind != jobUpload || j.Created.Before(since) {
+			continue
+		}
+		switch {
+		case j.ID == current.ID || j.Status == tube.JobDone:
+			done++
+		case j.Status == tube.JobFailed:
+			failed++
+		default:
+			// more to go
+			return
+		}
+		if j.Created.Before(start) {
+			start = j.Created
+		}
+	}
+	if done+failed < importNoticeMin {
+		return
+	}
+	// don't send it twice for the same batch
+	if ok, err := u.ClaimImportNotice(ctx, now, start); err != nil || !ok {
+		if err != nil {
+			slog.ErrorContext(ctx, "notify: failed to claim import notice", "user_id", u.ID, "err", err)
+		}
+		return
+	}
+	if failed > 0 {
+		postNotification(ctx, u.ID, jobUpload, "/upload", "notification_import_failed", strconv.Itoa(done), strconv.Itoa(failed))
+	} else {
+		postNotification(ctx, u.ID, jobUpload, "/music", "notification_import", strconv.Itoa(done))
+	}
+	data := struct {
+		Done   int
+		Failed int
+	}{
+		Done:   done,
+		Failed: failed,
+	}
+	if err := notify(ctx, u, tube.EmailImport, "import", data); err != nil {
+		slog.ErrorContext(ctx, "notify: failed to send import notice", "user_id", u.ID, "err", err)
+	}
+}
+
+// notifySecurity sends a security alert, like a password change.
+// event is the name of a mail_security_* string describing what happened.
+func notifySecurity(ctx context.Context, u tube.User, event, ip string) {
+	data := struct {
+		Event string
+		Time  string
+		IP    string
+	}{
+		Event: "mail_security_" + event,
+		Time:  time.Now().UTC().Format(time.RFC1123),
+		IP:    ip,
+	}
+	if err := notify(ctx, u, tube.EmailSecurity, "security", data); err != nil {
+		slog.ErrorContext(ctx, "notify: failed to send security alert", "user_id", u.ID, "event", event, "err", err)
+	}
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func init() {
+	kami.Use("/api/nowplaying", requireAllowedLocation)
+	kami.Post("/api/nowplaying", handle(postNowPlaying))
+}
+
+// POST /api/nowplaying?id=<track>&next=<track>
+// The web player calls this when a track starts.
+// The response has Link: rel=preload headers for what to fetch ahead of time:
+// the next track's audio and artwork, so the next track can start right away.
+func postNowPlaying(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	id := r.FormValue("id")
+	if id == "" {
+		return errBadRequest("missing id")
+	}
+	if _, err := tube.GetTrack(ctx, u.ID, id); err != nil {
+		return err
+	}
+
+	if nextID := r.FormValue("next"); nextID != "" {
+		next, err := tube.GetTrack(ctx, u.ID, nextID)
+		switch {
+		case errors.Is(err, tube.ErrNotFound):
+			// deleted from another tab or something, just skip it
+		case err != nil:
+			return err
+		default:
+			w.Header().Add("Link", preloadLink(presignTrackDL(u, next, clientCountry(r)), "audio"))
+			if next.Picture.ID != "" {
+				w.Header().Add("Link", preloadLink(artURL(next.Picture), "image"))
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func preloadLink(href, as string) string {
+	return fmt.Sprintf("<%s>; rel=preload; as=%s", href, as)
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// The web player installs as a PWA. Its service worker (sw.gojs) caches pages as they're visited,
+// artwork forever (its URLs are immutable), and the audio of tracks pinned for offline listening.
+
+func init() {
+	kami.Get("/manifest.webmanifest", handle(webManifest))
+	kami.Get("/sw.js", handle(serviceWorker))
+
+	kami.Use("/api/offline", forbidGuests)
+	kami.Use("/api/offline/", forbidGuests)
+	kami.Get("/api/offline", handle(getOfflineManifest))
+	kami.Put("/api/offline/:id", handle(pinTrack))
+	kami.Delete("/api/offline/:id", handle(unpinTrack))
+}
+
+type webAppManifest struct {
+	Name            string           `json:"name"`
+	ShortName       string           `json:"short_name"`
+	StartURL        string           `json:"start_url"`
+	Scope           string           `json:"scope"`
+	Display         string           `json:"display"`
+	BackgroundColor string           `json:"background_color"`
+	ThemeColor      string           `json:"theme_color"`
+	Icons           []webAppIcon     `json:"icons"`
+	Shortcuts       []webAppShortcut `json:"shortcuts,omitempty"`
+}
+
+type webAppIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+type webAppShortcut struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// StaticURL is where icons and other static files are served from, without a trailing slash.
+var StaticURL = "https://cdn.inter.tube/static"
+
+func appManifest() webAppManifest {
+	return webAppManifest{
+		Name:            Domain,
+		ShortName:       "intertube",
+		StartURL:        "/music",
+		Scope:           "/",
+		Display:         "standalone",
+		BackgroundColor: "#ffffff",
+		ThemeColor:      "#ff0000",
+		Icons: []webAppIcon{
+			{Src: StaticURL + "/tube-red-180.png", Sizes: "180x180", Type: "image/png"},
+			{Src: StaticURL + "/tube-red-32.png", Sizes: "32x32", Type: "image/png"},
+		},
+		Shortcuts: []webAppShortcut{
+			{Name: "albums", URL: "/music/albums"},
+			{Name: "upload", URL: "/upload"},
+		},
+	}
+}
+
+// GET /manifest.webmanifest
+func webManifest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	return json.NewEncoder(w).Encode(appManifest())
+}
+
+// GET /sw.js
+// Served from the root so it can control every page.
+// Its version changes with each deploy, which makes browsers install the new one
+// and throw out the old caches.
+func serviceWorker(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	tmpl := templates.Lookup("sw.gojs")
+	if tmpl == nil {
+		return errors.New("no template: sw.gojs")
+	}
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	data := struct {
+		Version int64
+	}{
+		Version: Deployed.Unix(),
+	}
+	return tmpl.Execute(w, data)
+}
+
+type offlineManifest struct {
+	Version string
+	Tracks  []offlineTrack
+}
+
+// offlineTrack is everything the service worker needs to keep a track around.
+type offlineTrack struct {
+	ID     string
+	Title  string
+	Artist string
+	Album  string
+	Size   int
+	Pinned int64 // unix time
+	// same-origin URLs; the audio one redirects to storage
+	Audio string
+	Art   string `json:",omitempty"`
+}
+
+// GET /api/offline
+// Lists the tracks pinned for offline listening.
+// The response can be cached and revalidated, and is only sent again after the library changes.
+func getOfflineManifest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	version := strconv.FormatInt(lastestMod(u.LastMod).UnixNano(), 36)
+	etag := `"` + version + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	tracks, err := u.GetTracks(ctx)
+	if err != nil && err != tube.ErrNotFound {
+		return err
+	}
+	manifest := offlineManifest{
+		Version: version,
+		Tracks:  []offlineTrack{},
+	}
+	for _, t := range tracks {
+		if t.Pinned.IsZero() || t.Deleted {
+			continue
+		}
+		ot := offlineTrack{
+			ID:     t.ID,
+			Title:  t.Info.Title,
+			Artist: t.Info.Artist,
+			Album:  t.Info.Album,
+			Size:   t.Size,
+			Pinned: t.Pinned.Unix(),
+			Audio:  t.FileURL(),
+		}
+		if t.Picture.ID != "" {
+			ot.Art = artURL(t.Picture)
+		}
+		manifest.Tracks = append(manifest.Tracks, ot)
+	}
+	renderJSON(w, manifest, http.StatusOK)
+	return nil
+}
+
+// PUT /api/offline/:id
+func pinTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return setPinned(ctx, w, true)
+}
+
+// DELETE /api/offline/:id
+func unpinTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return setPinned(ctx, w, false)
+}
+
+func setPinned(ctx context.Context, w http.ResponseWriter, pinned bool) error {
+	u, _ := userFrom(ctx)
+	track, err := tube.GetTrack(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	if err := track.SetPinned(ctx, pinned); err != nil {
+		return fmt.Errorf("pin track: %w", err)
+	}
+	if err := u.UpdateLastMod(ctx); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebManifest(t *testing.T) {
+	oldDomain, oldStatic := Domain, StaticURL
+	t.Cleanup(func() { Domain, StaticURL = oldDomain, oldStatic })
+	Domain = "music.example.com"
+	StaticURL = "https://static.example.com/tube"
+
+	w := httptest.NewRecorder()
+	if err := webManifest(context.Background(), w, httptest.NewRequest("GET", "/manifest.webmanifest", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var got webAppManifest
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != Domain {
+		t.Errorf("name: %q, want %q", got.Name, Domain)
+	}
+	if len(got.Icons) == 0 {
+		t.Fatal("no icons")
+	}
+	for _, icon := range got.Icons {
+		if !strings.HasPrefix(icon.Src, StaticURL+"/") {
+			t.Errorf("icon %s: %q, want it under %s", icon.Sizes, icon.Src, StaticURL)
+		}
+	}
+}
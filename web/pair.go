@@ -0,0 +1,263 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// Devices that are a pain to type a password into (TVs, mostly) can pair instead:
+//  1. The device calls POST /api/pair and shows the returned URL as a QR code, and the code as text.
+//  2. Someone logged in scans it (or goes to /pair and types the code), and approves the device.
+//  3. Meanwhile, the device polls POST /api/pair/poll until it gets a device token,
+//     which works as the password for the Subsonic API.
+
+const (
+	// how often devices should poll, in seconds
+	pairPollInterval = 5
+
+	maxDeviceNameLen = 64
+)
+
+func init() {
+	kami.Post("/api/pair", handle(startPairing))
+	kami.Post("/api/pair/poll", handle(pollPairing))
+
+	kami.Use("/pair", forbidImpersonation)
+	kami.Get("/pair", handle(pairForm))
+	kami.Post("/pair", handle(approvePairing))
+
+	kami.Use("/api/account/tokens", forbidImpersonation)
+	kami.Use("/api/account/tokens/", forbidImpersonation)
+	kami.Get("/api/account/tokens", handle(listDeviceTokens))
+	kami.Delete("/api/account/tokens/:id", handle(revokeDeviceToken))
+}
+
+func pairURL(code string) string {
+	return "https://" + Domain + "/pair?code=" + url.QueryEscape(code)
+}
+
+// POST /api/pair
+// Starts pairing a device: {"Name": "living room TV"}.
+func startPairing(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var input struct {
+		Name string
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			return err
+		}
+	}
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		name = r.UserAgent()
+	}
+	if len(name) > maxDeviceNameLen {
+		name = name[:maxDeviceNameLen]
+	}
+
+	p, err := tube.NewPairing(ctx, name)
+	if err != nil {
+		return err
+	}
+	resp := struct {
+		Code     string
+		Secret   string
+		URL      string
+		Expires  int64 // unix time
+		Interval int   // seconds between polls
+	}{
+		Code:     p.Code,
+		Secret:   p.Secret,
+		URL:      pairURL(p.Code),
+		Expires:  p.Expires.Unix(),
+		Interval: pairPollInterval,
+	}
+	renderJSON(w, resp, http.StatusCreated)
+	return nil
+}
+
+// POST /api/pair/poll
+// Checks on a pairing: {"Code": "...", "Secret": "..."}.
+// Responds with 202 Accepted until it's approved, then hands over the device token, once.
+func pollPairing(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var input struct {
+		Code   string
+		Secret string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	p, err := tube.GetPairing(ctx, tube.NormalizePairingCode(input.Code))
+	if err != nil {
+		return err
+	}
+	approved, err := p.Claim(ctx, input.Secret)
+	if err != nil {
+		return err
+	}
+	if !approved {
+		resp := struct {
+			Status   string
+			Interval int
+		}{
+			Status:   "pending",
+			Interval: pairPollInterval,
+		}
+		renderJSON(w, resp, http.StatusAccepted)
+		return nil
+	}
+
+	u, err := tube.GetUser(ctx, p.UserID)
+	if err != nil {
+		return err
+	}
+	resp := struct {
+		Status   string
+		Username string
+		Token    string
+	}{
+		Status:   "approved",
+		Username: u.Email,
+		Token:    p.Token,
+	}
+	renderJSON(w, resp, http.StatusOK)
+	return nil
+}
+
+type pairFormData struct {
+	User     tube.User
+	Code     string
+	Name     string
+	Done     bool
+	ErrorMsg string
+}
+
+// GET /pair?code=...
+func pairForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	data := pairFormData{
+		User: u,
+		Code: tube.NormalizePairingCode(r.FormValue("code")),
+	}
+	if data.Code != "" {
+		p, err := tube.GetPairing(ctx, data.Code)
+		switch {
+		case errors.Is(err, tube.ErrNotFound), err == nil && p.Approved():
+			data.ErrorMsg = translate(ctx, "pair_expired")
+			data.Code = ""
+		case err != nil:
+			return err
+		default:
+			data.Name = p.Name
+		}
+	}
+	renderTemplate(ctx, w, "pair", data, http.StatusOK)
+	return nil
+}
+
+// POST /pair
+// Approves a device, handing it a new device token.
+func approvePairing(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	data := pairFormData{
+		User: u,
+	}
+	code := tube.NormalizePairingCode(r.FormValue("code"))
+	p, err := tube.GetPairing(ctx, code)
+	if errors.Is(err, tube.ErrNotFound) || (err == nil && p.Approved()) {
+		data.ErrorMsg = translate(ctx, "pair_expired")
+		renderTemplate(ctx, w, "pair", data, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.FormValue("approve") == "" {
+		// typed in the code, so show what's being approved first
+		data.Code = p.Code
+		data.Name = p.Name
+		renderTemplate(ctx, w, "pair", data, http.StatusOK)
+		return nil
+	}
+
+	dt, token, err := tube.CreateDeviceToken(ctx, u.ID, p.Name)
+	if err != nil {
+		return fmt.Errorf("pair: creating token: %w", err)
+	}
+	if err := p.Approve(ctx, u.ID, token); err != nil {
+		// this token is no good now
+		if err := dt.Delete(ctx); err != nil {
+			return fmt.Errorf("pair: deleting unused token: %w", err)
+		}
+		if !errors.Is(err, tube.ErrNotFound) {
+			return fmt.Errorf("pair: approving: %w", err)
+		}
+		// beaten to it
+		data.ErrorMsg = translate(ctx, "pair_expired")
+		renderTemplate(ctx, w, "pair", data, http.StatusConflict)
+		return nil
+	}
+	audit(ctx, r, u.ID, tube.EventTokenCreated, "paired: "+p.Name)
+
+	data.Name = p.Name
+	data.Done = true
+	renderTemplate(ctx, w, "pair", data, http.StatusOK)
+	return nil
+}
+
+// checkDeviceToken logs in with a device token in place of a password.
+// login has to be the email of the token's owner, as handed to the device when it was paired.
+func checkDeviceToken(ctx context.Context, login, token string) (tube.User, tube.DeviceToken, error) {
+	dt, err := tube.CheckDeviceToken(ctx, token)
+	if errors.Is(err, tube.ErrNotFound) {
+		return tube.User{}, dt, errBadPassword
+	}
+	if err != nil {
+		return tube.User{}, dt, err
+	}
+	u, err := tube.GetUser(ctx, dt.UserID)
+	if err != nil {
+		return u, dt, err
+	}
+	if !strings.EqualFold(u.Email, login) {
+		return tube.User{}, dt, errBadPassword
+	}
+	return u, dt, nil
+}
+
+// GET /api/account/tokens
+// Lists paired devices.
+func listDeviceTokens(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	tokens, err := tube.GetDeviceTokens(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if tokens == nil {
+		tokens = []tube.DeviceToken{}
+	}
+	renderJSON(w, tokens, http.StatusOK)
+	return nil
+}
+
+// DELETE /api/account/tokens/:id
+// Unpairs a device. Devices that don't exist or belong to someone else are not found.
+func revokeDeviceToken(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	dt := tube.DeviceToken{ID: kami.Param(ctx, "id"), UserID: u.ID}
+	if err := dt.Delete(ctx); err != nil {
+		return err
+	}
+	audit(ctx, r, u.ID, tube.EventTokenRevoked, dt.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
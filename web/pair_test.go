@@ -0,0 +1,54 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestRevokeDeviceToken(t *testing.T) {
+	ctx, u := testDB(t)
+	other := tube.User{Email: "other@example.com"}
+	if err := other.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mine, _, err := tube.CreateDeviceToken(ctx, u.ID, "tv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, _, err := tube.CreateDeviceToken(ctx, other.ID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = withUser(ctx, u)
+	revoke := func(id string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		err := revokeDeviceToken(kami.SetParam(ctx, "id", id), w, httptest.NewRequest("DELETE", "/api/account/tokens/"+id, nil))
+		return w, err
+	}
+
+	for _, id := range []string{theirs.ID, "nope"} {
+		_, err := revoke(id)
+		if code, _ := errorStatus(err); code != http.StatusNotFound {
+			t.Errorf("revoking %s: %d (%v), want 404", id, code, err)
+		}
+	}
+	if tokens, err := tube.GetDeviceTokens(ctx, other.ID); err != nil || len(tokens) != 1 {
+		t.Errorf("someone else's devices: %v, %v; want 1", tokens, err)
+	}
+
+	w, err := revoke(mine.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("revoking my device: %d, want 204", w.Code)
+	}
+	if tokens, err := tube.GetDeviceTokens(ctx, u.ID); err != nil || len(tokens) != 0 {
+		t.Errorf("my devices after revoking: %v, %v; want none", tokens, err)
+	}
+}
@@ -9,11 +9,11 @@ import (
 	"github.com/guregu/intertube/tube"
 )
 
-func createPlaylistForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func createPlaylistForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	var tracks []tube.Track
 	query := r.FormValue("q")
@@ -21,7 +21,7 @@ func createPlaylistForm(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		var err error
 		tracks, err = lib.Query(query)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
@@ -40,6 +40,7 @@ func createPlaylistForm(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	}
 
 	renderTemplate(ctx, w, page, data, http.StatusOK)
+	return nil
 }
 
 /*
@@ -70,18 +71,18 @@ type PLUIMeta struct {
 }
 
 // TODO: static playlist
-func createPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func createPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	const playlistVersion = 1
 
 	u, _ := userFrom(ctx)
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	var plr PlaylistRequest
 	if err := json.NewDecoder(r.Body).Decode(&plr); err != nil {
-		panic(err)
+		return err
 	}
 	expr := plr.Form.Expr
 
@@ -96,7 +97,7 @@ func createPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	// test out query
 	tracks, err := lib.Query(expr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	pl.With(tracks)
 
@@ -105,15 +106,16 @@ func createPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		Ver:   playlistVersion,
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 	pl.UIMeta = enc
 
 	if err := pl.Create(ctx); err != nil {
-		panic(err)
+		return err
 	}
 	w.Header().Set("Location", fmt.Sprintf("/playlist/%d", pl.ID))
 	w.WriteHeader(http.StatusCreated)
+	return nil
 }
 
 func playlistTracks(lib *Library, pl tube.Playlist) ([]tube.Track, error) {
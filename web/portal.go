@@ -0,0 +1,109 @@
+package web
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stripe/stripe-go/v72"
+	portalconfig "github.com/stripe/stripe-go/v72/billingportal/configuration"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// metadata key marking portal configurations created by us;
+// the value is the list of prices it was made for
+const portalConfigKey = "intertube_prices"
+
+var (
+	portalConfigMu sync.Mutex
+	portalConfigID string
+)
+
+// billingPortalConfig returns a portal configuration that lets customers switch
+// between our plans mid-cycle (prorated), update their card, and see invoices.
+// It is created on demand and recreated whenever the plans' prices change.
+func billingPortalConfig() (string, error) {
+	portalConfigMu.Lock()
+	defer portalConfigMu.Unlock()
+	if portalConfigID != "" {
+		return portalConfigID, nil
+	}
+
+	plans := tube.GetPlans()
+	prices, err := getStripePrices(plans)
+	if err != nil {
+		return "", err
+	}
+	byProduct := make(map[string][]*string)
+	var priceIDs []string
+	for kind, price := range prices {
+		if tube.GetPlan(kind).Metered {
+			// can't switch between licensed and metered prices in the portal
+			continue
+		}
+		byProduct[price.Product.ID] = append(byProduct[price.Product.ID], stripe.String(price.ID))
+		priceIDs = append(priceIDs, price.ID)
+	}
+	sort.Strings(priceIDs)
+	version := strings.Join(priceIDs, ",")
+
+	iter := portalconfig.List(&stripe.BillingPortalConfigurationListParams{
+		Active: stripe.Bool(true),
+	})
+	for iter.Next() {
+		cfg := iter.BillingPortalConfiguration()
+		if cfg.Metadata[portalConfigKey] == version {
+			portalConfigID = cfg.ID
+			return cfg.ID, nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return "", err
+	}
+
+	var products []*stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams
+	for prod, ids := range byProduct {
+		products = append(products, &stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams{
+			Product: stripe.String(prod),
+			Prices:  ids,
+		})
+	}
+	params := &stripe.BillingPortalConfigurationParams{
+		BusinessProfile: &stripe.BillingPortalConfigurationBusinessProfileParams{
+			PrivacyPolicyURL:  stripe.String(fmt.Sprintf("https://%s/privacy", Domain)),
+			TermsOfServiceURL: stripe.String(fmt.Sprintf("https://%s/terms", Domain)),
+		},
+		DefaultReturnURL: stripe.String(fmt.Sprintf("https://%s/settings", Domain)),
+		Features: &stripe.BillingPortalConfigurationFeaturesParams{
+			CustomerUpdate: &stripe.BillingPortalConfigurationFeaturesCustomerUpdateParams{
+				Enabled:        stripe.Bool(true),
+				AllowedUpdates: []*string{stripe.String("email"), stripe.String("address")},
+			},
+			InvoiceHistory: &stripe.BillingPortalConfigurationFeaturesInvoiceHistoryParams{
+				Enabled: stripe.Bool(true),
+			},
+			PaymentMethodUpdate: &stripe.BillingPortalConfigurationFeaturesPaymentMethodUpdateParams{
+				Enabled: stripe.Bool(true),
+			},
+			SubscriptionCancel: &stripe.BillingPortalConfigurationFeaturesSubscriptionCancelParams{
+				Enabled: stripe.Bool(true),
+				Mode:    stripe.String("at_period_end"),
+			},
+			SubscriptionUpdate: &stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateParams{
+				Enabled:               stripe.Bool(true),
+				DefaultAllowedUpdates: []*string{stripe.String("price")},
+				ProrationBehavior:     stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+				Products:              products,
+			},
+		},
+	}
+	params.AddMetadata(portalConfigKey, version)
+	cfg, err := portalconfig.New(params)
+	if err != nil {
+		return "", err
+	}
+	portalConfigID = cfg.ID
+	return cfg.ID, nil
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func init() {
+	kami.Use("/api/account/preferences", forbidGuests)
+	kami.Get("/api/account/preferences", handle(getPreferences))
+	kami.Put("/api/account/preferences", handle(putPreferences))
+}
+
+// preferences is the API view of tube.Preferences, plus the theme.
+type preferences struct {
+	Theme string
+	tube.Preferences
+}
+
+func userPreferences(u tube.User) preferences {
+	prefs := preferences{
+		Theme:       u.Theme,
+		Preferences: u.Prefs,
+	}
+	if prefs.Home == nil {
+		prefs.Home = []string{}
+	}
+	return prefs
+}
+
+// GET /api/account/preferences
+func getPreferences(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	renderJSON(w, userPreferences(u), http.StatusOK)
+	return nil
+}
+
+// PUT /api/account/preferences
+// Replaces all preferences; fields left out are reset to their defaults.
+func putPreferences(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var input preferences
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	if input.Theme != "" && templates.Lookup("_style-"+input.Theme+".gohtml") == nil {
+		return errBadRequest("invalid theme: " + input.Theme)
+	}
+	prefs, err := input.Preferences.Normalize()
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	if err := u.SetPreferences(ctx, input.Theme, prefs); err != nil {
+		return err
+	}
+	renderJSON(w, userPreferences(u), http.StatusOK)
+	return nil
+}
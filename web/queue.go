@@ -0,0 +1,81 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func init() {
+	kami.Use("/api/queue", forbidGuests)
+	kami.Get("/api/queue", handle(getPlayQueue))
+	kami.Put("/api/queue", handle(putPlayQueue))
+}
+
+// playQueue is the API view of tube.PlayQueue.
+type playQueue struct {
+	Tracks   []string
+	Current  string
+	Position float64 // seconds
+	Playing  bool    `json:",omitempty"`
+	Changed  int64   `json:",omitempty"` // unix millis
+}
+
+// GET /api/queue
+// Returns the saved play queue, which is empty if nothing has been saved.
+func getPlayQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	q, err := tube.GetPlayQueue(ctx, u.ID)
+	if err != nil && !errors.Is(err, tube.ErrNotFound) {
+		return err
+	}
+	resp := playQueue{
+		Tracks:   q.Tracks,
+		Current:  q.Current,
+		Position: q.Position,
+		Playing:  q.Playing,
+	}
+	if resp.Tracks == nil {
+		resp.Tracks = []string{}
+	}
+	if !q.Changed.IsZero() {
+		resp.Changed = q.Changed.UnixMilli()
+	}
+	renderJSON(w, resp, http.StatusOK)
+	return nil
+}
+
+// PUT /api/queue
+// Replaces the saved play queue. The web player calls this (debounced) whenever it changes.
+func putPlayQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var input playQueue
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	if len(input.Tracks) > tube.MaxQueueLen {
+		return errBadRequest(fmt.Sprintf("too many tracks (max %d)", tube.MaxQueueLen))
+	}
+	if input.Position < 0 {
+		return errBadRequest("invalid position")
+	}
+	q := tube.PlayQueue{
+		UserID:    u.ID,
+		Tracks:    input.Tracks,
+		Current:   input.Current,
+		Position:  input.Position,
+		Playing:   input.Playing,
+		ChangedBy: "web",
+	}
+	if err := tube.SavePlayQueue(ctx, q); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"io"
+	"log/slog"
 	"net/http"
 )
 
@@ -12,9 +13,8 @@ func renderText(w http.ResponseWriter, text string, code int) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	setCacheHeaders(w)
 	w.WriteHeader(code)
-	_, err := io.WriteString(w, text)
-	if err != nil {
-		panic(err)
+	if _, err := io.WriteString(w, text); err != nil {
+		slog.Debug("render: write failed", "err", err)
 	}
 }
 
@@ -23,16 +23,24 @@ func renderJSON(w http.ResponseWriter, data any, code int) {
 	setCacheHeaders(w)
 	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		panic(err)
+		slog.Error("render: encoding JSON failed", "err", err)
 	}
 }
 
+// renderTemplate renders the named template.
+// Once it's started writing, errors can only be logged.
 func renderTemplate(ctx context.Context, w http.ResponseWriter, tmpl string, data any, code int) {
+	t, err := getTemplate(ctx, tmpl)
+	if err != nil {
+		slog.ErrorContext(ctx, "render: no template", "template", tmpl, "err", err)
+		renderText(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	setCacheHeaders(w)
 	w.WriteHeader(code)
-	if err := getTemplate(ctx, tmpl).Execute(w, data); err != nil {
-		panic(err)
+	if err := t.Execute(w, data); err != nil {
+		slog.ErrorContext(ctx, "render: template failed", "template", tmpl, "err", err)
 	}
 }
 
@@ -42,10 +50,11 @@ func renderXML(w http.ResponseWriter, data any, code int) {
 	w.WriteHeader(code)
 
 	if _, err := io.WriteString(w, xml.Header); err != nil {
-		panic(err)
+		slog.Debug("render: write failed", "err", err)
+		return
 	}
 	if err := xml.NewEncoder(w).Encode(data); err != nil {
-		panic(err)
+		slog.Error("render: encoding XML failed", "err", err)
 	}
 }
 
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requireAllowedLocation enforces the user's IP and country restrictions on streaming and downloads.
+func requireAllowedLocation(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	u, ok := userFrom(ctx)
+	if !ok || u.Restrict.Empty() {
+		return ctx
+	}
+	ip, country := clientIP(r), clientCountry(r)
+	if u.Restrict.Allowed(ip, country) {
+		return ctx
+	}
+	slog.InfoContext(ctx, "restrict: blocked", "ip", ip, "country", country)
+	if isSubsonicReq(r) {
+		writeSubsonic(ctx, w, r, subErr(50, "Not allowed from this location"))
+		return nil
+	}
+	http.Error(w, "access from this location is restricted by your account settings", http.StatusForbidden)
+	return nil
+}
+
+// Where requests come from, set by the configuration.
+var (
+	// TrustedProxies are the load balancers and CDNs in front of us.
+	// Only the addresses they add to X-Forwarded-For are believed.
+	TrustedProxies []*net.IPNet
+	// CountryHeader is where the CDN in front of us puts the viewer's country code.
+	CountryHeader string
+)
+
+// clientIP returns the client's address: the remote address, or,
+// if that's a trusted proxy, the last address in X-Forwarded-For that isn't one.
+// Anything to the left of that was written by the client and can't be believed.
+func clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0 && ip != nil && trustedProxy(ip); i-- {
+		ip = net.ParseIP(strings.TrimSpace(hops[i]))
+	}
+	return ip
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, cidr := range TrustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCountry returns the country code set by the CDN in front of us, if any.
+// Only the configured CDN's header is read, as clients can send any of the others,
+// and if there are trusted proxies, only when it came through one of them.
+func clientCountry(r *http.Request) string {
+	if CountryHeader == "" {
+		return ""
+	}
+	if len(TrustedProxies) > 0 && !trustedProxy(remoteIP(r)) {
+		return ""
+	}
+	if cc := r.Header.Get(CountryHeader); cc != "XX" {
+		return cc
+	}
+	return ""
+}
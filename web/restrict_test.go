@@ -0,0 +1,68 @@
+package web
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	TrustedProxies = []*net.IPNet{lb}
+	t.Cleanup(func() { TrustedProxies = nil })
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		// not through a proxy, so X-Forwarded-For is the client's
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.2:1234", "198.51.100.1", "198.51.100.1"},
+		// the client can put anything it likes on the left
+		{"10.0.0.2:1234", "192.0.2.1, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.2:1234", "192.0.2.1, 198.51.100.1, 10.1.1.1", "198.51.100.1"},
+		{"10.0.0.2:1234", "", ""},
+		{"10.0.0.2:1234", "junk", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		got := clientIP(r)
+		if (got == nil && test.want != "") || (got != nil && got.String() != test.want) {
+			t.Errorf("clientIP(%s, %q) = %v, want %q", test.remote, test.xff, got, test.want)
+		}
+	}
+}
+
+func TestClientCountry(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("CF-IPCountry", "JP")
+	r.Header.Set("CloudFront-Viewer-Country", "US")
+
+	if got := clientCountry(r); got != "" {
+		t.Errorf("without a country header configured: got %q", got)
+	}
+
+	CountryHeader = "CloudFront-Viewer-Country"
+	t.Cleanup(func() { CountryHeader = "" })
+	if got := clientCountry(r); got != "US" {
+		t.Errorf("got %q, want US", got)
+	}
+
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	TrustedProxies = []*net.IPNet{lb}
+	t.Cleanup(func() { TrustedProxies = nil })
+	if got := clientCountry(r); got != "US" {
+		t.Errorf("through a trusted proxy: got %q, want US", got)
+	}
+	r.RemoteAddr = "203.0.113.9:1234"
+	if got := clientCountry(r); got != "" {
+		t.Errorf("around the proxy: got %q, want nothing", got)
+	}
+}
@@ -3,41 +3,79 @@ package web
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/guregu/intertube/storage"
 	"github.com/guregu/intertube/tube"
 )
 
 type settingsFormData struct {
-	User         tube.User
-	Plan         tube.Plan
-	HasSub       bool
-	ErrorMsg     string
-	CacheEnabled bool
+	User              tube.User
+	Plan              tube.Plan
+	HasSub            bool
+	ErrorMsg          string
+	CacheEnabled      bool
+	EncryptionEnabled bool
 }
 
-func settingsForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func (data settingsFormData) ReferralLink() string {
+	if !UseStripe || data.User.ReferralCode == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s/register?ref=%s", Domain, data.User.ReferralCode)
+}
+
+func (settingsFormData) ReferralBonus() int64 {
+	return tube.ReferralBonus
+}
+
+type notifySetting struct {
+	Category tube.EmailCategory
+	On       bool
+}
+
+func (data settingsFormData) Notifications() []notifySetting {
+	settings := make([]notifySetting, 0, len(tube.EmailCategories))
+	for _, cat := range tube.EmailCategories {
+		settings = append(settings, notifySetting{
+			Category: cat,
+			On:       data.User.WantsEmail(cat),
+		})
+	}
+	return settings
+}
+
+func settingsForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	plan := tube.GetPlan(u.Plan)
 
+	if err := u.EnsureReferralCode(ctx); err != nil {
+		return err
+	}
+
 	var hasSub bool
 	if UseStripe {
 		cust, err := getCustomer(u.CustomerID)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		// spew.Dump(cust)
 		hasSub = cust.Subscriptions != nil && len(cust.Subscriptions.Data) > 0
 	}
 
 	data := settingsFormData{
-		User:         u,
-		HasSub:       hasSub,
-		Plan:         plan,
-		CacheEnabled: storage.IsCacheEnabled(),
+		User:              u,
+		HasSub:            hasSub,
+		Plan:              plan,
+		CacheEnabled:      storage.IsCacheEnabled(),
+		EncryptionEnabled: storage.EncryptionEnabled(),
 	}
 	renderTemplate(ctx, w, "settings", data, http.StatusOK)
+	return nil
 }
 
 func settings(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -46,7 +84,7 @@ func settings(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	cust, err := getCustomer(u.CustomerID)
 	if err != nil {
-		fmt.Println("cust err", err)
+		slog.ErrorContext(ctx, "settings: failed to get customer", "err", err)
 		// panic(err)
 	}
 	// spew.Dump(cust)
@@ -54,21 +92,69 @@ func settings(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	renderError := func(err error) {
 		data := settingsFormData{
-			User:         u,
-			Plan:         plan,
-			HasSub:       hasSub,
-			ErrorMsg:     err.Error(),
-			CacheEnabled: storage.IsCacheEnabled(),
+			User:              u,
+			Plan:              plan,
+			HasSub:            hasSub,
+			ErrorMsg:          err.Error(),
+			CacheEnabled:      storage.IsCacheEnabled(),
+			EncryptionEnabled: storage.EncryptionEnabled(),
 		}
 		renderTemplate(ctx, w, "settings", data, http.StatusOK)
 	}
 
 	email := r.FormValue("email")
 	if email != "" && u.Email != email {
+		prev := u
 		if err := u.SetEmail(ctx, email); err != nil {
 			renderError(err)
 			return
 		}
+		audit(ctx, r, u.ID, tube.EventEmailChanged, prev.Email+" → "+u.Email)
+		// to the old address, in case it wasn't them
+		notifySecurity(ctx, prev, "email", clientIP(r).String())
+	}
+
+	restrict, err := tube.ParseRestrictions(r.FormValue("restrict-cidrs"), r.FormValue("restrict-countries"))
+	if err != nil {
+		renderError(err)
+		return
+	}
+	if !u.Restrict.Equal(restrict) {
+		if err := u.SetRestrictions(ctx, restrict); err != nil {
+			renderError(err)
+			return
+		}
+		detail := strings.Join(append(restrict.CIDRs, restrict.Countries...), " ")
+		audit(ctx, r, u.ID, tube.EventRestrictionsSet, detail)
+	}
+
+	if encrypt := r.FormValue("encrypt") == "on"; storage.EncryptionEnabled() && encrypt != u.Encrypt {
+		var key []byte
+		if encrypt && len(u.DataKey) == 0 {
+			var err error
+			if key, err = storage.NewDataKey(); err != nil {
+				renderError(err)
+				return
+			}
+		}
+		if err := u.SetEncrypt(ctx, encrypt, key); err != nil {
+			renderError(err)
+			return
+		}
+		audit(ctx, r, u.ID, tube.EventEncryptionSet, strconv.FormatBool(encrypt))
+	}
+
+	var optout []tube.EmailCategory
+	for _, cat := range tube.EmailCategories {
+		if r.FormValue("notify-"+string(cat)) != "on" {
+			optout = append(optout, cat)
+		}
+	}
+	if len(optout) != len(u.EmailOptOut) || slices.ContainsFunc(optout, u.WantsEmail) {
+		if err := u.SetEmailOptOut(ctx, optout); err != nil {
+			renderError(err)
+			return
+		}
 	}
 
 	theme := r.FormValue("theme")
@@ -79,6 +165,23 @@ func settings(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	lang := r.FormValue("language")
+	loudness := tube.LoudnessOpt(r.FormValue("loudness"))
+	if u.Prefs.Language != lang || u.Prefs.Loudness != loudness {
+		prefs := u.Prefs
+		prefs.Language = lang
+		prefs.Loudness = loudness
+		prefs, err := prefs.Normalize()
+		if err != nil {
+			renderError(err)
+			return
+		}
+		if err := u.SetPreferences(ctx, u.Theme, prefs); err != nil {
+			renderError(err)
+			return
+		}
+	}
+
 	disp := tube.DisplayOptions{}
 	disp.Stretch = r.FormValue("display-stretch") == "on"
 	switch r.FormValue("musiclink") {
@@ -130,6 +233,11 @@ func changePassword(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		renderTemplate(ctx, w, "settings-password", data, http.StatusOK)
 	}
 
+	if u.DirectoryDN != "" {
+		renderError(errDirectoryPassword)
+		return
+	}
+
 	oldpw := r.FormValue("old-password")
 	newpw := r.FormValue("new-password")
 	confirm := r.FormValue("new-password-confirm")
@@ -159,6 +267,8 @@ func changePassword(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		renderError(err)
 		return
 	}
+	audit(ctx, r, u.ID, tube.EventPasswordChanged, "")
+	notifySecurity(ctx, u, "password", clientIP(r).String())
 
 	data := struct {
 		User     tube.User
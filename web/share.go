@@ -0,0 +1,185 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// Share links are public pages for a single track, with OpenGraph and Twitter card tags
+// so they unfurl with the album art and an inline player wherever they're pasted.
+
+func init() {
+	kami.Use("/api/share", forbidGuests)
+	kami.Use("/api/share/", forbidGuests)
+	kami.Get("/api/share", handle(listShares))
+	kami.Post("/api/share", handle(createShare))
+	kami.Delete("/api/share/:id", handle(deleteShare))
+
+	kami.Get("/s/:id", handle(sharePage))
+	kami.Get("/s/:id/audio", handle(shareAudio))
+}
+
+func shareURL(s tube.Share) string {
+	return "https://" + Domain + "/s/" + s.ID
+}
+
+// shareView is the API view of tube.Share.
+type shareView struct {
+	tube.Share
+	URL string
+}
+
+// GET /api/share
+// Lists the user's share links, newest first.
+func listShares(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	shares, err := tube.GetShares(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.After(shares[j].Created)
+	})
+	views := make([]shareView, 0, len(shares))
+	for _, s := range shares {
+		views = append(views, shareView{Share: s, URL: shareURL(s)})
+	}
+	renderJSON(w, views, http.StatusOK)
+	return nil
+}
+
+// POST /api/share
+// Makes a share link for a track: {"Track": "id"}.
+// Sharing the same track again returns the same link.
+func createShare(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var input struct {
+		Track string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return err
+	}
+	t, err := tube.GetTrack(ctx, u.ID, input.Track)
+	if err != nil {
+		return err
+	}
+	shares, err := tube.GetShares(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	var share tube.Share
+	for _, s := range shares {
+		if s.TrackID == t.ID {
+			share = s
+			break
+		}
+	}
+	code := http.StatusOK
+	if share.ID == "" {
+		share, err = tube.NewShare(u.ID, t.ID)
+		if err != nil {
+			return err
+		}
+		if err := share.Create(ctx); err != nil {
+			return err
+		}
+		code = http.StatusCreated
+	}
+	resp := struct {
+		ID  string
+		URL string
+	}{
+		ID:  share.ID,
+		URL: shareURL(share),
+	}
+	renderJSON(w, resp, code)
+	return nil
+}
+
+// DELETE /api/share/:id
+// Revokes a share link. Links that don't exist or belong to someone else are not found.
+func deleteShare(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	s := tube.Share{ID: kami.Param(ctx, "id"), UserID: u.ID}
+	if err := s.Delete(ctx); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// loadShare finds the shared track and its owner.
+// Links to deleted tracks, or from accounts that can't play music, are gone.
+func loadShare(ctx context.Context, id string) (tube.Share, tube.Track, tube.User, error) {
+	s, err := tube.GetShare(ctx, id)
+	if err != nil {
+		return s, tube.Track{}, tube.User{}, err
+	}
+	owner, err := tube.GetUser(ctx, s.UserID)
+	if err != nil {
+		return s, tube.Track{}, owner, err
+	}
+	if owner.Deleting() || accessLevel(owner) == tube.AccessLocked {
+		return s, tube.Track{}, owner, tube.ErrNotFound
+	}
+	t, err := tube.GetTrack(ctx, s.UserID, s.TrackID)
+	if err != nil {
+		return s, t, owner, err
+	}
+	if t.Deleted {
+		return s, t, owner, tube.ErrNotFound
+	}
+	return s, t, owner, nil
+}
+
+// GET /s/:id
+func sharePage(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	s, t, _, err := loadShare(ctx, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	data := struct {
+		Track    tube.Track
+		URL      string
+		AudioURL string
+		ImageURL string
+	}{
+		Track:    t,
+		URL:      shareURL(s),
+		AudioURL: shareURL(s) + "/audio",
+	}
+	if t.Picture.ID != "" {
+		data.ImageURL = "https://" + Domain + thumbURL(t.Picture, 512)
+	}
+	renderTemplate(ctx, w, "share", data, http.StatusOK)
+	return nil
+}
+
+// GET /s/:id/audio
+// Redirects to the shared track's audio, or streams it if it can't be downloaded directly.
+func shareAudio(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	_, t, owner, err := loadShare(ctx, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	if egressBlocked(ctx, w, r, owner) {
+		return nil
+	}
+	if t.IsCold() {
+		ready, err := t.Thaw(ctx)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			warmingUp(ctx, w, r)
+			return nil
+		}
+	}
+	return sendTrack(ctx, w, r, owner, t)
+}
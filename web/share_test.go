@@ -0,0 +1,65 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestShares(t *testing.T) {
+	ctx, u := testDB(t)
+	other := tube.User{Email: "other@example.com"}
+	if err := other.Create(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mine, err := tube.NewShare(u.ID, "track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := tube.NewShare(other.ID, "track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []tube.Share{mine, theirs} {
+		if err := s.Create(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx = withUser(ctx, u)
+
+	w := httptest.NewRecorder()
+	if err := listShares(ctx, w, httptest.NewRequest("GET", "/api/share", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var list []shareView
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != mine.ID || list[0].URL != shareURL(mine) {
+		t.Errorf("shares: %+v, want just %s", list, mine.ID)
+	}
+
+	for _, id := range []string{theirs.ID, "nope"} {
+		del := kami.SetParam(ctx, "id", id)
+		err := deleteShare(del, httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/share/"+id, nil))
+		if code, _ := errorStatus(err); code != http.StatusNotFound {
+			t.Errorf("deleting share %s: %d (%v), want 404", id, code, err)
+		}
+	}
+	if _, err := tube.GetShare(ctx, theirs.ID); err != nil {
+		t.Error("someone else's share is gone:", err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := deleteShare(kami.SetParam(ctx, "id", mine.ID), w, httptest.NewRequest("DELETE", "/api/share/"+mine.ID, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("deleting my share: %d, want 204", w.Code)
+	}
+}
@@ -0,0 +1,166 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// The now-playing status is for things outside of inter.tube that want to show what a user is listening to,
+// like Discord rich presence bridges, OBS overlays, and smart home dashboards.
+// It's read with a status token, which can't do anything else, so it's safe to paste into their settings.
+
+const (
+	// a track that should've ended this long ago isn't playing anymore
+	statusGrace = 30 * time.Second
+	// nor is one that's been paused this long
+	statusPausedTTL = 15 * time.Minute
+)
+
+func init() {
+	kami.Get("/api/status/nowplaying", handle(getStatusNowPlaying))
+
+	kami.Use("/api/account/status", forbidGuests)
+	kami.Use("/api/account/status", forbidImpersonation)
+	kami.Post("/api/account/status", handle(createStatusToken))
+	kami.Delete("/api/account/status", handle(deleteStatusToken))
+}
+
+type nowPlayingStatus struct {
+	Playing bool
+	Paused  bool         `json:",omitempty"`
+	Track   *statusTrack `json:",omitempty"`
+	Updated int64        `json:",omitempty"` // unix millis
+}
+
+type statusTrack struct {
+	ID       string
+	Title    string
+	Artist   string
+	Album    string
+	ArtURL   string  `json:",omitempty"`
+	Duration int     // seconds
+	Position float64 // seconds
+}
+
+// GET /api/status/nowplaying?token=...
+// Also takes the token as Authorization: Bearer ...
+// Position is as of the request, so clients can count up from it between polls.
+func getStatusNowPlaying(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	token := r.FormValue("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	u, err := tube.CheckStatusToken(ctx, token)
+	if errors.Is(err, tube.ErrNotFound) {
+		return errUnauthorized("invalid status token")
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	// overlays are web pages on other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	status, err := nowPlaying(ctx, u, time.Now())
+	if err != nil {
+		return err
+	}
+	renderJSON(w, status, http.StatusOK)
+	return nil
+}
+
+// nowPlaying works out what u is listening to from their saved play queue.
+func nowPlaying(ctx context.Context, u tube.User, now time.Time) (nowPlayingStatus, error) {
+	var status nowPlayingStatus
+	if u.Deleting() || accessLevel(u) == tube.AccessLocked {
+		return status, nil
+	}
+	q, err := tube.GetPlayQueue(ctx, u.ID)
+	if errors.Is(err, tube.ErrNotFound) || (err == nil && q.Current == "") {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	t, err := tube.GetTrack(ctx, u.ID, q.Current)
+	if errors.Is(err, tube.ErrNotFound) || (err == nil && t.Deleted) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+
+	pos := q.Position
+	if q.Playing {
+		pos += now.Sub(q.Changed).Seconds()
+	}
+	duration := float64(t.Duration)
+	switch {
+	case q.Playing && t.Duration > 0 && pos > duration+statusGrace.Seconds():
+		return status, nil
+	case !q.Playing && now.Sub(q.Changed) > statusPausedTTL:
+		return status, nil
+	}
+	if t.Duration > 0 {
+		pos = min(pos, duration)
+	}
+
+	status.Playing = q.Playing
+	status.Paused = !q.Playing
+	status.Updated = q.Changed.UnixMilli()
+	status.Track = &statusTrack{
+		ID:       t.ID,
+		Title:    t.Info.Title,
+		Artist:   t.Info.Artist,
+		Album:    t.Info.Album,
+		Duration: t.Duration,
+		Position: pos,
+	}
+	if status.Track.Artist == "" {
+		status.Track.Artist = t.Info.AlbumArtist
+	}
+	if t.Picture.ID != "" {
+		status.Track.ArtURL = "https://" + Domain + thumbURL(t.Picture, 512)
+	}
+	return status, nil
+}
+
+// POST /api/account/status
+// Makes a new status token, replacing the old one.
+func createStatusToken(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	token, err := u.SetStatusToken(ctx)
+	if err != nil {
+		return err
+	}
+	audit(ctx, r, u.ID, tube.EventTokenCreated, "now playing status")
+	resp := struct {
+		Token string
+		URL   string
+	}{
+		Token: token,
+		URL:   "https://" + Domain + "/api/status/nowplaying?token=" + token,
+	}
+	renderJSON(w, resp, http.StatusCreated)
+	return nil
+}
+
+// DELETE /api/account/status
+// Turns off the now-playing status.
+func deleteStatusToken(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	if err := u.RemoveStatusToken(ctx); err != nil {
+		return err
+	}
+	audit(ctx, r, u.ID, tube.EventTokenRevoked, "now playing status")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,21 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/storage"
+)
+
+func init() {
+	kami.Get(storage.LocalPrefix+"*path", serveLocalStorage)
+	kami.Head(storage.LocalPrefix+"*path", serveLocalStorage)
+	kami.Put(storage.LocalPrefix+"*path", serveLocalStorage)
+}
+
+// serveLocalStorage handles presigned URLs when using the "fs" storage type
+func serveLocalStorage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	storage.ServeLocal(w, r, kami.Param(ctx, "path"))
+}
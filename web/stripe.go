@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -18,10 +18,10 @@ import (
 	"github.com/stripe/stripe-go/v72/customer"
 	stripeprice "github.com/stripe/stripe-go/v72/price"
 	"github.com/stripe/stripe-go/v72/product"
+	"github.com/stripe/stripe-go/v72/sub"
 	"github.com/stripe/stripe-go/v72/webhook"
 
 	// "github.com/stripe/stripe-go/v72/client"
-	"github.com/davecgh/go-spew/spew"
 
 	"github.com/guregu/intertube/tube"
 )
@@ -32,24 +32,34 @@ var (
 	UseStripe       bool
 )
 
-func initStripe() {
+// InitStripe enables payments if Stripe is configured in the environment.
+func InitStripe() {
+	if SelfHosted {
+		slog.Info("payment is disabled (self-hosted mode)")
+		return
+	}
+
 	key := os.Getenv("STRIPE_KEY")
 	stripePublicKey = os.Getenv("STRIPE_PUBLIC")
 	if key == "" || stripePublicKey == "" {
-		log.Println("Payment is disabled (missing Stripe key)")
+		slog.Info("payment is disabled (missing Stripe key)")
 		return
 	}
 
 	stripe.Key = key
 	UseStripe = true
 
+	if price := os.Getenv("STRIPE_METERED_PRICE"); price != "" {
+		tube.SetPlanPrice(tube.PlanKindMetered, price)
+	}
+
 	stripeSigSecret = os.Getenv("STRIPE_SIG")
 	if stripeSigSecret == "" {
-		log.Println("no stripe webhook sig")
+		slog.Warn("stripe: missing webhook signing secret")
 	}
 }
 
-func stripePortal(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func stripePortal(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	// get id
 	// if u.CustomerID == "" {
@@ -66,22 +76,28 @@ func stripePortal(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	// 	}
 	// }
 
+	cfg, err := billingPortalConfig()
+	if err != nil {
+		return err
+	}
 	sesh, err := portalsession.New(&stripe.BillingPortalSessionParams{
-		Customer:  stripe.String(u.CustomerID),
-		ReturnURL: stripe.String(fmt.Sprintf("https://%s/settings", Domain)),
+		Customer:      stripe.String(u.CustomerID),
+		ReturnURL:     stripe.String(fmt.Sprintf("https://%s/settings", Domain)),
+		Configuration: stripe.String(cfg),
 	})
 	// TODO: nice error msg
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	http.Redirect(w, r, sesh.URL, http.StatusSeeOther)
+	return nil
 }
 
-func stripeCheckout(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func stripeCheckout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	price := r.FormValue("price")
 	if price == "" {
-		panic("missing price")
+		return errBadRequest("missing price")
 	}
 	u, _ := userFrom(ctx)
 	var email, customerID *string
@@ -97,6 +113,13 @@ func stripeCheckout(ctx context.Context, w http.ResponseWriter, r *http.Request)
 			TrialEnd: stripe.Int64(u.PlanExpire.UTC().Unix()),
 		}
 	}
+	// metered prices are billed by usage, so they can't have a quantity
+	quantity := stripe.Int64(1)
+	for _, plan := range tube.GetPlans() {
+		if plan.PriceID == price && plan.Metered {
+			quantity = nil
+		}
+	}
 	resp, err := checkoutsession.New(&stripe.CheckoutSessionParams{
 		SuccessURL:         stripe.String(fmt.Sprintf("https://%s/buy/success?session_id={CHECKOUT_SESSION_ID}", Domain)),
 		CancelURL:          stripe.String(fmt.Sprintf("https://%s/buy/?cancel", Domain)),
@@ -110,13 +133,13 @@ func stripeCheckout(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		LineItems: []*stripe.CheckoutSessionLineItemParams{
 			{
 				Price:    stripe.String(price),
-				Quantity: stripe.Int64(1),
+				Quantity: quantity,
 			},
 		},
 		SubscriptionData: subparam,
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	data := struct {
@@ -126,12 +149,13 @@ func stripeCheckout(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	renderJSON(w, data, http.StatusOK)
+	return nil
 }
 
-func stripeCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func stripeCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	sessionID := r.URL.Query().Get("session_id")
 	if sessionID == "" {
-		panic("no session ID")
+		return errBadRequest("missing session ID")
 	}
 
 	params := &stripe.CheckoutSessionParams{}
@@ -139,7 +163,7 @@ func stripeCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Re
 	params.AddExpand("customer.subscriptions")
 	sesh, err := checkoutsession.Get(sessionID, params)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	switch sesh.PaymentStatus {
@@ -147,7 +171,7 @@ func stripeCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Re
 		if sesh.Subscription != nil {
 			u, err := reconcileSub(ctx, sesh.Subscription)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			data := struct {
 				User   tube.User
@@ -157,11 +181,10 @@ func stripeCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Re
 				Status: string(sesh.PaymentStatus),
 			}
 			renderTemplate(ctx, w, "checkout", data, http.StatusOK)
-			return
+			return nil
 		}
 	case stripe.CheckoutSessionPaymentStatusUnpaid:
-		log.Println("checkout failure")
-		spew.Dump(sesh)
+		slog.WarnContext(ctx, "stripe: checkout unpaid", "session", sesh.ID)
 
 		data := struct {
 			Status string
@@ -169,48 +192,57 @@ func stripeCheckoutResult(ctx context.Context, w http.ResponseWriter, r *http.Re
 			Status: string(sesh.PaymentStatus),
 		}
 		renderTemplate(ctx, w, "checkout-unpaid", data, http.StatusOK)
-		return
+		return nil
 	}
 
 	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	return nil
 }
 
-func stripeWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func stripeWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer r.Body.Close()
 
 	event, err := webhook.ConstructEvent(data, r.Header.Get("Stripe-Signature"), stripeSigSecret)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error verifying webhook signature: %v\n", err)
+		slog.WarnContext(ctx, "stripe: invalid webhook signature", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	log.Println("========")
-	log.Println("got stripe webhook:", event.Type)
-	log.Println(string(event.Data.Raw))
+	slog.InfoContext(ctx, "stripe: webhook", "type", event.Type)
+	slog.DebugContext(ctx, "stripe: webhook data", "data", string(event.Data.Raw))
 
 	switch event.Type {
 	case "checkout.session.completed":
 		var sesh *stripe.CheckoutSession
 		if err := json.Unmarshal(event.Data.Raw, &sesh); err != nil {
-			panic(err)
+			return err
+		}
+		if sesh.Mode == stripe.CheckoutSessionModePayment && sesh.Metadata["gift_plan"] != "" {
+			if sesh.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+				return nil
+			}
+			if _, err := fulfillGift(ctx, sesh); err != nil {
+				return err
+			}
+			return nil
 		}
 		uid, err := strconv.Atoi(sesh.ClientReferenceID)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		u, err := tube.GetUser(ctx, uid)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		if u.CustomerID != sesh.Customer.ID {
-			log.Println("set customerID for: ", u.ID, sesh.Customer.ID, "; old:", u.CustomerID)
+			slog.InfoContext(ctx, "stripe: set customer ID", "user_id", u.ID, "customer", sesh.Customer.ID, "old", u.CustomerID)
 			if err := u.SetCustomerID(ctx, sesh.Customer.ID); err != nil {
-				panic(err)
+				return err
 			}
 		}
 	case "customer.subscription.trial_will_end":
@@ -218,36 +250,64 @@ func stripeWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	case "invoice.paid":
 		var invoice *stripe.Invoice
 		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
-			panic(err)
+			return err
 		}
 
-		u, err := getUserByCustomer(ctx, invoice.Customer)
+		if invoice.Subscription == nil {
+			// one-off payment (gifts)
+			return nil
+		}
+		// the invoice's line items can include prorations for a previous plan,
+		// so use the subscription as the source of truth
+		s, err := sub.Get(invoice.Subscription.ID, nil)
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		item := invoice.Lines.Data[0]
-		expires := time.Unix(item.Period.End, 0)
-		plan, err := getPlanByProdID(item.Price.Product.ID)
+		u, err := reconcileSub(ctx, s)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		// update expire date
-		canceled := invoice.Subscription != nil && (invoice.Subscription.CancelAt > 0 && invoice.Subscription.CancelAtPeriodEnd)
-		if err := u.SetPlan(ctx, plan.Kind, tube.PlanStatusActive, expires, canceled); err != nil {
-			panic(err)
+		audit(ctx, nil, u.ID, tube.EventPaid, fmt.Sprintf("%s until %s (%s)", u.Plan, u.PlanExpire.Format(time.RFC3339),
+			formatCurrency(invoice.AmountPaid, invoice.Currency)))
+		if invoice.AmountPaid > 0 {
+			creditReferral(ctx, u)
 		}
-	case /*"customer.subscription.created", */ "customer.subscription.updated", "customer.subscription.deleted":
+	case "invoice.payment_failed":
+		var invoice *stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		if invoice.Subscription == nil {
+			return nil
+		}
+		s, err := sub.Get(invoice.Subscription.ID, nil)
+		if err != nil {
+			return err
+		}
+		u, err := reconcileSub(ctx, s)
+		if err != nil {
+			return err
+		}
+		data := struct {
+			Amount string
+		}{
+			Amount: formatCurrency(invoice.AmountDue, invoice.Currency),
+		}
+		if err := notify(ctx, u, tube.EmailBilling, "billing", data); err != nil {
+			slog.ErrorContext(ctx, "stripe: failed to send payment failed notice", "user_id", u.ID, "err", err)
+		}
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
 		var sub *stripe.Subscription
 		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			panic(err)
+			return err
 		}
 		if _, err := reconcileSub(ctx, sub); err != nil {
-			panic(err)
+			return err
 		}
 	default:
-		return
+		return nil
 	}
+	return nil
 }
 
 func reconcileSub(ctx context.Context, sub *stripe.Subscription) (tube.User, error) {
@@ -265,16 +325,31 @@ func reconcileSub(ctx context.Context, sub *stripe.Subscription) (tube.User, err
 		}
 	}
 	item := sub.Items.Data[0]
-	log.Println("prod ID", item)
+	slog.DebugContext(ctx, "stripe: subscription item", "item", item.ID, "product", item.Price.Product.ID)
 	plan, err := getPlanByProdID(item.Price.Product.ID)
 	if err != nil {
-		panic(err)
+		return u, err
 	}
 	expires := time.Unix(sub.CurrentPeriodEnd, 0)
 	canceled := sub.CancelAt > 0 && sub.CancelAtPeriodEnd
-	log.Println("update sub for", u.ID, "to", plan, "expire", expires, "canceled?", canceled)
-	err = u.SetPlan(ctx, plan.Kind, tube.PlanStatus(sub.Status), expires, canceled)
-	return u, err
+	slog.InfoContext(ctx, "stripe: update subscription", "user_id", u.ID, "plan", plan.Kind, "expires", expires, "canceled", canceled)
+	changed := u.Plan != plan.Kind || u.PlanStatus != tube.PlanStatus(sub.Status) || u.Canceled != canceled
+	if err = u.SetPlan(ctx, plan.Kind, tube.PlanStatus(sub.Status), expires, canceled); err != nil {
+		return u, err
+	}
+	var meteredItem string
+	if plan.Metered {
+		meteredItem = item.ID
+	}
+	if u.MeteredItem != meteredItem {
+		if err := u.SetMeteredItem(ctx, meteredItem); err != nil {
+			return u, err
+		}
+	}
+	if changed {
+		audit(ctx, nil, u.ID, tube.EventPlanChanged, fmt.Sprintf("%s (%s) canceled=%v", plan.Kind, sub.Status, canceled))
+	}
+	return u, nil
 }
 
 func getStripePrices(plans []tube.Plan) (map[tube.PlanKind]*stripe.Price, error) {
@@ -284,7 +359,7 @@ func getStripePrices(plans []tube.Plan) (map[tube.PlanKind]*stripe.Price, error)
 	})
 	for iter.Next() {
 		price := iter.Price()
-		fmt.Println("meta", price)
+		slog.Debug("stripe: price", "price", price.ID)
 		for _, plan := range plans {
 			if plan.PriceID == price.ID {
 				prices[plan.Kind] = price
@@ -305,13 +380,13 @@ func getUserByCustomer(ctx context.Context, c *stripe.Customer) (tube.User, erro
 		if err == nil {
 			return u, nil
 		}
-		log.Println("getUserByCustomer error1:", err)
+		slog.WarnContext(ctx, "stripe: customer's account not found", "account", uid, "err", err)
 	}
 
 	if u, err := tube.GetUserByCustomerID(ctx, c.ID); err == nil {
 		return u, nil
 	} else {
-		log.Println("getUserByCustomer error2:", err)
+		slog.WarnContext(ctx, "stripe: customer not found", "customer", c.ID, "err", err)
 	}
 
 	return tube.GetUserByEmail(ctx, c.Email)
@@ -336,6 +411,15 @@ func getCustomer(id string) (*stripe.Customer, error) {
 	return cust, err
 }
 
+// requirePayment hides billing pages when payment is disabled.
+func requirePayment(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if !UseStripe {
+		http.NotFound(w, r)
+		return nil
+	}
+	return ctx
+}
+
 func ensureCustomer(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 	if !UseStripe {
 		return ctx
@@ -343,7 +427,8 @@ func ensureCustomer(ctx context.Context, w http.ResponseWriter, r *http.Request)
 
 	if u, ok := userFrom(ctx); ok {
 		if err := ensureStripeCustomer(ctx, &u); err != nil {
-			panic(err)
+			renderError(ctx, w, r, err)
+			return nil
 		}
 		ctx = withUser(ctx, u)
 		return ctx
@@ -383,3 +468,37 @@ func formatCurrency(amt int64, currency stripe.Currency) string {
 	}
 	return fmt.Sprintf("%g %s", dec, strings.ToUpper(string(currency)))
 }
+
+// cancelSubscriptions immediately cancels all of a customer's subscriptions.
+func cancelSubscriptions(customerID string) error {
+	cust, err := getCustomer(customerID)
+	if err != nil {
+		return err
+	}
+	if cust.Subscriptions == nil {
+		return nil
+	}
+	for _, s := range cust.Subscriptions.Data {
+		if s.Status == stripe.SubscriptionStatusCanceled {
+			continue
+		}
+		if _, err := sub.Cancel(s.ID, nil); err != nil {
+			return fmt.Errorf("cancel subscription %s: %w", s.ID, err)
+		}
+	}
+	return nil
+}
+
+// creditReferral rewards a converted referral, if there is one.
+func creditReferral(ctx context.Context, u tube.User) {
+	ok, err := u.CreditReferral(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "referral: failed to credit", "user_id", u.ID, "err", err)
+		return
+	}
+	if ok {
+		slog.InfoContext(ctx, "referral: credited", "user_id", u.ID, "referrer", u.ReferredBy)
+		audit(ctx, nil, u.ID, tube.EventReferralCredited, "")
+		audit(ctx, nil, u.ReferredBy, tube.EventReferralCredited, "user "+strconv.Itoa(u.ID))
+	}
+}
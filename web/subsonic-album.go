@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/xml"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
@@ -57,7 +58,7 @@ func newSubsonicAlbum(tt []tube.Track, includeTracks bool) subsonicAlbum {
 	return album
 }
 
-func subsonicGetAlbumList2(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetAlbumList2(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	filter := subsonicFilter(r)
 
@@ -70,7 +71,7 @@ func subsonicGetAlbumList2(ctx context.Context, w http.ResponseWriter, r *http.R
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	split := lib.Albums(filter)
 
@@ -89,19 +90,20 @@ func subsonicGetAlbumList2(ctx context.Context, w http.ResponseWriter, r *http.R
 	resp.List.Albums = albums
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetAlbumList1(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetAlbumList1(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	filter := subsonicFilter(r)
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	allAlbums := lib.Albums(filter)
 
-	fmt.Printf("FILTER: %#v\n", filter)
+	slog.DebugContext(ctx, "subsonic: album list", "filter", fmt.Sprintf("%#v", filter))
 
 	resp := struct {
 		subsonicResponse
@@ -118,21 +120,22 @@ func subsonicGetAlbumList1(ctx context.Context, w http.ResponseWriter, r *http.R
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetAlbum(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetAlbum(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	rawid := r.FormValue("id")
 	ssid := tube.ParseSSID(rawid)
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	album, ok := lib.albums[ssid.String()]
 	if !ok {
 		writeSubsonic(ctx, w, r, subErr(70, "The requested data was not found."))
-		return
+		return nil
 	}
 
 	type subsonicAlbumResp struct {
@@ -144,6 +147,7 @@ func subsonicGetAlbum(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		Album:            newSubsonicAlbum(album.tracks, true),
 	}
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
 func subsonicFilter(r *http.Request) organize {
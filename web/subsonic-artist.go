@@ -47,15 +47,13 @@ func newSubsonicArtist(a *artistInfo) subsonicArtist {
 	return artist
 }
 
-func subsonicGetArtists(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetArtists(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
-	tracks, err := u.GetTracks(ctx)
+	grp, err := artistIndex(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	grp := groupTracks(tracks, true)
-
 	type artistsResp struct {
 		subsonicResponse
 		Indexes struct {
@@ -71,17 +69,27 @@ func subsonicGetArtists(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	resp.Indexes.List = newSubsonicIndexes(grp)
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetIndexes(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// artistIndex groups the user's tracks by artist, cached until their library changes.
+func artistIndex(ctx context.Context, u tube.User) (groupedTracks, error) {
+	return tube.Cached(tube.ModKey(u, "artists"), func() (groupedTracks, error) {
+		tracks, err := u.GetTracks(ctx)
+		if err != nil {
+			return groupedTracks{}, err
+		}
+		return groupTracks(tracks, true), nil
+	})
+}
+
+func subsonicGetIndexes(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
-	tracks, err := u.GetTracks(ctx)
+	grp, err := artistIndex(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	grp := groupTracks(tracks, true)
-
 	type artistsResp struct {
 		subsonicResponse
 		// TODO: ignoredArticles=""
@@ -98,16 +106,17 @@ func subsonicGetIndexes(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	resp.Indexes.List = newSubsonicIndexes(grp)
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetArtist(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetArtist(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	rawid := r.FormValue("id")
 	id := tube.ParseSSID(rawid).ID
 
 	tracks, err := u.GetTracks(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	sortTracks(tracks)
 
@@ -140,6 +149,7 @@ func subsonicGetArtist(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
 func subsonicGetArtistInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) {
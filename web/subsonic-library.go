@@ -3,7 +3,7 @@ package web
 import (
 	"context"
 	"encoding/xml"
-	"fmt"
+	"log/slog"
 	"net/http"
 	"sort"
 	"strconv"
@@ -116,12 +116,12 @@ func subsonicGetMusicFolders(ctx context.Context, w http.ResponseWriter, r *http
 	writeSubsonic(ctx, w, r, resp)
 }
 
-func subsonicGetGenres(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetGenres(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	grp, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	type subsonicGenre struct {
@@ -149,9 +149,10 @@ func subsonicGetGenres(ctx context.Context, w http.ResponseWriter, r *http.Reque
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicSearch2(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicSearch2(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	q := r.FormValue("query")
 	mfid := r.FormValue("musicFolderId")
@@ -164,7 +165,7 @@ func subsonicSearch2(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := struct {
@@ -206,9 +207,10 @@ func subsonicSearch2(ctx context.Context, w http.ResponseWriter, r *http.Request
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicSearch3(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicSearch3(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	q := r.FormValue("query")
 	mfid := r.FormValue("musicFolderId")
@@ -221,7 +223,7 @@ func subsonicSearch3(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := struct {
@@ -263,9 +265,10 @@ func subsonicSearch3(ctx context.Context, w http.ResponseWriter, r *http.Request
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetSongsByGenre(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetSongsByGenre(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	size, _ := strconv.Atoi(r.FormValue("size"))
@@ -279,13 +282,12 @@ func subsonicGetSongsByGenre(ctx context.Context, w http.ResponseWriter, r *http
 	genre := r.FormValue("genre")
 	match := tube.ParseSSID(r.FormValue("musicFolderId"))
 
-	lib, err := getLibrary(ctx, u)
+	lib, err := getGenreLibrary(ctx, u, genre)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	got := lib.Tracks(organize{
 		by:     "",
-		genre:  genre,
 		ssid:   match,
 		offset: offset,
 		size:   size,
@@ -309,16 +311,17 @@ func subsonicGetSongsByGenre(ctx context.Context, w http.ResponseWriter, r *http
 	resp.Songs.List = result
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
 // TODO: this is broken in json mode (doesn't turn into arrays)
-func subsonicGetStarred(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetStarred(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	match := tube.ParseSSID(r.FormValue("musicFolderId"))
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := struct {
@@ -361,8 +364,7 @@ func subsonicGetStarred(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		ssid:    match,
 		starred: true,
 	})
-	fmt.Println("STARS", tracks)
-	fmt.Println("LIB", lib.stars)
+	slog.DebugContext(ctx, "subsonic: starred", "tracks", len(tracks), "stars", len(lib.stars))
 	for _, t := range tracks {
 		resp.Starred.List = append(resp.Starred.List, newSubsonicSong(t, "song"))
 	}
@@ -403,8 +405,9 @@ func subsonicGetStarred(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		}
 
 		writeSubsonic(ctx, w, r, jresp)
-		return
+		return nil
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
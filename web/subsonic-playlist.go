@@ -49,7 +49,7 @@ func newSubsonicPlaylist(pl tube.Playlist, tracks []tube.Track, owner tube.User)
 	return list
 }
 
-func subsonicGetPlaylists(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetPlaylists(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	// <playlist id="15" name="Some random songs" comment="Just something I tossed together" owner="admin" public="false" songCount="6" duration="1391" created="2012-04-17T19:53:44" coverArt="pl-15">
 	u, _ := userFrom(ctx)
 
@@ -64,7 +64,7 @@ func subsonicGetPlaylists(ctx context.Context, w http.ResponseWriter, r *http.Re
 
 	pls, err := tube.GetPlaylists(ctx, u.ID)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// lib, err := getLibrary(ctx, u)
 	// if err != nil {
@@ -77,30 +77,31 @@ func subsonicGetPlaylists(ctx context.Context, w http.ResponseWriter, r *http.Re
 	}
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	// id := tube.ParseSSID(r.FormValue("id"))
 	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	pl, err := tube.GetPlaylist(ctx, u.ID, id)
 	if err == tube.ErrNotFound {
 		writeSubsonic(ctx, w, r, subErr(70, "The requested data was not found."))
-		return
+		return nil
 	} else if err != nil {
-		panic(err)
+		return err
 	}
 	tracks, err := playlistTracks(lib, pl)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := struct {
@@ -111,9 +112,10 @@ func subsonicGetPlaylist(ctx context.Context, w http.ResponseWriter, r *http.Req
 		Playlist:         newSubsonicPlaylist(pl, tracks, u),
 	}
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicCreatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicCreatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	r.ParseForm()
@@ -128,7 +130,7 @@ func subsonicCreatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	var tracks []tube.Track
 	for _, id := range ids {
@@ -142,13 +144,13 @@ func subsonicCreatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 	if pid != 0 {
 		pl, err := tube.GetPlaylist(ctx, u.ID, pid)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		pl.With(tracks)
 		if err := pl.Save(ctx); err != nil {
-			panic(err)
+			return err
 		}
-		return
+		return nil
 	}
 
 	pl := tube.Playlist{
@@ -157,7 +159,7 @@ func subsonicCreatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 	}
 	pl.With(tracks)
 	if err := pl.Create(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := struct {
@@ -168,9 +170,10 @@ func subsonicCreatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 		Playlist:         newSubsonicPlaylist(pl, tracks, u),
 	}
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicUpdatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicUpdatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	r.ParseForm()
@@ -181,7 +184,7 @@ func subsonicUpdatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 	// pid := tube.ParseSSID(r.FormValue("playlistId"))
 	pid, err := strconv.Atoi(r.FormValue("playlistId"))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	var add []string
@@ -193,18 +196,18 @@ func subsonicUpdatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 	for _, idx := range r.Form["songIndexToRemove"] {
 		i, err := strconv.Atoi(idx)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		rem[i] = struct{}{}
 	}
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	pl, err := tube.GetPlaylist(ctx, u.ID, pid)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	ids := make([]string, 0, len(pl.Tracks))
@@ -227,7 +230,7 @@ func subsonicUpdatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 	}
 
 	if err := pl.Save(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := struct {
@@ -238,18 +241,20 @@ func subsonicUpdatePlaylist(ctx context.Context, w http.ResponseWriter, r *http.
 		Playlist:         newSubsonicPlaylist(pl, tracks, u),
 	}
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicDeletePlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicDeletePlaylist(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	pid, err := strconv.Atoi(r.FormValue("playlistId"))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if err := tube.DeletePlaylist(ctx, u.ID, pid); err != nil {
-		panic(err)
+		return err
 	}
 
 	writeSubsonic(ctx, w, r, subOK())
+	return nil
 }
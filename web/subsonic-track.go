@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/xml"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
@@ -12,7 +13,6 @@ import (
 
 	"github.com/guregu/kami"
 
-	"github.com/guregu/intertube/storage"
 	"github.com/guregu/intertube/tube"
 )
 
@@ -43,6 +43,15 @@ type subsonicSong struct {
 	BookmarkPos int       `xml:"bookmarkPosition,attr,omitempty" json:"bookmarkPosition,omitempty"`
 	Type        string    `xml:"type,attr" json:"type"`
 	Starred     string    `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+	// OpenSubsonic extension
+	ReplayGain *subsonicReplayGain `xml:"replayGain,omitempty" json:"replayGain,omitempty"`
+}
+
+type subsonicReplayGain struct {
+	TrackGain float64  `xml:"trackGain,attr" json:"trackGain"`
+	AlbumGain *float64 `xml:"albumGain,attr,omitempty" json:"albumGain,omitempty"`
+	TrackPeak float64  `xml:"trackPeak,attr,omitempty" json:"trackPeak,omitempty"`
+	AlbumPeak float64  `xml:"albumPeak,attr,omitempty" json:"albumPeak,omitempty"`
 }
 
 func newSubsonicSong(t tube.Track, tagName string) subsonicSong {
@@ -79,15 +88,25 @@ func newSubsonicSong(t tube.Track, tagName string) subsonicSong {
 	if !t.Starred.IsZero() {
 		song.Starred = t.Starred.Format(subsonicTimeLayout)
 	}
+	if rg := t.ReplayGain; rg != nil {
+		song.ReplayGain = &subsonicReplayGain{
+			TrackGain: rg.TrackGain,
+			TrackPeak: rg.TrackPeak,
+			AlbumPeak: rg.AlbumPeak,
+		}
+		if rg.HasAlbum {
+			song.ReplayGain.AlbumGain = &rg.AlbumGain
+		}
+	}
 	return song
 }
 
-func subsonicGetMusicDirectory(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetMusicDirectory(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// <child id="11" parent="10" title="Arrival" artist="ABBA" isDir="true" coverArt="22"/>
@@ -135,7 +154,7 @@ func subsonicGetMusicDirectory(ctx context.Context, w http.ResponseWriter, r *ht
 			resp.Dir.Children = append(resp.Dir.Children, dir)
 		}
 		writeSubsonic(ctx, w, r, resp)
-		return
+		return nil
 		// get albums
 	case tube.SSIDAlbum:
 		albums := lib.Albums(organize{
@@ -159,23 +178,23 @@ func subsonicGetMusicDirectory(ctx context.Context, w http.ResponseWriter, r *ht
 			}
 		}
 		writeSubsonic(ctx, w, r, resp)
-		return
+		return nil
 	}
 
-	panic("unknown ID?")
+	return errNotFound("unknown ID")
 }
 
-func subsonicGetSong(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetSong(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	ssid := tube.ParseSSID(r.FormValue("id"))
 
 	track, err := tube.GetTrack(ctx, u.ID, ssid.ID)
 	if err == tube.ErrNotFound {
 		writeSubsonic(ctx, w, r, subErr(70, "The requested data was not found."))
-		return
+		return nil
 	}
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	type songResponse struct {
@@ -191,17 +210,17 @@ func subsonicGetSong(ctx context.Context, w http.ResponseWriter, r *http.Request
 	// resp.Song.ArtistID = resp.Song.Artist
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicStream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	id := tube.ParseSSID(r.FormValue("id")).ID
 	ctx = kami.SetParam(ctx, "id", id)
-	fmt.Println("ID", id)
-	fmt.Println(r.Form)
-	downloadTrack(ctx, w, r)
+	slog.DebugContext(ctx, "subsonic: stream", "id", id, "query", subsonicLogQuery(r))
+	return downloadTrack(ctx, w, r)
 }
 
-func subsonicScrobble(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicScrobble(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	id := tube.ParseSSID(r.FormValue("id")).ID
 	// at := time.Now().UTC()
@@ -212,22 +231,23 @@ func subsonicScrobble(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	track, err := tube.GetTrack(ctx, u.ID, id)
 	if err != nil {
 		writeSubsonic(ctx, w, r, subErr(70, "The requested data was not found."))
-		return
+		return nil
 	}
 
 	if err := track.IncPlays(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	writeSubsonic(ctx, w, r, subOK())
+	return nil
 }
 
-func subsonicGetCoverArt(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetCoverArt(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	rawid := r.FormValue("id")
 	if rawid == "" {
 		writeSubsonic(ctx, w, r, subErr(10, "Required parameter is missing."))
-		return
+		return nil
 	}
 	id := tube.ParseSSID(r.FormValue("id"))
 
@@ -245,7 +265,7 @@ func subsonicGetCoverArt(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 	lib, err := getLibrary(ctx, u)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	var track tube.Track
@@ -271,11 +291,11 @@ func subsonicGetCoverArt(ctx context.Context, w http.ResponseWriter, r *http.Req
 		if strings.HasPrefix(rawid, "pl-") {
 			pid, err := strconv.Atoi(strings.TrimPrefix(rawid, "pl-"))
 			if err != nil {
-				panic(err)
+				return err
 			}
 			pl, err := tube.GetPlaylist(ctx, u.ID, pid)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			for _, tid := range pl.Tracks {
 				if t, ok := lib.TrackByID(tid); ok && t.Picture.ID != "" {
@@ -292,18 +312,16 @@ func subsonicGetCoverArt(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 	if track.Picture.ID == "" {
 		writeSubsonic(ctx, w, r, subErr(70, "The requested data was not found."))
-		return
+		return nil
 	}
 
-	href, err := storage.FilesBucket.PresignGet(track.Picture.StorageKey(), thumbnailDownloadTTL)
-	if err != nil {
-		panic(err)
-	}
-
-	http.Redirect(w, r, href, http.StatusTemporaryRedirect)
+	// the art itself is cached for good, but which art this is can change
+	setCacheHeaders(w)
+	http.Redirect(w, r, artURL(track.Picture), http.StatusTemporaryRedirect)
+	return nil
 }
 
-func subsonicGetRandomSongs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicGetRandomSongs(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	size, _ := strconv.Atoi(r.FormValue("size"))
@@ -321,7 +339,7 @@ func subsonicGetRandomSongs(ctx context.Context, w http.ResponseWriter, r *http.
 
 	tracks, err := u.GetTracks(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	result := make([]subsonicSong, 0, size)
@@ -347,44 +365,78 @@ func subsonicGetRandomSongs(ctx context.Context, w http.ResponseWriter, r *http.
 	resp.Songs.List = result
 
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicGetLyrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	// TODO: unstub
+func subsonicGetLyrics(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	artist := r.FormValue("artist")
+	title := r.FormValue("title")
+
+	type subsonicLyrics struct {
+		Artist  string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+		Title   string `xml:"title,attr,omitempty" json:"title,omitempty"`
+		Content string `xml:",chardata" json:"value"`
+	}
 	resp := struct {
 		subsonicResponse
-		Lyrics struct {
-			// Artist string attr
-			// Title string attr
-			// Content chardata
-		} `xml:"lyrics" json:"lyrics"`
+		Lyrics subsonicLyrics `xml:"lyrics" json:"lyrics"`
 	}{
 		subsonicResponse: subOK(),
 	}
+
+	if title != "" {
+		lib, err := getLibrary(ctx, u)
+		if err != nil {
+			return err
+		}
+		for _, t := range lib.tracks {
+			if !strings.EqualFold(t.Info.Title, title) ||
+				(artist != "" && !strings.EqualFold(t.Info.Artist, artist) && !strings.EqualFold(t.Info.AlbumArtist, artist)) {
+				continue
+			}
+			words, err := trackLyrics(ctx, t)
+			if err != nil {
+				return fmt.Errorf("lyrics for track %s: %w", t.ID, err)
+			}
+			if !words.Found() || words.Text == "" {
+				continue
+			}
+			resp.Lyrics = subsonicLyrics{
+				Artist:  t.Info.Artist,
+				Title:   t.Info.Title,
+				Content: words.Text,
+			}
+			break
+		}
+	}
 	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
-func subsonicStar(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicStar(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	r.ParseForm()
 	now := time.Now().UTC()
 	ids := append(r.Form["id"], append(r.Form["albumId"], r.Form["artistId"]...)...)
 	for _, id := range ids {
 		if err := tube.SetStar(ctx, u.ID, tube.ParseSSID(id), now); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	writeSubsonic(ctx, w, r, subOK())
+	return nil
 }
 
-func subsonicUnstar(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func subsonicUnstar(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	r.ParseForm()
 	ids := append(r.Form["id"], append(r.Form["albumId"], r.Form["artistId"]...)...)
 	for _, id := range ids {
 		if err := tube.DeleteStar(ctx, u.ID, id); err != nil {
-			panic(err)
+			return err
 		}
 	}
 	writeSubsonic(ctx, w, r, subOK())
+	return nil
 }
@@ -5,9 +5,12 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -49,38 +52,37 @@ func init() {
 	add("getLicense", subsonicGetLicense)
 	add("getUser", subsonicGetUser)
 	add("getMusicFolders", subsonicGetMusicFolders)
-	add("getMusicDirectory", subsonicGetMusicDirectory)
-	add("getAlbumList", subsonicGetAlbumList1)
-	add("getAlbumList2", subsonicGetAlbumList2)
-	add("getAlbum", subsonicGetAlbum)
-	add("getArtists", subsonicGetArtists)
-	add("getIndexes", subsonicGetIndexes)
-	add("getGenres", subsonicGetGenres)
-	add("getArtist", subsonicGetArtist)
-	add("getRandomSongs", subsonicGetRandomSongs)
-	add("getSongsByGenre", subsonicGetSongsByGenre)
-	add("getStarred", subsonicGetStarred)
-	add("getStarred2", subsonicGetStarred)
-	add("search2", subsonicSearch2)
-	add("search3", subsonicSearch3)
-	add("getSong", subsonicGetSong)
-	add("getCoverArt", subsonicGetCoverArt)
-	add("stream", subsonicStream)
-	add("download", subsonicStream)
-	add("scrobble", subsonicScrobble)
-	add("star", subsonicStar)
-	add("unstar", subsonicUnstar)
-	add("getPlaylists", subsonicGetPlaylists)
-	add("getPlaylist", subsonicGetPlaylist)
-	add("createPlaylist", subsonicCreatePlaylist)
-	add("updatePlaylist", subsonicUpdatePlaylist)
-	add("deletePlaylist", subsonicDeletePlaylist)
-	// TODO: unstub
-	add("savePlayQueue", subsonicSavePlayQueue)
-	add("getPlayQueue", subsonicGetPlayQueue)
+	add("getMusicDirectory", subsonicHandle(subsonicGetMusicDirectory))
+	add("getAlbumList", subsonicHandle(subsonicGetAlbumList1))
+	add("getAlbumList2", subsonicHandle(subsonicGetAlbumList2))
+	add("getAlbum", subsonicHandle(subsonicGetAlbum))
+	add("getArtists", subsonicHandle(subsonicGetArtists))
+	add("getIndexes", subsonicHandle(subsonicGetIndexes))
+	add("getGenres", subsonicHandle(subsonicGetGenres))
+	add("getArtist", subsonicHandle(subsonicGetArtist))
+	add("getRandomSongs", subsonicHandle(subsonicGetRandomSongs))
+	add("getSongsByGenre", subsonicHandle(subsonicGetSongsByGenre))
+	add("getStarred", subsonicHandle(subsonicGetStarred))
+	add("getStarred2", subsonicHandle(subsonicGetStarred))
+	add("search2", subsonicHandle(subsonicSearch2))
+	add("search3", subsonicHandle(subsonicSearch3))
+	add("getSong", subsonicHandle(subsonicGetSong))
+	add("getCoverArt", subsonicHandle(subsonicGetCoverArt))
+	add("stream", subsonicWith(requireAllowedLocation, subsonicHandle(subsonicStream)))
+	add("download", subsonicWith(requireAllowedLocation, subsonicHandle(subsonicStream)))
+	add("scrobble", subsonicHandle(subsonicScrobble))
+	add("star", subsonicWith(forbidGuests, subsonicHandle(subsonicStar)))
+	add("unstar", subsonicWith(forbidGuests, subsonicHandle(subsonicUnstar)))
+	add("getPlaylists", subsonicHandle(subsonicGetPlaylists))
+	add("getPlaylist", subsonicHandle(subsonicGetPlaylist))
+	add("createPlaylist", subsonicWith(forbidGuests, subsonicHandle(subsonicCreatePlaylist)))
+	add("updatePlaylist", subsonicWith(forbidGuests, subsonicHandle(subsonicUpdatePlaylist)))
+	add("deletePlaylist", subsonicWith(forbidGuests, subsonicHandle(subsonicDeletePlaylist)))
+	add("savePlayQueue", subsonicWith(forbidGuests, subsonicHandle(subsonicSavePlayQueue)))
+	add("getPlayQueue", subsonicHandle(subsonicGetPlayQueue))
 	add("getArtistInfo", subsonicGetArtistInfo)
 	add("getArtistInfo2", subsonicGetArtistInfo)
-	add("getLyrics", subsonicGetLyrics)
+	add("getLyrics", subsonicHandle(subsonicGetLyrics))
 	add("getNowPlaying", subsonicGetNowPlaying)
 
 	// TODO:
@@ -201,8 +203,8 @@ func subsonicGetUser(ctx context.Context, w http.ResponseWriter, r *http.Request
 			AdminRole:         false,
 			SettingsRole:      false,
 			DownloadRole:      true,
-			UploadRole:        true,
-			PlaylistRole:      true,
+			UploadRole:        u.GetRole().AtLeast(tube.RoleUser),
+			PlaylistRole:      u.GetRole().AtLeast(tube.RoleUser),
 			CoverArtRole:      true,
 			CommentRole:       false,
 			PodcastRole:       false,
@@ -218,9 +220,8 @@ func subsonicGetUser(ctx context.Context, w http.ResponseWriter, r *http.Request
 }
 
 func subsonicAuth(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
-	if DebugMode {
-		out, _ := httputil.DumpRequest(r, true)
-		fmt.Println(string(out))
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		slog.DebugContext(ctx, "subsonic: request", "method", r.Method, "path", r.URL.Path, "query", subsonicLogQuery(r))
 	}
 
 	u := r.FormValue("u")
@@ -247,29 +248,43 @@ func subsonicAuth(ctx context.Context, w http.ResponseWriter, r *http.Request) c
 		return nil
 	}
 
-	// TODO: use subsonic token or something
-	user, err := tube.GetUserByEmail(ctx, u)
-	if err != nil {
-		writeSubsonic(ctx, w, r, subErr(40, "Wrong username or password"))
-		return nil
-	}
-
 	// http://your-server/rest/ping.view?u=joe&p=sesame&v=1.12.0&c=myapp
 	// http://your-server/rest/ping.view?u=joe&p=enc:736573616d65&v=1.12.0&c=myapp
 	if strings.HasPrefix(p, "enc:") {
 		enc := strings.TrimPrefix(p, "enc:")
 		pw, err := hex.DecodeString(enc)
 		if err != nil {
-			panic(err)
+			writeSubsonic(ctx, w, r, subErr(40, "Wrong username or password"))
+			return nil
 		}
 		p = string(pw)
 	}
 
-	if !user.ValidPassword(p) {
+	// TODO: use subsonic token or something
+	var user tube.User
+	var err error
+	if tube.IsDeviceToken(p) {
+		// paired devices use a device token as their password.
+		// these are never tried against LDAP, so a revoked device that keeps
+		// retrying can't lock the account out of the directory.
+		var dt tube.DeviceToken
+		user, dt, err = checkDeviceToken(ctx, u, p)
+		if err == nil {
+			ctx = withDevice(ctx, dt)
+		}
+	} else {
+		user, err = checkLogin(ctx, r, u, p)
+	}
+	if err != nil || user.Deleting() {
 		writeSubsonic(ctx, w, r, subErr(40, "Wrong username or password"))
 		return nil
 	}
 
+	if accessLevel(user) == tube.AccessLocked {
+		writeSubsonic(ctx, w, r, subErr(50, "Subscription expired"))
+		return nil
+	}
+
 	ctx = withUser(ctx, user)
 	return ctx
 }
@@ -296,14 +311,91 @@ func subsonicGetLicense(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	writeSubsonic(ctx, w, r, resp)
 }
 
-func subsonicSavePlayQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	// TODO: unstub
+// shared with the web player, see /api/queue
+func subsonicSavePlayQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	r.ParseForm()
+
+	if len(r.Form["id"]) == 0 {
+		if err := tube.ClearPlayQueue(ctx, u.ID); err != nil {
+			return err
+		}
+		writeSubsonic(ctx, w, r, subOK())
+		return nil
+	}
+
+	q := tube.PlayQueue{
+		UserID:    u.ID,
+		Current:   tube.ParseSSID(r.FormValue("current")).ID,
+		ChangedBy: r.FormValue("c"),
+	}
+	for _, id := range r.Form["id"] {
+		q.Tracks = append(q.Tracks, tube.ParseSSID(id).ID)
+	}
+	if len(q.Tracks) > tube.MaxQueueLen {
+		writeSubsonic(ctx, w, r, subErr(0, fmt.Sprintf("Too many tracks (max %d).", tube.MaxQueueLen)))
+		return nil
+	}
+	if pos := r.FormValue("position"); pos != "" {
+		ms, err := strconv.ParseInt(pos, 10, 64)
+		if err != nil || ms < 0 {
+			writeSubsonic(ctx, w, r, subErr(0, "Invalid position."))
+			return nil
+		}
+		q.Position = float64(ms) / 1000
+	}
+	if err := tube.SavePlayQueue(ctx, q); err != nil {
+		return err
+	}
 	writeSubsonic(ctx, w, r, subOK())
+	return nil
 }
 
-func subsonicGetPlayQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	// TODO: unstub
-	writeSubsonic(ctx, w, r, subOK())
+func subsonicGetPlayQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	q, err := tube.GetPlayQueue(ctx, u.ID)
+	if err == tube.ErrNotFound {
+		writeSubsonic(ctx, w, r, subOK())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	lib, err := getLibrary(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	// <playQueue current="133" position="45000" username="admin" changed="2015-02-18T15:22:22.825Z" changedBy="android">
+	type playQueue struct {
+		Current   string         `xml:"current,attr,omitempty" json:"current,omitempty"`
+		Position  int64          `xml:"position,attr" json:"position"`
+		Username  string         `xml:"username,attr" json:"username"`
+		Changed   string         `xml:"changed,attr" json:"changed"`
+		ChangedBy string         `xml:"changedBy,attr" json:"changedBy"`
+		Entries   []subsonicSong `json:"entry,omitempty"`
+	}
+	resp := struct {
+		subsonicResponse
+		PlayQueue playQueue `xml:"playQueue" json:"playQueue"`
+	}{
+		subsonicResponse: subOK(),
+		PlayQueue: playQueue{
+			Position:  int64(q.Position * 1000),
+			Username:  u.Email,
+			Changed:   q.Changed.Format(subsonicTimeLayout),
+			ChangedBy: q.ChangedBy,
+		},
+	}
+	if q.Current != "" {
+		resp.PlayQueue.Current = tube.NewSSID(tube.SSIDTrack, q.Current).String()
+	}
+	// tracks deleted since it was saved are left out
+	for _, t := range lib.TracksByID(q.Tracks) {
+		resp.PlayQueue.Entries = append(resp.PlayQueue.Entries, newSubsonicSong(t, "entry"))
+	}
+	writeSubsonic(ctx, w, r, resp)
+	return nil
 }
 
 func subsonicGetNowPlaying(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -311,6 +403,23 @@ func subsonicGetNowPlaying(ctx context.Context, w http.ResponseWriter, r *http.R
 	writeSubsonic(ctx, w, r, subOK())
 }
 
+// subsonicSecrets are request parameters that carry credentials: passwords (or device tokens),
+// token authentication's token and salt, and API keys.
+var subsonicSecrets = []string{"p", "t", "s", "apiKey"}
+
+// subsonicLogQuery returns the request's parameters for logging, with credentials redacted.
+func subsonicLogQuery(r *http.Request) string {
+	r.ParseForm()
+	form := make(url.Values, len(r.Form))
+	for k, v := range r.Form {
+		if slices.Contains(subsonicSecrets, k) {
+			v = []string{"REDACTED"}
+		}
+		form[k] = v
+	}
+	return form.Encode()
+}
+
 func writeSubsonic(ctx context.Context, w http.ResponseWriter, r *http.Request, resp any) {
 	f := formatFrom(ctx)
 	switch f {
@@ -323,10 +432,9 @@ func writeSubsonic(ctx context.Context, w http.ResponseWriter, r *http.Request,
 			Resp: resp,
 		}
 
-		if DebugMode {
-			fmt.Println("\n>>>>>>>>>>>>>>> "+r.URL.EscapedPath(), " ? ", r.URL.Query().Encode())
+		if slog.Default().Enabled(ctx, slog.LevelDebug) {
 			raw, err := json.Marshal(wrap)
-			fmt.Println("=================\n"+string(raw)+"\n~~~~~~~err", err, "~~~~~~~")
+			slog.DebugContext(ctx, "subsonic: response", "query", subsonicLogQuery(r), "body", string(raw), "err", err)
 		}
 
 		renderJSON(w, wrap, http.StatusOK)
@@ -345,23 +453,56 @@ func writeSubsonic(ctx context.Context, w http.ResponseWriter, r *http.Request,
 			Resp: resp,
 		}
 
-		fmt.Fprintf(w, "%s(", cb)
 		js, err := json.Marshal(wrap)
 		if err != nil {
-			panic(err)
+			slog.ErrorContext(ctx, "subsonic: encoding response failed", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		fmt.Fprintf(w, "%s(", cb)
 		fmt.Fprint(w, string(js))
 		fmt.Fprint(w, ");")
-	case "xml":
-		if DebugMode {
+	default:
+		// XML is the default, and what unknown formats get
+		if slog.Default().Enabled(ctx, slog.LevelDebug) {
 			raw, err := xml.MarshalIndent(resp, "  ", "	")
-			fmt.Println("\n>>>>>>>>>>>>>>> "+r.URL.EscapedPath(), " ? ", r.URL.Query().Encode())
-			fmt.Println("=================\n"+string(raw)+"\n~~~~~~~~ err:", err, "~~~~")
+			slog.DebugContext(ctx, "subsonic: response", "query", subsonicLogQuery(r), "body", string(raw), "err", err)
 		}
 
 		renderXML(w, resp, http.StatusOK)
-	default:
-		panic("unknown format: " + f)
+	}
+}
+
+// subsonicWith runs middleware for a single Subsonic method, which is served at several paths.
+func subsonicWith(mw func(context.Context, http.ResponseWriter, *http.Request) context.Context, h kami.HandlerFunc) kami.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if ctx = mw(ctx, w, r); ctx == nil {
+			return
+		}
+		h(ctx, w, r)
+	}
+}
+
+// subsonicHandle adapts h for kami, rendering any error it returns as a Subsonic error.
+// Server errors are logged and their details aren't shown.
+func subsonicHandle(h handler) kami.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		err := h(ctx, w, r)
+		if err == nil {
+			return
+		}
+		status, msg := errorStatus(err)
+		if status >= 500 {
+			slog.ErrorContext(ctx, "subsonic: request failed", "status", status, "err", err)
+		}
+		code := 0 // A generic error.
+		switch {
+		case status == http.StatusNotFound:
+			code = 70 // The requested data was not found.
+		case errors.Is(err, strconv.ErrSyntax):
+			code = 10 // Required parameter is missing.
+		}
+		writeSubsonic(ctx, w, r, subErr(code, msg))
 	}
 }
 
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/guregu/intertube/tube"
+)
+
+func TestSubsonicAuth(t *testing.T) {
+	ctx, u := testDB(t)
+	pw, err := tube.HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetPassword(ctx, pw); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := tube.CreateDeviceToken(ctx, u.ID, "TV")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := func(login, password string) (context.Context, bool) {
+		t.Helper()
+		q := url.Values{"u": {login}, "p": {password}, "f": {"json"}}
+		r := httptest.NewRequest("GET", "/rest/getLicense.view?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		got := subsonicAuth(ctx, w, r)
+		if got == nil {
+			return nil, false
+		}
+		user, ok := userFrom(got)
+		if ok && user.ID != u.ID {
+			t.Fatalf("logged in as user %d, want %d", user.ID, u.ID)
+		}
+		return got, ok
+	}
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		ok       bool
+	}{
+		{"password", u.Email, "hunter2", true},
+		{"hex password", u.Email, "enc:" + hex.EncodeToString([]byte("hunter2")), true},
+		{"wrong password", u.Email, "hunter3", false},
+		{"device token", u.Email, token, true},
+		{"device token, email in caps", "TEST@example.com", token, true},
+		{"someone else's device token", "other@example.com", token, false},
+		{"made-up device token", u.Email, "AAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", false},
+	}
+	for _, test := range tests {
+		got, ok := auth(test.login, test.password)
+		if ok != test.ok {
+			t.Errorf("%s: logged in = %v, want %v", test.name, ok, test.ok)
+		}
+		if !ok {
+			continue
+		}
+		if _, isDevice := deviceFrom(got); isDevice != (test.password == token) {
+			t.Errorf("%s: device = %v", test.name, isDevice)
+		}
+	}
+
+	// changing the password unpairs devices
+	if err := u.SetPassword(ctx, pw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := auth(u.Email, token); ok {
+		t.Error("device token still works after the password changed")
+	}
+}
+
+func TestSubsonicHandle(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, `status="ok"`},
+		{tube.ErrNotFound, `<error code="70" message="not found">`},
+		{errors.New("secret details"), `<error code="0" message="internal server error">`},
+	}
+	for _, test := range tests {
+		h := subsonicHandle(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			if test.err != nil {
+				return test.err
+			}
+			writeSubsonic(ctx, w, r, subOK())
+			return nil
+		})
+		r := httptest.NewRequest("GET", "/rest/getPlayQueue.view", nil)
+		w := httptest.NewRecorder()
+		h(context.Background(), w, r)
+		if body := w.Body.String(); !strings.Contains(body, test.want) {
+			t.Errorf("error %v: got %s, want %s", test.err, body, test.want)
+		}
+	}
+}
+
+func TestSubsonicLogQuery(t *testing.T) {
+	r := httptest.NewRequest("GET", "/rest/stream.view?u=me&p=enc:68756e74657232&t=abc&s=salt&apiKey=key&id=123", nil)
+	got, err := url.ParseQuery(subsonicLogQuery(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range subsonicSecrets {
+		if v := got.Get(k); v != "REDACTED" {
+			t.Errorf("%s: %q, want it redacted", k, v)
+		}
+	}
+	if got.Get("u") != "me" || got.Get("id") != "123" {
+		t.Errorf("other parameters: %v", got)
+	}
+}
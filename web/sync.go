@@ -4,17 +4,56 @@ import (
 	"context"
 	"net/http"
 	"sort"
+	"strconv"
+	"time"
+
+	"github.com/guregu/kami"
 
 	"github.com/guregu/intertube/tube"
 )
 
-func syncForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func init() {
+	kami.Get("/api/changes", handle(listChanges))
+}
+
+// GET /api/changes?since=...
+// Lists the IDs of tracks created, updated, or deleted since the Watermark
+// (Unix nanoseconds) from a previous call, so clients don't need to reload the whole library.
+// Without since, every track is listed as created.
+func listChanges(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	var since time.Time
+	if raw := r.FormValue("since"); raw != "" {
+		ns, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errBadRequest("invalid since")
+		}
+		since = time.Unix(0, ns).UTC()
+	}
+	// taken before reading, so anything changed during this call comes up again next time
+	watermark := time.Now().UTC()
+	changes, err := u.GetTrackChanges(ctx, since)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		tube.TrackChanges
+		Watermark int64
+	}{
+		TrackChanges: changes,
+		Watermark:    watermark.UnixNano(),
+	}
+	renderJSON(w, data, http.StatusOK)
+	return nil
+}
+
+func syncForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	// test lol
 	tracks, err := u.GetTracks(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	lib := NewLibrary(tracks, nil)
 	type meta struct {
@@ -24,6 +63,7 @@ func syncForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		Path    string
 		URL     string
 	}
+	country := clientCountry(r)
 	metadata := make([]meta, 0, len(lib.tracks))
 	index := make(map[string]meta, len(lib.tracks))
 	for _, t := range lib.Tracks(organize{}) {
@@ -32,7 +72,7 @@ func syncForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 			Size:    t.Size,
 			LastMod: t.LocalMod,
 			Path:    t.VirtualPath(),
-			URL:     presignTrackDL(u, t),
+			URL:     presignTrackDL(u, t, country),
 		}
 		metadata = append(metadata, m)
 		index[m.ID] = m
@@ -51,4 +91,5 @@ func syncForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		Index:    index,
 	}
 	renderTemplate(ctx, w, "sync", data, http.StatusOK)
+	return nil
 }
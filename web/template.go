@@ -5,7 +5,7 @@ import (
 	"context"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -15,24 +15,25 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/kardianos/osext"
 
+	"github.com/guregu/intertube/ldap"
 	"github.com/guregu/intertube/storage"
 	"github.com/guregu/intertube/tube"
 )
 
 var templates *template.Template
 
-func getTemplate(ctx context.Context, name string) *template.Template {
+func getTemplate(ctx context.Context, name string) (*template.Template, error) {
 	t := templates.Lookup(name + ".gohtml")
 	if t == nil {
-		panic("no template: " + name)
+		return nil, fmt.Errorf("render: missing template: %s", name)
 	}
 
 	t, err := t.Clone()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	t.Funcs(templateFuncs(ctx))
-	return t
+	return t, nil
 }
 
 func templateFuncs(ctx context.Context) template.FuncMap {
@@ -52,6 +53,14 @@ func templateFuncs(ctx context.Context) template.FuncMap {
 	m["lang"] = func() string { return lang }
 	m["path"] = func() string { return pathFrom(ctx) }
 	m["loggedin"] = func() bool { return loggedIn }
+	m["impersonator"] = func() int {
+		id, _ := impersonatorFrom(ctx)
+		return id
+	}
+	m["lapsed"] = func() bool { return loggedIn && accessLevel(user) != tube.AccessFull }
+	m["locked"] = func() bool { return loggedIn && accessLevel(user) == tube.AccessLocked }
+	m["graceends"] = func() string { return user.GraceEnds().Format("2006-01-02") }
+	m["announcements"] = func() []tube.Announcement { return currentAnnouncements(ctx) }
 
 	return m
 }
@@ -71,6 +80,7 @@ func parseTemplates() *template.Template {
 		"render":     renderFunc(context.Background()),
 		"stylesheet": renderCSSFunc(context.Background(), "default"),
 		"opts":       func() tube.DisplayOptions { return tube.DisplayOptions{} },
+		"static":     func(name string) string { return StaticURL + "/" + name },
 
 		"timestamp": func(t time.Time) template.HTML {
 			dateFmt := "2006-01-02 15:04"
@@ -126,19 +136,27 @@ func parseTemplates() *template.Template {
 		},
 		"currency": formatCurrency,
 
-		"tr":       translateFunc(defaultLocalizer),
-		"tc":       translateCountFunc(defaultLocalizer),
-		"lang":     func() string { return "en" },
-		"path":     func() string { return "" },
-		"loggedin": func() bool { return false },
+		"tr":            translateFunc(defaultLocalizer),
+		"tc":            translateCountFunc(defaultLocalizer),
+		"lang":          func() string { return "en" },
+		"path":          func() string { return "" },
+		"loggedin":      func() bool { return false },
+		"impersonator":  func() int { return 0 },
+		"lapsed":        func() bool { return false },
+		"locked":        func() bool { return false },
+		"graceends":     func() string { return "" },
+		"announcements": func() []tube.Announcement { return nil },
 
+		"art":   artURL,
+		"thumb": thumbURL,
 		"sign": func(key string) (string, error) {
-			return storage.FilesBucket.PresignGet(key, thumbnailDownloadTTL)
+			return storage.FilesBucket.PresignGet(key, ThumbnailDownloadTTL)
 		},
 
 		"payment": func() bool {
 			return UseStripe
 		},
+		"directory": ldap.Enabled,
 
 		"blankzero": func(i int) string {
 			if i == 0 {
@@ -163,14 +181,14 @@ func parseTemplates() *template.Template {
 
 func renderFunc(ctx context.Context) func(string, interface{}) (template.HTML, error) {
 	return func(name string, data interface{}) (template.HTML, error) {
-		target := getTemplate(ctx, name)
-		if target == nil {
-			return "", fmt.Errorf("render: missing template: %s", name)
+		target, err := getTemplate(ctx, name)
+		if err != nil {
+			return "", err
 		}
 		var buf bytes.Buffer
-		err := target.Execute(&buf, data)
+		err = target.Execute(&buf, data)
 		if err != nil {
-			fmt.Println("ERR!!", err)
+			slog.ErrorContext(ctx, "render: template failed", "template", name, "err", err)
 			return "", err
 		}
 		return template.HTML(buf.String()), nil
@@ -186,14 +204,14 @@ func renderCSSFunc(ctx context.Context, active string) func(string, interface{})
 			name = active
 		}
 		name = "_style-" + name
-		target := getTemplate(ctx, name)
-		if target == nil {
-			return "", fmt.Errorf("render: missing template: %s", name)
+		target, err := getTemplate(ctx, name)
+		if err != nil {
+			return "", err
 		}
 		var buf bytes.Buffer
-		err := target.Execute(&buf, data)
+		err = target.Execute(&buf, data)
 		if err != nil {
-			fmt.Println("ERR!!", err)
+			slog.ErrorContext(ctx, "render: template failed", "template", name, "err", err)
 			return "", err
 		}
 		return template.CSS(buf.String()), nil
@@ -209,18 +227,27 @@ func WatchFiles() func() error {
 	go func() {
 		for {
 			select {
-			case ev := <-watcher.Events:
-				log.Println("watch event:", ev)
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				slog.Debug("watch event", "event", ev)
 				switch filepath.Ext(ev.Name) {
 				case ".gohtml", ".gojs":
-					log.Println("Reloading templates...", filepath.Base(ev.Name))
+					slog.Info("reloading templates", "file", filepath.Base(ev.Name))
 					templates = parseTemplates()
 				case ".toml":
-					log.Println("Reloading translations...", filepath.Base(ev.Name))
-					loadTranslations() // TODO: this is racy/busted, newer Go versions get mad
+					slog.Info("reloading translations", "file", filepath.Base(ev.Name))
+					// TODO: this is racy/busted, newer Go versions get mad
+					if err := loadTranslations(); err != nil {
+						slog.Error("reloading translations failed", "err", err)
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
 				}
-			case err := <-watcher.Errors:
-				log.Println("watch error:", err)
+				slog.Error("watch error", "err", err)
 			}
 		}
 	}()
@@ -235,6 +262,6 @@ func WatchFiles() func() error {
 	if err := watcher.Add(filepath.Join(here, "assets", "text")); err != nil {
 		panic(err)
 	}
-	log.Println("Hot reloading enabled")
+	slog.Info("hot reloading enabled")
 	return watcher.Close
 }
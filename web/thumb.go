@@ -0,0 +1,192 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/kami"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/guregu/intertube/storage"
+	"github.com/guregu/intertube/tube"
+)
+
+// sizes pictures can be scaled down to, in pixels on the longest side
+var thumbSizes = []int{128, 256, 512}
+
+const (
+	// how long a request waits for a thumbnail before falling back to the full picture
+	thumbWait = 2 * time.Second
+	// how long making one can take
+	thumbTimeout = time.Minute
+)
+
+// thumbs makes sure each thumbnail is only made once at a time,
+// no matter how many requests are waiting for it
+var thumbs singleflight.Group
+
+func init() {
+	kami.Get("/art/:size/:file", handle(getThumb))
+}
+
+// thumbURL is the permanent URL of p scaled down to fit size.
+func thumbURL(p tube.Picture, size int) string {
+	return "/art/" + strconv.Itoa(size) + "/" + p.ID + "." + p.Ext
+}
+
+// thumbKey is where p's thumbnail is stored, and its type.
+func thumbKey(p tube.Picture, size int) (key, ctype string) {
+	key = p.ThumbKey(size)
+	if path.Ext(key) == ".png" {
+		return key, "image/png"
+	}
+	return key, "image/jpeg"
+}
+
+// GET /art/:size/:id.:ext
+// Thumbnails are made on first request and stored next to the picture.
+// If it's taking a while, the client is sent to the full picture in the meantime.
+func getThumb(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	size, err := strconv.Atoi(kami.Param(ctx, "size"))
+	if err != nil || !validThumbSize(size) {
+		return errNotFound("not found")
+	}
+	file := kami.Param(ctx, "file")
+	if !validArtFile.MatchString(file) {
+		return errNotFound("not found")
+	}
+	ext := path.Ext(file)
+	pic := tube.Picture{ID: strings.TrimSuffix(file, ext), Ext: ext[1:]}
+	etag := fmt.Sprintf(`"%s-%d"`, pic.ID, size)
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("Cache-Control", artCacheControl)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	key, ctype := thumbKey(pic, size)
+	bucket := storage.WithContext(ctx, storage.FilesBucket)
+	if !bucket.Exists(key) {
+		done := thumbs.DoChan(key, func() (any, error) {
+			// keep going even if this request gives up, so the next one finds it
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), thumbTimeout)
+			defer cancel()
+			return nil, makeThumb(ctx, pic, size)
+		})
+		select {
+		case res := <-done:
+			if res.Err != nil {
+				return res.Err
+			}
+		case <-time.After(thumbWait):
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, artURL(pic), http.StatusFound)
+			return nil
+		}
+	}
+
+	obj, err := bucket.Get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Cache-Control", artCacheControl)
+	w.Header().Set("ETag", etag)
+	_, err = io.Copy(w, obj)
+	return err
+}
+
+func validThumbSize(size int) bool {
+	for _, s := range thumbSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// makeThumb scales p down to fit within size×size and stores it.
+// Pictures that are already small enough are stored as they are.
+func makeThumb(ctx context.Context, p tube.Picture, size int) error {
+	bucket := storage.Traced(ctx, storage.FilesBucket)
+	if !bucket.Exists(p.StorageKey()) {
+		return errNotFound("not found")
+	}
+	obj, err := bucket.Get(p.StorageKey())
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("thumbnail: decoding %s: %w", p.StorageKey(), err)
+	}
+
+	key, ctype := thumbKey(p, size)
+	var buf bytes.Buffer
+	img := scaleDown(src, size)
+	if ctype == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return err
+	}
+	return bucket.Put(ctype, key, bytes.NewReader(buf.Bytes()))
+}
+
+// scaleDown shrinks src to fit within size×size, averaging the pixels that go into each new one.
+func scaleDown(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	dw, dh := size, size
+	if sw > sh {
+		dh = max(1, sh*size/sw)
+	} else {
+		dw = max(1, sw*size/sh)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.Set(x, y, color.NRGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/guregu/kami"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/guregu/intertube/logging"
+	"github.com/guregu/intertube/tracing"
+)
+
+type requestidkey struct{}
+
+const requestIDHeader = "X-Request-ID"
+
+// request IDs from a load balancer or proxy are trusted if they look reasonable
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// startSpan starts the request's root span and assigns it a request ID,
+// which is sent back in the X-Request-ID header.
+func startSpan(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Start(ctx, r.Method+" "+r.URL.Path,
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLPath(r.URL.Path))
+
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID(span)
+	}
+	span.SetAttributes(attribute.String("request.id", id))
+	w.Header().Set(requestIDHeader, id)
+	ctx = logging.With(ctx, "request_id", id, "route", r.Method+" "+routeLabel(r.URL.Path, 0))
+	return withRequestID(ctx, id)
+}
+
+// endSpan finishes the span started by startSpan.
+func endSpan(ctx context.Context, r *http.Request, route string, code int) {
+	span := trace.SpanFromContext(ctx)
+	span.SetName(r.Method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPResponseStatusCode(code))
+	if exception := kami.Exception(ctx); exception != nil {
+		span.SetAttributes(attribute.String("panic", fmt.Sprint(exception)))
+	}
+	if code >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
+
+// newRequestID uses the trace ID when tracing, so the two can be matched up.
+func newRequestID(span trace.Span) string {
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestidkey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestidkey{}).(string)
+	return id
+}
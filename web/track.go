@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -17,43 +18,45 @@ import (
 	"github.com/guregu/intertube/tube"
 )
 
-func deleteTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func deleteTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	trackID := kami.Param(ctx, "id")
 
 	if err := tube.DeleteTrack(ctx, u.ID, trackID); err != nil {
-		panic(err)
+		return err
 	}
+	audit(ctx, r, u.ID, tube.EventTrackDeleted, trackID)
 	if err := u.UpdateLastMod(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "deleted "+trackID)
+	return nil
 }
 
-func incPlays(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func incPlays(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	trackID := kami.Param(ctx, "id")
 	secs, _ := strconv.ParseFloat(r.FormValue("duration"), 64)
 
 	track, err := tube.GetTrack(ctx, u.ID, trackID)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if track.Duration == 0 && secs > 0 {
 		if err := track.SetDuration(ctx, int(secs)); err != nil && !dynamo.IsCondCheckFailed(err) {
-			panic(err)
+			return err
 		}
 	}
 
 	if err := track.IncPlays(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	if err := tube.IncTotalPlays(ctx, int(secs)); err != nil {
-		panic(err)
+		return err
 	}
 
 	// TODO: hmm...
@@ -62,9 +65,10 @@ func incPlays(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	// }
 
 	fmt.Fprint(w, track.Plays)
+	return nil
 }
 
-func setResume(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func setResume(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	trackID := kami.Param(ctx, "id")
 	secs, _ := strconv.ParseFloat(r.FormValue("cur"), 64)  // track current position
@@ -73,36 +77,32 @@ func setResume(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	track, err := tube.GetTrack(ctx, u.ID, trackID)
 	if err != nil {
-		if err == tube.ErrNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		panic(err)
+		return err
 	}
 
 	if err := track.SetResume(ctx, secs, mod); err != nil {
 		if dynamo.IsCondCheckFailed(err) {
-			w.WriteHeader(http.StatusConflict)
-			return
+			return errConflict("resume position is out of date")
 		}
-		panic(err)
+		return err
 	}
 
 	if err := u.UpdateLastMod(ctx); err != nil {
-		panic(err)
+		return err
 	}
 
 	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
-func editTrackForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func editTrackForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	// trackID, _ := strconv.Atoi(kami.Param(ctx, "id"))
 	id := kami.Param(ctx, "id")
 	ids := strings.Split(id, ",")
 	t, tracks, err := getMultiTracks(ctx, u, ids)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	multi := len(tracks) > 1
 
@@ -112,12 +112,21 @@ func editTrackForm(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	// }
 	// group := groupTracks(allTracks, true)
 
+	var words tube.Lyrics
+	if !multi {
+		words, err = trackLyrics(ctx, t)
+		if err != nil {
+			return fmt.Errorf("lyrics for track %s: %w", t.ID, err)
+		}
+	}
+
 	data := struct {
 		User     tube.User
 		IDs      string
 		Track    tube.Track
 		Tracks   tube.Tracks
 		Multi    bool
+		Lyrics   tube.Lyrics
 		LastMod  int64
 		ErrorMsg string
 	}{
@@ -126,18 +135,20 @@ func editTrackForm(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		Track:   t,
 		Tracks:  tracks,
 		Multi:   multi,
+		Lyrics:  words,
 		LastMod: u.LastMod.UnixNano(),
 	}
 	renderTemplate(ctx, w, "track-edit", data, http.StatusOK)
+	return nil
 }
 
-func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 	id := kami.Param(ctx, "id")
 	ids := strings.Split(id, ",")
 	t, tracks, err := getMultiTracks(ctx, u, ids)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	multi := len(tracks) > 1
 
@@ -154,6 +165,7 @@ func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 			Track    tube.Track
 			Tracks   tube.Tracks
 			Multi    bool
+			Lyrics   tube.Lyrics
 			LastMod  int64
 			ErrorMsg string
 		}{
@@ -178,22 +190,22 @@ func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		f, fh, err := r.FormFile("pic")
 		if err != http.ErrMissingFile && err != nil {
 			renderError(err)
-			return
+			return nil
 		}
 		if err == nil {
 			data, err := ioutil.ReadAll(f)
 			if err != nil {
 				renderError(err)
-				return
+				return nil
 			}
 			ext := path.Ext(fh.Filename)
 			if len(ext) > 0 && ext[0] == '.' {
 				ext = ext[1:]
 			}
-			pic, err := savePic(data, ext, fh.Header.Get("Content-Type"), t.Picture.Desc)
+			pic, err := savePic(ctx, data, ext, fh.Header.Get("Content-Type"), t.Picture.Desc)
 			if err != nil {
 				renderError(err)
-				return
+				return nil
 			}
 			newPic = pic
 		}
@@ -219,15 +231,21 @@ func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t.LastMod = time.Now().UTC()
 		if err := t.Save(ctx); err != nil {
 			renderError(err)
-			return
+			return nil
 		}
 		if err := u.UpdateLastMod(ctx); err != nil {
 			renderError(err)
-			return
+			return nil
+		}
+		if _, ok := r.Form["lyrics"]; ok {
+			if err := editLyrics(ctx, t, r.FormValue("lyrics")); err != nil {
+				renderError(err)
+				return nil
+			}
 		}
 
 		http.Redirect(w, r, "/track/"+t.ID+"/edit", http.StatusSeeOther)
-		return
+		return nil
 	}
 
 	info := tube.TrackInfo{
@@ -242,7 +260,7 @@ func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	disc, _ := strconv.Atoi(r.FormValue("disc"))
 	discs, _ := strconv.Atoi(r.FormValue("discs"))
 
-	update := func(u *dynamo.Update) {
+	update := func(u tube.Update) {
 		if info.Artist != "" {
 			u.Set("Artist", strings.ToLower(info.Artist))
 			u.Set("Info.Artist", info.Artist)
@@ -279,13 +297,27 @@ func editTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	if err := tube.MassUpdateTracks(ctx, u.ID, ids, update); err != nil {
 		renderError(err)
-		return
+		return nil
 	}
 	if err := u.UpdateLastMod(ctx); err != nil {
 		renderError(err)
-		return
+		return nil
 	}
 	http.Redirect(w, r, "/track/"+id+"/edit", http.StatusSeeOther)
+	return nil
+}
+
+// editLyrics saves the lyrics from the edit form as the user's own, if they were changed.
+func editLyrics(ctx context.Context, t tube.Track, text string) error {
+	old, err := tube.GetLyrics(ctx, t.UserID, t.ID)
+	if err != nil && !errors.Is(err, tube.ErrNotFound) {
+		return err
+	}
+	if strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n")) == old.Text {
+		return nil
+	}
+	_, err = saveUserLyrics(ctx, t, text)
+	return err
 }
 
 func getMultiTracks(ctx context.Context, u tube.User, ids []string) (t tube.Track, tracks tube.Tracks, err error) {
@@ -293,13 +325,13 @@ func getMultiTracks(ctx context.Context, u tube.User, ids []string) (t tube.Trac
 	if !multi {
 		t, err = tube.GetTrack(ctx, u.ID, ids[0])
 		if err != nil {
-			panic(err)
+			return t, nil, err
 		}
 		tracks = tube.Tracks{t}
 	} else {
 		tracks, err = tube.GetTracksBatch(ctx, u.ID, ids)
 		if err != nil {
-			panic(err)
+			return t, nil, err
 		}
 		t = tracks[0]
 		for _, tx := range tracks {
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/dynamo"
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// Deleted tracks go to the trash, where they can be restored for 30 days (tube.TrashTTL)
+// before the scheduled jobs delete them for good.
+
+func init() {
+	kami.Use("/api/trash", forbidGuests)
+	kami.Use("/api/trash", requireUnlocked)
+	kami.Use("/api/trash/", forbidGuests)
+	kami.Use("/api/trash/", requireUnlocked)
+	kami.Get("/api/trash", handle(listTrash))
+	kami.Post("/api/trash/:id/restore", handle(restoreTrack))
+	kami.Delete("/api/trash/:id", handle(purgeTrack))
+}
+
+// GET /api/trash
+// Lists deleted tracks, most recently deleted first, with when they'll be gone for good.
+func listTrash(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	trash, err := tube.GetTrash(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if trash == nil {
+		trash = []tube.TrashedTrack{}
+	}
+	renderJSON(w, trash, http.StatusOK)
+	return nil
+}
+
+// POST /api/trash/:id/restore
+// Puts a deleted track back in the library. It counts towards usage again,
+// so there has to be room for it. Responds with 409 Conflict if it's been uploaded again since.
+func restoreTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	tt, err := tube.GetTrashedTrack(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	if quota := u.CalcQuota(); quota != 0 && u.Usage+int64(tt.Track.Size) > quota {
+		return errBadRequest("upload quota exceeded")
+	}
+	t, err := tt.Restore(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		return errConflict("track is already in the library")
+	}
+	if err != nil {
+		return err
+	}
+	if err := u.UpdateLastMod(ctx); err != nil {
+		return err
+	}
+	renderJSON(w, t, http.StatusOK)
+	return nil
+}
+
+// DELETE /api/trash/:id
+// Deletes a track in the trash for good, without waiting.
+func purgeTrack(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	tt, err := tube.GetTrashedTrack(ctx, u.ID, kami.Param(ctx, "id"))
+	if err != nil {
+		return err
+	}
+	if err := tt.Purge(ctx); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
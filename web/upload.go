@@ -3,10 +3,12 @@ package web
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"path"
 	"strings"
@@ -20,17 +22,18 @@ import (
 	"github.com/mewkiz/flac"
 	"golang.org/x/crypto/sha3"
 
+	"github.com/guregu/intertube/lyrics"
 	"github.com/guregu/intertube/storage"
 	"github.com/guregu/intertube/tube"
 )
 
-func uploadForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func uploadForm(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	u, _ := userFrom(ctx)
 
 	// test lol
 	tracks, err := u.GetTracks(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	lib := NewLibrary(tracks, nil)
 	type meta struct {
@@ -53,38 +56,29 @@ func uploadForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		Dupes: dupes,
 	}
 	renderTemplate(ctx, w, "upload", data, http.StatusOK)
+	return nil
 }
 
-func handleUpload(ctx context.Context, key string, user tube.User, b2ID string) (tube.Track, error) {
-	id := path.Base(key)
-
-	fmeta, err := tube.GetFile(ctx, id)
-	if err != nil {
-		return tube.Track{}, err
-	}
+// handleUpload makes a track out of the upload fmeta, which is size bytes.
+// Only the parts of the file that are needed are downloaded,
+// but the content hash (the track ID) covers all of the audio.
+func handleUpload(ctx context.Context, fmeta *tube.File, size int64, user tube.User, b2ID string, check uploadCheck) (tube.Track, error) {
+	id := fmeta.ID
+	key := fmeta.Path()
 
 	if fmeta.TrackID != "" {
-		log.Println("already exists?", fmeta.TrackID)
+		slog.InfoContext(ctx, "upload: already processed", "file", id, "track", fmeta.TrackID)
 		track, err := tube.GetTrack(ctx, user.ID, fmeta.TrackID)
 		if err == nil {
+			discardPlaintext(ctx, track, key)
 			return track, nil
 		}
-		log.Println("error getting pre-existing track:", err)
+		slog.WarnContext(ctx, "upload: failed to get already processed track", "file", id, "track", fmeta.TrackID, "err", err)
 	}
 
-	log.Println("get file ...")
+	slog.DebugContext(ctx, "upload: get file", "file", id)
 
-	r, err := storage.UploadsBucket.Get(key)
-	if err != nil {
-		return tube.Track{}, err
-	}
-	defer r.Close()
-
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, r); err != nil {
-		return tube.Track{}, err
-	}
-	raw := bytes.NewReader(buf.Bytes())
+	raw := storage.NewObjectReader(storage.Traced(ctx, storage.UploadsBucket), key, size)
 
 	_, format, err := tag.Identify(raw)
 	if err != tag.ErrNoTagsFound && err != nil {
@@ -108,7 +102,7 @@ func handleUpload(ctx context.Context, key string, user tube.User, b2ID string)
 	}
 	raw.Seek(0, io.SeekStart)
 
-	log.Println("calcDuration ...")
+	slog.DebugContext(ctx, "upload: calcDuration", "file", id)
 
 	dur, err := calcDuration(raw, format)
 	if err != nil && !skippableError(err) {
@@ -137,13 +131,24 @@ func handleUpload(ctx context.Context, key string, user tube.User, b2ID string)
 	unfuckID3(tags)
 	raw.Seek(0, io.SeekStart)
 
-	log.Println("tag.SumAll ...")
+	slog.DebugContext(ctx, "upload: tag.SumAll", "file", id, "fetched", raw.Fetched())
 
 	sum, err := tag.SumAll(raw)
 	if err != nil {
 		return tube.Track{}, err
 	}
 
+	if check.SHA256 != "" {
+		// everything's been read by now anyway
+		data, err := raw.Bytes()
+		if err != nil {
+			return tube.Track{}, err
+		}
+		if got := sha256.Sum256(data); !strings.EqualFold(hex.EncodeToString(got[:]), check.SHA256) {
+			return tube.Track{}, errBadRequest("upload doesn't match sha256, try uploading it again")
+		}
+	}
+
 	trackInfo := tube.TrackInfo{
 		Title:       tags.Title(),
 		Artist:      tags.Artist(),
@@ -166,49 +171,85 @@ func handleUpload(ctx context.Context, key string, user tube.User, b2ID string)
 		Filename: strings.ToValidUTF8(fmeta.Name, replacementChar),
 		Filetype: string(tags.FileType()),
 		UploadID: fmeta.ID,
-		Size:     buf.Len(),
+		Size:     int(size),
 		LocalMod: fmeta.LocalMod,
 		Duration: dur,
 
 		TagFormat: string(tags.Format()),
 		// Metadata:  meta,
+
+		ReplayGain: tags.replayGain(),
 	}
 	track.Number, track.Total = tags.Track()
 	track.Disc, track.Discs = tags.Disc()
 	track.ApplyInfo(trackInfo)
 
-	log.Println("copyUploadToFiles ...")
-	err = copyUploadToFiles(ctx, track.StorageKey(), b2ID, fmeta)
-	if err != nil {
-		return tube.Track{}, err
+	if user.Encrypt && len(user.DataKey) > 0 {
+		slog.DebugContext(ctx, "upload: encrypt", "file", id)
+		sealed, err := storage.NewSealer(user.DataKey, raw, size)
+		if err != nil {
+			return tube.Track{}, err
+		}
+		if err := storage.Traced(ctx, storage.FilesBucket).Put("application/octet-stream", track.StorageKey(), sealed); err != nil {
+			return tube.Track{}, err
+		}
+		track.Encrypted = true
+	} else {
+		slog.DebugContext(ctx, "upload: copyUploadToFiles", "file", id)
+		err = copyUploadToFiles(ctx, track.StorageKey(), b2ID, *fmeta)
+		if err != nil {
+			return tube.Track{}, err
+		}
 	}
 
 	if pic := tags.Picture(); pic != nil {
-		log.Println("savePic ...")
-		track.Picture, err = savePic(pic.Data, pic.Ext, pic.Type, pic.Description)
+		slog.DebugContext(ctx, "upload: savePic", "file", id)
+		track.Picture, err = savePic(ctx, pic.Data, pic.Ext, pic.Type, pic.Description)
 		if err != nil {
 			return tube.Track{}, err
 		}
 	}
 
-	log.Println("track.Create ...")
+	slog.DebugContext(ctx, "upload: track.CreateFromUpload", "file", id)
 
-	if err := track.Create(ctx); err != nil {
+	if err := track.CreateFromUpload(ctx, fmeta); err != nil {
 		return tube.Track{}, err
 	}
-
-	log.Println("SetTrackID ...")
-
-	if err := fmeta.SetTrackID(track.ID); err != nil {
-		return tube.Track{}, err
+	// kept until now in case processing fails and is retried
+	discardPlaintext(ctx, track, key)
+
+	if text := strings.TrimSpace(tags.Lyrics()); text != "" {
+		embedded := tube.Lyrics{
+			UserID:  track.UserID,
+			TrackID: track.ID,
+			Text:    strings.ToValidUTF8(text, replacementChar),
+			Synced:  lyrics.IsSynced(text),
+			Source:  tube.LyricsEmbedded,
+		}
+		if _, err := embedded.SaveUnedited(ctx); err != nil {
+			// not worth failing the upload over
+			slog.ErrorContext(ctx, "upload: failed to save lyrics", "file", id, "err", err)
+		}
 	}
 
 	return track, nil
 }
 
+// discardPlaintext deletes the upload of an encrypted track,
+// as the whole point is not to keep the plaintext around.
+// Failure is logged; processing the upload again tries again.
+func discardPlaintext(ctx context.Context, track tube.Track, key string) {
+	if !track.Encrypted {
+		return
+	}
+	if err := storage.Traced(ctx, storage.UploadsBucket).Delete(key); err != nil {
+		slog.ErrorContext(ctx, "upload: failed to delete plaintext upload", "key", key, "err", err)
+	}
+}
+
 var replacementChar = "�"
 
-func savePic(data []byte, ext string, mimetype string, desc string) (tube.Picture, error) {
+func savePic(ctx context.Context, data []byte, ext string, mimetype string, desc string) (tube.Picture, error) {
 	id, err := sha3Sum(data)
 	if err != nil {
 		return tube.Picture{}, err
@@ -219,7 +260,7 @@ func savePic(data []byte, ext string, mimetype string, desc string) (tube.Pictur
 		Type: mimetype,
 		Desc: desc,
 	}
-	err = storage.FilesBucket.Put(mimetype, pic.StorageKey(), bytes.NewReader(data))
+	err = storage.Traced(ctx, storage.FilesBucket).Put(mimetype, pic.StorageKey(), bytes.NewReader(data))
 	return pic, err
 }
 
@@ -267,7 +308,7 @@ func calcDuration(r io.ReadSeeker, ftype tag.FileType) (int, error) {
 		length, format, err := oggvorbis.GetLength(r)
 		if err != nil {
 			// TODO: verify
-			log.Println("OGG ERROR:", err)
+			slog.Warn("upload: couldn't get OGG length", "err", err)
 			return 0, nil
 		}
 		sec := length / int64(format.SampleRate)
@@ -0,0 +1,183 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/guregu/kami"
+
+	"github.com/guregu/intertube/tube"
+)
+
+// how many albums and files the usage report lists
+const usageTopN = 50
+
+// bitrate buckets in the usage report, in kbps: [Min, Max)
+var usageBitrates = []struct {
+	Name     string
+	Min, Max int
+}{
+	{"under 128", 0, 128},
+	{"128-191", 128, 192},
+	{"192-255", 192, 256},
+	{"256-319", 256, 320},
+	{"320-499", 320, 500},
+	{"500 and up", 500, 1 << 30}, // lossless
+}
+
+func init() {
+	kami.Use("/api/account/usage", forbidGuests)
+	kami.Get("/api/account/usage", handle(getUsageReport))
+}
+
+// usageReport breaks down what's taking up a user's storage.
+type usageReport struct {
+	Usage    int64
+	Quota    int64
+	Tracks   int
+	Formats  []usageGroup
+	Bitrates []usageGroup
+	Albums   []usageGroup // biggest first
+	Largest  []usageFile  // biggest first
+	// this month's downloads, if the plan has a cap
+	Egress *usageEgress `json:",omitempty"`
+}
+
+type usageEgress struct {
+	Used      int64
+	Cap       int64
+	Remaining int64
+	Resets    time.Time
+	// past the cap, downloads are slowed down instead of refused
+	Throttle int64 `json:",omitempty"` // bytes per second
+}
+
+type usageGroup struct {
+	Name   string
+	Artist string `json:",omitempty"` // for albums
+	Tracks int
+	Size   int64
+}
+
+type usageFile struct {
+	ID       string
+	Title    string
+	Artist   string
+	Album    string
+	Filetype string
+	Bitrate  int // kbps, estimated from the size
+	Size     int64
+}
+
+// GET /api/account/usage
+// Breaks down storage usage by format, bitrate, and album, and lists the largest files,
+// to help decide what to delete or re-encode when running out of space.
+// Also shows how much of the monthly download allowance is left, if there is one.
+func getUsageReport(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	u, _ := userFrom(ctx)
+	tracks, err := u.GetTracks(ctx)
+	if err != nil {
+		return err
+	}
+	report := newUsageReport(tracks)
+	report.Usage = u.Usage
+	report.Quota = u.CalcQuota()
+	if limit := u.EgressCap(); limit > 0 {
+		now := time.Now()
+		used := u.EgressUsed(now)
+		report.Egress = &usageEgress{
+			Used:      used,
+			Cap:       limit,
+			Remaining: max(limit-used, 0),
+			Resets:    tube.EgressResets(now),
+			Throttle:  EgressThrottle,
+		}
+	}
+	renderJSON(w, report, http.StatusOK)
+	return nil
+}
+
+func newUsageReport(tracks tube.Tracks) usageReport {
+	var report usageReport
+	formats := make(map[string]*usageGroup)
+	bitrates := make([]usageGroup, len(usageBitrates))
+	for i, b := range usageBitrates {
+		bitrates[i].Name = b.Name
+	}
+	albums := make(map[string]*usageGroup)
+	files := make([]usageFile, 0, len(tracks))
+
+	add := func(g *usageGroup, size int64) {
+		g.Tracks++
+		g.Size += size
+	}
+	for _, t := range tracks {
+		if t.Deleted {
+			continue
+		}
+		size := int64(t.Size)
+		report.Tracks++
+
+		format := cmp.Or(t.Filetype, "unknown")
+		if formats[format] == nil {
+			formats[format] = &usageGroup{Name: format}
+		}
+		add(formats[format], size)
+
+		bitrate := t.Bitrate()
+		for i, b := range usageBitrates {
+			if bitrate >= b.Min && bitrate < b.Max {
+				add(&bitrates[i], size)
+				break
+			}
+		}
+
+		code := t.AlbumCode()
+		if albums[code] == nil {
+			albums[code] = &usageGroup{
+				Name:   cmp.Or(t.Info.Album, tube.UnknownAlbum),
+				Artist: cmp.Or(t.Info.AlbumArtist, t.Info.Artist, tube.UnknownArtist),
+			}
+		}
+		add(albums[code], size)
+
+		files = append(files, usageFile{
+			ID:       t.ID,
+			Title:    cmp.Or(t.Info.Title, t.Filename),
+			Artist:   t.Info.Artist,
+			Album:    t.Info.Album,
+			Filetype: t.Filetype,
+			Bitrate:  bitrate,
+			Size:     size,
+		})
+	}
+
+	bySize := func(a, b usageGroup) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), cmp.Compare(a.Name, b.Name))
+	}
+	report.Formats = make([]usageGroup, 0, len(formats))
+	for _, g := range formats {
+		report.Formats = append(report.Formats, *g)
+	}
+	slices.SortFunc(report.Formats, bySize)
+
+	report.Bitrates = slices.DeleteFunc(bitrates, func(g usageGroup) bool {
+		return g.Tracks == 0
+	})
+
+	report.Albums = make([]usageGroup, 0, len(albums))
+	for _, g := range albums {
+		report.Albums = append(report.Albums, *g)
+	}
+	slices.SortFunc(report.Albums, bySize)
+	report.Albums = report.Albums[:min(len(report.Albums), usageTopN)]
+
+	slices.SortFunc(files, func(a, b usageFile) int {
+		return cmp.Compare(b.Size, a.Size)
+	})
+	report.Largest = files[:min(len(files), usageTopN)]
+	return report
+}